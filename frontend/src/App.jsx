@@ -53,6 +53,8 @@ function App() {
   // Search state (persisted across tab switches)
   const [searchQuery, setSearchQuery] = useState('')
   const [searchResults, setSearchResults] = useState([])
+  const [searchTotal, setSearchTotal] = useState(0)
+  const [searchCursor, setSearchCursor] = useState('')
   const [searchLoading, setSearchLoading] = useState(false)
   const [searchExecuted, setSearchExecuted] = useState(false)
   const [searchScrollPosition, setSearchScrollPosition] = useState(0)
@@ -420,6 +422,10 @@ function App() {
               setSearchQuery={setSearchQuery}
               results={searchResults}
               setResults={setSearchResults}
+              total={searchTotal}
+              setTotal={setSearchTotal}
+              nextCursor={searchCursor}
+              setNextCursor={setSearchCursor}
               loading={searchLoading}
               setLoading={setSearchLoading}
               searched={searchExecuted}
@@ -59,6 +59,10 @@ function MediaGrid({ conversation, startDate, endDate }) {
   // Filter out failed videos from display
   const displayableItems = mediaItems.filter(item => !failedVideos.has(item.id))
 
+  const archiveParams = new URLSearchParams({ address: conversation.address, kind: 'image,video' })
+  if (startDate) archiveParams.set('start', startDate.toISOString())
+  if (endDate) archiveParams.set('end', endDate.toISOString())
+
   if (loading) {
     return (
       <div className="d-flex justify-content-center align-items-center" style={{ minHeight: '400px' }}>
@@ -97,6 +101,11 @@ function MediaGrid({ conversation, startDate, endDate }) {
 
   return (
     <>
+      <div className="d-flex justify-content-end mx-3 mt-3 mb-0">
+        <a className="btn btn-sm btn-outline-secondary" href={`${API_BASE}/media/archive?${archiveParams}`} download>
+          Download all
+        </a>
+      </div>
       {transcodeVideos.size > 0 && failedVideos.size === 0 && (
         <div className="alert alert-info mx-3 mt-3 mb-0" role="alert">
           <small>
@@ -126,6 +135,7 @@ function MediaGrid({ conversation, startDate, endDate }) {
                   <>
                     <video
                       src={`${API_BASE}/media?id=${item.id}${transcodeVideos.has(item.id) ? '&transcode=true' : ''}#t=0.1`}
+                      poster={`${API_BASE}/media/thumb?id=${item.id}`}
                       preload="metadata"
                       muted
                       playsInline
@@ -156,7 +166,7 @@ function MediaGrid({ conversation, startDate, endDate }) {
                   </>
                 ) : (
                   <img
-                    src={`${API_BASE}/media?id=${item.id}`}
+                    src={`${API_BASE}/media/thumb?id=${item.id}`}
                     alt={`Media ${index + 1}`}
                     loading="lazy"
                   />
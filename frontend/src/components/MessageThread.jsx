@@ -789,7 +789,9 @@ function MessageThread({ conversation, startDate, endDate, messageLimit }) {
                           <svg style={{width: '0.7rem', height: '0.7rem'}} fill="none" stroke="currentColor" viewBox="0 0 24 24">
                             <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M12 8v4l3 3m6-3a9 9 0 11-18 0 9 9 0 0118 0z" />
                           </svg>
-                          {formatTime(message.date)}
+                          <span title={message.date_sent ? `Sent ${format(new Date(message.date_sent), 'MMM d, yyyy h:mm:ss a')}` : undefined}>
+                            {formatTime(message.date)}
+                          </span>
                         </div>
                       </div>
                     </div>
@@ -1,13 +1,22 @@
 import { useNavigate } from 'react-router'
-import { useEffect, useRef } from 'react'
+import { useEffect, useRef, useState } from 'react'
 import axios from 'axios'
 import { format } from 'date-fns'
 
 const API_BASE = import.meta.env.VITE_API_URL || 'http://localhost:8085/api'
 
-function Search({ searchQuery, setSearchQuery, results, setResults, loading, setLoading, searched, setSearched, scrollPosition, setScrollPosition }) {
+const PAGE_SIZE = 200
+
+function Search({ searchQuery, setSearchQuery, results, setResults, total, setTotal, nextCursor, setNextCursor, loading, setLoading, searched, setSearched, scrollPosition, setScrollPosition }) {
   const navigate = useNavigate()
   const scrollContainerRef = useRef(null)
+  const [loadingMore, setLoadingMore] = useState(false)
+  const [error, setError] = useState('')
+  const [mode, setMode] = useState('words')
+
+  const fetchPage = (cursor) => axios.get(`${API_BASE}/search`, {
+    params: { q: searchQuery, mode, limit: PAGE_SIZE, ...(cursor ? { cursor } : {}) }
+  })
 
   const handleSearch = async (e) => {
     e.preventDefault()
@@ -15,20 +24,37 @@ function Search({ searchQuery, setSearchQuery, results, setResults, loading, set
 
     setLoading(true)
     setSearched(true)
+    setError('')
 
     try {
-      const response = await axios.get(`${API_BASE}/search`, {
-        params: { q: searchQuery, limit: 1000 }
-      })
+      const response = await fetchPage('')
       setResults(response.data || [])
+      setTotal(parseInt(response.headers['x-total-count'] || '0', 10))
+      setNextCursor(response.headers['x-next-cursor'] || '')
     } catch (error) {
       console.error('Error searching:', error)
+      setError(error.response?.data?.error || '')
       setResults([])
+      setTotal(0)
+      setNextCursor('')
     } finally {
       setLoading(false)
     }
   }
 
+  const handleLoadMore = async () => {
+    setLoadingMore(true)
+    try {
+      const response = await fetchPage(nextCursor)
+      setResults([...results, ...(response.data || [])])
+      setNextCursor(response.headers['x-next-cursor'] || '')
+    } catch (error) {
+      console.error('Error loading more results:', error)
+    } finally {
+      setLoadingMore(false)
+    }
+  }
+
   const handleResultClick = (result) => {
     // Navigate to the conversation with the message ID as a query parameter
     navigate(`/conversation/${encodeURIComponent(result.address)}?messageId=${result.message_id}`)
@@ -92,12 +118,24 @@ function Search({ searchQuery, setSearchQuery, results, setResults, loading, set
               id="messageSearch"
               name="messageSearch"
               className="form-control"
-              placeholder="Search message contents..."
+              placeholder='Search messages, e.g. invoice from:"Jane" after:2021-01-01 has:media'
               aria-label="Search message contents"
               value={searchQuery}
               onChange={(e) => setSearchQuery(e.target.value)}
               autoFocus
             />
+            <select
+              className="form-select flex-grow-0 w-auto"
+              aria-label="Search mode"
+              value={mode}
+              onChange={(e) => setMode(e.target.value)}
+            >
+              <option value="words">Words</option>
+              <option value="prefix">Prefix</option>
+              <option value="substring">Substring</option>
+              <option value="fuzzy">Fuzzy</option>
+              <option value="regex">Regex</option>
+            </select>
             <button
               type="submit"
               className="btn btn-primary"
@@ -119,9 +157,11 @@ function Search({ searchQuery, setSearchQuery, results, setResults, loading, set
           <div className="mt-2 small text-muted">
             {results.length > 0 ? (
               <>
-                Found <strong>{results.length.toLocaleString()}</strong> result{results.length !== 1 ? 's' : ''}
-                {results.length >= 1000 && ' (limited to first 1000)'}
+                Found <strong>{total.toLocaleString()}</strong> result{total !== 1 ? 's' : ''}
+                {results.length < total && ` (showing ${results.length.toLocaleString()})`}
               </>
+            ) : error ? (
+              <span className="text-danger">{error}</span>
             ) : (
               'No results found'
             )}
@@ -199,6 +239,13 @@ function Search({ searchQuery, setSearchQuery, results, setResults, loading, set
                 </div>
               </div>
             ))}
+            {nextCursor && (
+              <div className="col-12 text-center py-2">
+                <button className="btn btn-outline-primary btn-sm" onClick={handleLoadMore} disabled={loadingMore}>
+                  {loadingMore ? 'Loading...' : 'Load more'}
+                </button>
+              </div>
+            )}
           </div>
         )}
       </div>
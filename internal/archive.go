@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaExtensions covers the attachment types phones commonly send, where
+// mime.ExtensionsByType is either missing or picks an odd one (".jpe")
+var mediaExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/jpg":       ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/heic":      ".heic",
+	"image/heif":      ".heif",
+	"video/mp4":       ".mp4",
+	"video/3gpp":      ".3gp",
+	"video/quicktime": ".mov",
+	"audio/amr":       ".amr",
+	"audio/mpeg":      ".mp3",
+	"audio/mp4":       ".m4a",
+	"audio/aac":       ".aac",
+	"audio/ogg":       ".ogg",
+	"text/vcard":      ".vcf",
+	"text/x-vcard":    ".vcf",
+}
+
+// mediaExtension returns a filename extension for a media type
+func mediaExtension(mediaType string) string {
+	ct := strings.ToLower(strings.TrimSpace(mediaType))
+	if ext, ok := mediaExtensions[ct]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(ct); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// sanitizeArchiveName makes a string safe to use as a path component on
+// common filesystems
+func sanitizeArchiveName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.Trim(strings.TrimSpace(s), ".")
+}
+
+// mediaArchiveName builds the filename for an attachment in a media archive:
+// date, contact and original part name, e.g.
+// "2019-06-02_183012_Mom_IMG_1234.jpg". Attachments without a part name use
+// their message ID instead.
+func mediaArchiveName(item GalleryItem) string {
+	contact := sanitizeArchiveName(item.ContactName)
+	if contact == "" || contact == "(Unknown)" {
+		contact = sanitizeArchiveName(item.Address)
+	}
+
+	name := sanitizeArchiveName(path.Base(item.Name))
+	if name == "" {
+		name = strconv.FormatInt(item.ID, 10)
+	}
+	if path.Ext(name) == "" {
+		name += mediaExtension(item.MediaType)
+	}
+
+	return item.Date.Format("2006-01-02_150405") + "_" + contact + "_" + name
+}
+
+// GetMediaArchiveItems lists the attachments matching a filter, oldest first,
+// for building a media archive. Cursor and Limit are ignored.
+func GetMediaArchiveItems(userDB *sql.DB, filter GalleryFilter) ([]GalleryItem, error) {
+	conds, args, err := galleryConditions(filter)
+	if err != nil {
+		return nil, err
+	}
+	return mediaArchiveItems(userDB, conds, args)
+}
+
+// mediaArchiveItems lists the attachments matching conds on messages m,
+// oldest first
+func mediaArchiveItems(userDB dbQueryer, conds string, args []interface{}) ([]GalleryItem, error) {
+	query := `
+		SELECT m.id, m.address, COALESCE(m.contact_name, ''), m.date_ms, m.type, m.media_type,
+			COALESCE(mn.name, ''), length(m.media_data)
+		FROM messages m
+		LEFT JOIN media_names mn ON mn.message_id = m.id
+		WHERE m.record_type IN (1, 2) AND m.media_type != ''
+	` + conds + " ORDER BY m.date_ms, m.id"
+
+	rows, err := userDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []GalleryItem
+	for rows.Next() {
+		var item GalleryItem
+		var dateMs int64
+		var size sql.NullInt64
+		if err := rows.Scan(&item.ID, &item.Address, &item.ContactName, &dateMs, &item.Type, &item.MediaType,
+			&item.Name, &size); err != nil {
+			return nil, err
+		}
+		item.Date = time.UnixMilli(dateMs)
+		item.Kind = mediaKind(item.MediaType)
+		item.Size = size.Int64
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// WriteMediaArchive streams a zip of the given attachments to w. Media is
+// stored rather than deflated since it's already compressed, and each blob
+// is copied out in chunks so the archive never has to be staged in memory
+// or on disk. JPEGs are the exception: they're loaded whole so the message
+// date can be written into their EXIF data if they don't carry one.
+func WriteMediaArchive(w io.Writer, store MessageStore, items []GalleryItem) error {
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool, len(items))
+
+	for _, item := range items {
+		name := mediaArchiveName(item)
+		if used[name] {
+			ext := path.Ext(name)
+			name = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), item.ID, ext)
+		}
+		used[name] = true
+
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: item.Date,
+		})
+		if err != nil {
+			return err
+		}
+
+		id := strconv.FormatInt(item.ID, 10)
+		ct := strings.ToLower(strings.TrimSpace(item.MediaType))
+		if ct == "image/jpeg" || ct == "image/jpg" {
+			data, _, err := store.GetMedia(id)
+			if err != nil {
+				return fmt.Errorf("failed to read media %s: %w", id, err)
+			}
+			if _, err := fw.Write(jpegWithExifDate(data, item.Date)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := io.Copy(fw, store.MediaReader(id, item.Size)); err != nil {
+			return fmt.Errorf("failed to copy media %s: %w", id, err)
+		}
+	}
+
+	return zw.Close()
+}
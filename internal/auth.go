@@ -52,34 +52,7 @@ func InitAuthDB(filepath string) error {
 		authDB.SetMaxOpenConns(1)
 	}
 
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		username TEXT NOT NULL UNIQUE,
-		password_hash TEXT NOT NULL,
-		created_at INTEGER NOT NULL
-	);
-
-	CREATE TABLE IF NOT EXISTS sessions (
-		id TEXT PRIMARY KEY,
-		user_id TEXT NOT NULL,
-		created_at INTEGER NOT NULL,
-		expires_at INTEGER NOT NULL,
-		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-	);
-
-	CREATE TABLE IF NOT EXISTS settings (
-		user_id TEXT PRIMARY KEY,
-		settings_json TEXT NOT NULL DEFAULT '{}',
-		updated_at INTEGER NOT NULL,
-		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
-	CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
-	`
-
-	_, err = authDB.Exec(createTableSQL)
+	_, _, err = runMigrations(authDB, authDBMigrations)
 	return err
 }
 
@@ -232,23 +205,50 @@ func CleanExpiredSessions() error {
 	return err
 }
 
-// UpdatePassword updates a user's password
-func UpdatePassword(userID string, newPassword string) error {
+// UpdatePassword updates a user's password. If their database is
+// encrypted, its data key is re-sealed under the new password, so the old
+// one no longer unlocks it. oldPassword unseals the key; pass "" when it
+// isn't known (an admin reset), which only works if the key is escrowed.
+//
+// An admin reset of a password user whose key isn't escrowed fails with
+// ErrDataKeyUnavailable and changes nothing: nothing but their old
+// password can unseal the key, and resetting anyway would leave their
+// messages unreadable. Callers must handle it, e.g. by telling the admin
+// the user needs to change their password themselves. Other errors are
+// ErrIncorrectPassword when oldPassword is wrong, or storage failures.
+func UpdatePassword(userID string, oldPassword string, newPassword string) error {
 	// Hash the new password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	_, err = authDB.Exec(
+	slots, err := resealDataKeys(userID, oldPassword, newPassword)
+	if err != nil {
+		return fmt.Errorf("failed to re-seal data key: %w", err)
+	}
+
+	tx, err := authDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
 		"UPDATE users SET password_hash = ? WHERE id = ?",
 		string(hashedPassword), userID,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update password: %w", err)
 	}
+	for _, slot := range slots {
+		_, err = tx.Exec("UPDATE user_keys SET salt = ?, password_key = ? WHERE id = ?", slot.salt, slot.passwordKey, slot.id)
+		if err != nil {
+			return fmt.Errorf("failed to update data key: %w", err)
+		}
+	}
 
-	return nil
+	return tx.Commit()
 }
 
 // ListUsers returns all users in the database
@@ -1,7 +1,6 @@
 package internal
 
 import (
-	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -93,6 +92,17 @@ func HandleRegister(c echo.Context) error {
 		})
 	}
 
+	// Encrypt the new user's database under their password
+	if EncryptNewDatabases {
+		if err := CreateDataKey(user.ID, req.Password); err != nil {
+			slog.Error("Error creating data key", "error", err)
+			return c.JSON(http.StatusInternalServerError, AuthResponse{
+				Success: false,
+				Error:   "Failed to create user",
+			})
+		}
+	}
+
 	// Create session
 	session, err := CreateSession(user.ID, user.Username)
 	if err != nil {
@@ -106,13 +116,8 @@ func HandleRegister(c echo.Context) error {
 	// Set session cookie
 	setSessionCookie(c, session.ID, session.ExpiresAt)
 
-	// Initialize user's database (using UUID as filename)
-	dbPathPrefix := os.Getenv("DB_PATH_PREFIX")
-	if dbPathPrefix == "" {
-		dbPathPrefix = "."
-	}
-	userDBPath := fmt.Sprintf("%s/sbv_%s.db", dbPathPrefix, user.ID)
-	if err := InitUserDB(user.ID, userDBPath); err != nil {
+	// Initialize user's storage (a database file named by UUID with SQLite)
+	if err := InitUserStore(user.ID); err != nil {
 		slog.Error("Error initializing user database", "error", err)
 		return echo.ErrInternalServerError
 	}
@@ -159,6 +164,16 @@ func HandleLogin(c echo.Context) error {
 		})
 	}
 
+	// Unlock the user's data key while the password is at hand, if their
+	// database is encrypted
+	if err := UnlockDataKey(user.ID, req.Password); err != nil {
+		slog.Error("Error unlocking data key", "error", err)
+		return c.JSON(http.StatusInternalServerError, AuthResponse{
+			Success: false,
+			Error:   "Failed to unlock user data",
+		})
+	}
+
 	// Create session
 	session, err := CreateSession(user.ID, user.Username)
 	if err != nil {
@@ -279,7 +294,7 @@ func HandleChangePassword(c echo.Context) error {
 	}
 
 	// Update password
-	if err := UpdatePassword(user.ID, req.NewPassword); err != nil {
+	if err := UpdatePassword(user.ID, req.OldPassword, req.NewPassword); err != nil {
 		slog.Error("Error updating password", "error", err)
 		return c.JSON(http.StatusInternalServerError, AuthResponse{
 			Success: false,
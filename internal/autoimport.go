@@ -163,11 +163,17 @@ func (s *AutoImportService) processFile(userID, filePath, filename string) {
 		return
 	}
 
+	// Messages added by this import are the ones above the current highest ID
+	sinceID, err := maxMessageID(userDB)
+	if err != nil {
+		slog.Warn("Failed to get latest message ID", "userID", userID, "error", err)
+	}
+
 	// Determine file type and parse
 	var parseErr error
 	if strings.HasSuffix(strings.ToLower(filename), ".xml") {
 		logWriter.log("Detected XML backup file")
-		parseErr = s.parseXMLBackup(userDB, filePath, logWriter)
+		parseErr = s.parseXMLBackup(userID, userDB, filePath, logWriter)
 	} else {
 		logWriter.log("ERROR: Unsupported file type")
 		slog.Warn("Unsupported file type", "userID", userID, "file", filename)
@@ -201,8 +207,26 @@ func (s *AutoImportService) processFile(userID, filePath, filename string) {
 		logWriter.log("Import duration: %s", duration)
 		slog.Error("Import failed", "userID", userID, "file", filename, "error", parseErr, "duration", duration)
 	} else {
-		// Move file to complete directory
-		if err := os.Rename(filePath, completePath); err != nil {
+		// Before the log file is moved, so the counts land in it
+		matches, err := RecordSavedSearchMatches(userID, userDB, sinceID)
+		if err != nil {
+			slog.Warn("Failed to check saved searches", "userID", userID, "error", err)
+		}
+		for _, m := range matches {
+			logWriter.log("Saved search %q: %d new matching messages", m.Name, m.Count)
+		}
+
+		// A backup holds every message and attachment in plaintext, so for
+		// users whose database is encrypted it's deleted rather than kept
+		encrypted := userMediaKey(userID) != nil
+		if encrypted {
+			if err := os.Remove(filePath); err != nil {
+				logWriter.log("ERROR: Failed to delete imported file: %v", err)
+				slog.Error("Failed to delete imported file", "userID", userID, "error", err)
+				return
+			}
+		} else if err := os.Rename(filePath, completePath); err != nil {
+			// Move file to complete directory
 			logWriter.log("ERROR: Failed to move file to complete directory: %v", err)
 			slog.Error("Failed to move file", "userID", userID, "error", err)
 			return
@@ -216,8 +240,14 @@ func (s *AutoImportService) processFile(userID, filePath, filename string) {
 		}
 
 		logWriter.log("Import completed successfully in %s", duration)
-		logWriter.log("File moved to: %s", completePath)
+		if encrypted {
+			logWriter.log("File deleted, since the database is encrypted")
+		} else {
+			logWriter.log("File moved to: %s", completePath)
+		}
 		slog.Info("Import completed", "userID", userID, "file", filename, "duration", duration)
+
+		afterImport(userID, userDB)
 	}
 }
 
@@ -248,7 +278,7 @@ func (s *AutoImportService) isFileStable(filePath string) bool {
 }
 
 // parseXMLBackup parses an XML backup file
-func (s *AutoImportService) parseXMLBackup(userDB *sql.DB, filePath string, logger *importLogger) error {
+func (s *AutoImportService) parseXMLBackup(userID string, userDB *sql.DB, filePath string, logger *importLogger) error {
 	logger.log("Parsing XML backup file")
 
 	file, err := os.Open(filePath)
@@ -263,7 +293,7 @@ func (s *AutoImportService) parseXMLBackup(userDB *sql.DB, filePath string, logg
 	logger.log("File size: %d bytes", fileSize)
 
 	// Parse the XML backup using streaming parser
-	totalProcessed, totalSkipped, err := ParseSMSBackupStreaming(userDB, file, 100)
+	totalProcessed, totalSkipped, err := ParseSMSBackupStreaming(userDB, file, 100, UserDedupStrategy(userID))
 	if err != nil {
 		return fmt.Errorf("failed to parse backup: %w", err)
 	}
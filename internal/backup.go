@@ -0,0 +1,493 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrInvalidSnapshot is returned by ValidateSnapshot for a snapshot that's
+// incomplete, altered or from a newer build
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+const (
+	snapshotPrefix     = "snapshot-"
+	snapshotManifest   = "manifest.json"
+	snapshotTimeFormat = "20060102-150405"
+)
+
+// Snapshot is a consistent copy of the auth database and every user
+// database, taken while the server runs. Each snapshot is a directory under
+// the backup directory holding the copies and a manifest describing them.
+type Snapshot struct {
+	Name      string         `json:"name"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []SnapshotFile `json:"files"`
+}
+
+// SnapshotFile is one database in a snapshot
+type SnapshotFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Encrypted databases are copied still encrypted under their user's
+	// key, so restoring them needs the snapshot's own auth database
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// snapshotMutex keeps scheduled and requested snapshots from overlapping
+var snapshotMutex sync.Mutex
+
+// BackupDir returns where snapshots are kept: BACKUP_DIR, or a backups
+// directory under dbPathPrefix
+func BackupDir(dbPathPrefix string) string {
+	if dir := os.Getenv("BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(dbPathPrefix, "backups")
+}
+
+// CreateSnapshot copies every database under dbPathPrefix into a new
+// snapshot in backupDir. Databases are copied with VACUUM INTO, which reads
+// a single transaction, so writes carry on meanwhile. The snapshot is
+// written under a .partial name and only renamed into place once complete.
+func CreateSnapshot(dbPathPrefix, backupDir string) (*Snapshot, error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	now := time.Now().UTC()
+	snap := &Snapshot{Name: snapshotPrefix + now.Format(snapshotTimeFormat), CreatedAt: now}
+	dir := filepath.Join(backupDir, snap.Name)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("snapshot %s already exists", snap.Name)
+	}
+
+	partial := dir + ".partial"
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return nil, err
+	}
+	os.RemoveAll(partial)
+	if err := os.Mkdir(partial, 0700); err != nil {
+		return nil, err
+	}
+	complete := false
+	defer func() {
+		if !complete {
+			os.RemoveAll(partial)
+		}
+	}()
+
+	paths, _, err := databaseFiles(dbPathPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		dest := filepath.Join(partial, name)
+		if err := snapshotDatabase(path, dest); err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", name, err)
+		}
+		file, err := describeSnapshotFile(dest)
+		if err != nil {
+			return nil, err
+		}
+		snap.Files = append(snap.Files, *file)
+	}
+
+	manifest, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(partial, snapshotManifest), manifest, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(partial, dir); err != nil {
+		return nil, err
+	}
+	complete = true
+
+	slog.Info("Created snapshot", "path", dir, "databases", len(snap.Files))
+	return snap, nil
+}
+
+// userIDFromDBPath returns the user ID a user database at path belongs
+// to, or false if path isn't a user database
+func userIDFromDBPath(path string) (string, bool) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "sbv_") || !strings.HasSuffix(name, ".db") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, "sbv_"), ".db"), true
+}
+
+// snapshotDatabase copies the database at path to dest. An encrypted user
+// database stays encrypted under the same key.
+func snapshotDatabase(path, dest string) error {
+	userID, isUserDB := userIDFromDBPath(path)
+	if !isUserDB {
+		return copyDatabase(path, dest)
+	}
+
+	// Hold the user's init lock so their database isn't opened mid-copy
+	lockIface, _ := userDBInitLocks.LoadOrStore(userID, &sync.Mutex{})
+	initLock := lockIface.(*sync.Mutex)
+	initLock.Lock()
+	defer initLock.Unlock()
+
+	key, err := databaseKeyFor(userID, path)
+	if errors.Is(err, ErrDatabaseLocked) {
+		return copyLockedDatabase(path, dest)
+	}
+	if err != nil {
+		return err
+	}
+	source, err := userDatabaseDSN(userID, path)
+	if err != nil {
+		return err
+	}
+	if source == path {
+		return copyDatabase(path, dest)
+	}
+	return copyDatabase(source, encryptedDSN(dest, key.vfsKeyID))
+}
+
+// copyLockedDatabase copies an encrypted database whose key hasn't been
+// unlocked. It can't be open in this process, so it's copied byte for
+// byte, as long as no other process is writing to it.
+func copyLockedDatabase(path, dest string) error {
+	for _, suffix := range []string{"-wal", "-journal"} {
+		if _, err := os.Stat(path + suffix); err == nil {
+			return fmt.Errorf("encrypted database is in use by another process and can't be read without its user's key")
+		}
+	}
+	return copyFile(path, dest)
+}
+
+// copyFile copies the file at src to a new file at dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// describeSnapshotFile returns the manifest entry for a copied database
+func describeSnapshotFile(path string) (*SnapshotFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := isEncryptedDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotFile{
+		Name:      filepath.Base(path),
+		Size:      size,
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+		Encrypted: encrypted,
+	}, nil
+}
+
+// readSnapshotManifest reads the manifest of the snapshot in dir
+func readSnapshotManifest(dir string) (*Snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotManifest))
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// ListSnapshots returns the complete snapshots in backupDir, newest first
+func ListSnapshots(backupDir string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(backupDir)
+	if os.IsNotExist(err) {
+		return []Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), snapshotPrefix) || strings.HasSuffix(entry.Name(), ".partial") {
+			continue
+		}
+		snap, err := readSnapshotManifest(filepath.Join(backupDir, entry.Name()))
+		if err != nil {
+			slog.Warn("Skipping snapshot without a readable manifest", "name", entry.Name(), "error", err)
+			continue
+		}
+		snap.Name = entry.Name()
+		snapshots = append(snapshots, *snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name > snapshots[j].Name
+	})
+	return snapshots, nil
+}
+
+// RotateSnapshots removes all but the newest keep snapshots in backupDir,
+// along with any left incomplete, and returns how many it removed
+func RotateSnapshots(backupDir string, keep int) (int, error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	partials, err := filepath.Glob(filepath.Join(backupDir, snapshotPrefix+"*.partial"))
+	if err != nil {
+		return 0, err
+	}
+	for _, partial := range partials {
+		os.RemoveAll(partial)
+	}
+
+	snapshots, err := ListSnapshots(backupDir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i := keep; i < len(snapshots); i++ {
+		if err := os.RemoveAll(filepath.Join(backupDir, snapshots[i].Name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// RunScheduledSnapshot takes a snapshot and rotates out old ones, logging
+// rather than returning failures
+func RunScheduledSnapshot(dbPathPrefix, backupDir string, keep int) {
+	if _, err := CreateSnapshot(dbPathPrefix, backupDir); err != nil {
+		slog.Error("Failed to create scheduled snapshot", "error", err)
+		return
+	}
+	removed, err := RotateSnapshots(backupDir, keep)
+	if err != nil {
+		slog.Error("Failed to rotate snapshots", "error", err)
+		return
+	}
+	if removed > 0 {
+		slog.Info("Rotated snapshots", "removed", removed, "kept", keep)
+	}
+}
+
+// ValidateSnapshot checks the snapshot in dir can be restored: every file
+// in its manifest is present and unchanged, the unencrypted databases pass
+// an integrity check, and none is newer than this build. Encrypted
+// databases can only be checked against their checksums.
+func ValidateSnapshot(dir string) (*Snapshot, error) {
+	snap, err := readSnapshotManifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read manifest: %v", ErrInvalidSnapshot, err)
+	}
+
+	hasAuthDB := false
+	for _, file := range snap.Files {
+		if file.Name != filepath.Base(file.Name) {
+			return nil, fmt.Errorf("%w: bad file name %q", ErrInvalidSnapshot, file.Name)
+		}
+		path := filepath.Join(dir, file.Name)
+		actual, err := describeSnapshotFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidSnapshot, file.Name, err)
+		}
+		if actual.Size != file.Size || actual.SHA256 != file.SHA256 {
+			return nil, fmt.Errorf("%w: %s doesn't match its checksum", ErrInvalidSnapshot, file.Name)
+		}
+
+		migrations := userDBMigrations
+		if file.Name == filepath.Base(AuthDBPath("")) {
+			hasAuthDB = true
+			migrations = authDBMigrations
+		} else if _, ok := userIDFromDBPath(file.Name); !ok {
+			return nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidSnapshot, file.Name)
+		}
+		if actual.Encrypted {
+			continue
+		}
+		if err := checkSnapshotDatabase(path, len(migrations)); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidSnapshot, file.Name, err)
+		}
+	}
+	if !hasAuthDB {
+		return nil, fmt.Errorf("%w: no auth database", ErrInvalidSnapshot)
+	}
+	return snap, nil
+}
+
+// checkSnapshotDatabase runs an integrity check on a database without
+// modifying it, and checks its schema isn't newer than latest
+func checkSnapshotDatabase(path string, latest int) error {
+	// immutable keeps SQLite from creating a -shm or journal next to it
+	database, err := sql.Open(sqliteDriver, "file:"+path+"?mode=ro&immutable=1")
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	var result string
+	if err := database.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	version, err := schemaVersion(database)
+	if err != nil {
+		return err
+	}
+	if version > latest {
+		return fmt.Errorf("schema version %d is newer than this build (%d)", version, latest)
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces the databases under dbPathPrefix with those of
+// the snapshot in dir, after validating it. The server must not be running.
+// The databases being replaced are moved into a new directory under
+// dbPathPrefix, which is returned. Cached media conversions of every user
+// involved are removed, since message IDs may no longer match.
+func RestoreSnapshot(dbPathPrefix, dir string) (string, error) {
+	snap, err := ValidateSnapshot(dir)
+	if err != nil {
+		return "", err
+	}
+
+	// Closing the auth database checkpoints and removes its WAL, so any
+	// WAL or journal left is another process's
+	if authDB != nil {
+		authDB.Close()
+		authDB = nil
+	}
+	current, _, err := databaseFiles(dbPathPrefix)
+	if err != nil {
+		return "", err
+	}
+	for _, path := range current {
+		for _, suffix := range []string{"-wal", "-journal"} {
+			if _, err := os.Stat(path + suffix); err == nil {
+				return "", fmt.Errorf("%s is in use; stop the server first", path)
+			}
+		}
+	}
+
+	staging := filepath.Join(dbPathPrefix, "restoring-"+snap.Name)
+	os.RemoveAll(staging)
+	if err := os.Mkdir(staging, 0700); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	for _, file := range snap.Files {
+		if err := copyFile(filepath.Join(dir, file.Name), filepath.Join(staging, file.Name)); err != nil {
+			return "", fmt.Errorf("failed to stage %s: %w", file.Name, err)
+		}
+	}
+
+	movedTo := filepath.Join(dbPathPrefix, "pre-restore-"+time.Now().UTC().Format(snapshotTimeFormat))
+	if err := os.Mkdir(movedTo, 0700); err != nil {
+		return "", err
+	}
+	userIDs := make(map[string]bool)
+	for _, path := range current {
+		if userID, ok := userIDFromDBPath(path); ok {
+			userIDs[userID] = true
+		}
+		if err := os.Rename(path, filepath.Join(movedTo, filepath.Base(path))); err != nil {
+			return movedTo, fmt.Errorf("failed to move %s aside: %w", path, err)
+		}
+		os.Remove(path + "-shm")
+	}
+	for _, file := range snap.Files {
+		if userID, ok := userIDFromDBPath(file.Name); ok {
+			userIDs[userID] = true
+		}
+		if err := os.Rename(filepath.Join(staging, file.Name), filepath.Join(dbPathPrefix, file.Name)); err != nil {
+			return movedTo, fmt.Errorf("failed to restore %s (previous databases are in %s): %w", file.Name, movedTo, err)
+		}
+	}
+
+	if err := InitAuthDB(AuthDBPath(dbPathPrefix)); err != nil {
+		return movedTo, fmt.Errorf("failed to open restored auth database: %w", err)
+	}
+	if mediaCache != nil {
+		for userID := range userIDs {
+			mediaCache.removeUser(userID)
+		}
+	}
+
+	slog.Info("Restored snapshot", "snapshot", dir, "databases", len(snap.Files), "previous", movedTo)
+	return movedTo, nil
+}
+
+// HandleListBackups handles GET /api/admin/backup
+func HandleListBackups(c echo.Context) error {
+	dbPathPrefix := os.Getenv("DB_PATH_PREFIX")
+	if dbPathPrefix == "" {
+		dbPathPrefix = "."
+	}
+	snapshots, err := ListSnapshots(BackupDir(dbPathPrefix))
+	if err != nil {
+		slog.Error("Error listing snapshots", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list snapshots",
+		})
+	}
+	return c.JSON(http.StatusOK, snapshots)
+}
+
+// HandleCreateBackup handles POST /api/admin/backup, taking a snapshot now
+func HandleCreateBackup(c echo.Context) error {
+	dbPathPrefix := os.Getenv("DB_PATH_PREFIX")
+	if dbPathPrefix == "" {
+		dbPathPrefix = "."
+	}
+	snap, err := CreateSnapshot(dbPathPrefix, BackupDir(dbPathPrefix))
+	if err != nil {
+		slog.Error("Error creating snapshot", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create snapshot",
+		})
+	}
+	return c.JSON(http.StatusOK, snap)
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	dir, user := setupEncryptionTest(t)
+	backupDir := filepath.Join(dir, "backups")
+
+	if err := InitUserDB(user.ID, UserDBPath(dir, user.ID)); err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	msg := &Message{Address: "+15551234567", Body: "keep me", Type: 1, Date: time.Now()}
+	if err := InsertMessage(userDBs[user.ID], msg); err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+
+	// A second user's encrypted database, locked as after a restart, is
+	// copied as it is
+	locked, err := CreateUser("bob", "password123")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer forgetDataKeys(locked.ID)
+	if err := CreateDataKey(locked.ID, "password123"); err != nil {
+		t.Fatalf("Failed to create data key: %v", err)
+	}
+	if err := InitUserDB(locked.ID, UserDBPath(dir, locked.ID)); err != nil {
+		t.Fatalf("Failed to create encrypted database: %v", err)
+	}
+	closeTestUserDB(locked.ID)
+	forgetDataKeys(locked.ID)
+
+	snap, err := CreateSnapshot(dir, backupDir)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	if len(snap.Files) != 3 {
+		t.Fatalf("Expected 3 databases in the snapshot, got %+v", snap.Files)
+	}
+	for _, file := range snap.Files {
+		if want := file.Name == filepath.Base(UserDBPath(dir, locked.ID)); file.Encrypted != want {
+			t.Errorf("Expected %s encrypted=%v", file.Name, want)
+		}
+	}
+	if snapshots, err := ListSnapshots(backupDir); err != nil || len(snapshots) != 1 || snapshots[0].Name != snap.Name {
+		t.Errorf("Expected the snapshot to be listed, got %+v (%v)", snapshots, err)
+	}
+
+	// Changes after the snapshot are undone by restoring it
+	if _, err := userDBs[user.ID].Exec("DELETE FROM messages"); err != nil {
+		t.Fatalf("Failed to delete messages: %v", err)
+	}
+	closeTestUserDB(user.ID)
+
+	snapDir := filepath.Join(backupDir, snap.Name)
+	movedTo, err := RestoreSnapshot(dir, snapDir)
+	if err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(movedTo, filepath.Base(UserDBPath(dir, user.ID)))); err != nil {
+		t.Errorf("Expected the replaced database to be kept: %v", err)
+	}
+	if count := countTestMessages(t, dir, user.ID); count != 1 {
+		t.Errorf("Expected 1 message after restoring, got %d", count)
+	}
+	if _, err := GetUserByUsername("bob"); err != nil {
+		t.Errorf("Expected the restored auth database to be open: %v", err)
+	}
+	if err := UnlockDataKey(locked.ID, "password123"); err != nil {
+		t.Errorf("Expected the restored encrypted database's key to unlock: %v", err)
+	}
+	if count := countTestMessages(t, dir, locked.ID); count != 0 {
+		t.Errorf("Expected the restored encrypted database to open, got %d messages", count)
+	}
+	closeTestUserDB(locked.ID)
+
+	// A snapshot that's been altered isn't restored
+	path := filepath.Join(snapDir, filepath.Base(UserDBPath(dir, user.ID)))
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open snapshot file: %v", err)
+	}
+	f.WriteAt([]byte{0xff}, 100)
+	f.Close()
+	if _, err := RestoreSnapshot(dir, snapDir); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("Expected ErrInvalidSnapshot, got %v", err)
+	}
+}
+
+func TestRotateSnapshots(t *testing.T) {
+	backupDir := t.TempDir()
+	for _, name := range []string{"snapshot-20260101-000000", "snapshot-20260102-000000", "snapshot-20260103-000000"} {
+		if err := os.Mkdir(filepath.Join(backupDir, name), 0700); err != nil {
+			t.Fatalf("Failed to create snapshot directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(backupDir, name, snapshotManifest), []byte(`{"files":[]}`), 0600); err != nil {
+			t.Fatalf("Failed to write manifest: %v", err)
+		}
+	}
+	partial := filepath.Join(backupDir, "snapshot-20260104-000000.partial")
+	if err := os.Mkdir(partial, 0700); err != nil {
+		t.Fatalf("Failed to create partial snapshot: %v", err)
+	}
+
+	removed, err := RotateSnapshots(backupDir, 2)
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected 1 snapshot removed, got %d (%v)", removed, err)
+	}
+	snapshots, err := ListSnapshots(backupDir)
+	if err != nil || len(snapshots) != 2 || snapshots[0].Name != "snapshot-20260103-000000" || snapshots[1].Name != "snapshot-20260102-000000" {
+		t.Errorf("Expected the two newest snapshots kept, got %+v (%v)", snapshots, err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Error("Expected the incomplete snapshot to be removed")
+	}
+}
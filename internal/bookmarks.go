@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// bookmarkedColumn selects whether the message aliased m is bookmarked
+const bookmarkedColumn = "EXISTS (SELECT 1 FROM bookmarks b WHERE b.message_id = m.id)"
+
+// Bookmark listing bounds
+const (
+	DefaultBookmarkLimit = 100
+	MaxBookmarkContext   = 50
+)
+
+// SetBookmark stars a message, or updates the note on one already starred.
+// Returns sql.ErrNoRows if there's no such message; calls can't be starred.
+func SetBookmark(userDB *sql.DB, messageID int64, note string) error {
+	var exists bool
+	err := userDB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND record_type IN (1, 2))", messageID,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	unlock := LockForWrite(userDB)
+	defer unlock()
+	_, err = userDB.Exec(`
+		INSERT INTO bookmarks (message_id, note, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(message_id) DO UPDATE SET note = excluded.note
+	`, messageID, note, time.Now().Unix())
+	return err
+}
+
+// DeleteBookmark unstars a message. Returns sql.ErrNoRows if it wasn't
+// starred.
+func DeleteBookmark(userDB *sql.DB, messageID int64) error {
+	unlock := LockForWrite(userDB)
+	defer unlock()
+	result, err := userDB.Exec("DELETE FROM bookmarks WHERE message_id = ?", messageID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetBookmark returns one starred message with contextSize items of its
+// conversation on either side, or sql.ErrNoRows if it isn't starred
+func GetBookmark(userDB *sql.DB, messageID int64, contextSize int) (*Bookmark, error) {
+	b := &Bookmark{MessageID: messageID}
+	var createdAt int64
+	err := userDB.QueryRow(
+		"SELECT note, created_at FROM bookmarks WHERE message_id = ?", messageID,
+	).Scan(&b.Note, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	b.CreatedAt = time.Unix(createdAt, 0)
+
+	ctx, err := GetMessageContext(userDB, messageID, contextSize, contextSize, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	b.Address = ctx.Address
+	if i := ctx.TargetOffset - ctx.Offset; i >= 0 && i < len(ctx.Items) {
+		b.Message = ctx.Items[i].Message
+		b.ContactName = ctx.Items[i].ContactName
+	}
+	if contextSize > 0 {
+		b.Context = ctx.Items
+	}
+	return b, nil
+}
+
+// GetBookmarks lists starred messages, most recently starred first, each
+// with contextSize items of its conversation on either side
+func GetBookmarks(userDB *sql.DB, contextSize, limit, offset int) ([]Bookmark, error) {
+	rows, err := userDB.Query(
+		"SELECT message_id FROM bookmarks ORDER BY created_at DESC, message_id DESC LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	bookmarks := []Bookmark{}
+	for _, id := range ids {
+		b, err := GetBookmark(userDB, id, contextSize)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, *b)
+	}
+	return bookmarks, nil
+}
+
+// HandleBookmarks handles GET /api/bookmarks
+func HandleBookmarks(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	contextSize := 0
+	if val, err := strconv.Atoi(c.QueryParam("context")); err == nil && val > 0 {
+		contextSize = min(val, MaxBookmarkContext)
+	}
+	limit := DefaultBookmarkLimit
+	if val, err := strconv.Atoi(c.QueryParam("limit")); err == nil && val > 0 {
+		limit = val
+	}
+	offset := 0
+	if val, err := strconv.Atoi(c.QueryParam("offset")); err == nil && val > 0 {
+		offset = val
+	}
+
+	bookmarks, err := GetBookmarks(userDB, contextSize, limit, offset)
+	if err != nil {
+		slog.Error("Error getting bookmarks", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get bookmarks",
+		})
+	}
+
+	return c.JSON(http.StatusOK, bookmarks)
+}
+
+// HandleSetBookmark handles PUT /api/bookmarks/:id, starring a message with
+// an optional {"note": "..."} body
+func HandleSetBookmark(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	messageID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid message ID",
+		})
+	}
+
+	var body struct {
+		Note string `json:"note"`
+	}
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid bookmark data",
+			})
+		}
+	}
+
+	err = SetBookmark(userDB, messageID, body.Note)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Message not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error setting bookmark", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to bookmark message",
+		})
+	}
+
+	bookmark, err := GetBookmark(userDB, messageID, 0)
+	if err != nil {
+		slog.Error("Error getting bookmark", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get bookmark",
+		})
+	}
+	return c.JSON(http.StatusOK, bookmark)
+}
+
+// HandleDeleteBookmark handles DELETE /api/bookmarks/:id
+func HandleDeleteBookmark(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	messageID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid message ID",
+		})
+	}
+
+	err = DeleteBookmark(userDB, messageID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Bookmark not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error deleting bookmark", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete bookmark",
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
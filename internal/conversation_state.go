@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrInvalidConversationState is returned for an unknown conversation list
+// view or analytics exclusion
+var ErrInvalidConversationState = errors.New("invalid conversation state")
+
+// Values of the show parameter of GetConversations
+const (
+	ConversationsShowDefault  = ""         // everything not archived or hidden
+	ConversationsShowArchived = "archived" // only archived, not hidden
+	ConversationsShowHidden   = "hidden"
+	ConversationsShowAll      = "all"
+)
+
+// conversationShowCondition returns the SQL condition on address selecting
+// the conversations a list view shows
+func conversationShowCondition(show string) (string, error) {
+	switch show {
+	case ConversationsShowDefault:
+		return " AND address NOT IN (SELECT address FROM conversation_state WHERE archived = 1 OR hidden = 1)", nil
+	case ConversationsShowArchived:
+		return " AND address IN (SELECT address FROM conversation_state WHERE archived = 1 AND hidden = 0)", nil
+	case ConversationsShowHidden:
+		return " AND address IN (SELECT address FROM conversation_state WHERE hidden = 1)", nil
+	case ConversationsShowAll:
+		return "", nil
+	}
+	return "", fmt.Errorf("%w: unknown view %q", ErrInvalidConversationState, show)
+}
+
+// conversationExcludeCondition returns the SQL condition on address leaving
+// out conversations with any of the given flags ("muted", "hidden" or
+// "archived")
+func conversationExcludeCondition(flags []string) (string, error) {
+	var cols []string
+	for _, flag := range flags {
+		switch flag {
+		case "muted", "hidden", "archived":
+			cols = append(cols, flag+" = 1")
+		case "":
+		default:
+			return "", fmt.Errorf("%w: can't exclude %q", ErrInvalidConversationState, flag)
+		}
+	}
+	if len(cols) == 0 {
+		return "", nil
+	}
+	return " AND address NOT IN (SELECT address FROM conversation_state WHERE " + strings.Join(cols, " OR ") + ")", nil
+}
+
+// ConversationStateUpdate changes some of a conversation's flags; nil
+// fields are left as they are
+type ConversationStateUpdate struct {
+	Pinned   *bool `json:"pinned"`
+	Archived *bool `json:"archived"`
+	Hidden   *bool `json:"hidden"`
+	Muted    *bool `json:"muted"`
+}
+
+// GetConversationState returns the flags set on a conversation. A
+// conversation that has never had any set gets all flags false.
+func GetConversationState(userDB *sql.DB, address string) (*ConversationState, error) {
+	s := &ConversationState{Address: address}
+	var updatedAt int64
+	err := userDB.QueryRow(
+		"SELECT pinned, archived, hidden, muted, updated_at FROM conversation_state WHERE address = ?", address,
+	).Scan(&s.Pinned, &s.Archived, &s.Hidden, &s.Muted, &updatedAt)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.UpdatedAt = time.Unix(updatedAt, 0)
+	return s, nil
+}
+
+// SetConversationState applies an update to a conversation's flags and
+// returns the result. Returns sql.ErrNoRows if the user has no conversation
+// at the address.
+func SetConversationState(userDB *sql.DB, address string, update ConversationStateUpdate) (*ConversationState, error) {
+	var exists bool
+	err := userDB.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE address = ?)", address).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	s, err := GetConversationState(userDB, address)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		dst *bool
+		src *bool
+	}{
+		{&s.Pinned, update.Pinned},
+		{&s.Archived, update.Archived},
+		{&s.Hidden, update.Hidden},
+		{&s.Muted, update.Muted},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	s.UpdatedAt = time.Unix(time.Now().Unix(), 0)
+
+	unlock := LockForWrite(userDB)
+	defer unlock()
+	_, err = userDB.Exec(`
+		INSERT INTO conversation_state (address, pinned, archived, hidden, muted, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(address) DO UPDATE SET
+			pinned = excluded.pinned, archived = excluded.archived,
+			hidden = excluded.hidden, muted = excluded.muted,
+			updated_at = excluded.updated_at
+	`, address, s.Pinned, s.Archived, s.Hidden, s.Muted, s.UpdatedAt.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// HandleConversationState handles PUT /api/conversations/state?address=,
+// setting whichever of pinned, archived, hidden and muted the body includes
+func HandleConversationState(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	address := c.QueryParam("address")
+	if address == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "address parameter is required",
+		})
+	}
+
+	var update ConversationStateUpdate
+	if err := c.Bind(&update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid conversation state data",
+		})
+	}
+
+	state, err := SetConversationState(userDB, address, update)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Conversation not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error setting conversation state", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update conversation",
+		})
+	}
+
+	return c.JSON(http.StatusOK, state)
+}
@@ -24,6 +24,8 @@ func CustomCORSMiddleware() echo.MiddlewareFunc {
 			if allowedOrigins[origin] {
 				c.Response().Header().Set("Access-Control-Allow-Origin", origin)
 				c.Response().Header().Set("Access-Control-Allow-Credentials", "true")
+				// Paging details for /api/search
+				c.Response().Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor")
 			}
 
 			// Handle preflight requests
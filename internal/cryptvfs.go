@@ -0,0 +1,410 @@
+package internal
+
+/*
+#include <stdlib.h>
+#include <string.h>
+
+// Declarations from sqlite3.h. The header isn't on the include path (the
+// driver bundles its own copy of SQLite), but these structs and functions
+// are part of SQLite's stable ABI and resolve against the driver's build.
+typedef long long sqlite3_int64;
+typedef const char *sqlite3_filename;
+typedef struct sqlite3_file sqlite3_file;
+struct sqlite3_file {
+	const struct sqlite3_io_methods *pMethods;
+};
+typedef struct sqlite3_io_methods sqlite3_io_methods;
+struct sqlite3_io_methods {
+	int iVersion;
+	int (*xClose)(sqlite3_file*);
+	int (*xRead)(sqlite3_file*, void*, int iAmt, sqlite3_int64 iOfst);
+	int (*xWrite)(sqlite3_file*, const void*, int iAmt, sqlite3_int64 iOfst);
+	int (*xTruncate)(sqlite3_file*, sqlite3_int64 size);
+	int (*xSync)(sqlite3_file*, int flags);
+	int (*xFileSize)(sqlite3_file*, sqlite3_int64 *pSize);
+	int (*xLock)(sqlite3_file*, int);
+	int (*xUnlock)(sqlite3_file*, int);
+	int (*xCheckReservedLock)(sqlite3_file*, int *pResOut);
+	int (*xFileControl)(sqlite3_file*, int op, void *pArg);
+	int (*xSectorSize)(sqlite3_file*);
+	int (*xDeviceCharacteristics)(sqlite3_file*);
+	int (*xShmMap)(sqlite3_file*, int iPg, int pgsz, int, void volatile**);
+	int (*xShmLock)(sqlite3_file*, int offset, int n, int flags);
+	void (*xShmBarrier)(sqlite3_file*);
+	int (*xShmUnmap)(sqlite3_file*, int deleteFlag);
+	int (*xFetch)(sqlite3_file*, sqlite3_int64 iOfst, int iAmt, void **pp);
+	int (*xUnfetch)(sqlite3_file*, sqlite3_int64 iOfst, void *p);
+};
+typedef void (*sqlite3_syscall_ptr)(void);
+typedef struct sqlite3_vfs sqlite3_vfs;
+struct sqlite3_vfs {
+	int iVersion;
+	int szOsFile;
+	int mxPathname;
+	sqlite3_vfs *pNext;
+	const char *zName;
+	void *pAppData;
+	int (*xOpen)(sqlite3_vfs*, sqlite3_filename zName, sqlite3_file*, int flags, int *pOutFlags);
+	int (*xDelete)(sqlite3_vfs*, const char *zName, int syncDir);
+	int (*xAccess)(sqlite3_vfs*, const char *zName, int flags, int *pResOut);
+	int (*xFullPathname)(sqlite3_vfs*, const char *zName, int nOut, char *zOut);
+	void *(*xDlOpen)(sqlite3_vfs*, const char *zFilename);
+	void (*xDlError)(sqlite3_vfs*, int nByte, char *zErrMsg);
+	void (*(*xDlSym)(sqlite3_vfs*, void*, const char *zSymbol))(void);
+	void (*xDlClose)(sqlite3_vfs*, void*);
+	int (*xRandomness)(sqlite3_vfs*, int nByte, char *zOut);
+	int (*xSleep)(sqlite3_vfs*, int microseconds);
+	int (*xCurrentTime)(sqlite3_vfs*, double*);
+	int (*xGetLastError)(sqlite3_vfs*, int, char *);
+	int (*xCurrentTimeInt64)(sqlite3_vfs*, sqlite3_int64*);
+	int (*xSetSystemCall)(sqlite3_vfs*, const char *zName, sqlite3_syscall_ptr);
+	sqlite3_syscall_ptr (*xGetSystemCall)(sqlite3_vfs*, const char *zName);
+	const char *(*xNextSystemCall)(sqlite3_vfs*, const char *zName);
+};
+sqlite3_int64 sqlite3_uri_int64(sqlite3_filename, const char*, sqlite3_int64);
+sqlite3_vfs *sqlite3_vfs_find(const char *zVfsName);
+int sqlite3_vfs_register(sqlite3_vfs*, int makeDflt);
+
+#define SQLITE_OK                 0
+#define SQLITE_ERROR              1
+#define SQLITE_CANTOPEN           14
+#define SQLITE_IOERR              10
+#define SQLITE_IOERR_READ         (SQLITE_IOERR | (1<<8))
+#define SQLITE_IOERR_SHORT_READ   (SQLITE_IOERR | (2<<8))
+#define SQLITE_IOERR_WRITE        (SQLITE_IOERR | (3<<8))
+#define SQLITE_IOERR_NOMEM        (SQLITE_IOERR | (12<<8))
+#define SQLITE_OPEN_MAIN_DB       0x00000100
+#define SQLITE_OPEN_MAIN_JOURNAL  0x00000800
+#define SQLITE_OPEN_SUPER_JOURNAL 0x00004000
+#define SQLITE_OPEN_WAL           0x00080000
+#define SQLITE_IOCAP_SEQUENTIAL            0x00000400
+#define SQLITE_IOCAP_UNDELETABLE_WHEN_OPEN 0x00000800
+#define SQLITE_IOCAP_IMMUTABLE             0x00002000
+
+// Implemented in Go (cryptvfs_blocks.go)
+extern int sbvcryptBlocks(long long keyID, int kind, char *buf, int n, long long block, int encrypt);
+
+// File kinds, which keep the same block of different files from
+// encrypting alike
+#define SBVCRYPT_MAIN    0
+#define SBVCRYPT_JOURNAL 1
+#define SBVCRYPT_WAL     2
+#define SBVCRYPT_TEMP    3
+
+static sqlite3_vfs *sbvcrypt_base;
+static sqlite3_vfs sbvcrypt_vfs;
+static int sbvcrypt_block;
+static sqlite3_int64 sbvcrypt_temp_key;
+
+typedef struct sbvcrypt_file {
+	sqlite3_file base;
+	sqlite3_file *real;  // the base VFS's file, allocated after this struct
+	sqlite3_int64 key;   // Go key registry ID; 0 passes data through as-is
+	int kind;
+} sbvcrypt_file;
+
+static sqlite3_int64 sbvcrypt_floor(sqlite3_int64 n) {
+	return n / sbvcrypt_block * sbvcrypt_block;
+}
+
+// sbvcrypt_read_blocks reads and decrypts the whole blocks in
+// [start, start+n). Blocks past the end of the file (or torn by a crash
+// mid-write) are zeroed, and SQLITE_IOERR_SHORT_READ returned.
+static int sbvcrypt_read_blocks(sbvcrypt_file *p, unsigned char *dst, sqlite3_int64 start, int n) {
+	int valid = n;
+	int rc = p->real->pMethods->xRead(p->real, dst, n, start);
+	if (rc == SQLITE_IOERR_SHORT_READ) {
+		sqlite3_int64 size;
+		int rc2 = p->real->pMethods->xFileSize(p->real, &size);
+		if (rc2 != SQLITE_OK) {
+			return rc2;
+		}
+		valid = size <= start ? 0 : (int)sbvcrypt_floor(size - start);
+		if (valid > n) {
+			valid = n;
+		}
+		memset(dst + valid, 0, n - valid);
+	} else if (rc != SQLITE_OK) {
+		return rc;
+	}
+	if (valid > 0 && sbvcryptBlocks(p->key, p->kind, (char*)dst, valid, start / sbvcrypt_block, 0) != 0) {
+		return SQLITE_IOERR_READ;
+	}
+	return valid < n ? SQLITE_IOERR_SHORT_READ : SQLITE_OK;
+}
+
+static int sbvcrypt_close(sqlite3_file *f) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xClose(p->real);
+}
+
+static int sbvcrypt_read(sqlite3_file *f, void *buf, int amt, sqlite3_int64 off) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	if (!p->key) {
+		return p->real->pMethods->xRead(p->real, buf, amt, off);
+	}
+	sqlite3_int64 start = sbvcrypt_floor(off);
+	int n = (int)(sbvcrypt_floor(off + amt + sbvcrypt_block - 1) - start);
+	if (start == off && n == amt) {
+		return sbvcrypt_read_blocks(p, buf, start, n);
+	}
+
+	unsigned char *work = malloc(n);
+	if (!work) {
+		return SQLITE_IOERR_NOMEM;
+	}
+	int rc = sbvcrypt_read_blocks(p, work, start, n);
+	if (rc == SQLITE_OK || rc == SQLITE_IOERR_SHORT_READ) {
+		memcpy(buf, work + (off - start), amt);
+	}
+	free(work);
+	return rc;
+}
+
+// sbvcrypt_write encrypts whole blocks, so a write that starts or ends
+// partway through one reads the rest of it back first
+static int sbvcrypt_write(sqlite3_file *f, const void *buf, int amt, sqlite3_int64 off) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	if (!p->key) {
+		return p->real->pMethods->xWrite(p->real, buf, amt, off);
+	}
+	sqlite3_int64 start = sbvcrypt_floor(off);
+	sqlite3_int64 end = sbvcrypt_floor(off + amt + sbvcrypt_block - 1);
+	int n = (int)(end - start);
+
+	unsigned char *work = malloc(n);
+	if (!work) {
+		return SQLITE_IOERR_NOMEM;
+	}
+	int rc = SQLITE_OK;
+	if (start != off) {
+		rc = sbvcrypt_read_blocks(p, work, start, sbvcrypt_block);
+	}
+	if ((rc == SQLITE_OK || rc == SQLITE_IOERR_SHORT_READ) && end != off + amt && (start == off || n > sbvcrypt_block)) {
+		rc = sbvcrypt_read_blocks(p, work + n - sbvcrypt_block, end - sbvcrypt_block, sbvcrypt_block);
+	}
+	if (rc == SQLITE_OK || rc == SQLITE_IOERR_SHORT_READ) {
+		memcpy(work + (off - start), buf, amt);
+		if (sbvcryptBlocks(p->key, p->kind, (char*)work, n, start / sbvcrypt_block, 1) != 0) {
+			rc = SQLITE_IOERR_WRITE;
+		} else {
+			rc = p->real->pMethods->xWrite(p->real, work, n, start);
+		}
+	}
+	free(work);
+	return rc;
+}
+
+// sbvcrypt_truncate keeps files a whole number of blocks long. The padding
+// past the size SQLite asked for is never valid content: WAL frames and
+// journal records carry checksums, and database files are only truncated
+// at page boundaries.
+static int sbvcrypt_truncate(sqlite3_file *f, sqlite3_int64 size) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	if (p->key) {
+		size = sbvcrypt_floor(size + sbvcrypt_block - 1);
+	}
+	return p->real->pMethods->xTruncate(p->real, size);
+}
+
+static int sbvcrypt_sync(sqlite3_file *f, int flags) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xSync(p->real, flags);
+}
+
+static int sbvcrypt_file_size(sqlite3_file *f, sqlite3_int64 *size) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xFileSize(p->real, size);
+}
+
+static int sbvcrypt_lock(sqlite3_file *f, int lock) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xLock(p->real, lock);
+}
+
+static int sbvcrypt_unlock(sqlite3_file *f, int lock) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xUnlock(p->real, lock);
+}
+
+static int sbvcrypt_check_reserved_lock(sqlite3_file *f, int *out) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xCheckReservedLock(p->real, out);
+}
+
+static int sbvcrypt_file_control(sqlite3_file *f, int op, void *arg) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xFileControl(p->real, op, arg);
+}
+
+static int sbvcrypt_sector_size(sqlite3_file *f) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	int size = p->real->pMethods->xSectorSize(p->real);
+	return p->key && size < sbvcrypt_block ? sbvcrypt_block : size;
+}
+
+// A partial-block write rewrites the whole block, so an encrypted file
+// can't promise writes leave neighboring bytes alone or are atomic
+static int sbvcrypt_device_characteristics(sqlite3_file *f) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	int caps = p->real->pMethods->xDeviceCharacteristics(p->real);
+	if (p->key) {
+		caps &= SQLITE_IOCAP_SEQUENTIAL | SQLITE_IOCAP_UNDELETABLE_WHEN_OPEN | SQLITE_IOCAP_IMMUTABLE;
+	}
+	return caps;
+}
+
+// The WAL index (-shm) only holds page numbers and checksums, so it's
+// shared memory as usual
+static int sbvcrypt_shm_map(sqlite3_file *f, int pg, int pgsz, int extend, void volatile **pp) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xShmMap(p->real, pg, pgsz, extend, pp);
+}
+
+static int sbvcrypt_shm_lock(sqlite3_file *f, int offset, int n, int flags) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xShmLock(p->real, offset, n, flags);
+}
+
+static void sbvcrypt_shm_barrier(sqlite3_file *f) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	p->real->pMethods->xShmBarrier(p->real);
+}
+
+static int sbvcrypt_shm_unmap(sqlite3_file *f, int deleteFlag) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	return p->real->pMethods->xShmUnmap(p->real, deleteFlag);
+}
+
+// Version 2: no xFetch, so SQLite never memory-maps ciphertext
+static const sqlite3_io_methods sbvcrypt_io = {
+	2,
+	sbvcrypt_close,
+	sbvcrypt_read,
+	sbvcrypt_write,
+	sbvcrypt_truncate,
+	sbvcrypt_sync,
+	sbvcrypt_file_size,
+	sbvcrypt_lock,
+	sbvcrypt_unlock,
+	sbvcrypt_check_reserved_lock,
+	sbvcrypt_file_control,
+	sbvcrypt_sector_size,
+	sbvcrypt_device_characteristics,
+	sbvcrypt_shm_map,
+	sbvcrypt_shm_lock,
+	sbvcrypt_shm_barrier,
+	sbvcrypt_shm_unmap,
+	0,
+	0,
+};
+
+// sbvcrypt_open encrypts a database, its journal and WAL with the key named
+// by the database URI's sbvkey parameter, and temporary files (sorts,
+// statement journals, VACUUM's copy) with a per-process key
+static int sbvcrypt_open(sqlite3_vfs *vfs, sqlite3_filename name, sqlite3_file *f, int flags, int *outFlags) {
+	sbvcrypt_file *p = (sbvcrypt_file*)f;
+	p->real = (sqlite3_file*)&p[1];
+	p->key = 0;
+	p->kind = SBVCRYPT_TEMP;
+	if (flags & (SQLITE_OPEN_MAIN_DB | SQLITE_OPEN_MAIN_JOURNAL | SQLITE_OPEN_WAL)) {
+		p->key = name ? sqlite3_uri_int64(name, "sbvkey", 0) : 0;
+		if (p->key <= 0) {
+			f->pMethods = 0;
+			return SQLITE_CANTOPEN;
+		}
+		if (flags & SQLITE_OPEN_MAIN_JOURNAL) {
+			p->kind = SBVCRYPT_JOURNAL;
+		} else if (flags & SQLITE_OPEN_WAL) {
+			p->kind = SBVCRYPT_WAL;
+		} else {
+			p->kind = SBVCRYPT_MAIN;
+		}
+	} else if (!(flags & SQLITE_OPEN_SUPER_JOURNAL)) {
+		// Super-journals only list journal file names
+		p->key = sbvcrypt_temp_key;
+	}
+
+	int rc = sbvcrypt_base->xOpen(sbvcrypt_base, name, p->real, flags, outFlags);
+	if (rc != SQLITE_OK) {
+		f->pMethods = 0;
+		return rc;
+	}
+	f->pMethods = &sbvcrypt_io;
+	return SQLITE_OK;
+}
+
+// sbvcrypt_register registers the VFS under name, layered over the default
+// one, which handles everything besides file contents
+static int sbvcrypt_register(const char *name, int block, sqlite3_int64 tempKey) {
+	sbvcrypt_base = sqlite3_vfs_find(0);
+	if (!sbvcrypt_base) {
+		return SQLITE_ERROR;
+	}
+	sbvcrypt_block = block;
+	sbvcrypt_temp_key = tempKey;
+	sbvcrypt_vfs = *sbvcrypt_base;
+	sbvcrypt_vfs.pNext = 0;
+	sbvcrypt_vfs.zName = name;
+	sbvcrypt_vfs.szOsFile = sizeof(sbvcrypt_file) + sbvcrypt_base->szOsFile;
+	sbvcrypt_vfs.xOpen = sbvcrypt_open;
+	return sqlite3_vfs_register(&sbvcrypt_vfs, 0);
+}
+*/
+import "C"
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// cryptVFSName is the SQLite VFS that encrypts database files. It wraps
+// the default VFS, encrypting every cryptBlockSize bytes of a file with
+// AES-256-XTS, tweaked by the block's position and the kind of file, the
+// way disk encryption does. Databases opened through it are unreadable
+// without their key, including their journals, WALs and temporary files;
+// file sizes and which blocks changed between two copies are not hidden,
+// and nothing is authenticated, so it protects a copied or stolen volume
+// rather than detecting tampering.
+//
+// SQLCipher would do the same job, but only by replacing the SQLite the
+// driver bundles for every user, encrypted or not: either a Go binding
+// that ships its own, older SQLite (without the FTS5 trigram tokenizer
+// substring search needs), or linking a system libsqlcipher into every
+// build and Docker image. A VFS leaves the bundled SQLite as it is. The C
+// here is only the plumbing SQLite calls through; the cryptography is Go's
+// (see cryptvfs_blocks.go), and encryption_test.go runs it in both
+// journal modes and across key rotation.
+const cryptVFSName = "sbv-crypt"
+
+// cryptBlockSize is the unit files are encrypted in. It divides every
+// SQLite page size, so pages never share a block and database writes need
+// no read-back; only the journal and WAL, whose records have headers of
+// their own, write partial blocks.
+const cryptBlockSize = 512
+
+func init() {
+	// Temporary files don't outlive the process, so they get a key that
+	// doesn't either
+	tempKey := make([]byte, xtsKeySize)
+	if _, err := rand.Read(tempKey); err != nil {
+		panic(fmt.Sprintf("failed to generate temporary file key: %v", err))
+	}
+	tempKeyID, err := registerVFSKey(tempKey)
+	if err != nil {
+		panic(fmt.Sprintf("failed to register temporary file key: %v", err))
+	}
+
+	// SQLite keeps the name pointer, so it's never freed
+	if rc := C.sbvcrypt_register(C.CString(cryptVFSName), C.int(cryptBlockSize), C.sqlite3_int64(tempKeyID)); rc != 0 {
+		panic(fmt.Sprintf("failed to register %s VFS: SQLite error %d", cryptVFSName, int(rc)))
+	}
+}
+
+// encryptedDSN returns the DSN opening the database at path through
+// cryptVFSName with a key from registerVFSKey
+func encryptedDSN(path string, keyID int64) string {
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	return fmt.Sprintf("file:%s?vfs=%s&sbvkey=%d", escaped, cryptVFSName, keyID)
+}
@@ -0,0 +1,76 @@
+package internal
+
+import "C"
+
+import (
+	"crypto/aes"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/crypto/xts"
+)
+
+// xtsKeySize is the key size of AES-256-XTS: two AES-256 keys
+const xtsKeySize = 64
+
+// vfsKeys are the keys cryptVFSName encrypts with, by the ID databases name
+// them by in their DSN (see encryptedDSN). Keys stay out of DSNs, which end
+// up in error messages.
+var (
+	vfsKeys      = make(map[int64]*xts.Cipher)
+	vfsKeysMutex sync.RWMutex
+	nextVFSKeyID int64
+)
+
+// registerVFSKey makes an AES-256-XTS key available to cryptVFSName and
+// returns its ID
+func registerVFSKey(key []byte) (int64, error) {
+	if len(key) != xtsKeySize {
+		return 0, fmt.Errorf("database key must be %d bytes, not %d", xtsKeySize, len(key))
+	}
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return 0, err
+	}
+	vfsKeysMutex.Lock()
+	defer vfsKeysMutex.Unlock()
+	nextVFSKeyID++
+	vfsKeys[nextVFSKeyID] = c
+	return nextVFSKeyID, nil
+}
+
+// unregisterVFSKey forgets a key once no open database uses it
+func unregisterVFSKey(id int64) {
+	vfsKeysMutex.Lock()
+	delete(vfsKeys, id)
+	vfsKeysMutex.Unlock()
+}
+
+// sbvcryptBlocks encrypts or decrypts n bytes of whole blocks in place for
+// cryptVFSName, starting at block number block of a file of the given
+// kind. It returns nonzero if the key isn't registered.
+//
+//export sbvcryptBlocks
+func sbvcryptBlocks(keyID C.longlong, kind C.int, buf *C.char, n C.int, block C.longlong, encrypt C.int) C.int {
+	vfsKeysMutex.RLock()
+	c := vfsKeys[int64(keyID)]
+	vfsKeysMutex.RUnlock()
+	if c == nil {
+		return 1
+	}
+
+	data := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(n))
+	for i := 0; i+cryptBlockSize <= len(data); i += cryptBlockSize {
+		// The top byte of the tweak is the file kind, so e.g. a page in
+		// the WAL doesn't encrypt like the same page in the database
+		sector := uint64(kind)<<56 | uint64(int64(block)+int64(i/cryptBlockSize))
+		b := data[i : i+cryptBlockSize]
+		if encrypt != 0 {
+			c.Encrypt(b, b, sector)
+		} else {
+			c.Decrypt(b, b, sector)
+		}
+	}
+	return 0
+}
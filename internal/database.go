@@ -2,10 +2,13 @@ package internal
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -62,6 +65,88 @@ func LockForWrite(database *sql.DB) func() {
 	return lock.Unlock
 }
 
+// dbQueryer is satisfied by both *sql.DB and *sql.Tx
+type dbQueryer interface {
+	dbExecer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// tableExists reports whether a table (including a virtual table) exists
+func tableExists(database dbQueryer, name string) bool {
+	var n int
+	err := database.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n)
+	return err == nil && n > 0
+}
+
+// derivedIndexes are tables kept up to date by triggers on messages. The
+// triggers only see rows written after the table was created, so a database
+// from before one existed needs it backfilled once, by the given statement.
+// These predate schema versioning, so the initial migration backfills
+// whichever are missing; later derived tables backfill in their own
+// migration.
+var derivedIndexes = []struct {
+	table    string
+	backfill string
+}{
+	{"messages_trigram", "INSERT INTO messages_trigram(messages_trigram) VALUES('rebuild')"},
+	{"search_names", `
+		INSERT OR IGNORE INTO search_names(address, kind, name)
+		SELECT DISTINCT address, 'number', REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(address, ' ', ''), '-', ''), '(', ''), ')', ''), '.', '') FROM messages;
+		INSERT OR IGNORE INTO search_names(address, kind, name)
+		SELECT DISTINCT address, 'contact', contact_name FROM messages
+		WHERE COALESCE(contact_name, '') NOT IN ('', '(Unknown)');
+		INSERT OR IGNORE INTO search_names(address, kind, name)
+		SELECT DISTINCT address, 'group', subject FROM messages
+		WHERE COALESCE(subject, '') != '' AND address LIKE '%,%';
+	`},
+	{"sender_stats", `
+		INSERT INTO sender_stats(address, messages, sent, templated)
+		SELECT address, COUNT(*), SUM(type = 2), SUM(` + templatedBody("body") + `)
+		FROM messages WHERE record_type IN (1, 2) GROUP BY address
+	`},
+}
+
+// missingDerivedIndexes lists the derived index tables a database doesn't
+// have yet. Call before creating the schema.
+func missingDerivedIndexes(database dbQueryer) []string {
+	var missing []string
+	for _, idx := range derivedIndexes {
+		if !tableExists(database, idx.table) {
+			missing = append(missing, idx.table)
+		}
+	}
+	return missing
+}
+
+// backfillDerivedIndexes populates newly created derived index tables from
+// existing messages. Callers must hold the database's write lock.
+func backfillDerivedIndexes(database dbQueryer, tables []string) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	var count int
+	if err := database.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	for _, idx := range derivedIndexes {
+		if !slices.Contains(tables, idx.table) {
+			continue
+		}
+		slog.Info("Building search index", "table", idx.table, "messages", count)
+		start := time.Now()
+		if _, err := database.Exec(idx.backfill); err != nil {
+			return fmt.Errorf("failed to build %s: %w", idx.table, err)
+		}
+		slog.Info("Search index built", "table", idx.table, "duration", time.Since(start))
+	}
+	return nil
+}
+
 // truncateString truncates a string to maxLen characters for logging
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
@@ -92,7 +177,7 @@ func SanitizeUsername(username string) string {
 
 func InitDB(filepath string) error {
 	var err error
-	db, err = sql.Open("sqlite3", filepath)
+	db, err = sql.Open(sqliteDriver, filepath)
 	if err != nil {
 		return err
 	}
@@ -124,83 +209,7 @@ func InitDB(filepath string) error {
 		// are serialized via LockForWrite instead of capping the connection pool.
 	}
 
-	createTableSQL := `
-	-- Unified table for SMS messages, MMS messages, and call logs
-	-- record_type: 1 = SMS, 2 = MMS, 3 = call
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		record_type INTEGER NOT NULL DEFAULT 1,
-		address TEXT NOT NULL,
-		body TEXT,
-		type INTEGER NOT NULL,
-		date INTEGER NOT NULL,
-		read INTEGER DEFAULT 0,
-		thread_id INTEGER,
-		subject TEXT,
-		media_type TEXT,
-		media_data BLOB,
-		protocol INTEGER,
-		status INTEGER,
-		service_center TEXT,
-		sub_id INTEGER,
-		contact_name TEXT,
-		sender TEXT,
-		content_type TEXT,
-		read_report INTEGER,
-		read_status INTEGER,
-		message_id TEXT,
-		message_size INTEGER,
-		message_type INTEGER,
-		sim_slot INTEGER,
-		addresses TEXT,
-		duration INTEGER,
-		presentation INTEGER,
-		subscription_id TEXT
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_address ON messages(address);
-	CREATE INDEX IF NOT EXISTS idx_date ON messages(date);
-	CREATE INDEX IF NOT EXISTS idx_thread ON messages(thread_id);
-	CREATE INDEX IF NOT EXISTS idx_record_type ON messages(record_type);
-	CREATE INDEX IF NOT EXISTS idx_record_type_date ON messages(record_type, date);
-	CREATE INDEX IF NOT EXISTS idx_address_date ON messages(address, date);
-
-	-- Create unique constraints for idempotent imports
-	-- record_type differentiates SMS (1), MMS (2), and calls (3)
-	CREATE UNIQUE INDEX IF NOT EXISTS idx_message_unique ON messages(record_type, address, date, type, COALESCE(body, ''), COALESCE(content_type, ''), COALESCE(message_id, ''), COALESCE(duration, 0));
-
-	-- Create FTS5 virtual table for full-text search of messages
-	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
-		message_id UNINDEXED,
-		address UNINDEXED,
-		body,
-		contact_name UNINDEXED,
-		date UNINDEXED,
-		content='messages',
-		content_rowid='id'
-	);
-
-	-- Create triggers to keep FTS table in sync
-	CREATE TRIGGER IF NOT EXISTS messages_ai AFTER INSERT ON messages BEGIN
-		INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
-		VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
-	END;
-
-	CREATE TRIGGER IF NOT EXISTS messages_ad AFTER DELETE ON messages BEGIN
-		INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
-		VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
-	END;
-
-	CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE ON messages BEGIN
-		INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
-		VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
-		INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
-		VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
-	END;
-	`
-
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
+	if _, _, err := runMigrations(db, userDBMigrations); err != nil {
 		return err
 	}
 
@@ -210,7 +219,12 @@ func InitDB(filepath string) error {
 
 // InitUserDB initializes a database for a specific user
 func InitUserDB(userID string, filepath string) error {
-	userDB, err := sql.Open("sqlite3", filepath)
+	// Encrypted databases open through the encrypting VFS
+	dsn, err := userDatabaseDSN(userID, filepath)
+	if err != nil {
+		return err
+	}
+	userDB, err := sql.Open(sqliteDriver, dsn)
 	if err != nil {
 		return err
 	}
@@ -244,80 +258,7 @@ func InitUserDB(userID string, filepath string) error {
 		userDB.SetMaxOpenConns(1)
 	}
 
-	createTableSQL := `
-	-- Unified table for SMS messages, MMS messages, and call logs
-	-- record_type: 1 = SMS, 2 = MMS, 3 = call
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		record_type INTEGER NOT NULL DEFAULT 1,
-		address TEXT NOT NULL,
-		body TEXT,
-		type INTEGER NOT NULL,
-		date INTEGER NOT NULL,
-		read INTEGER DEFAULT 0,
-		thread_id INTEGER,
-		subject TEXT,
-		media_type TEXT,
-		media_data BLOB,
-		protocol INTEGER,
-		status INTEGER,
-		service_center TEXT,
-		sub_id INTEGER,
-		contact_name TEXT,
-		sender TEXT,
-		content_type TEXT,
-		read_report INTEGER,
-		read_status INTEGER,
-		message_id TEXT,
-		message_size INTEGER,
-		message_type INTEGER,
-		sim_slot INTEGER,
-		addresses TEXT,
-		duration INTEGER,
-		presentation INTEGER,
-		subscription_id TEXT
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_address ON messages(address);
-	CREATE INDEX IF NOT EXISTS idx_date ON messages(date);
-	CREATE INDEX IF NOT EXISTS idx_thread ON messages(thread_id);
-	CREATE INDEX IF NOT EXISTS idx_record_type ON messages(record_type);
-	CREATE INDEX IF NOT EXISTS idx_record_type_date ON messages(record_type, date);
-	CREATE INDEX IF NOT EXISTS idx_address_date ON messages(address, date);
-
-	-- record_type differentiates SMS (1), MMS (2), and calls (3)
-	CREATE UNIQUE INDEX IF NOT EXISTS idx_message_unique ON messages(record_type, address, date, type, COALESCE(body, ''), COALESCE(content_type, ''), COALESCE(message_id, ''), COALESCE(duration, 0));
-
-	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
-		message_id UNINDEXED,
-		address UNINDEXED,
-		body,
-		contact_name UNINDEXED,
-		date UNINDEXED,
-		content='messages',
-		content_rowid='id'
-	);
-
-	CREATE TRIGGER IF NOT EXISTS messages_ai AFTER INSERT ON messages BEGIN
-		INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
-		VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
-	END;
-
-	CREATE TRIGGER IF NOT EXISTS messages_ad AFTER DELETE ON messages BEGIN
-		INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
-		VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
-	END;
-
-	CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE ON messages BEGIN
-		INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
-		VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
-		INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
-		VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
-	END;
-	`
-
-	_, err = userDB.Exec(createTableSQL)
-	if err != nil {
+	if _, _, err := runMigrations(userDB, userDBMigrations); err != nil {
 		return err
 	}
 
@@ -358,7 +299,7 @@ func GetUserDB(userID string, username string) (*sql.DB, error) {
 				dbPathPrefix = "."
 			}
 			// Use UUID as database filename instead of sanitized username
-			filepath := fmt.Sprintf("%s/sbv_%s.db", dbPathPrefix, userID)
+			filepath := UserDBPath(dbPathPrefix, userID)
 
 			// InitUserDB will create the database if it doesn't exist
 			if err := InitUserDB(userID, filepath); err != nil {
@@ -374,7 +315,15 @@ func GetUserDB(userID string, username string) (*sql.DB, error) {
 	return userDB, nil
 }
 
+// InsertMessage inserts msg unless it's an exact duplicate of an existing
+// message (see DedupExact)
 func InsertMessage(userDB dbExecer, msg *Message) error {
+	return insertMessage(userDB, msg, DedupExact)
+}
+
+// insertMessage inserts msg unless it's a duplicate under the dedup
+// strategy
+func insertMessage(userDB dbExecer, msg *Message, dedup string) error {
 	// Convert addresses slice to JSON string
 	var addressesJSON string
 	if len(msg.Addresses) > 0 {
@@ -390,21 +339,48 @@ func InsertMessage(userDB dbExecer, msg *Message) error {
 		recordType = 2 // MMS
 	}
 
+	dedupKey := dedupKey(msg.Address, int64(msg.Type), msg.Sender, msg.Date.Unix(), msg.Body, msg.MediaData)
+
+	completed, err := completeEarlierImport(userDB, messageImportKey(recordType, msg),
+		columnAssignments(messageBackupColumns)+`, dedup_key = CASE WHEN dedup_key IS NULL THEN NULL
+			ELSE message_dedup_key(address, type, COALESCE(sender, ''), ?, COALESCE(body, ''), COALESCE(media_data, X'')) END`,
+		append(messageBackupValues(msg), msg.Date.Unix()))
+	if err != nil {
+		return err
+	}
+	if completed {
+		return insertMessageParts(userDB, messageImportKey(recordType, msg), msg.Parts)
+	}
+
+	// idx_message_unique skips exact duplicates, and messages_tombstone_bi
+	// exact copies of deleted ones; with DedupNormalized, so does a
+	// dedup_key matching a message or tombstone. (The SELECT needs a WHERE
+	// for SQLite to parse ON CONFLICT as an upsert clause.)
+	guard := "WHERE true"
+	var guardArgs []interface{}
+	if dedup == DedupNormalized {
+		guard = `WHERE NOT EXISTS (SELECT 1 FROM messages WHERE dedup_key = ?)
+			AND NOT EXISTS (SELECT 1 FROM tombstones WHERE dedup_key = ?)`
+		guardArgs = append(guardArgs, dedupKey, dedupKey)
+	}
 	query := `
 		INSERT INTO messages (
-			record_type, address, body, type, date, read, thread_id, subject, media_type, media_data,
+			record_type, address, body, type, date, date_ms, read, thread_id, subject, media_type, media_data,
 			protocol, status, service_center, sub_id, contact_name, sender,
-			content_type, read_report, read_status, message_id, message_size, message_type, sim_slot, addresses
+			content_type, read_report, read_status, message_id, message_size, message_type, sim_slot, addresses,
+			dedup_key, ` + messageBackupColumns + `
 		)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ` + inPlaceholders(len(messageBackupValues(msg))) + `
+		` + guard + `
 		ON CONFLICT DO NOTHING
 	`
-	result, err := userDB.Exec(query,
+	args := []interface{}{
 		recordType, // record_type: 1 = SMS, 2 = MMS
 		msg.Address,
 		msg.Body,
 		msg.Type,
 		msg.Date.Unix(),
+		msg.Date.UnixMilli(),
 		msg.Read,
 		msg.ThreadID,
 		msg.Subject,
@@ -424,7 +400,10 @@ func InsertMessage(userDB dbExecer, msg *Message) error {
 		msg.MessageType,
 		msg.SimSlot,
 		addressesJSON,
-	)
+		dedupKey,
+	}
+	args = append(args, messageBackupValues(msg)...)
+	result, err := userDB.Exec(query, append(args, guardArgs...)...)
 	if err != nil {
 		slog.Debug("InsertMessage: Error inserting message", "error", err)
 		return err
@@ -436,25 +415,217 @@ func InsertMessage(userDB dbExecer, msg *Message) error {
 	}
 	msg.ID = id
 
+	inserted, _ := result.RowsAffected()
+	if inserted > 0 {
+		if err := insertMessageParts(userDB, messageImportKey(recordType, msg), msg.Parts); err != nil {
+			return err
+		}
+	}
+
+	// Image dimensions are cheap to read from the header while the data is
+	// already in memory; everything else is left to IndexMediaMetadata
+	if inserted > 0 && len(msg.MediaData) > 0 {
+		if width, height, ok := imageDimensions(msg.MediaData); ok {
+			if _, err := userDB.Exec(
+				"INSERT OR REPLACE INTO media_meta (message_id, width, height) VALUES (?, ?, ?)",
+				id, width, height,
+			); err != nil {
+				return err
+			}
+		}
+		if msg.MediaName != "" {
+			if _, err := userDB.Exec(
+				"INSERT OR REPLACE INTO media_names (message_id, name) VALUES (?, ?)",
+				id, msg.MediaName,
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Backup fields beyond those idx_message_unique compares, which an import
+// of a message or call sets and completeEarlierImport fills in
+const (
+	messageBackupColumns = "date_sent, locked, seen, creator, priority, delivery_report, recipients, extra"
+	callBackupColumns    = "post_dial_digits, features, phone_account_id, extra"
+)
+
+func messageBackupValues(msg *Message) []interface{} {
+	return []interface{}{
+		nullableMillis(msg.DateSent), boolInt(msg.Locked), boolInt(msg.Seen), msg.Creator, msg.Priority, msg.DeliveryReport,
+		recipientsJSON(msg.Recipients), extraJSON(msg.Extra),
+	}
+}
+
+func callBackupValues(call *CallLog) []interface{} {
+	return []interface{}{call.PostDialDigits, call.Features, call.PhoneAccountID, extraJSON(call.Extra)}
+}
+
+// boolInt is 1 for true and 0 for false, as flags are stored
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// columnAssignments turns a list of columns into "column = ?" assignments
+func columnAssignments(columns string) string {
+	names := strings.Split(columns, ", ")
+	for i, name := range names {
+		names[i] = name + " = ?"
+	}
+	return strings.Join(names, ", ")
+}
+
+// importKey is an incoming message or call as idx_message_unique sees it
+type importKey struct {
+	recordType                   int
+	address                      string
+	msgType                      int
+	body, contentType, messageID string
+	duration                     int
+	date                         time.Time
+}
+
+func messageImportKey(recordType int, msg *Message) importKey {
+	return importKey{recordType, msg.Address, msg.Type, msg.Body, msg.ContentType, msg.MessageID, 0, msg.Date}
+}
+
+func callImportKey(call *CallLog) importKey {
+	return importKey{3, call.Number, call.Type, "", "", "", call.Duration, call.Date}
+}
+
+// earlierImportUpdate returns the UPDATE that fills in the copy of an
+// incoming message or call imported by an earlier version: one from before
+// dates kept milliseconds (see migrateMillisecondDates), whose date_ms has
+// whole seconds, or from before every backup field was kept (see
+// migrateBackupFields), whose extra is NULL. That way re-importing the
+// backup completes it, rather than adding a second copy or doing nothing.
+// set assigns the other columns to fill.
+func earlierImportUpdate(key importKey, set string, setArgs []interface{}) (string, []interface{}) {
+	dateMs := key.date.UnixMilli()
+	query := `
+		UPDATE messages SET date_ms = ?, ` + set + `
+		WHERE record_type = ? AND address = ? AND date = ? AND (date_ms = ? OR date_ms = date * 1000)
+			AND extra IS NULL AND type = ? AND COALESCE(body, '') = ? AND COALESCE(content_type, '') = ?
+			AND COALESCE(message_id, '') = ? AND COALESCE(duration, 0) = ?`
+	args := append([]interface{}{dateMs}, setArgs...)
+	args = append(args, key.recordType, key.address, key.date.Unix(), dateMs, key.msgType,
+		key.body, key.contentType, key.messageID, key.duration)
+	return query, args
+}
+
+// insertMessageParts stores an MMS's parts for the message imported with
+// key, unless it has them already
+func insertMessageParts(userDB dbExecer, key importKey, parts []MessagePart) error {
+	for _, part := range parts {
+		attributes, _ := json.Marshal(part.Attributes)
+		_, err := userDB.Exec(`
+			INSERT INTO message_parts (message_id, position, attributes, data, media)
+			SELECT id, ?, ?, ?, ? FROM messages
+			WHERE record_type = ? AND address = ? AND date_ms = ? AND type = ? AND COALESCE(body, '') = ?
+				AND COALESCE(content_type, '') = ? AND COALESCE(message_id, '') = ? AND COALESCE(duration, 0) = ?
+			ON CONFLICT DO NOTHING`,
+			part.Position, string(attributes), part.Data, boolInt(part.Media),
+			key.recordType, key.address, key.date.UnixMilli(), key.msgType, key.body,
+			key.contentType, key.messageID, key.duration,
+		)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// completeEarlierImport runs earlierImportUpdate, reporting whether there
+// was an earlier copy
+func completeEarlierImport(userDB dbExecer, key importKey, set string, setArgs []interface{}) (bool, error) {
+	query, args := earlierImportUpdate(key, set, setArgs)
+	result, err := userDB.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// recipientsJSON encodes recipients for the recipients column, or nil if
+// there are none
+func recipientsJSON(recipients []Recipient) interface{} {
+	if len(recipients) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(recipients)
+	return string(data)
+}
+
+// parseRecipients decodes the recipients column
+func parseRecipients(data string) []Recipient {
+	if data == "" {
+		return nil
+	}
+	var recipients []Recipient
+	if err := json.Unmarshal([]byte(data), &recipients); err != nil {
+		slog.Warn("Ignoring malformed recipients", "error", err)
+		return nil
+	}
+	return recipients
+}
+
+// extraJSON encodes extra for the extra column. It's never NULL, even
+// without attributes, since NULL marks rows from earlier versions.
+func extraJSON(extra map[string]string) string {
+	if len(extra) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(extra)
+	return string(data)
+}
+
+// nullableMillis returns t in Unix milliseconds, or nil for a nil t
+func nullableMillis(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
+
+// timeFromMillis is the inverse of nullableMillis
+func timeFromMillis(ms sql.NullInt64) *time.Time {
+	if !ms.Valid {
+		return nil
+	}
+	t := time.UnixMilli(ms.Int64)
+	return &t
+}
+
 func InsertCallLog(userDB dbExecer, call *CallLog) error {
+	completed, err := completeEarlierImport(userDB, callImportKey(call), columnAssignments(callBackupColumns), callBackupValues(call))
+	if err != nil || completed {
+		return err
+	}
+
 	query := `
-		INSERT INTO messages (record_type, address, type, date, duration, presentation, subscription_id, contact_name)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (record_type, address, type, date, date_ms, duration, presentation, subscription_id, contact_name,
+			` + callBackupColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT DO NOTHING
 	`
-	result, err := userDB.Exec(query,
+	result, err := userDB.Exec(query, append([]interface{}{
 		3, // record_type: 3 = call
 		call.Number,
 		call.Type,
 		call.Date.Unix(),
+		call.Date.UnixMilli(),
 		call.Duration,
 		call.Presentation,
 		call.SubscriptionID,
 		call.ContactName,
-	)
+	}, callBackupValues(call)...)...)
 	if err != nil {
 		return err
 	}
@@ -480,8 +651,9 @@ func InsertCallLogBatch(userDB *sql.DB, calls []CallLog) error {
 	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`
-		INSERT INTO messages (record_type, address, type, date, duration, presentation, subscription_id, contact_name)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (record_type, address, type, date, date_ms, duration, presentation, subscription_id, contact_name,
+			` + callBackupColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT DO NOTHING
 	`)
 	if err != nil {
@@ -490,16 +662,24 @@ func InsertCallLogBatch(userDB *sql.DB, calls []CallLog) error {
 	defer stmt.Close()
 
 	for i := range calls {
-		_, err := stmt.Exec(
+		completed, err := completeEarlierImport(tx, callImportKey(&calls[i]), columnAssignments(callBackupColumns), callBackupValues(&calls[i]))
+		if err != nil {
+			return err
+		}
+		if completed {
+			continue
+		}
+		_, err = stmt.Exec(append([]interface{}{
 			3, // record_type: 3 = call
 			calls[i].Number,
 			calls[i].Type,
 			calls[i].Date.Unix(),
+			calls[i].Date.UnixMilli(),
 			calls[i].Duration,
 			calls[i].Presentation,
 			calls[i].SubscriptionID,
 			calls[i].ContactName,
-		)
+		}, callBackupValues(&calls[i])...)...)
 		if err != nil {
 			return err
 		}
@@ -508,11 +688,11 @@ func InsertCallLogBatch(userDB *sql.DB, calls []CallLog) error {
 	return tx.Commit()
 }
 
-func GetConversations(userDB *sql.DB, startDate, endDate *time.Time) ([]Conversation, error) {
+func GetConversations(userDB *sql.DB, startDate, endDate *time.Time, tag, show, category string) ([]Conversation, error) {
 	// Find the latest row per address via a correlated subquery against
-	// idx_address_date, rather than joining a second CTE that re-scans the
+	// idx_address_date_ms, rather than joining a second CTE that re-scans the
 	// whole table. EXPLAIN QUERY PLAN confirms this drives the subquery as an
-	// indexed SEARCH (address=? AND date=?) instead of a second full SCAN of
+	// indexed SEARCH (address=? AND date_ms=?) instead of a second full SCAN of
 	// messages -- meaningful on large per-user databases, especially over
 	// network-backed storage where a second full-table scan is expensive.
 	dateFilter := "1=1"
@@ -525,8 +705,29 @@ func GetConversations(userDB *sql.DB, startDate, endDate *time.Time) ([]Conversa
 		dateFilter += " AND date <= ?"
 		args = append(args, endDate.Unix())
 	}
+	if tag != "" {
+		cond, tagArgs := tagConversationCondition(tag)
+		dateFilter += cond
+		args = append(args, tagArgs...)
+	}
+	stateCond, err := conversationShowCondition(show)
+	if err != nil {
+		return nil, err
+	}
+	dateFilter += stateCond
+	categoryCond, err := senderCategoryCondition("", category)
+	if err != nil {
+		return nil, err
+	}
+	dateFilter += categoryCond
+	return queryConversations(userDB, dateFilter, args)
+}
+
+// queryConversations summarizes each address with messages matching filter,
+// a SQL condition over the messages table, most recent first
+func queryConversations(userDB *sql.DB, filter string, args []interface{}) ([]Conversation, error) {
 	// args are used twice: once for the agg CTE, once for the correlated subquery
-	args = append(args, args...)
+	args = append(append([]interface{}{}, args...), args...)
 
 	query := `
 		WITH
@@ -535,10 +736,10 @@ func GetConversations(userDB *sql.DB, startDate, endDate *time.Time) ([]Conversa
 				address,
 				MAX(COALESCE(contact_name, ''))                                AS contact_name,
 				MAX(CASE WHEN subject != '' THEN subject ELSE NULL END)        AS subject,
-				MAX(date)                                                       AS last_date,
+				MAX(date_ms)                                                    AS last_date,
 				COUNT(*)                                                        AS activity_count
 			FROM messages
-			WHERE ` + dateFilter + `
+			WHERE ` + filter + `
 			GROUP BY address
 		)
 		SELECT
@@ -556,14 +757,18 @@ func GetConversations(userDB *sql.DB, startDate, endDate *time.Time) ([]Conversa
 						WHEN m.record_type = 3 AND m.type = 6 THEN 'Refused call'
 						ELSE COALESCE(m.body, '')
 					END
-				FROM messages m INDEXED BY idx_address_date
-				WHERE m.address = agg.address AND m.date = agg.last_date
+				FROM messages m INDEXED BY idx_address_date_ms
+				WHERE m.address = agg.address AND m.date_ms = agg.last_date
 				LIMIT 1
 			) AS last_message,
 			agg.last_date,
-			agg.activity_count
+			agg.activity_count,
+			COALESCE(cs.pinned, 0), COALESCE(cs.archived, 0), COALESCE(cs.hidden, 0), COALESCE(cs.muted, 0),
+			` + senderCategoryExpr("agg.address", "ss") + `
 		FROM agg
-		ORDER BY agg.last_date DESC
+		LEFT JOIN conversation_state cs ON cs.address = agg.address
+		LEFT JOIN sender_stats ss ON ss.address = agg.address
+		ORDER BY COALESCE(cs.pinned, 0) DESC, agg.last_date DESC
 	`
 
 	rows, err := userDB.Query(query, args...)
@@ -575,17 +780,29 @@ func GetConversations(userDB *sql.DB, startDate, endDate *time.Time) ([]Conversa
 	conversations := []Conversation{}
 	for rows.Next() {
 		var c Conversation
-		var lastDateUnix int64
+		var lastDateMs int64
 		var subject sql.NullString
-		err := rows.Scan(&c.Address, &c.ContactName, &subject, &c.LastMessage, &lastDateUnix, &c.MessageCount)
+		err := rows.Scan(&c.Address, &c.ContactName, &subject, &c.LastMessage, &lastDateMs, &c.MessageCount,
+			&c.Pinned, &c.Archived, &c.Hidden, &c.Muted, &c.Category)
 		if err != nil {
 			return nil, err
 		}
-		c.LastDate = time.Unix(lastDateUnix, 0)
+		c.LastDate = time.UnixMilli(lastDateMs)
 		c.Subject = subject.String
 		c.Type = "conversation" // Changed from "message" or "call" to indicate it's a merged conversation
 		conversations = append(conversations, c)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tagNames, err := conversationTagNames(userDB)
+	if err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		conversations[i].Tags = tagNames[conversations[i].Address]
+	}
 
 	return conversations, nil
 }
@@ -609,15 +826,19 @@ func formatCallType(callType int) string {
 	}
 }
 
-func GetMessages(userDB *sql.DB, address string, startDate, endDate *time.Time) ([]Message, error) {
+// GetMessages returns a conversation's SMS and MMS. Media data isn't
+// loaded; it's fetched on demand via /api/media.
+func GetMessages(userDB dbQueryer, address string, startDate, endDate *time.Time) ([]Message, error) {
 	query := `
-		SELECT id, address, body, type, date, read, thread_id,
-		       COALESCE(subject, ''), COALESCE(media_type, ''), COALESCE(media_data, ''),
+		SELECT id, address, body, type, date_ms, date_sent, read, thread_id,
+		       COALESCE(subject, ''), COALESCE(media_type, ''),
 		       COALESCE(protocol, 0), COALESCE(status, 0), COALESCE(service_center, ''),
 		       COALESCE(sub_id, 0), COALESCE(contact_name, ''), COALESCE(sender, ''),
 		       COALESCE(content_type, ''), COALESCE(read_report, 0), COALESCE(read_status, 0),
 		       COALESCE(message_id, ''), COALESCE(message_size, 0), COALESCE(message_type, 0),
-		       COALESCE(sim_slot, 0), COALESCE(addresses, '')
+		       COALESCE(sim_slot, 0), COALESCE(addresses, ''),
+		       COALESCE(locked, 0), COALESCE(seen, 0), COALESCE(creator, ''),
+		       COALESCE(priority, 0), COALESCE(delivery_report, 0), COALESCE(recipients, '')
 		FROM messages
 		WHERE record_type IN (1, 2) AND address = ?  -- 1 = SMS, 2 = MMS
 	`
@@ -632,7 +853,7 @@ func GetMessages(userDB *sql.DB, address string, startDate, endDate *time.Time)
 		args = append(args, endDate.Unix())
 	}
 
-	query += " ORDER BY date ASC"
+	query += " ORDER BY date_ms ASC, id ASC"
 
 	slog.Debug("GetMessages: executing query", "address", address)
 	slog.Debug("GetMessages: SQL query", "query", query)
@@ -648,18 +869,22 @@ func GetMessages(userDB *sql.DB, address string, startDate, endDate *time.Time)
 	messages := []Message{}
 	for rows.Next() {
 		var m Message
-		var dateUnix int64
+		var dateMs int64
+		var dateSent sql.NullInt64
 		var readInt int
-		var addressesStr string
-		err := rows.Scan(&m.ID, &m.Address, &m.Body, &m.Type, &dateUnix,
-			&readInt, &m.ThreadID, &m.Subject, &m.MediaType, &m.MediaData,
+		var addressesStr, recipients string
+		err := rows.Scan(&m.ID, &m.Address, &m.Body, &m.Type, &dateMs, &dateSent,
+			&readInt, &m.ThreadID, &m.Subject, &m.MediaType,
 			&m.Protocol, &m.Status, &m.ServiceCenter, &m.SubID, &m.ContactName, &m.Sender,
 			&m.ContentType, &m.ReadReport, &m.ReadStatus, &m.MessageID,
-			&m.MessageSize, &m.MessageType, &m.SimSlot, &addressesStr)
+			&m.MessageSize, &m.MessageType, &m.SimSlot, &addressesStr,
+			&m.Locked, &m.Seen, &m.Creator, &m.Priority, &m.DeliveryReport, &recipients)
 		if err != nil {
 			return nil, err
 		}
-		m.Date = time.Unix(dateUnix, 0)
+		m.Recipients = parseRecipients(recipients)
+		m.Date = time.UnixMilli(dateMs)
+		m.DateSent = timeFromMillis(dateSent)
 		m.Read = readInt == 1
 
 		// Parse addresses from comma-separated string
@@ -667,10 +892,6 @@ func GetMessages(userDB *sql.DB, address string, startDate, endDate *time.Time)
 			m.Addresses = strings.Split(addressesStr, ",")
 		}
 
-		// Don't load media data - it will be fetched on demand via /api/media
-		// Clear MediaData to save memory in response
-		m.MediaData = nil
-
 		slog.Debug("GetMessages: Message", "id", m.ID, "address", m.Address, "media_type", m.MediaType, "body", truncateString(m.Body, 50))
 
 		messages = append(messages, m)
@@ -680,10 +901,11 @@ func GetMessages(userDB *sql.DB, address string, startDate, endDate *time.Time)
 	return messages, nil
 }
 
-func GetCallLogs(userDB *sql.DB, number string, startDate, endDate *time.Time) ([]CallLog, error) {
+func GetCallLogs(userDB dbQueryer, number string, startDate, endDate *time.Time) ([]CallLog, error) {
 	query := `
-		SELECT id, address, duration, date, type,
-		       COALESCE(presentation, 0), COALESCE(subscription_id, ''), COALESCE(contact_name, '')
+		SELECT id, address, duration, date_ms, type,
+		       COALESCE(presentation, 0), COALESCE(subscription_id, ''), COALESCE(contact_name, ''),
+		       COALESCE(post_dial_digits, ''), COALESCE(features, 0), COALESCE(phone_account_id, '')
 		FROM messages
 		WHERE record_type = 3 AND address = ?  -- 3 = call
 	`
@@ -698,7 +920,7 @@ func GetCallLogs(userDB *sql.DB, number string, startDate, endDate *time.Time) (
 		args = append(args, endDate.Unix())
 	}
 
-	query += " ORDER BY date ASC"
+	query += " ORDER BY date_ms ASC, id ASC"
 
 	rows, err := userDB.Query(query, args...)
 	if err != nil {
@@ -709,23 +931,25 @@ func GetCallLogs(userDB *sql.DB, number string, startDate, endDate *time.Time) (
 	calls := []CallLog{}
 	for rows.Next() {
 		var c CallLog
-		var dateUnix int64
-		err := rows.Scan(&c.ID, &c.Number, &c.Duration, &dateUnix, &c.Type,
-			&c.Presentation, &c.SubscriptionID, &c.ContactName)
+		var dateMs int64
+		err := rows.Scan(&c.ID, &c.Number, &c.Duration, &dateMs, &c.Type,
+			&c.Presentation, &c.SubscriptionID, &c.ContactName,
+			&c.PostDialDigits, &c.Features, &c.PhoneAccountID)
 		if err != nil {
 			return nil, err
 		}
-		c.Date = time.Unix(dateUnix, 0)
+		c.Date = time.UnixMilli(dateMs)
 		calls = append(calls, c)
 	}
 
 	return calls, nil
 }
 
-func GetAllCalls(userDB *sql.DB, startDate, endDate *time.Time, limit, offset int) ([]CallLog, error) {
+func GetAllCalls(userDB dbQueryer, startDate, endDate *time.Time, limit, offset int) ([]CallLog, error) {
 	query := `
-		SELECT id, address, duration, date, type,
-		       COALESCE(presentation, 0), COALESCE(subscription_id, ''), COALESCE(contact_name, '')
+		SELECT id, address, duration, date_ms, type,
+		       COALESCE(presentation, 0), COALESCE(subscription_id, ''), COALESCE(contact_name, ''),
+		       COALESCE(post_dial_digits, ''), COALESCE(features, 0), COALESCE(phone_account_id, '')
 		FROM messages
 		WHERE record_type = 3  -- 3 = call
 	`
@@ -740,7 +964,7 @@ func GetAllCalls(userDB *sql.DB, startDate, endDate *time.Time, limit, offset in
 		args = append(args, endDate.Unix())
 	}
 
-	query += " ORDER BY date ASC LIMIT ? OFFSET ?"
+	query += " ORDER BY date_ms ASC, id ASC LIMIT ? OFFSET ?"
 	args = append(args, limit, offset)
 
 	rows, err := userDB.Query(query, args...)
@@ -752,38 +976,36 @@ func GetAllCalls(userDB *sql.DB, startDate, endDate *time.Time, limit, offset in
 	calls := []CallLog{}
 	for rows.Next() {
 		var c CallLog
-		var dateUnix int64
-		err := rows.Scan(&c.ID, &c.Number, &c.Duration, &dateUnix, &c.Type,
-			&c.Presentation, &c.SubscriptionID, &c.ContactName)
+		var dateMs int64
+		err := rows.Scan(&c.ID, &c.Number, &c.Duration, &dateMs, &c.Type,
+			&c.Presentation, &c.SubscriptionID, &c.ContactName,
+			&c.PostDialDigits, &c.Features, &c.PhoneAccountID)
 		if err != nil {
 			return nil, err
 		}
-		c.Date = time.Unix(dateUnix, 0)
+		c.Date = time.UnixMilli(dateMs)
 		calls = append(calls, c)
 	}
 
 	return calls, nil
 }
 
-func GetActivity(userDB *sql.DB, startDate, endDate *time.Time, limit, offset int) ([]ActivityItem, error) {
-	return GetActivityByAddress(userDB, "", startDate, endDate, limit, offset)
+// GetActivity returns messages and calls across all conversations, limited
+// to those with a tag (on the message or its conversation) if tag is set
+func GetActivity(userDB *sql.DB, startDate, endDate *time.Time, tag string, limit, offset int) ([]ActivityItem, error) {
+	return getActivity(userDB, "", startDate, endDate, tag, limit, offset)
 }
 
 func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *time.Time, limit, offset int) ([]ActivityItem, error) {
-	var activities []ActivityItem
+	return getActivity(userDB, address, startDate, endDate, "", limit, offset)
+}
 
+func getActivity(userDB *sql.DB, address string, startDate, endDate *time.Time, tag string, limit, offset int) ([]ActivityItem, error) {
 	// Query from unified table — media_data is intentionally excluded; fetched on-demand via /api/media
 	query := `
-		SELECT record_type, date, address, COALESCE(contact_name, '') as contact_name,
-		       id, body, type, read, thread_id, COALESCE(subject, ''),
-		       COALESCE(media_type, ''),
-		       COALESCE(protocol, 0), COALESCE(status, 0), COALESCE(service_center, ''),
-		       COALESCE(sub_id, 0), COALESCE(content_type, ''), COALESCE(read_report, 0),
-		       COALESCE(read_status, 0), COALESCE(message_id, ''), COALESCE(message_size, 0),
-		       COALESCE(message_type, 0), COALESCE(sim_slot, 0), COALESCE(addresses, ''),
-		       COALESCE(duration, 0), COALESCE(presentation, 0), COALESCE(subscription_id, ''),
-		       COALESCE(sender, '')
+		SELECT ` + activityColumns(activityAnnotations) + `
 		FROM messages
+		LEFT JOIN bookmarks b ON b.message_id = messages.id
 		WHERE 1=1
 	`
 
@@ -800,8 +1022,15 @@ func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *ti
 		query += " AND date <= ?"
 		args = append(args, endDate.Unix())
 	}
+	if tag != "" {
+		cond, tagArgs := tagMessageCondition("messages.", tag)
+		query += cond
+		args = append(args, tagArgs...)
+	}
 
-	query += " ORDER BY date ASC LIMIT ? OFFSET ?"
+	// id breaks ties between same-millisecond messages so offsets are
+	// stable (see GetMessageContext)
+	query += " ORDER BY date_ms ASC, id ASC LIMIT ? OFFSET ?"
 	args = append(args, limit, offset)
 
 	slog.Debug("GetActivityByAddress: executing query", "address", address, "limit", limit, "offset", offset)
@@ -815,9 +1044,44 @@ func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *ti
 	}
 	defer rows.Close()
 
+	activities, err := scanActivities(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("GetActivityByAddress: Returning activities", "count", len(activities), "address", address)
+	return activities, nil
+}
+
+// activityAnnotations are activityColumns' annotations from messages left
+// joined with bookmarks b
+var activityAnnotations = "b.message_id IS NOT NULL, COALESCE(b.note, ''), " + tagNamesColumn("messages.id")
+
+// activityColumns is the select list scanActivities reads. annotations
+// selects whether the message is bookmarked, its bookmark note and its tag
+// names joined by tagSeparator.
+func activityColumns(annotations string) string {
+	return `record_type, date_ms, date_sent, address, COALESCE(contact_name, '') as contact_name,
+		       id, body, type, read, thread_id, COALESCE(subject, ''),
+		       COALESCE(media_type, ''),
+		       COALESCE(protocol, 0), COALESCE(status, 0), COALESCE(service_center, ''),
+		       COALESCE(sub_id, 0), COALESCE(content_type, ''), COALESCE(read_report, 0),
+		       COALESCE(read_status, 0), COALESCE(messages.message_id, ''), COALESCE(message_size, 0),
+		       COALESCE(message_type, 0), COALESCE(sim_slot, 0), COALESCE(addresses, ''),
+		       COALESCE(duration, 0), COALESCE(presentation, 0), COALESCE(subscription_id, ''),
+		       COALESCE(sender, ''), COALESCE(locked, 0), COALESCE(seen, 0), COALESCE(creator, ''),
+		       COALESCE(priority, 0), COALESCE(delivery_report, 0), COALESCE(recipients, ''),
+		       COALESCE(post_dial_digits, ''), COALESCE(features, 0), COALESCE(phone_account_id, ''),
+		       ` + annotations
+}
+
+// scanActivities reads rows selected with activityColumns
+func scanActivities(rows *sql.Rows) ([]ActivityItem, error) {
+	var activities []ActivityItem
 	for rows.Next() {
 		var recordType int64
-		var dateUnix int64
+		var dateMs int64
+		var dateSent sql.NullInt64
 		var address, contactName string
 
 		// Shared fields
@@ -828,17 +1092,29 @@ func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *ti
 		var body, subject, mediaType, serviceCenter, contentType, messageID, subscriptionID, addressesStr, sender sql.NullString
 		var readInt, threadID, protocol, status, subID, readReport, readStatus, messageSize, messageTypeField, simSlot sql.NullInt64
 
+		// Remaining backup fields
+		var locked, seen bool
+		var creator, recipients, postDialDigits, phoneAccountID string
+		var priority, deliveryReport, features int
+
 		// Call fields
 		var duration, presentation sql.NullInt64
 
-		err := rows.Scan(&recordType, &dateUnix, &address, &contactName,
+		var bookmarked bool
+		var bookmarkNote string
+		var tagNames sql.NullString
+
+		err := rows.Scan(&recordType, &dateMs, &dateSent, &address, &contactName,
 			&id, &body, &itemType, &readInt, &threadID, &subject,
 			&mediaType,
 			&protocol, &status, &serviceCenter,
 			&subID, &contentType, &readReport,
 			&readStatus, &messageID, &messageSize,
 			&messageTypeField, &simSlot, &addressesStr,
-			&duration, &presentation, &subscriptionID, &sender)
+			&duration, &presentation, &subscriptionID, &sender,
+			&locked, &seen, &creator, &priority, &deliveryReport, &recipients,
+			&postDialDigits, &features, &phoneAccountID,
+			&bookmarked, &bookmarkNote, &tagNames)
 		if err != nil {
 			return nil, err
 		}
@@ -854,7 +1130,7 @@ func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *ti
 
 		activity := ActivityItem{
 			Type:        activityTypeStr,
-			Date:        time.Unix(dateUnix, 0),
+			Date:        time.UnixMilli(dateMs),
 			Address:     address,
 			ContactName: contactName,
 		}
@@ -862,26 +1138,36 @@ func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *ti
 		if (recordType == 1 || recordType == 2) && id.Valid {
 			// Handle SMS (1) and MMS (2)
 			msg := &Message{
-				ID:            id.Int64,
-				Address:       address,
-				Body:          body.String,
-				Date:          time.Unix(dateUnix, 0),
-				ThreadID:      int(threadID.Int64),
-				Subject:       subject.String,
-				MediaType:     mediaType.String,
-				Protocol:      int(protocol.Int64),
-				Status:        int(status.Int64),
-				ServiceCenter: serviceCenter.String,
-				SubID:         int(subID.Int64),
-				ContactName:   contactName,
-				ContentType:   contentType.String,
-				ReadReport:    int(readReport.Int64),
-				ReadStatus:    int(readStatus.Int64),
-				MessageID:     messageID.String,
-				MessageSize:   int(messageSize.Int64),
-				MessageType:   int(messageTypeField.Int64),
-				SimSlot:       int(simSlot.Int64),
-				Sender:        sender.String,
+				ID:             id.Int64,
+				Address:        address,
+				Body:           body.String,
+				Date:           time.UnixMilli(dateMs),
+				DateSent:       timeFromMillis(dateSent),
+				ThreadID:       int(threadID.Int64),
+				Subject:        subject.String,
+				MediaType:      mediaType.String,
+				Protocol:       int(protocol.Int64),
+				Status:         int(status.Int64),
+				ServiceCenter:  serviceCenter.String,
+				SubID:          int(subID.Int64),
+				ContactName:    contactName,
+				ContentType:    contentType.String,
+				ReadReport:     int(readReport.Int64),
+				ReadStatus:     int(readStatus.Int64),
+				MessageID:      messageID.String,
+				MessageSize:    int(messageSize.Int64),
+				MessageType:    int(messageTypeField.Int64),
+				SimSlot:        int(simSlot.Int64),
+				Sender:         sender.String,
+				Locked:         locked,
+				Seen:           seen,
+				Creator:        creator,
+				Priority:       priority,
+				DeliveryReport: deliveryReport,
+				Recipients:     parseRecipients(recipients),
+				Bookmarked:     bookmarked,
+				BookmarkNote:   bookmarkNote,
+				Tags:           splitTagNames(tagNames),
 			}
 			if itemType.Valid {
 				msg.Type = int(itemType.Int64)
@@ -911,11 +1197,14 @@ func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *ti
 				ID:             id.Int64,
 				Number:         address,
 				Duration:       int(duration.Int64),
-				Date:           time.Unix(dateUnix, 0),
+				Date:           time.UnixMilli(dateMs),
 				Type:           int(itemType.Int64),
 				Presentation:   int(presentation.Int64),
 				SubscriptionID: subscriptionID.String,
 				ContactName:    contactName,
+				PostDialDigits: postDialDigits,
+				Features:       features,
+				PhoneAccountID: phoneAccountID,
 			}
 			slog.Debug("GetActivityByAddress: Call", "id", call.ID, "number", call.Number, "type", call.Type, "duration", call.Duration)
 			activity.Call = call
@@ -923,9 +1212,7 @@ func GetActivityByAddress(userDB *sql.DB, address string, startDate, endDate *ti
 
 		activities = append(activities, activity)
 	}
-
-	slog.Debug("GetActivityByAddress: Returning activities", "count", len(activities), "address", address)
-	return activities, nil
+	return activities, rows.Err()
 }
 
 // CountActivityByAddress returns the total number of activity rows for a given address and date range
@@ -949,10 +1236,57 @@ func CountActivityByAddress(userDB *sql.DB, address string, startDate, endDate *
 	return count, err
 }
 
+// GetMessageContext returns up to before items preceding and after items
+// following a message in its conversation, in GetActivityByAddress order,
+// along with the offset of the first returned item and of the message
+// itself. The date range, if given, is the one the conversation is being
+// viewed with; sql.ErrNoRows is returned if the message isn't in it.
+func GetMessageContext(userDB *sql.DB, messageID int64, before, after int, startDate, endDate *time.Time) (*MessageContext, error) {
+	var address string
+	var dateUnix, dateMs int64
+	err := userDB.QueryRow("SELECT address, date, date_ms FROM messages WHERE id = ?", messageID).Scan(&address, &dateUnix, &dateMs)
+	if err != nil {
+		return nil, err
+	}
+	if (startDate != nil && dateUnix < startDate.Unix()) || (endDate != nil && dateUnix > endDate.Unix()) {
+		return nil, sql.ErrNoRows
+	}
+
+	query := "SELECT COUNT(*) FROM messages WHERE address = ? AND (date_ms < ? OR (date_ms = ? AND id < ?))"
+	args := []interface{}{address, dateMs, dateMs, messageID}
+	if startDate != nil {
+		query += " AND date >= ?"
+		args = append(args, startDate.Unix())
+	}
+	var targetOffset int
+	if err := userDB.QueryRow(query, args...).Scan(&targetOffset); err != nil {
+		return nil, err
+	}
+
+	total, err := CountActivityByAddress(userDB, address, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := max(0, targetOffset-before)
+	items, err := GetActivityByAddress(userDB, address, startDate, endDate, targetOffset-offset+1+after, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageContext{
+		Address:      address,
+		Items:        items,
+		Offset:       offset,
+		TargetOffset: targetOffset,
+		Total:        total,
+	}, nil
+}
+
 // GetMediaByAddress fetches only media items (images/videos) for a specific address
-func GetMediaByAddress(userDB *sql.DB, address string, startDate, endDate *time.Time) ([]Message, error) {
+func GetMediaByAddress(userDB dbQueryer, address string, startDate, endDate *time.Time) ([]Message, error) {
 	query := `
-		SELECT id, address, COALESCE(body, '') as body, date,
+		SELECT id, address, COALESCE(body, '') as body, date_ms,
 		       COALESCE(contact_name, '') as contact_name, COALESCE(media_type, '') as media_type,
 		       read, thread_id
 		FROM messages
@@ -976,7 +1310,7 @@ func GetMediaByAddress(userDB *sql.DB, address string, startDate, endDate *time.
 		args = append(args, endDate.Unix())
 	}
 
-	query += " ORDER BY date DESC"
+	query += " ORDER BY date_ms DESC, id DESC"
 
 	rows, err := userDB.Query(query, args...)
 	if err != nil {
@@ -987,15 +1321,15 @@ func GetMediaByAddress(userDB *sql.DB, address string, startDate, endDate *time.
 	var mediaItems []Message
 	for rows.Next() {
 		var m Message
-		var dateUnix int64
+		var dateMs int64
 		var readInt int64
 
-		err := rows.Scan(&m.ID, &m.Address, &m.Body, &dateUnix, &m.ContactName, &m.MediaType, &readInt, &m.ThreadID)
+		err := rows.Scan(&m.ID, &m.Address, &m.Body, &dateMs, &m.ContactName, &m.MediaType, &readInt, &m.ThreadID)
 		if err != nil {
 			return nil, err
 		}
 
-		m.Date = time.Unix(dateUnix, 0)
+		m.Date = time.UnixMilli(dateMs)
 		m.Read = readInt == 1
 
 		mediaItems = append(mediaItems, m)
@@ -1004,41 +1338,165 @@ func GetMediaByAddress(userDB *sql.DB, address string, startDate, endDate *time.
 	return mediaItems, nil
 }
 
-func GetMessageMedia(userDB *sql.DB, messageID string) ([]byte, string, error) {
+// MediaInfo describes a message's stored attachment without loading it
+type MediaInfo struct {
+	MediaType string
+	Size      int64
+	Date      time.Time
+}
+
+// GetMediaInfo returns the type, size and date of a message's attachment.
+// length() on a BLOB is answered from the record header, so this doesn't
+// read the attachment itself.
+func GetMediaInfo(userDB dbQueryer, messageID string) (*MediaInfo, error) {
+	query := `
+		SELECT COALESCE(media_type, ''), COALESCE(length(media_data), 0), date
+		FROM messages
+		WHERE id = ? AND record_type IN (1, 2)  -- 1 = SMS, 2 = MMS
+	`
+
+	var info MediaInfo
+	var dateUnix int64
+	err := userDB.QueryRow(query, messageID).Scan(&info.MediaType, &info.Size, &dateUnix)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size == 0 || info.MediaType == "" {
+		return nil, fmt.Errorf("no media found")
+	}
+	info.Date = time.Unix(dateUnix, 0)
+	return &info, nil
+}
+
+// mediaChunkSize is how much of an attachment mediaBlobReader fetches per
+// query. SQLite materializes the whole value when evaluating substr() on a
+// BLOB column, so this is a trade-off: too small and a large video costs
+// hundreds of queries, each re-reading the full value; too large and we're
+// back to holding big buffers per request.
+const mediaChunkSize = 1 << 20 // 1 MB
+
+// mediaChunk returns up to n bytes of a message's media_data, starting at
+// offset
+func mediaChunk(userDB dbQueryer, messageID string, offset, n int64) ([]byte, error) {
+	var chunk []byte
+	// substr() is 1-indexed
+	err := userDB.QueryRow(
+		"SELECT substr(media_data, ?, ?) FROM messages WHERE id = ?",
+		offset+1, n, messageID,
+	).Scan(&chunk)
+	return chunk, err
+}
+
+// mediaBlobReader is an io.ReadSeeker over an attachment of size bytes,
+// fetching it in mediaChunkSize pieces (see mediaChunk) rather than loading
+// the whole attachment into Go memory. Each chunk is its own short query,
+// so no connection or read transaction is held open while a response
+// streams -- important in rollback journal mode, where a long-lived reader
+// would block imports from committing.
+type mediaBlobReader struct {
+	fetch  func(offset, n int64) ([]byte, error)
+	size   int64
+	offset int64
+
+	buf    []byte
+	bufOff int64 // offset of buf[0] within the blob
+}
+
+func newMediaBlobReader(size int64, fetch func(offset, n int64) ([]byte, error)) *mediaBlobReader {
+	return &mediaBlobReader{fetch: fetch, size: size}
+}
+
+func (r *mediaBlobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	// Refill when the current offset falls outside the buffered chunk
+	if r.offset < r.bufOff || r.offset >= r.bufOff+int64(len(r.buf)) {
+		chunk, err := r.fetch(r.offset, mediaChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(chunk) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.buf = chunk
+		r.bufOff = r.offset
+	}
+
+	n := copy(p, r.buf[r.offset-r.bufOff:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *mediaBlobReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("negative seek position")
+	}
+	r.offset = abs
+	return abs, nil
+}
+
+// mediaNeedsConversion reports whether browserMedia converts this media
+// type for browser playback (HEIC images, 3GP video, AMR audio)
+func mediaNeedsConversion(mediaType string) bool {
+	return isHEICContentType(mediaType) || needsVideoConversion(mediaType) || needsAudioConversion(mediaType)
+}
+
+// getRawMessageMedia returns a message's attachment exactly as stored,
+// without any browser-compatibility conversion
+func getRawMessageMedia(userDB dbQueryer, messageID string) ([]byte, string, error) {
 	query := `
 		SELECT COALESCE(media_data, ''), COALESCE(media_type, '')
 		FROM messages
 		WHERE id = ? AND record_type IN (1, 2)  -- 1 = SMS, 2 = MMS
 	`
 
-	slog.Debug("GetMessageMedia: Fetching media", "message_id", messageID)
-	slog.Debug("GetMessageMedia: SQL query", "query", query)
+	slog.Debug("getRawMessageMedia: Fetching media", "message_id", messageID)
+	slog.Debug("getRawMessageMedia: SQL query", "query", query)
 
 	var mediaData []byte
 	var mediaType string
 
 	err := userDB.QueryRow(query, messageID).Scan(&mediaData, &mediaType)
 	if err != nil {
-		slog.Debug("GetMessageMedia: Error scanning row", "message_id", messageID, "error", err)
+		slog.Debug("getRawMessageMedia: Error scanning row", "message_id", messageID, "error", err)
 		return nil, "", err
 	}
 
-	slog.Debug("GetMessageMedia: Found media", "media_type", mediaType, "data_length", len(mediaData), "message_id", messageID)
+	slog.Debug("getRawMessageMedia: Found media", "media_type", mediaType, "data_length", len(mediaData), "message_id", messageID)
 
 	if len(mediaData) == 0 || mediaType == "" {
-		slog.Debug("GetMessageMedia: No media found", "message_id", messageID)
+		slog.Debug("getRawMessageMedia: No media found", "message_id", messageID)
 		return nil, "", fmt.Errorf("no media found")
 	}
 
+	return mediaData, mediaType, nil
+}
+
+// browserMedia converts a message's attachment to a format browsers can
+// show, if it needs it. A failed conversion returns the original.
+func browserMedia(messageID string, mediaData []byte, mediaType string) ([]byte, string) {
 	// Convert HEIC to JPEG if needed
 	if isHEICContentType(mediaType) {
 		convertedData, err := convertHEICtoJPEG(mediaData)
 		if err != nil {
 			slog.Error("Failed to convert HEIC to JPEG", "message_id", messageID, "error", err)
 			// Return original if conversion fails
-			return mediaData, mediaType, nil
+			return mediaData, mediaType
 		}
-		return convertedData, "image/jpeg", nil
+		return convertedData, "image/jpeg"
 	}
 
 	// Convert unsupported video formats (3GP, etc.) to MP4 if needed
@@ -1048,10 +1506,10 @@ func GetMessageMedia(userDB *sql.DB, messageID string) ([]byte, string, error) {
 		if err != nil {
 			slog.Error("Failed to convert video to MP4", "message_id", messageID, "error", err)
 			// Return original if conversion fails
-			return mediaData, mediaType, nil
+			return mediaData, mediaType
 		}
 		slog.Info("Successfully converted video to MP4", "message_id", messageID)
-		return convertedData, "video/mp4", nil
+		return convertedData, "video/mp4"
 	}
 
 	// Convert unsupported audio formats (AMR, etc.) to MP3 if needed
@@ -1060,20 +1518,20 @@ func GetMessageMedia(userDB *sql.DB, messageID string) ([]byte, string, error) {
 		convertedData, err := convertAudioToMP3(mediaData)
 		if err != nil {
 			slog.Error("Failed to convert audio to MP3", "message_id", messageID, "error", err)
-			return mediaData, mediaType, nil
+			return mediaData, mediaType
 		}
 		slog.Info("Successfully converted audio to MP3", "message_id", messageID)
-		return convertedData, "audio/mpeg", nil
+		return convertedData, "audio/mpeg"
 	}
 
-	return mediaData, mediaType, nil
+	return mediaData, mediaType
 }
 
 // ErrNoDateRange indicates the account has no messages yet, distinct from
 // an actual query failure
 var ErrNoDateRange = fmt.Errorf("no data available")
 
-func GetDateRange(userDB *sql.DB) (time.Time, time.Time, error) {
+func GetDateRange(userDB dbQueryer) (time.Time, time.Time, error) {
 	var minDate, maxDate int64
 
 	// Get min/max from unified messages table
@@ -1102,52 +1560,11 @@ type SearchResult struct {
 	Body        string    `json:"body"`
 	Date        time.Time `json:"date"`
 	Snippet     string    `json:"snippet"`
-}
-
-// SearchMessages performs full-text search on message contents
-func SearchMessages(userDB *sql.DB, query string, limit int) ([]SearchResult, error) {
-	if query == "" {
-		return []SearchResult{}, nil
-	}
-
-	sqlQuery := `
-		SELECT
-			m.id,
-			m.address,
-			COALESCE(m.contact_name, ''),
-			m.body,
-			m.date,
-			snippet(messages_fts, 2, '<mark>', '</mark>', '...', 50) as snippet
-		FROM messages_fts
-		JOIN messages m ON messages_fts.rowid = m.id
-		WHERE messages_fts MATCH ?
-		ORDER BY rank
-		LIMIT ?
-	`
-
-	rows, err := userDB.Query(sqlQuery, query, limit)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	results := []SearchResult{}
-	for rows.Next() {
-		var r SearchResult
-		var dateUnix int64
-		err := rows.Scan(&r.MessageID, &r.Address, &r.ContactName, &r.Body, &dateUnix, &r.Snippet)
-		if err != nil {
-			return nil, err
-		}
-		r.Date = time.Unix(dateUnix, 0)
-		results = append(results, r)
-	}
-
-	return results, nil
+	Bookmarked  bool      `json:"bookmarked,omitempty"`
 }
 
 // GetAnalytics retrieves analytics data for the Summary tab
-func GetAnalytics(userDB *sql.DB, startDate, endDate *time.Time, topN int, tzOffsetMinutes int) (*AnalyticsResponse, error) {
+func GetAnalytics(userDB *sql.DB, startDate, endDate *time.Time, tag, category string, exclude []string, topN int, tzOffsetMinutes int) (*AnalyticsResponse, error) {
 	analytics := &AnalyticsResponse{}
 
 	// Build date filter
@@ -1161,6 +1578,21 @@ func GetAnalytics(userDB *sql.DB, startDate, endDate *time.Time, topN int, tzOff
 		dateFilter += " AND date <= ?"
 		args = append(args, endDate.Unix())
 	}
+	if tag != "" {
+		cond, tagArgs := tagMessageCondition("", tag)
+		dateFilter += cond
+		args = append(args, tagArgs...)
+	}
+	excludeCond, err := conversationExcludeCondition(exclude)
+	if err != nil {
+		return nil, err
+	}
+	dateFilter += excludeCond
+	categoryCond, err := senderCategoryCondition("", category)
+	if err != nil {
+		return nil, err
+	}
+	dateFilter += categoryCond
 
 	// 1. Get summary statistics
 	if err := getSummaryStats(userDB, dateFilter, args, analytics); err != nil {
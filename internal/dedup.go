@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Dedup strategies for imports, chosen per user in Settings.Import. Calls
+// are always deduplicated exactly.
+const (
+	// DedupExact skips a message only if it matches an existing one on every
+	// column idx_message_unique covers, so copies that differ at all (a
+	// trailing space, a content type) are both kept
+	DedupExact = "exact"
+	// DedupNormalized also skips a message whose conversation, direction,
+	// sender, date to the second and body, ignoring differences in
+	// whitespace, match an existing one (see dedupKey)
+	DedupNormalized = "normalized"
+)
+
+// ErrInvalidDedup is returned for an unknown dedup strategy, or a merge of
+// messages that aren't duplicates of each other
+var ErrInvalidDedup = errors.New("invalid dedup")
+
+// ValidateDedupStrategy checks a Settings.Import.Dedup value. PostgreSQL
+// doesn't keep dedup keys, so only DedupExact is valid with it.
+func ValidateDedupStrategy(strategy string) error {
+	switch strategy {
+	case "", DedupExact:
+		return nil
+	case DedupNormalized:
+		if UsingPostgres() {
+			return fmt.Errorf("%w: the %s strategy needs SQLite", ErrInvalidDedup, DedupNormalized)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: strategy must be %s or %s, not %q", ErrInvalidDedup, DedupExact, DedupNormalized, strategy)
+}
+
+// UserDedupStrategy returns the dedup strategy a user's imports use,
+// falling back to DedupExact if their settings can't be read
+func UserDedupStrategy(userID string) string {
+	settings, err := GetUserSettings(userID)
+	if err != nil {
+		slog.Warn("Failed to get settings, deduplicating exactly", "userID", userID, "error", err)
+		return DedupExact
+	}
+	if settings.Import.Dedup == "" {
+		return DedupExact
+	}
+	return settings.Import.Dedup
+}
+
+// normalizeBody is the message_normalize_body SQL function: body with runs
+// of whitespace collapsed to one space and trimmed
+func normalizeBody(body string) string {
+	return strings.Join(strings.Fields(body), " ")
+}
+
+// dedupKey is the message_dedup_key SQL function: a hash of what makes two
+// SMS or MMS messages the same under DedupNormalized, including a hash of
+// the attachment so distinct pictures sent together aren't taken for one.
+// date is in seconds rather than milliseconds: messages imported before
+// dates kept milliseconds only have whole seconds, and backup apps differ
+// in whether they keep them, so copies of one message can disagree below
+// the second. Exact dedup (idx_message_unique) compares milliseconds.
+func dedupKey(address string, msgType int64, sender string, date int64, body string, media []byte) string {
+	mediaHash := ""
+	if len(media) > 0 {
+		sum := sha256.Sum256(media)
+		mediaHash = hex.EncodeToString(sum[:])
+	}
+	return tombstoneKey(address, msgType, sender, date, normalizeBody(body), mediaHash)
+}
+
+// DuplicateGroup is a set of messages that are near-duplicates of each
+// other: same conversation, direction, sender, second and attachment, and
+// the same body apart from whitespace
+type DuplicateGroup struct {
+	Address    string    `json:"address"`
+	Type       int       `json:"type"`
+	Date       time.Time `json:"date"`
+	Body       string    `json:"body"`        // normalized
+	MessageIDs []int64   `json:"message_ids"` // the copy a merge keeps first
+}
+
+// DuplicateReport lists a user's near-duplicate messages
+type DuplicateReport struct {
+	Groups    []DuplicateGroup `json:"groups"`
+	Redundant int              `json:"redundant"` // copies merging every group would remove
+}
+
+// FindDuplicates groups messages that are near-duplicates of each other,
+// those sharing a dedup_key. Dates are compared to the second (see
+// dedupKey), so distinct messages sent in the same second with the same
+// text show up too; the report is for review before merging.
+func FindDuplicates(userDB *sql.DB) (*DuplicateReport, error) {
+	// Messages with the same dedup_key have the same address, type, second
+	// and normalized body, so any row's are the group's
+	rows, err := userDB.Query(`
+		SELECT address, type, date, message_normalize_body(COALESCE(body, '')), group_concat(id)
+		FROM messages
+		WHERE dedup_key IN (
+			SELECT dedup_key FROM messages WHERE dedup_key IS NOT NULL
+			GROUP BY dedup_key HAVING COUNT(*) > 1
+		)
+		GROUP BY dedup_key
+		ORDER BY date DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DuplicateReport{Groups: []DuplicateGroup{}}
+	for rows.Next() {
+		var g DuplicateGroup
+		var dateUnix int64
+		var ids string
+		if err := rows.Scan(&g.Address, &g.Type, &dateUnix, &g.Body, &ids); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g.Date = time.Unix(dateUnix, 0)
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			g.MessageIDs = append(g.MessageIDs, id)
+		}
+		report.Groups = append(report.Groups, g)
+		report.Redundant += len(g.MessageIDs) - 1
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Put the copy a merge keeps first in each group
+	for i := range report.Groups {
+		keep, err := mergeKeeper(userDB, report.Groups[i].MessageIDs)
+		if err != nil {
+			return nil, err
+		}
+		ids := report.Groups[i].MessageIDs
+		sort.Slice(ids, func(a, b int) bool {
+			return ids[a] == keep || (ids[b] != keep && ids[a] < ids[b])
+		})
+	}
+	return report, nil
+}
+
+// mergeKeeper returns which of a group of duplicates a merge keeps: one
+// with media if any has it, then one with a contact name, then the first
+// imported
+func mergeKeeper(q dbQueryer, ids []int64) (int64, error) {
+	placeholders, args := idPlaceholders(ids)
+	var keep int64
+	err := q.QueryRow(`
+		SELECT id FROM messages WHERE id IN (`+placeholders+`)
+		ORDER BY COALESCE(media_type, '') != '' DESC, COALESCE(contact_name, '') != '' DESC, id
+		LIMIT 1`, args...).Scan(&keep)
+	return keep, err
+}
+
+// idPlaceholders returns "?, ?, ..." and the arguments for a list of IDs
+func idPlaceholders(ids []int64) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", "), args
+}
+
+// MergeDuplicates merges a group of near-duplicate messages into the copy
+// mergeKeeper picks, returning how many copies were removed. The kept copy
+// gets a contact name from the others if it has none, and their bookmarks
+// and tags. Removed copies are tombstoned, so re-importing the backups they
+// came from doesn't bring them back.
+func MergeDuplicates(userID string, userDB *sql.DB, ids []int64) (int, error) {
+	if len(ids) < 2 {
+		return 0, fmt.Errorf("%w: at least two messages are needed", ErrInvalidDedup)
+	}
+	placeholders, args := idPlaceholders(ids)
+
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	tx, err := userDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Every ID must exist and the messages must be duplicates of each other
+	var found, groups int
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COUNT(DISTINCT dedup_key)
+		FROM messages WHERE dedup_key IS NOT NULL AND id IN (`+placeholders+`)`, args...).Scan(&found, &groups)
+	if err != nil {
+		return 0, err
+	}
+	if found != len(ids) {
+		return 0, fmt.Errorf("%w: not all messages were found", ErrInvalidDedup)
+	}
+	if groups != 1 {
+		return 0, fmt.Errorf("%w: the messages aren't duplicates of each other", ErrInvalidDedup)
+	}
+
+	keep, err := mergeKeeper(tx, ids)
+	if err != nil {
+		return 0, err
+	}
+	var removed []int64
+	for _, id := range ids {
+		if id != keep {
+			removed = append(removed, id)
+		}
+	}
+	removedPlaceholders, removedArgs := idPlaceholders(removed)
+
+	if _, err := tx.Exec(`
+		UPDATE messages SET contact_name = COALESCE((
+			SELECT contact_name FROM messages WHERE id IN (`+removedPlaceholders+`) AND COALESCE(contact_name, '') != '' LIMIT 1
+		), contact_name)
+		WHERE id = ? AND COALESCE(contact_name, '') = ''`,
+		append(append([]interface{}{}, removedArgs...), keep)...,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT OR IGNORE INTO bookmarks (message_id, note, created_at)
+		SELECT ?, note, created_at FROM bookmarks WHERE message_id IN (`+removedPlaceholders+`)
+		ORDER BY created_at`,
+		append([]interface{}{keep}, removedArgs...)...,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT OR IGNORE INTO message_tags (tag_id, message_id)
+		SELECT tag_id, ? FROM message_tags WHERE message_id IN (`+removedPlaceholders+`)`,
+		append([]interface{}{keep}, removedArgs...)...,
+	); err != nil {
+		return 0, err
+	}
+
+	var mediaIDs []int64
+	rows, err := tx.Query("SELECT id FROM messages WHERE id IN ("+removedPlaceholders+") AND media_type != ''", removedArgs...)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		mediaIDs = append(mediaIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT OR IGNORE INTO tombstones (key, dedup_key, record_type, address, date, deleted_at)
+		SELECT `+tombstoneKeyExpr("")+`, dedup_key, record_type, address, date, ?
+		FROM messages WHERE id IN (`+removedPlaceholders+`)`,
+		append([]interface{}{time.Now().Unix()}, removedArgs...)...,
+	); err != nil {
+		return 0, fmt.Errorf("failed to record tombstones: %w", err)
+	}
+	result, err := tx.Exec("DELETE FROM messages WHERE id IN ("+removedPlaceholders+")", removedArgs...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if mediaCache != nil && len(mediaIDs) > 0 {
+		mediaCache.removeMessages(userID, mediaIDs)
+	}
+	return int(deleted), nil
+}
+
+// HandleDuplicates handles GET /api/duplicates
+func HandleDuplicates(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	report, err := FindDuplicates(userDB)
+	if err != nil {
+		slog.Error("Error finding duplicates", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to find duplicates",
+		})
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// HandleMergeDuplicates handles POST /api/duplicates/merge, merging one
+// group ({"message_ids": [...]}) or every group in the report ({"all": true})
+func HandleMergeDuplicates(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	var body struct {
+		MessageIDs []int64 `json:"message_ids"`
+		All        bool    `json:"all"`
+	}
+	if err := c.Bind(&body); err != nil || body.All == (len(body.MessageIDs) > 0) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Expected message_ids or all",
+		})
+	}
+
+	groups := [][]int64{body.MessageIDs}
+	if body.All {
+		report, err := FindDuplicates(userDB)
+		if err != nil {
+			slog.Error("Error finding duplicates", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to find duplicates",
+			})
+		}
+		groups = groups[:0]
+		for _, g := range report.Groups {
+			groups = append(groups, g.MessageIDs)
+		}
+	}
+
+	merged, removed := 0, 0
+	for _, ids := range groups {
+		n, err := MergeDuplicates(userID, userDB, ids)
+		if errors.Is(err, ErrInvalidDedup) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			slog.Error("Error merging duplicates", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to merge duplicates",
+			})
+		}
+		merged++
+		removed += n
+	}
+
+	slog.Info("Merged duplicates", "userID", userID, "groups", merged, "removed", removed)
+	return c.JSON(http.StatusOK, map[string]int{"merged": merged, "removed": removed})
+}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrInvalidDelete is returned for a bulk delete without any criteria or
+// with an unknown record type or category
+var ErrInvalidDelete = errors.New("invalid delete")
+
+// tombstoneKey is the tombstone_key SQL function: a hash of the values
+// idx_message_unique deduplicates on, so a tombstone identifies a message
+// the same way imports do without keeping its body
+func tombstoneKey(values ...interface{}) string {
+	h := sha256.New()
+	for _, v := range values {
+		fmt.Fprintf(h, "%v\x1f", v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tombstoneKeyExpr returns the tombstone_key call for a messages row, its
+// columns prefixed by prefix (e.g. "new."). It hashes the columns of
+// idx_message_unique, but with the date in whole seconds as it was before
+// dates kept milliseconds, so older tombstones still match.
+func tombstoneKeyExpr(prefix string) string {
+	return "tombstone_key(" + prefix + "record_type, " + prefix + "address, " + prefix + "date, " + prefix + "type, " +
+		"COALESCE(" + prefix + "body, ''), COALESCE(" + prefix + "content_type, ''), " +
+		"COALESCE(" + prefix + "message_id, ''), COALESCE(" + prefix + "duration, 0))"
+}
+
+// DeleteFilter selects messages and calls to delete. At least one field
+// must be set.
+type DeleteFilter struct {
+	MessageID  int64
+	Address    string
+	RecordType string // "sms", "mms" or "call"
+	Category   string // SenderCategoryPersonal or SenderCategoryAutomated
+	StartDate  *time.Time
+	EndDate    *time.Time
+}
+
+// conditions returns the SQL WHERE clause selecting the filter's rows
+func (f DeleteFilter) conditions() (string, []interface{}, error) {
+	where := "1=1"
+	var args []interface{}
+	if f.MessageID != 0 {
+		where += " AND id = ?"
+		args = append(args, f.MessageID)
+	}
+	if f.Address != "" {
+		where += " AND address = ?"
+		args = append(args, f.Address)
+	}
+	switch f.RecordType {
+	case "":
+	case "sms":
+		where += " AND record_type = 1"
+	case "mms":
+		where += " AND record_type = 2"
+	case "call":
+		where += " AND record_type = 3"
+	default:
+		return "", nil, fmt.Errorf("%w: type must be sms, mms or call", ErrInvalidDelete)
+	}
+	categoryCond, err := senderCategoryCondition("", f.Category)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidDelete, err)
+	}
+	where += categoryCond
+	dateConds, dateArgs := dateConditions(f.StartDate, f.EndDate)
+	where += dateConds
+	args = append(args, dateArgs...)
+
+	if len(args) == 0 && f.RecordType == "" && f.Category == "" {
+		return "", nil, fmt.Errorf("%w: nothing selected", ErrInvalidDelete)
+	}
+	return where, args, nil
+}
+
+// DeleteMessages deletes the messages and calls matching filter and
+// returns how many were removed. The triggers on messages clean up the
+// search indexes, bookmarks, tags and media metadata; cached conversions
+// and thumbnails are removed here. With tombstone set, each deleted row is
+// recorded so imports skip it from then on.
+func DeleteMessages(userID string, userDB *sql.DB, filter DeleteFilter, tombstone bool) (int, error) {
+	where, args, err := filter.conditions()
+	if err != nil {
+		return 0, err
+	}
+
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	tx, err := userDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var mediaIDs []int64
+	rows, err := tx.Query("SELECT id FROM messages WHERE "+where+" AND media_type != ''", args...)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		mediaIDs = append(mediaIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if tombstone {
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO tombstones (key, dedup_key, record_type, address, date, deleted_at)
+			SELECT `+tombstoneKeyExpr("")+`, dedup_key, record_type, address, date, ?
+			FROM messages WHERE `+where,
+			append([]interface{}{time.Now().Unix()}, args...)...,
+		); err != nil {
+			return 0, fmt.Errorf("failed to record tombstones: %w", err)
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM messages WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if mediaCache != nil && len(mediaIDs) > 0 {
+		mediaCache.removeMessages(userID, mediaIDs)
+	}
+	return int(deleted), nil
+}
+
+// handleDelete runs a delete for one of the delete endpoints. notFound is
+// the error reported when nothing matched, or "" to report zero deletions
+// as success.
+func handleDelete(c echo.Context, filter DeleteFilter, notFound string) error {
+	userID := c.Get("user_id").(string)
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	deleted, err := DeleteMessages(userID, userDB, filter, c.QueryParam("tombstone") == "true")
+	if errors.Is(err, ErrInvalidDelete) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		slog.Error("Error deleting messages", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete messages",
+		})
+	}
+	if deleted == 0 && notFound != "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": notFound,
+		})
+	}
+
+	slog.Info("Deleted messages", "userID", userID, "count", deleted, "address", filter.Address, "type", filter.RecordType)
+	return c.JSON(http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+// HandleDeleteMessage handles DELETE /api/messages/:id
+func HandleDeleteMessage(c echo.Context) error {
+	messageID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || messageID <= 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid message ID",
+		})
+	}
+	return handleDelete(c, DeleteFilter{MessageID: messageID}, "Message not found")
+}
+
+// HandleDeleteConversation handles DELETE /api/conversations?address=,
+// deleting every message and call with the address
+func HandleDeleteConversation(c echo.Context) error {
+	address := c.QueryParam("address")
+	if address == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "address parameter is required",
+		})
+	}
+	return handleDelete(c, DeleteFilter{Address: address}, "Conversation not found")
+}
+
+// HandleDeleteMessages handles DELETE /api/messages, deleting by any
+// combination of start, end (RFC3339), type, category and address
+func HandleDeleteMessages(c echo.Context) error {
+	filter := DeleteFilter{
+		Address:    c.QueryParam("address"),
+		RecordType: c.QueryParam("type"),
+		Category:   c.QueryParam("category"),
+	}
+	for _, p := range []struct {
+		param string
+		dst   **time.Time
+	}{
+		{"start", &filter.StartDate},
+		{"end", &filter.EndDate},
+	} {
+		if s := c.QueryParam(p.param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "Invalid " + p.param + " date",
+				})
+			}
+			*p.dst = &t
+		}
+	}
+	return handleDelete(c, filter, "")
+}
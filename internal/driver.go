@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the driver message databases are opened with: sqlite3
+// plus the SQL functions in sqliteFunctions
+const sqliteDriver = "sqlite3_sbv"
+
+// sqliteFunctions are registered on every connection sqliteDriver opens.
+// impl returns the Go function implementing each, called once per
+// connection so a function can keep per-connection state. All of them are
+// deterministic, so SQLite may use them in indexes and triggers.
+var sqliteFunctions = []struct {
+	name string
+	impl func() interface{}
+}{
+	// tombstone_key, see deletes.go
+	{"tombstone_key", func() interface{} { return tombstoneKey }},
+	// message_dedup_key and message_normalize_body, see dedup.go
+	{"message_dedup_key", func() interface{} { return dedupKey }},
+	{"message_normalize_body", func() interface{} { return normalizeBody }},
+	// REGEXP, which SQLite leaves to the application, see regex.go
+	{"regexp", newRegexpFunc},
+}
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, fn := range sqliteFunctions {
+				if err := conn.RegisterFunc(fn.name, fn.impl(), true); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,635 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/xts"
+)
+
+// Encryption at rest
+//
+// An encrypted user has a random data key that their database (through
+// cryptVFSName) and cached media (see MediaCache) are encrypted under. The
+// data key is only stored sealed: under a key derived from the user's
+// password, so the database can be opened once they log in, and for OIDC
+// users, who have no password, under the server key instead. The user_keys
+// table of the auth database holds the sealed copies.
+//
+// Unsealed data keys are kept in memory until the process exits, so a
+// password user's database is locked again after a restart until they
+// next log in (AuthMiddleware asks them to).
+
+// EncryptNewDatabases makes databases of newly registered users encrypted
+var EncryptNewDatabases bool
+
+// serverKey seals OIDC users' data keys; nil when not configured
+var serverKey []byte
+
+var (
+	// ErrDatabaseLocked is returned for an encrypted database whose key is
+	// sealed with the user's password, until they log in
+	ErrDatabaseLocked = errors.New("database is encrypted and locked until the user logs in")
+	// ErrNoServerKey is returned when a data key would need sealing or
+	// unsealing with the server key but none is configured
+	ErrNoServerKey = errors.New("ENCRYPTION_SERVER_KEY is not set")
+	// ErrDataKeyUnavailable is returned when changing the password of a
+	// user whose data key can only be unsealed with their current password,
+	// without it
+	ErrDataKeyUnavailable = errors.New("the user's data key is sealed with their password, which is needed to change it")
+	// ErrIncorrectPassword is returned when a password doesn't unseal a
+	// user's data key
+	ErrIncorrectPassword = errors.New("incorrect password")
+)
+
+const (
+	dataKeySize = 32
+
+	// Argon2id parameters for deriving the key sealing a data key from a
+	// password (RFC 9106's second recommended option)
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// sqliteHeader starts every unencrypted SQLite database
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// SetServerKey sets the server key from its hex encoding (32 bytes, e.g.
+// from `openssl rand -hex 32`)
+func SetServerKey(hexKey string) error {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("server key must be 64 hex characters")
+	}
+	serverKey = key
+	return nil
+}
+
+// sealAESGCM encrypts and authenticates plaintext under a 32-byte key,
+// returning the nonce followed by the ciphertext
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAESGCM reverses sealAESGCM
+func openAESGCM(key, sealed, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is truncated")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+// derivePasswordKey derives the key sealing a data key from a password
+func derivePasswordKey(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, 32)
+}
+
+// dataKeySlot is a row of user_keys: one data key, sealed under the
+// user's password, the server key, or both. Sealed keys are bound to the
+// user ID, so one can't be copied to another user's row.
+type dataKeySlot struct {
+	id          int64
+	salt        []byte
+	passwordKey []byte
+	escrowKey   []byte
+}
+
+// newDataKeySlot seals dataKey under password, unless it's "", and under
+// the server key if escrow is set
+func newDataKeySlot(userID string, dataKey []byte, password string, escrow bool) (*dataKeySlot, error) {
+	slot := &dataKeySlot{salt: make([]byte, 16)}
+	if _, err := rand.Read(slot.salt); err != nil {
+		return nil, err
+	}
+	var err error
+	if password != "" {
+		slot.passwordKey, err = sealAESGCM(derivePasswordKey(password, slot.salt), dataKey, []byte(userID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if escrow {
+		if serverKey == nil {
+			return nil, ErrNoServerKey
+		}
+		slot.escrowKey, err = sealAESGCM(serverKey, dataKey, []byte(userID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return slot, nil
+}
+
+// insertDataKeySlot stores a slot for the user, returning its ID
+func insertDataKeySlot(userID string, slot *dataKeySlot) (int64, error) {
+	result, err := authDB.Exec(
+		"INSERT INTO user_keys (user_id, salt, password_key, escrow_key, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, slot.salt, slot.passwordKey, slot.escrowKey, time.Now().Unix(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store data key: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// loadDataKeySlots returns a user's data key slots, newest first. A user
+// without any has an unencrypted database.
+func loadDataKeySlots(userID string) ([]dataKeySlot, error) {
+	rows, err := authDB.Query(
+		"SELECT id, salt, password_key, escrow_key FROM user_keys WHERE user_id = ? ORDER BY id DESC", userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load data keys: %w", err)
+	}
+	defer rows.Close()
+
+	var slots []dataKeySlot
+	for rows.Next() {
+		var slot dataKeySlot
+		if err := rows.Scan(&slot.id, &slot.salt, &slot.passwordKey, &slot.escrowKey); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	return slots, rows.Err()
+}
+
+// databaseKey is what an open database and its cached media are encrypted
+// with, derived from the user's data key
+type databaseKey struct {
+	vfsKeyID int64
+	mediaKey []byte
+}
+
+// newDatabaseKey derives a data key's database and media keys and
+// registers the former with cryptVFSName
+func newDatabaseKey(dataKey []byte) (*databaseKey, error) {
+	fileKey, err := hkdf.Key(sha256.New, dataKey, nil, "sbv database", xtsKeySize)
+	if err != nil {
+		return nil, err
+	}
+	mediaKey, err := hkdf.Key(sha256.New, dataKey, nil, "sbv media", 32)
+	if err != nil {
+		return nil, err
+	}
+	id, err := registerVFSKey(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &databaseKey{vfsKeyID: id, mediaKey: mediaKey}, nil
+}
+
+var (
+	// unlockedDataKeys are users' unsealed data keys, newest first, by user
+	// ID. There's normally one; an interrupted EncryptUserDatabase can
+	// leave two, and databaseKeyFor picks whichever the file needs.
+	unlockedDataKeys = make(map[string][][]byte)
+	// databaseKeys are the keys of the users' databases that have been
+	// opened, by user ID
+	databaseKeys  = make(map[string]*databaseKey)
+	dataKeysMutex sync.Mutex
+)
+
+// CreateDataKey makes a new user's database encrypted. The data key is
+// sealed under their password, or for an OIDC user (password "") under
+// the server key. Call before the database is first opened.
+func CreateDataKey(userID, password string) error {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	slot, err := newDataKeySlot(userID, dataKey, password, password == "")
+	if err != nil {
+		return err
+	}
+	if _, err := insertDataKeySlot(userID, slot); err != nil {
+		return err
+	}
+
+	dataKeysMutex.Lock()
+	unlockedDataKeys[userID] = [][]byte{dataKey}
+	dataKeysMutex.Unlock()
+	return nil
+}
+
+// UnlockDataKey unseals a user's data key with their password, so their
+// encrypted database can be opened. It does nothing for users whose
+// database isn't encrypted or whose key isn't sealed under a password.
+func UnlockDataKey(userID, password string) error {
+	slots, err := loadDataKeySlots(userID)
+	if err != nil {
+		return err
+	}
+	var dataKeys [][]byte
+	sealed := false
+	for _, slot := range slots {
+		if slot.passwordKey == nil {
+			continue
+		}
+		sealed = true
+		dataKey, err := openAESGCM(derivePasswordKey(password, slot.salt), slot.passwordKey, []byte(userID))
+		if err == nil {
+			dataKeys = append(dataKeys, dataKey)
+		}
+	}
+	if !sealed {
+		return nil
+	}
+	if len(dataKeys) == 0 {
+		return ErrIncorrectPassword
+	}
+
+	dataKeysMutex.Lock()
+	unlockedDataKeys[userID] = dataKeys
+	dataKeysMutex.Unlock()
+	return nil
+}
+
+// userDataKeys returns a user's unsealed data keys, unsealing escrowed
+// ones if they haven't been already, or nil if their database isn't
+// encrypted. Callers must hold dataKeysMutex.
+func userDataKeys(userID string) ([][]byte, error) {
+	if dataKeys := unlockedDataKeys[userID]; dataKeys != nil {
+		return dataKeys, nil
+	}
+	slots, err := loadDataKeySlots(userID)
+	if err != nil || len(slots) == 0 {
+		return nil, err
+	}
+
+	var dataKeys [][]byte
+	for _, slot := range slots {
+		if slot.escrowKey == nil || serverKey == nil {
+			continue
+		}
+		dataKey, err := openAESGCM(serverKey, slot.escrowKey, []byte(userID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to unseal escrowed data key: %w", err)
+		}
+		dataKeys = append(dataKeys, dataKey)
+	}
+	if len(dataKeys) == 0 {
+		return nil, ErrDatabaseLocked
+	}
+	unlockedDataKeys[userID] = dataKeys
+	return dataKeys, nil
+}
+
+// DatabaseLocked reports whether a user's database is encrypted under a
+// key that hasn't been unlocked since the server started
+func DatabaseLocked(userID string) bool {
+	userDBsMutex.RLock()
+	_, open := userDBs[userID]
+	userDBsMutex.RUnlock()
+	if open {
+		return false
+	}
+
+	dataKeysMutex.Lock()
+	defer dataKeysMutex.Unlock()
+	_, err := userDataKeys(userID)
+	return errors.Is(err, ErrDatabaseLocked)
+}
+
+// isEncryptedDatabase reports whether the file at path is an encrypted
+// database. A missing or empty file isn't.
+func isEncryptedDatabase(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	n, err := io.ReadFull(f, header)
+	if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return false, nil
+	}
+	return !bytes.Equal(header, sqliteHeader), nil
+}
+
+// dataKeyDecrypts reports whether the encrypted database at path is
+// encrypted under dataKey, by decrypting its first block
+func dataKeyDecrypts(path string, dataKey []byte) (bool, error) {
+	fileKey, err := hkdf.Key(sha256.New, dataKey, nil, "sbv database", xtsKeySize)
+	if err != nil {
+		return false, err
+	}
+	c, err := xts.NewCipher(aes.NewCipher, fileKey)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	block := make([]byte, cryptBlockSize)
+	if _, err := io.ReadFull(f, block); err != nil {
+		return false, err
+	}
+	c.Decrypt(block, block, 0)
+	return bytes.HasPrefix(block, sqliteHeader), nil
+}
+
+// databaseKeyFor returns the key of a user's database at path, or nil if
+// it isn't encrypted
+func databaseKeyFor(userID, path string) (*databaseKey, error) {
+	dataKeysMutex.Lock()
+	defer dataKeysMutex.Unlock()
+
+	if key := databaseKeys[userID]; key != nil {
+		return key, nil
+	}
+	dataKeys, err := userDataKeys(userID)
+	if err != nil || dataKeys == nil {
+		return nil, err
+	}
+
+	dataKey := dataKeys[0]
+	encrypted, err := isEncryptedDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		dataKey = nil
+		for _, candidate := range dataKeys {
+			if ok, err := dataKeyDecrypts(path, candidate); err != nil {
+				return nil, err
+			} else if ok {
+				dataKey = candidate
+				break
+			}
+		}
+		if dataKey == nil {
+			return nil, fmt.Errorf("none of the user's data keys decrypts %s", path)
+		}
+	}
+
+	key, err := newDatabaseKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	databaseKeys[userID] = key
+	return key, nil
+}
+
+// userDatabaseDSN returns the DSN to open a user's database at path with:
+// through cryptVFSName if the user has a data key, the path itself if not
+func userDatabaseDSN(userID, path string) (string, error) {
+	key, err := databaseKeyFor(userID, path)
+	if err != nil || key == nil {
+		return path, err
+	}
+	encrypted, err := isEncryptedDatabase(path)
+	if err != nil {
+		return "", err
+	}
+	if !encrypted {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			// Left by an interrupted EncryptUserDatabase
+			slog.Warn("User database has a data key but isn't encrypted; run -encrypt to encrypt it", "user_id", userID, "path", path)
+			return path, nil
+		}
+	}
+	return encryptedDSN(path, key.vfsKeyID), nil
+}
+
+// userMediaKey returns the key a user's cached media is encrypted with, or
+// nil if their database isn't encrypted. Media is only served from an open
+// database, whose key is known by then.
+func userMediaKey(userID string) []byte {
+	dataKeysMutex.Lock()
+	defer dataKeysMutex.Unlock()
+	if key := databaseKeys[userID]; key != nil {
+		return key.mediaKey
+	}
+	return nil
+}
+
+// forgetDataKeys drops a user's unsealed keys, e.g. once they've been
+// replaced. The user's database must not be open.
+func forgetDataKeys(userID string) {
+	dataKeysMutex.Lock()
+	defer dataKeysMutex.Unlock()
+	if key := databaseKeys[userID]; key != nil {
+		unregisterVFSKey(key.vfsKeyID)
+	}
+	delete(databaseKeys, userID)
+	delete(unlockedDataKeys, userID)
+}
+
+// resealDataKeys re-seals a user's data keys under a new password for
+// UpdatePassword. The keys are unsealed with oldPassword, or when that's
+// "" (an admin reset) from escrow. Returns the updated slots, none if the
+// user's database isn't encrypted.
+func resealDataKeys(userID, oldPassword, newPassword string) ([]dataKeySlot, error) {
+	slots, err := loadDataKeySlots(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i, slot := range slots {
+		var dataKey []byte
+		switch {
+		case oldPassword != "" && slot.passwordKey != nil:
+			dataKey, err = openAESGCM(derivePasswordKey(oldPassword, slot.salt), slot.passwordKey, []byte(userID))
+			if err != nil {
+				return nil, ErrIncorrectPassword
+			}
+		case slot.escrowKey != nil && serverKey != nil:
+			dataKey, err = openAESGCM(serverKey, slot.escrowKey, []byte(userID))
+			if err != nil {
+				return nil, fmt.Errorf("failed to unseal escrowed data key: %w", err)
+			}
+		default:
+			return nil, ErrDataKeyUnavailable
+		}
+
+		if _, err := rand.Read(slots[i].salt); err != nil {
+			return nil, err
+		}
+		slots[i].passwordKey, err = sealAESGCM(derivePasswordKey(newPassword, slots[i].salt), dataKey, []byte(userID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
+
+// EncryptUserDatabase encrypts a user's existing database in place under a
+// new data key, or if it's already encrypted, re-encrypts it under a new
+// one (rotating the key). A password user's password must be given; an
+// OIDC user's key is sealed under the server key. The server must not be
+// running, since the file is replaced. Returns whether the database was
+// already encrypted.
+func EncryptUserDatabase(dbPathPrefix string, user *User, password string) (rotated bool, err error) {
+	escrow := IsOIDCUser(user)
+	if escrow {
+		if serverKey == nil {
+			return false, ErrNoServerKey
+		}
+		password = ""
+	} else if !VerifyPassword(user, password) {
+		return false, ErrIncorrectPassword
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return false, err
+	}
+	slot, err := newDataKeySlot(user.ID, dataKey, password, escrow)
+	if err != nil {
+		return false, err
+	}
+
+	path := UserDBPath(dbPathPrefix, user.ID)
+	if info, err := os.Stat(path); os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		// Nothing to encrypt yet; the database will be created encrypted
+		if _, err := insertDataKeySlot(user.ID, slot); err != nil {
+			return false, err
+		}
+		forgetDataKeys(user.ID)
+		return false, nil
+	}
+
+	if password != "" {
+		if err := UnlockDataKey(user.ID, password); err != nil {
+			return false, err
+		}
+	}
+	source, err := userDatabaseDSN(user.ID, path)
+	if err != nil {
+		return false, err
+	}
+	rotated, err = isEncryptedDatabase(path)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := newDatabaseKey(dataKey)
+	if err != nil {
+		return false, err
+	}
+	defer unregisterVFSKey(key.vfsKeyID)
+
+	tmpPath := path + ".encrypting"
+	os.Remove(tmpPath)
+	if err := copyDatabase(source, encryptedDSN(tmpPath, key.vfsKeyID)); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	// Closing the last connection removes these, so another process still
+	// has the database open
+	for _, suffix := range []string{"-wal", "-journal"} {
+		if _, err := os.Stat(path + suffix); err == nil {
+			os.Remove(tmpPath)
+			return false, fmt.Errorf("%s is in use; stop the server first", path)
+		}
+	}
+
+	// The new key is stored before the file is swapped in, so if this is
+	// interrupted there's a key for whichever file is in place
+	slotID, err := insertDataKeySlot(user.ID, slot)
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to replace database: %w", err)
+	}
+	if _, err := authDB.Exec("DELETE FROM user_keys WHERE user_id = ? AND id != ?", user.ID, slotID); err != nil {
+		return rotated, fmt.Errorf("failed to remove old data keys: %w", err)
+	}
+	forgetDataKeys(user.ID)
+
+	// Whatever was cached is in the clear or under the old key
+	if mediaCache != nil {
+		mediaCache.removeUser(user.ID)
+	}
+
+	slog.Info("Encrypted user database", "user_id", user.ID, "path", path, "rotated", rotated)
+	return rotated, nil
+}
+
+// copyDatabase copies the database at DSN source to a new database at DSN
+// dest and checks the copy
+func copyDatabase(source, dest string) error {
+	src, err := sql.Open(sqliteDriver, source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Exec("PRAGMA busy_timeout=5000;"); err != nil {
+		return fmt.Errorf("failed to set busy timeout: %w", err)
+	}
+	if _, err := src.Exec("VACUUM INTO ?", dest); err != nil {
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+	if err := src.Close(); err != nil {
+		return err
+	}
+
+	dst, err := sql.Open(sqliteDriver, dest)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	var result string
+	if err := dst.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("failed to check copy: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("copy failed integrity check: %s", result)
+	}
+	return nil
+}
+
+// sealMedia encrypts cached media under a user's media key
+func sealMedia(key, data []byte) ([]byte, error) {
+	return sealAESGCM(key, data, nil)
+}
+
+// openMedia decrypts media sealed by sealMedia
+func openMedia(key, sealed []byte) ([]byte, error) {
+	return openAESGCM(key, sealed, nil)
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupEncryptionTest creates an auth database and a user in a temporary
+// directory, returning the directory and the user
+func setupEncryptionTest(t *testing.T) (string, *User) {
+	dir := t.TempDir()
+	if err := InitAuthDB(AuthDBPath(dir)); err != nil {
+		t.Fatalf("Failed to initialize auth database: %v", err)
+	}
+	user, err := CreateUser("alice", "password123")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	t.Cleanup(func() {
+		closeTestUserDB(user.ID)
+		forgetDataKeys(user.ID)
+	})
+	return dir, user
+}
+
+// closeTestUserDB closes a user's database so it's reopened from disk
+func closeTestUserDB(userID string) {
+	userDBsMutex.Lock()
+	if userDB := userDBs[userID]; userDB != nil {
+		userDB.Close()
+		delete(userDBs, userID)
+	}
+	userDBsMutex.Unlock()
+}
+
+// countTestMessages opens a user's database and counts their messages
+func countTestMessages(t *testing.T, dir string, userID string) int {
+	t.Helper()
+	if err := InitUserDB(userID, UserDBPath(dir, userID)); err != nil {
+		t.Fatalf("Failed to open user database: %v", err)
+	}
+	var count int
+	if err := userDBs[userID].QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil {
+		t.Fatalf("Failed to count messages: %v", err)
+	}
+	return count
+}
+
+// assertNoPlaintext fails if any of a database's files contain marker or
+// the SQLite header
+func assertNoPlaintext(t *testing.T, path string, marker string) {
+	t.Helper()
+	for _, f := range []string{path, path + "-wal", path + "-journal"} {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(data, []byte(marker)) || bytes.Contains(data, sqliteHeader) {
+			t.Errorf("Expected %s to be encrypted", filepath.Base(f))
+		}
+	}
+}
+
+func TestEncryptedUserDatabase(t *testing.T) {
+	defer func(wal bool) { UseWALMode = wal }(UseWALMode)
+
+	for _, wal := range []bool{true, false} {
+		UseWALMode = wal
+		dir, user := setupEncryptionTest(t)
+		path := UserDBPath(dir, user.ID)
+
+		if err := CreateDataKey(user.ID, "password123"); err != nil {
+			t.Fatalf("Failed to create data key: %v", err)
+		}
+		if err := InitUserDB(user.ID, path); err != nil {
+			t.Fatalf("Failed to create encrypted database: %v", err)
+		}
+		msg := &Message{Address: "+15551234567", Body: "the secret marker", Type: 1, Date: time.Now()}
+		if err := InsertMessage(userDBs[user.ID], msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+		if userMediaKey(user.ID) == nil {
+			t.Error("Expected a media key while the database is unlocked")
+		}
+		// Checked while open too, since the WAL holds the message until a
+		// checkpoint
+		assertNoPlaintext(t, path, "secret marker")
+		closeTestUserDB(user.ID)
+		assertNoPlaintext(t, path, "secret marker")
+
+		statuses, err := GetSchemaStatus(dir)
+		if err != nil || len(statuses) != 2 || !statuses[1].Encrypted {
+			t.Errorf("Expected the user database reported as encrypted, got %+v (%v)", statuses, err)
+		}
+
+		// After a restart the database stays locked until the user logs in
+		forgetDataKeys(user.ID)
+		if !DatabaseLocked(user.ID) {
+			t.Error("Expected the database to be locked")
+		}
+		if err := InitUserDB(user.ID, path); !errors.Is(err, ErrDatabaseLocked) {
+			t.Errorf("Expected ErrDatabaseLocked, got %v", err)
+		}
+		if err := UnlockDataKey(user.ID, "wrong"); !errors.Is(err, ErrIncorrectPassword) {
+			t.Errorf("Expected ErrIncorrectPassword, got %v", err)
+		}
+		if err := UnlockDataKey(user.ID, "password123"); err != nil {
+			t.Fatalf("Failed to unlock data key: %v", err)
+		}
+		if DatabaseLocked(user.ID) {
+			t.Error("Expected the database to be unlocked")
+		}
+		if count := countTestMessages(t, dir, user.ID); count != 1 {
+			t.Errorf("Expected 1 message, got %d", count)
+		}
+		closeTestUserDB(user.ID)
+		forgetDataKeys(user.ID)
+	}
+}
+
+func TestEncryptUserDatabase(t *testing.T) {
+	dir, user := setupEncryptionTest(t)
+	path := UserDBPath(dir, user.ID)
+
+	if err := InitUserDB(user.ID, path); err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	msg := &Message{Address: "+15551234567", Body: "the secret marker", Type: 1, Date: time.Now()}
+	if err := InsertMessage(userDBs[user.ID], msg); err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+	closeTestUserDB(user.ID)
+
+	if _, err := EncryptUserDatabase(dir, user, "wrong"); !errors.Is(err, ErrIncorrectPassword) {
+		t.Errorf("Expected ErrIncorrectPassword, got %v", err)
+	}
+	rotated, err := EncryptUserDatabase(dir, user, "password123")
+	if err != nil || rotated {
+		t.Fatalf("Expected the database encrypted, got rotated=%v (%v)", rotated, err)
+	}
+	assertNoPlaintext(t, path, "secret marker")
+	if !DatabaseLocked(user.ID) {
+		t.Error("Expected the encrypted database to need the password")
+	}
+	if err := UnlockDataKey(user.ID, "password123"); err != nil {
+		t.Fatalf("Failed to unlock data key: %v", err)
+	}
+	if count := countTestMessages(t, dir, user.ID); count != 1 {
+		t.Errorf("Expected 1 message after encrypting, got %d", count)
+	}
+	closeTestUserDB(user.ID)
+
+	// Encrypting again rotates the key, leaving only the new one
+	rotated, err = EncryptUserDatabase(dir, user, "password123")
+	if err != nil || !rotated {
+		t.Fatalf("Expected the key rotated, got rotated=%v (%v)", rotated, err)
+	}
+	if slots, err := loadDataKeySlots(user.ID); err != nil || len(slots) != 1 {
+		t.Errorf("Expected one data key after rotating, got %d (%v)", len(slots), err)
+	}
+	if err := UnlockDataKey(user.ID, "password123"); err != nil {
+		t.Fatalf("Failed to unlock rotated data key: %v", err)
+	}
+	if count := countTestMessages(t, dir, user.ID); count != 1 {
+		t.Errorf("Expected 1 message after rotating, got %d", count)
+	}
+}
+
+func TestUpdatePasswordResealsDataKey(t *testing.T) {
+	dir, user := setupEncryptionTest(t)
+	defer func() { serverKey = nil }()
+
+	if err := CreateDataKey(user.ID, "password123"); err != nil {
+		t.Fatalf("Failed to create data key: %v", err)
+	}
+	if err := InitUserDB(user.ID, UserDBPath(dir, user.ID)); err != nil {
+		t.Fatalf("Failed to create encrypted database: %v", err)
+	}
+	closeTestUserDB(user.ID)
+
+	if err := UpdatePassword(user.ID, "password123", "newpassword"); err != nil {
+		t.Fatalf("Failed to update password: %v", err)
+	}
+	forgetDataKeys(user.ID)
+	if err := UnlockDataKey(user.ID, "password123"); !errors.Is(err, ErrIncorrectPassword) {
+		t.Errorf("Expected the old password to be rejected, got %v", err)
+	}
+	if err := UnlockDataKey(user.ID, "newpassword"); err != nil {
+		t.Errorf("Expected the new password to unlock the key, got %v", err)
+	}
+
+	// Without an escrowed key an admin reset would lose the data
+	if err := UpdatePassword(user.ID, "", "reset"); !errors.Is(err, ErrDataKeyUnavailable) {
+		t.Errorf("Expected ErrDataKeyUnavailable, got %v", err)
+	}
+
+	// OIDC users' keys are escrowed, so they unlock without a password
+	if err := SetServerKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"); err != nil {
+		t.Fatalf("Failed to set server key: %v", err)
+	}
+	oidcUser, err := CreateUser("bob", "password123")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer forgetDataKeys(oidcUser.ID)
+	if err := CreateDataKey(oidcUser.ID, ""); err != nil {
+		t.Fatalf("Failed to create escrowed data key: %v", err)
+	}
+	forgetDataKeys(oidcUser.ID)
+	if DatabaseLocked(oidcUser.ID) {
+		t.Error("Expected an escrowed key to unlock without a password")
+	}
+}
+
+func TestMediaCacheEncryptedEntries(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { mediaCache = nil }()
+	if err := InitMediaCache(dir, 1<<20); err != nil {
+		t.Fatalf("Failed to initialize media cache: %v", err)
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	path := mediaCache.path("user", "1", "jpg")
+	produce := func() ([]byte, bool, error) { return []byte("converted media"), true, nil }
+
+	r, err := mediaCache.fetch(path, key, produce)
+	if err != nil {
+		t.Fatalf("Failed to fetch media: %v", err)
+	}
+	r.Close()
+	if stored, err := os.ReadFile(path); err != nil || bytes.Contains(stored, []byte("converted media")) {
+		t.Errorf("Expected the cached entry to be encrypted (%v)", err)
+	}
+
+	r = mediaCache.read(path, key)
+	if r == nil {
+		t.Fatal("Expected the encrypted entry to be cached")
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "converted media" {
+		t.Errorf("Expected the entry to decrypt, got %q", data)
+	}
+
+	// An entry that doesn't decrypt under the key is dropped
+	if r := mediaCache.read(path, make([]byte, 32)); r != nil {
+		r.Close()
+		t.Error("Expected an entry under another key to be a miss")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected the undecryptable entry to be removed")
+	}
+}
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Minimal EXIF support for JPEG attachments: just enough to find tags in
+// IFD0 and the Exif sub-IFD, and to add a capture date to photos that lack
+// one, without pulling in a full EXIF library.
+
+const (
+	exifTagOrientation      = 0x0112
+	exifTagDateTime         = 0x0132
+	exifTagExifIFDPointer   = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+)
+
+// TIFF field types used here
+const (
+	exifTypeASCII = 2
+	exifTypeShort = 3
+	exifTypeLong  = 4
+)
+
+// exifDateLayout is the EXIF date format; the value is 19 characters plus a
+// NUL terminator
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// jpegExifSegment locates a JPEG's EXIF (APP1) segment, returning the offsets
+// of the segment's marker and end within data and the TIFF block it holds.
+// tiff is nil if the JPEG has no EXIF segment.
+func jpegExifSegment(data []byte) (segStart, segEnd int, tiff []byte) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, 0, nil
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 0, 0, nil
+		}
+		marker := data[pos+1]
+		// Start of scan: image data follows, no more metadata segments
+		if marker == 0xDA || marker == 0xD9 {
+			return 0, 0, nil
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		if segLen < 2 || pos+2+segLen > len(data) {
+			return 0, 0, nil
+		}
+		seg := data[pos+4 : pos+2+segLen]
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return pos, pos + 2 + segLen, seg[6:]
+		}
+		pos += 2 + segLen
+	}
+	return 0, 0, nil
+}
+
+// jpegExifTIFF returns the TIFF block of a JPEG's EXIF (APP1) segment, or
+// nil if it has none
+func jpegExifTIFF(data []byte) []byte {
+	_, _, tiff := jpegExifSegment(data)
+	return tiff
+}
+
+// exifByteOrder returns the byte order declared in a TIFF header, or nil if
+// the header is invalid
+func exifByteOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// exifIFDEntry returns the offset of a tag's 12-byte entry in the IFD at
+// ifd, or -1 if the IFD doesn't contain it
+func exifIFDEntry(tiff []byte, order binary.ByteOrder, ifd int, tag uint16) int {
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return -1
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return -1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == tag {
+			return entry
+		}
+	}
+	return -1
+}
+
+// exifIFD0Short looks up a SHORT-valued tag in IFD0 of an EXIF TIFF block
+func exifIFD0Short(tiff []byte, tag uint16) (uint16, bool) {
+	order := exifByteOrder(tiff)
+	if order == nil {
+		return 0, false
+	}
+	entry := exifIFDEntry(tiff, order, int(order.Uint32(tiff[4:8])), tag)
+	// A single SHORT is stored inline in the value field
+	if entry < 0 || order.Uint16(tiff[entry+2:entry+4]) != exifTypeShort {
+		return 0, false
+	}
+	return order.Uint16(tiff[entry+8 : entry+10]), true
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when
+// it has none. Phone cameras commonly store photos in sensor orientation and
+// rely on this tag for display.
+func jpegOrientation(data []byte) int {
+	tiff := jpegExifTIFF(data)
+	if tiff == nil {
+		return 1
+	}
+	o, ok := exifIFD0Short(tiff, exifTagOrientation)
+	if !ok || o < 1 || o > 8 {
+		return 1
+	}
+	return int(o)
+}
+
+// exifHasDate reports whether an EXIF TIFF block records when the photo was
+// taken, either as DateTimeOriginal in the Exif sub-IFD or DateTime in IFD0
+func exifHasDate(tiff []byte) bool {
+	order := exifByteOrder(tiff)
+	if order == nil {
+		return false
+	}
+	ifd0 := int(order.Uint32(tiff[4:8]))
+	if exifIFDEntry(tiff, order, ifd0, exifTagDateTime) >= 0 {
+		return true
+	}
+	ptr := exifIFDEntry(tiff, order, ifd0, exifTagExifIFDPointer)
+	if ptr < 0 {
+		return false
+	}
+	exifIFD := int(order.Uint32(tiff[ptr+8 : ptr+12]))
+	return exifIFDEntry(tiff, order, exifIFD, exifTagDateTimeOriginal) >= 0
+}
+
+// jpegWithExifDate returns a JPEG with t recorded as its capture date when it
+// doesn't already have one, so photo libraries sort attachments by when they
+// were sent rather than when they were extracted. The input is returned
+// unchanged if it isn't a JPEG, already has a date, or its EXIF block can't
+// be safely extended.
+func jpegWithExifDate(data []byte, t time.Time) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data
+	}
+	date := append([]byte(t.Format(exifDateLayout)), 0)
+
+	segStart, segEnd, tiff := jpegExifSegment(data)
+	if tiff == nil {
+		return insertExifSegment(data, newExifDateTIFF(date))
+	}
+	if exifHasDate(tiff) {
+		return data
+	}
+	newTIFF := exifTIFFWithDateTime(tiff, date)
+	if newTIFF == nil {
+		return data
+	}
+
+	seg := exifAPP1Segment(newTIFF)
+	if seg == nil {
+		return data
+	}
+	out := make([]byte, 0, len(data)-(segEnd-segStart)+len(seg))
+	out = append(out, data[:segStart]...)
+	out = append(out, seg...)
+	return append(out, data[segEnd:]...)
+}
+
+// newExifDateTIFF builds a big-endian TIFF block holding only DateTime in
+// IFD0 and DateTimeOriginal in an Exif sub-IFD, both pointing at the same
+// date string
+func newExifDateTIFF(date []byte) []byte {
+	const (
+		ifd0Off    = 8
+		exifIFDOff = ifd0Off + 2 + 2*12 + 4
+		dateOff    = exifIFDOff + 2 + 12 + 4
+	)
+	order := binary.BigEndian
+	tiff := make([]byte, dateOff, dateOff+len(date))
+	copy(tiff, "MM\x00\x2a")
+	order.PutUint32(tiff[4:], ifd0Off)
+
+	order.PutUint16(tiff[ifd0Off:], 2)
+	putExifEntry(tiff[ifd0Off+2:], order, exifTagDateTime, exifTypeASCII, uint32(len(date)), dateOff)
+	putExifEntry(tiff[ifd0Off+14:], order, exifTagExifIFDPointer, exifTypeLong, 1, exifIFDOff)
+
+	order.PutUint16(tiff[exifIFDOff:], 1)
+	putExifEntry(tiff[exifIFDOff+2:], order, exifTagDateTimeOriginal, exifTypeASCII, uint32(len(date)), dateOff)
+
+	return append(tiff, date...)
+}
+
+// exifTIFFWithDateTime returns a copy of an existing TIFF block with a
+// DateTime entry added to IFD0. IFD0 can't grow in place, so a rebuilt copy
+// is appended to the end of the block and the header repointed at it; every
+// other offset in the block stays valid since nothing before it moves.
+func exifTIFFWithDateTime(tiff []byte, date []byte) []byte {
+	order := exifByteOrder(tiff)
+	if order == nil {
+		return nil
+	}
+	ifd0 := int(order.Uint32(tiff[4:8]))
+	if ifd0 < 8 || ifd0+2 > len(tiff) {
+		return nil
+	}
+	count := int(order.Uint16(tiff[ifd0 : ifd0+2]))
+	entriesEnd := ifd0 + 2 + count*12
+	if entriesEnd+4 > len(tiff) {
+		return nil
+	}
+
+	out := append([]byte(nil), tiff...)
+	// IFDs must start on a word boundary
+	if len(out)%2 == 1 {
+		out = append(out, 0)
+	}
+	newIFD := len(out)
+	dateOff := newIFD + 2 + (count+1)*12 + 4
+
+	var n [2]byte
+	order.PutUint16(n[:], uint16(count+1))
+	out = append(out, n[:]...)
+	added := false
+	for i := 0; i < count; i++ {
+		entry := tiff[ifd0+2+i*12 : ifd0+2+(i+1)*12]
+		// Entries are sorted by tag
+		if !added && order.Uint16(entry) > exifTagDateTime {
+			out = appendExifEntry(out, order, exifTagDateTime, exifTypeASCII, uint32(len(date)), uint32(dateOff))
+			added = true
+		}
+		out = append(out, entry...)
+	}
+	if !added {
+		out = appendExifEntry(out, order, exifTagDateTime, exifTypeASCII, uint32(len(date)), uint32(dateOff))
+	}
+	// Link to IFD1 (the embedded thumbnail), if any
+	out = append(out, tiff[entriesEnd:entriesEnd+4]...)
+	out = append(out, date...)
+
+	order.PutUint32(out[4:8], uint32(newIFD))
+	return out
+}
+
+func putExifEntry(b []byte, order binary.ByteOrder, tag, typ uint16, count, value uint32) {
+	order.PutUint16(b[0:], tag)
+	order.PutUint16(b[2:], typ)
+	order.PutUint32(b[4:], count)
+	order.PutUint32(b[8:], value)
+}
+
+func appendExifEntry(b []byte, order binary.ByteOrder, tag, typ uint16, count, value uint32) []byte {
+	var entry [12]byte
+	putExifEntry(entry[:], order, tag, typ, count, value)
+	return append(b, entry[:]...)
+}
+
+// exifAPP1Segment wraps a TIFF block in a JPEG APP1 segment, or returns nil
+// if it's too large for one
+func exifAPP1Segment(tiff []byte) []byte {
+	segLen := 2 + 6 + len(tiff)
+	if segLen > 0xFFFF {
+		return nil
+	}
+	seg := []byte{0xFF, 0xE1, byte(segLen >> 8), byte(segLen)}
+	seg = append(seg, "Exif\x00\x00"...)
+	return append(seg, tiff...)
+}
+
+// insertExifSegment adds an EXIF segment to a JPEG that has none, after the
+// JFIF (APP0) segment if there is one since some readers expect that first
+func insertExifSegment(data []byte, tiff []byte) []byte {
+	seg := exifAPP1Segment(tiff)
+	if seg == nil {
+		return data
+	}
+	pos := 2
+	if len(data) >= 6 && data[2] == 0xFF && data[3] == 0xE0 {
+		if end := pos + 2 + int(binary.BigEndian.Uint16(data[4:6])); end <= len(data) {
+			pos = end
+		}
+	}
+	out := make([]byte, 0, len(data)+len(seg))
+	out = append(out, data[:pos]...)
+	out = append(out, seg...)
+	return append(out, data[pos:]...)
+}
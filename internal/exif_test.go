@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+func TestJPEGWithExifDate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+
+	// A little-endian EXIF block with only an orientation tag, as some
+	// phones write for photos without a capture date
+	tiff := []byte("II\x2a\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = appendExifEntry(tiff, binary.LittleEndian, exifTagOrientation, exifTypeShort, 1, 6)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0)
+	withOrientation := insertExifSegment(buf.Bytes(), tiff)
+	if jpegOrientation(withOrientation) != 6 {
+		t.Fatalf("Expected test JPEG to have orientation 6")
+	}
+
+	date := time.Date(2019, 6, 2, 18, 30, 12, 0, time.Local)
+	for name, data := range map[string][]byte{
+		"no exif":           buf.Bytes(),
+		"exif without date": withOrientation,
+	} {
+		dated := jpegWithExifDate(data, date)
+		tiff := jpegExifTIFF(dated)
+		if tiff == nil || !exifHasDate(tiff) {
+			t.Errorf("%s: expected an EXIF date to be added", name)
+			continue
+		}
+		if !bytes.Contains(tiff, []byte("2019:06:02 18:30:12\x00")) {
+			t.Errorf("%s: expected date 2019:06:02 18:30:12", name)
+		}
+		if _, err := jpeg.DecodeConfig(bytes.NewReader(dated)); err != nil {
+			t.Errorf("%s: dated JPEG no longer decodes: %v", name, err)
+		}
+		// Adding a date again is a no-op
+		if again := jpegWithExifDate(dated, date.Add(time.Hour)); !bytes.Equal(again, dated) {
+			t.Errorf("%s: expected existing date to be kept", name)
+		}
+	}
+
+	if jpegOrientation(jpegWithExifDate(withOrientation, date)) != 6 {
+		t.Errorf("Expected orientation to survive adding a date")
+	}
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// fuzzyCandidateLimit caps how many trigram matches a fuzzy search scores.
+// Candidates come back best-first from FTS, so this trims the long tail of
+// messages that only share a trigram or two with the query.
+const fuzzyCandidateLimit = 2000
+
+// foldText lowercases s and strips diacritics ("Café" -> "cafe"), matching
+// what the trigram index does with remove_diacritics
+func foldText(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return strings.ToLower(folded)
+}
+
+// fuzzyWord is a word of a message body, folded for comparison, with its
+// byte range in the original text
+type fuzzyWord struct {
+	text       []rune
+	start, end int
+}
+
+// splitFuzzyWords splits text into runs of letters and digits
+func splitFuzzyWords(text string) []fuzzyWord {
+	var words []fuzzyWord
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			words = append(words, fuzzyWord{[]rune(foldText(text[start:i])), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, fuzzyWord{[]rune(foldText(text[start:])), start, len(text)})
+	}
+	return words
+}
+
+// fuzzyMaxEdits is how many typos a term of a given length may contain
+func fuzzyMaxEdits(n int) int {
+	switch {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	}
+	return 2
+}
+
+// editDistance is the Levenshtein distance between two rune slices
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// fuzzyTermDistance returns how far a term is from a word: 0 if the word
+// contains it (covering prefixes like "birthd" and unsegmented CJK text),
+// otherwise the edit distance to the whole word or to its prefix of the
+// term's length, whichever is closer
+func fuzzyTermDistance(term, word []rune) int {
+	if strings.Contains(string(word), string(term)) {
+		return 0
+	}
+	d := editDistance(term, word)
+	if len(word) > len(term) {
+		d = min(d, editDistance(term, word[:len(term)]))
+	}
+	return d
+}
+
+// fuzzyScore scores a message body against the query terms. ok is false if
+// any term has no close enough word. Each term contributes up to 1, less for
+// each edit needed, with a small bonus for matching a whole word exactly.
+func fuzzyScore(body string, terms [][]rune) (score float64, spans [][2]int, ok bool) {
+	words := splitFuzzyWords(body)
+	for _, term := range terms {
+		best, bestWord := len(term)+1, -1
+		for i, w := range words {
+			if d := fuzzyTermDistance(term, w.text); d < best {
+				best, bestWord = d, i
+				if d == 0 {
+					break
+				}
+			}
+		}
+		if bestWord < 0 || best > fuzzyMaxEdits(len(term)) {
+			return 0, nil, false
+		}
+		w := words[bestWord]
+		score += 1 - float64(best)/float64(len(term)+1)
+		if best == 0 && len(w.text) == len(term) {
+			score += 0.1
+		}
+		spans = append(spans, [2]int{w.start, w.end})
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	merged := spans[:0]
+	for _, sp := range spans {
+		if n := len(merged); n > 0 && sp[0] < merged[n-1][1] {
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return score, merged, true
+}
+
+// trigrams returns the distinct three-character substrings of s
+func trigrams(s []rune) []string {
+	seen := map[string]bool{}
+	var out []string
+	for i := 0; i+3 <= len(s); i++ {
+		t := string(s[i : i+3])
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// searchFuzzy implements SearchModeFuzzy. Candidates are messages sharing
+// any trigram with a query term, fetched through the trigram index; each is
+// then scored in Go by edit distance, so "birthdya" still finds "birthday".
+// Results are always ordered by score, and Total counts matches among the
+// first fuzzyCandidateLimit candidates.
+func searchFuzzy(userDB *sql.DB, opts SearchOptions, terms []searchTerm, conds string, args []interface{}, limit int) (*SearchPage, error) {
+	var queryTerms [][]rune
+	var candidates []string
+	var exclude []string
+	for _, t := range terms {
+		if t.or {
+			continue
+		}
+		if t.negate {
+			exclude = append(exclude, ftsQuote(t.text))
+			continue
+		}
+		// Phrases are scored word by word
+		for _, w := range splitFuzzyWords(t.text) {
+			queryTerms = append(queryTerms, w.text)
+			for _, tri := range trigrams(w.text) {
+				candidates = append(candidates, ftsQuote(tri))
+			}
+		}
+	}
+
+	page := &SearchPage{Results: []SearchResult{}}
+	// Terms shorter than a trigram can't produce candidates on their own
+	if len(candidates) == 0 {
+		return page, nil
+	}
+
+	if len(exclude) > 0 {
+		conds += " AND m.id NOT IN (SELECT rowid FROM messages_trigram WHERE messages_trigram MATCH ?)"
+		args = append(args, strings.Join(exclude, " OR "))
+	}
+
+	query := `
+		SELECT m.id, m.address, COALESCE(m.contact_name, ''), COALESCE(m.body, ''), m.date_ms, ` + bookmarkedColumn + `
+		FROM messages_trigram
+		JOIN messages m ON messages_trigram.rowid = m.id
+		WHERE messages_trigram MATCH ?` + conds + `
+		ORDER BY rank
+		LIMIT ?`
+	args = append([]interface{}{strings.Join(candidates, " OR ")}, args...)
+	args = append(args, fuzzyCandidateLimit)
+
+	rows, err := userDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type scored struct {
+		result SearchResult
+		score  float64
+	}
+	var matches []scored
+	for rows.Next() {
+		var r SearchResult
+		var dateMs int64
+		if err := rows.Scan(&r.MessageID, &r.Address, &r.ContactName, &r.Body, &dateMs, &r.Bookmarked); err != nil {
+			return nil, err
+		}
+		score, spans, ok := fuzzyScore(r.Body, queryTerms)
+		if !ok {
+			continue
+		}
+		r.Date = time.UnixMilli(dateMs)
+		r.Snippet = highlightSpans(r.Body, spans)
+		matches = append(matches, scored{r, score})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].result.Date.After(matches[j].result.Date)
+	})
+
+	offset := 0
+	if opts.Cursor != "" {
+		parts, err := decodeSearchCursor(opts.Cursor, 1)
+		if err != nil {
+			return nil, err
+		}
+		offset = int(parts[0])
+	}
+
+	page.Total = len(matches)
+	for i := offset; i < len(matches) && i < offset+limit; i++ {
+		page.Results = append(page.Results, matches[i].result)
+	}
+	if offset+limit < len(matches) {
+		page.NextCursor = encodeSearchCursor(int64(offset + limit))
+	}
+	return page, nil
+}
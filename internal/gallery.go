@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gallery page size bounds
+const (
+	DefaultGalleryLimit = 100
+	MaxGalleryLimit     = 500
+)
+
+// GalleryFilter narrows the media returned by GetGallery. Zero values mean
+// "no filter".
+type GalleryFilter struct {
+	Kinds     []string // "image", "video", "audio", "vcard"
+	StartDate *time.Time
+	EndDate   *time.Time
+	Address   string
+	Direction string // "sent" or "received"
+	Tag       string // tag name, on the message or its conversation
+	Cursor    string // NextCursor from the previous page
+	Limit     int
+}
+
+// ErrInvalidCursor is returned by GetGallery for a cursor it didn't issue
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// galleryKindConditions maps a media kind to a SQL condition on media_type.
+// The prefix ranges (rather than LIKE) let SQLite use idx_media_date_ms.
+var galleryKindConditions = map[string]string{
+	"image": "(m.media_type >= 'image/' AND m.media_type < 'image0')",
+	"video": "(m.media_type >= 'video/' AND m.media_type < 'video0')",
+	"audio": "(m.media_type >= 'audio/' AND m.media_type < 'audio0')",
+	"vcard": "m.media_type IN ('text/vcard', 'text/x-vcard', 'text/directory')",
+}
+
+// mediaKind classifies a media type into one of the gallery kinds, or
+// "other"
+func mediaKind(mediaType string) string {
+	ct := strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case strings.HasPrefix(ct, "image/"):
+		return "image"
+	case strings.HasPrefix(ct, "video/"):
+		return "video"
+	case strings.HasPrefix(ct, "audio/"):
+		return "audio"
+	case ct == "text/vcard" || ct == "text/x-vcard" || ct == "text/directory":
+		return "vcard"
+	}
+	return "other"
+}
+
+// encodeGalleryCursor and decodeGalleryCursor turn the (date in
+// milliseconds, id) position of the last item on a page into an opaque
+// token and back
+func encodeGalleryCursor(date, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", date, id)))
+}
+
+func decodeGalleryCursor(cursor string) (date, id int64, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, ErrInvalidCursor
+	}
+	dateStr, idStr, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, 0, ErrInvalidCursor
+	}
+	if date, err = strconv.ParseInt(dateStr, 10, 64); err != nil {
+		return 0, 0, ErrInvalidCursor
+	}
+	if id, err = strconv.ParseInt(idStr, 10, 64); err != nil {
+		return 0, 0, ErrInvalidCursor
+	}
+	return date, id, nil
+}
+
+// galleryConditions builds the WHERE clause additions for a filter's kind,
+// date, address and direction fields, shared by the gallery and the media
+// archive. The messages table must be aliased as m.
+func galleryConditions(filter GalleryFilter) (string, []interface{}, error) {
+	var query string
+	args := []interface{}{}
+
+	if len(filter.Kinds) > 0 {
+		var conds []string
+		for _, kind := range filter.Kinds {
+			cond, ok := galleryKindConditions[kind]
+			if !ok {
+				return "", nil, fmt.Errorf("unknown media kind %q", kind)
+			}
+			conds = append(conds, cond)
+		}
+		query += " AND (" + strings.Join(conds, " OR ") + ")"
+	}
+
+	if filter.StartDate != nil {
+		query += " AND m.date >= ?"
+		args = append(args, filter.StartDate.Unix())
+	}
+	if filter.EndDate != nil {
+		query += " AND m.date <= ?"
+		args = append(args, filter.EndDate.Unix())
+	}
+	if filter.Address != "" {
+		query += " AND m.address = ?"
+		args = append(args, filter.Address)
+	}
+
+	switch filter.Direction {
+	case "":
+	case "sent":
+		query += " AND m.type = 2"
+	case "received":
+		query += " AND m.type = 1"
+	default:
+		return "", nil, fmt.Errorf("unknown direction %q", filter.Direction)
+	}
+
+	if filter.Tag != "" {
+		cond, tagArgs := tagMessageCondition("m.", filter.Tag)
+		query += cond
+		args = append(args, tagArgs...)
+	}
+
+	return query, args, nil
+}
+
+// GetGallery returns a page of media attachments across all conversations,
+// newest first, with their metadata but not their data. Pagination is keyed
+// on (date_ms, id) so pages stay stable while new messages are imported.
+func GetGallery(userDB *sql.DB, filter GalleryFilter) (*GalleryPage, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultGalleryLimit
+	}
+	if limit > MaxGalleryLimit {
+		limit = MaxGalleryLimit
+	}
+
+	conds, args, err := galleryConditions(filter)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT m.id, m.address, COALESCE(m.contact_name, ''), m.date_ms, m.type, m.media_type,
+			COALESCE(mn.name, ''), length(m.media_data), mm.width, mm.height, mm.duration_ms
+		FROM messages m
+		LEFT JOIN media_meta mm ON mm.message_id = m.id
+		LEFT JOIN media_names mn ON mn.message_id = m.id
+		WHERE m.record_type IN (1, 2) AND m.media_type != ''
+	` + conds
+
+	if filter.Cursor != "" {
+		date, id, err := decodeGalleryCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query += " AND (m.date_ms < ? OR (m.date_ms = ? AND m.id < ?))"
+		args = append(args, date, date, id)
+	}
+
+	// Fetch one extra row to know whether there's another page
+	query += " ORDER BY m.date_ms DESC, m.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := userDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &GalleryPage{Items: []GalleryItem{}}
+	for rows.Next() {
+		var item GalleryItem
+		var dateMs int64
+		var size, width, height, duration sql.NullInt64
+		if err := rows.Scan(&item.ID, &item.Address, &item.ContactName, &dateMs, &item.Type, &item.MediaType,
+			&item.Name, &size, &width, &height, &duration); err != nil {
+			return nil, err
+		}
+		item.Date = time.UnixMilli(dateMs)
+		item.Kind = mediaKind(item.MediaType)
+		item.Size = size.Int64
+		item.Width = int(width.Int64)
+		item.Height = int(height.Int64)
+		item.DurationMs = duration.Int64
+		page.Items = append(page.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = encodeGalleryCursor(last.Date.UnixMilli(), last.ID)
+	}
+	return page, nil
+}
+
+// imageDimensions reads an image's display size from its header, accounting
+// for EXIF rotation. HEIC goes through libheif when it's available.
+func imageDimensions(data []byte) (width, height int, ok bool) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		w, h, err := heicDimensions(data)
+		if err != nil {
+			return 0, 0, false
+		}
+		return w, h, true
+	}
+	// Orientations 5-8 rotate by 90 degrees
+	if jpegOrientation(data) >= 5 {
+		return cfg.Height, cfg.Width, true
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// probeMediaMetadata runs ffprobe over a video or audio attachment and
+// returns its dimensions (zero for audio) and duration
+func probeMediaMetadata(data []byte) (width, height int, durationMs int64, err error) {
+	_, input, cleanup, err := converterInput("input", data)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer cleanup()
+
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "stream=codec_type,width,height:format=duration",
+		"-of", "json",
+		input,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, 0, 0, fmt.Errorf("ffprobe failed: %w, stderr: %s", err, stderr.String())
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+
+	for _, s := range probe.Streams {
+		if s.CodecType == "video" && s.Width > 0 {
+			width, height = s.Width, s.Height
+			break
+		}
+	}
+	if secs, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		durationMs = int64(secs * 1000)
+	}
+	return width, height, durationMs, nil
+}
+
+// IndexMediaMetadata fills in media_meta for attachments that don't have a
+// row yet: dimensions for images, and dimensions and duration for video and
+// audio (when ffprobe is installed). Images are normally indexed on insert;
+// this catches databases imported before the gallery existed and the media
+// types that need ffprobe.
+func IndexMediaMetadata(userID string, userDB *sql.DB) {
+	rows, err := userDB.Query(`
+		SELECT m.id, m.media_type
+		FROM messages m
+		LEFT JOIN media_meta mm ON mm.message_id = m.id
+		WHERE m.record_type IN (1, 2)
+		AND m.media_type != ''
+		AND mm.message_id IS NULL
+	`)
+	if err != nil {
+		slog.Error("Media index: failed to list media", "userID", userID, "error", err)
+		return
+	}
+
+	type pending struct {
+		id        int64
+		mediaType string
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.mediaType); err != nil {
+			rows.Close()
+			slog.Error("Media index: failed to scan media", "userID", userID, "error", err)
+			return
+		}
+		switch mediaKind(p.mediaType) {
+		case "image", "video", "audio":
+			todo = append(todo, p)
+		}
+	}
+	rows.Close()
+
+	if len(todo) == 0 {
+		return
+	}
+
+	_, ffprobeErr := exec.LookPath("ffprobe")
+
+	slog.Info("Media index: starting", "userID", userID, "count", len(todo))
+	start := time.Now()
+	indexed := 0
+	for _, p := range todo {
+		kind := mediaKind(p.mediaType)
+		if kind != "image" && ffprobeErr != nil {
+			continue
+		}
+
+		data, _, err := getRawMessageMedia(userDB, strconv.FormatInt(p.id, 10))
+		if err != nil {
+			slog.Warn("Media index: failed to load media", "userID", userID, "messageID", p.id, "error", err)
+			continue
+		}
+
+		var width, height int
+		var durationMs int64
+		if kind == "image" {
+			var ok bool
+			if width, height, ok = imageDimensions(data); !ok {
+				continue
+			}
+		} else if width, height, durationMs, err = probeMediaMetadata(data); err != nil {
+			slog.Warn("Media index: failed to probe media", "userID", userID, "messageID", p.id, "error", err)
+			continue
+		}
+
+		unlock := LockForWrite(userDB)
+		_, err = userDB.Exec(
+			"INSERT OR REPLACE INTO media_meta (message_id, width, height, duration_ms) VALUES (?, ?, ?, ?)",
+			p.id, width, height, durationMs,
+		)
+		unlock()
+		if err != nil {
+			slog.Warn("Media index: failed to store metadata", "userID", userID, "messageID", p.id, "error", err)
+			continue
+		}
+		indexed++
+	}
+	slog.Info("Media index: completed", "userID", userID, "indexed", indexed, "duration", time.Since(start))
+}
+
+// galleryIndexed records which users have had IndexMediaMetadata run during
+// this process, so the gallery only triggers it once per user
+var galleryIndexed sync.Map
+
+// ensureMediaIndexed starts a background IndexMediaMetadata pass the first
+// time a user's gallery is requested
+func ensureMediaIndexed(userID string, userDB *sql.DB) {
+	if _, loaded := galleryIndexed.LoadOrStore(userID, true); loaded {
+		return
+	}
+	go IndexMediaMetadata(userID, userDB)
+}
@@ -3,7 +3,9 @@ package internal
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
@@ -94,7 +96,7 @@ func HandleUpload(c echo.Context) error {
 }
 
 func HandleConversations(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -118,7 +120,12 @@ func HandleConversations(c echo.Context) error {
 		}
 	}
 
-	conversations, err := GetConversations(userDB, startDate, endDate)
+	conversations, err := store.GetConversations(startDate, endDate, c.QueryParam("tag"), c.QueryParam("show"), c.QueryParam("category"))
+	if errors.Is(err, ErrInvalidConversationState) || errors.Is(err, ErrInvalidCategory) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		slog.Error("Error getting conversations", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -130,7 +137,7 @@ func HandleConversations(c echo.Context) error {
 }
 
 func HandleMessages(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -162,18 +169,6 @@ func HandleMessages(c echo.Context) error {
 		}
 	}
 
-	// If type is "call", return call logs instead of messages
-	if convType == "call" {
-		calls, err := GetCallLogs(userDB, address, startDate, endDate)
-		if err != nil {
-			slog.Error("Error getting call logs", "error", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{
-				"error": "Failed to get call logs",
-			})
-		}
-		return c.JSON(http.StatusOK, calls)
-	}
-
 	// If type is "conversation", return combined messages and calls
 	if convType == "conversation" {
 		// Get user ID from context to fetch settings
@@ -210,13 +205,13 @@ func HandleMessages(c echo.Context) error {
 			}
 		}
 
-		total, err := CountActivityByAddress(userDB, address, startDate, endDate)
+		total, err := store.CountActivityByAddress(address, startDate, endDate)
 		if err != nil {
 			slog.Error("Error counting activity", "error", err)
 			total = 0
 		}
 
-		activities, err := GetActivityByAddress(userDB, address, startDate, endDate, limit, offset)
+		activities, err := store.GetActivityByAddress(address, startDate, endDate, limit, offset)
 		if err != nil {
 			slog.Error("Error getting activity", "error", err)
 			return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -241,7 +236,19 @@ func HandleMessages(c echo.Context) error {
 		})
 	}
 
-	messages, err := GetMessages(userDB, address, startDate, endDate)
+	// If type is "call", return call logs instead of messages
+	if convType == "call" {
+		calls, err := store.GetCallLogs(address, startDate, endDate)
+		if err != nil {
+			slog.Error("Error getting call logs", "error", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error": "Failed to get call logs",
+			})
+		}
+		return c.JSON(http.StatusOK, calls)
+	}
+
+	messages, err := store.GetMessages(address, startDate, endDate)
 	if err != nil {
 		slog.Error("Error getting messages", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -252,9 +259,86 @@ func HandleMessages(c echo.Context) error {
 	return c.JSON(http.StatusOK, messages)
 }
 
+// HandleMessageContext returns the messages around a given message in its
+// conversation, so a search hit can be shown in context without loading the
+// whole thread
+func HandleMessageContext(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	messageID, err := strconv.ParseInt(c.QueryParam("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Message ID required",
+		})
+	}
+
+	// Number of items to include on each side of the message
+	before, after := 25, 25
+	if val, err := strconv.Atoi(c.QueryParam("before")); err == nil && val >= 0 {
+		before = min(val, 500)
+	}
+	if val, err := strconv.Atoi(c.QueryParam("after")); err == nil && val >= 0 {
+		after = min(val, 500)
+	}
+
+	var startDate, endDate *time.Time
+
+	if startStr := c.QueryParam("start"); startStr != "" {
+		t, err := time.Parse(time.RFC3339, startStr)
+		if err == nil {
+			startDate = &t
+		}
+	}
+
+	if endStr := c.QueryParam("end"); endStr != "" {
+		t, err := time.Parse(time.RFC3339, endStr)
+		if err == nil {
+			endDate = &t
+		}
+	}
+
+	ctx, err := GetMessageContext(userDB, messageID, before, after, startDate, endDate)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Message not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error getting message context", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get message context",
+		})
+	}
+
+	// Hide calls the same way HandleMessages does; offsets still count them
+	// so they line up with /api/messages?type=conversation paging
+	userID, _ := c.Get("user_id").(string)
+	settings, err := GetUserSettings(userID)
+	if err != nil {
+		settings = GetDefaultSettings()
+	}
+	if !settings.Conversations.ShowCalls {
+		filteredActivities := []ActivityItem{}
+		for _, activity := range ctx.Items {
+			if activity.Type != "call" {
+				filteredActivities = append(filteredActivities, activity)
+			}
+		}
+		ctx.Items = filteredActivities
+	}
+
+	return c.JSON(http.StatusOK, ctx)
+}
+
 // HandleMediaItems returns only media (images/videos) for a conversation
 func HandleMediaItems(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -279,7 +363,7 @@ func HandleMediaItems(c echo.Context) error {
 		}
 	}
 
-	mediaItems, err := GetMediaByAddress(userDB, address, startDate, endDate)
+	mediaItems, err := store.GetMediaByAddress(address, startDate, endDate)
 	if err != nil {
 		slog.Error("Error getting media items", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -291,7 +375,7 @@ func HandleMediaItems(c echo.Context) error {
 }
 
 func HandleActivity(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -331,7 +415,7 @@ func HandleActivity(c echo.Context) error {
 		}
 	}
 
-	activities, err := GetActivity(userDB, startDate, endDate, limit, offset)
+	activities, err := store.GetActivity(startDate, endDate, c.QueryParam("tag"), limit, offset)
 	if err != nil {
 		slog.Error("Error getting activity", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -343,7 +427,7 @@ func HandleActivity(c echo.Context) error {
 }
 
 func HandleCalls(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -383,7 +467,7 @@ func HandleCalls(c echo.Context) error {
 		}
 	}
 
-	calls, err := GetAllCalls(userDB, startDate, endDate, limit, offset)
+	calls, err := store.GetAllCalls(startDate, endDate, limit, offset)
 	if err != nil {
 		slog.Error("Error getting calls", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -395,7 +479,7 @@ func HandleCalls(c echo.Context) error {
 }
 
 func HandleDateRange(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -403,7 +487,7 @@ func HandleDateRange(c echo.Context) error {
 		})
 	}
 
-	minDate, maxDate, err := GetDateRange(userDB)
+	minDate, maxDate, err := store.GetDateRange()
 	if err == ErrNoDateRange {
 		// No messages imported yet is a normal state for a new account,
 		// not a server error - return empty bounds instead of a 500
@@ -437,7 +521,7 @@ func HandleProgress(c echo.Context) error {
 }
 
 func HandleMedia(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -456,8 +540,7 @@ func HandleMedia(c echo.Context) error {
 	// Check if transcode is requested (for videos that browser can't play)
 	forceTranscode := c.QueryParam("transcode") == "true"
 
-	// Fetch media from database
-	media, contentType, err := GetMessageMedia(userDB, messageID)
+	info, err := store.GetMediaInfo(messageID)
 	if err != nil {
 		slog.Error("Error getting media", "error", err)
 		return c.JSON(http.StatusNotFound, map[string]string{
@@ -465,78 +548,201 @@ func HandleMedia(c echo.Context) error {
 		})
 	}
 
-	if len(media) == 0 {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "No media for this message",
-		})
-	}
+	contentType := info.MediaType
+	etag := fmt.Sprintf(`"%s-%d"`, messageID, info.Size)
+	var content io.ReadSeeker
 
-	// If transcode is requested and this is a video, try to convert it
-	if forceTranscode && strings.HasPrefix(contentType, "video/") {
-		slog.Info("Transcode requested for video", "messageID", messageID, "contentType", contentType)
-		convertedData, err := convertVideoToMP4(media)
+	transcodeVideo := forceTranscode && strings.HasPrefix(contentType, "video/")
+	if mediaNeedsConversion(contentType) || transcodeVideo {
+		userID, _ := c.Get("user_id").(string)
+		converted, convertedType, err := OpenConvertedMedia(userID, store, messageID, info.MediaType, transcodeVideo)
 		if err != nil {
-			slog.Error("Failed to transcode video", "messageID", messageID, "error", err)
-			// Continue with original video if conversion fails
-		} else {
-			slog.Info("Successfully transcoded video", "messageID", messageID)
-			media = convertedData
-			contentType = "video/mp4"
+			slog.Error("Error getting media", "error", err)
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error": "Media not found",
+			})
+		}
+		defer converted.Close()
+
+		contentType = convertedType
+		if contentType != info.MediaType || transcodeVideo {
+			etag = fmt.Sprintf(`"%s-%d-%s"`, messageID, info.Size, strings.ReplaceAll(contentType, "/", "-"))
 		}
+		content = converted
+	} else {
+		// Stream straight from the database in chunks, so large videos
+		// don't have to be held in memory to serve a range request
+		content = store.MediaReader(messageID, info.Size)
 	}
 
-	slog.Debug("Serving media", "messageID", messageID, "contentType", contentType, "size", len(media))
+	slog.Debug("Serving media", "messageID", messageID, "contentType", contentType, "size", info.Size)
 
-	// Set appropriate headers
+	// Set appropriate headers. http.ServeContent handles Range (including
+	// suffix and multi-range requests), If-None-Match, If-Modified-Since
+	// and Accept-Ranges from here.
+	c.Response().Header().Set("Content-Type", contentType)
 	c.Response().Header().Set("Cache-Control", "public, max-age=31536000") // Cache for 1 year
-	c.Response().Header().Set("Accept-Ranges", "bytes")                    // Enable range requests for video streaming
+	c.Response().Header().Set("ETag", etag)
 
-	// Check for Range header (needed for video playback)
-	rangeHeader := c.Request().Header.Get("Range")
-	if rangeHeader != "" {
-		contentLength := int64(len(media))
-		var start, end int64 = 0, contentLength - 1
+	http.ServeContent(c.Response(), c.Request(), "", info.Date, content)
+	return nil
+}
 
-		slog.Debug("Range request received", "messageID", messageID, "range", rangeHeader, "contentType", contentType, "contentLength", contentLength)
+// HandleMediaThumb serves a JPEG thumbnail of an image or video attachment
+// (a poster frame for video), generated on first request and cached
+func HandleMediaThumb(c echo.Context) error {
+	store, err := getUserStore(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
 
-		// Parse range header (e.g., "bytes=0-1023" or "bytes=0-")
-		n, _ := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
-		if n == 1 {
-			// Only start was specified (e.g., "bytes=0-")
-			end = contentLength - 1
-		} else if n == 0 {
-			// Invalid range, return 416 Range Not Satisfiable
-			slog.Warn("Invalid range header", "range", rangeHeader)
-			c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%d", contentLength))
-			return c.NoContent(http.StatusRequestedRangeNotSatisfiable)
+	messageID := c.QueryParam("id")
+	if messageID == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Message ID required",
+		})
+	}
+
+	size := DefaultThumbnailSize
+	if sizeStr := c.QueryParam("size"); sizeStr != "" {
+		if val, err := strconv.Atoi(sizeStr); err == nil && val > 0 {
+			size = val
 		}
+	}
+	size = snapThumbnailSize(size)
+
+	info, err := store.GetMediaInfo(messageID)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Media not found",
+		})
+	}
+	if !thumbnailSupported(info.MediaType) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "No thumbnail for this media type",
+		})
+	}
+
+	userID, _ := c.Get("user_id").(string)
+	thumb, err := OpenThumbnail(userID, store, messageID, size)
+	if errors.Is(err, errImageTooLarge) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Image too large for a thumbnail",
+		})
+	}
+	if err != nil {
+		slog.Error("Error generating thumbnail", "messageID", messageID, "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to generate thumbnail",
+		})
+	}
+	defer thumb.Close()
+
+	c.Response().Header().Set("Content-Type", "image/jpeg")
+	c.Response().Header().Set("Cache-Control", "public, max-age=31536000") // Cache for 1 year
+	c.Response().Header().Set("ETag", fmt.Sprintf(`"%s-%d-thumb%d"`, messageID, info.Size, size))
+
+	http.ServeContent(c.Response(), c.Request(), "", info.Date, thumb)
+	return nil
+}
+
+// HandleMediaArchive streams a zip of the media matching the gallery filters
+func HandleMediaArchive(c echo.Context) error {
+	store, err := getUserStore(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	filter, errMsg := parseGalleryFilter(c)
+	if errMsg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": errMsg,
+		})
+	}
+
+	// The list is metadata only; blobs are read one at a time while the
+	// zip streams, so no query stays open for the whole download
+	items, err := store.GetMediaArchiveItems(filter)
+	if err != nil {
+		slog.Error("Error listing media for archive", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to list media",
+		})
+	}
+
+	archiveName := "media"
+	if filter.Address != "" {
+		archiveName += "-" + sanitizeArchiveName(filter.Address)
+	}
+	c.Response().Header().Set("Content-Type", "application/zip")
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, archiveName))
+	c.Response().WriteHeader(http.StatusOK)
+
+	// Headers are already sent, so a failure can only cut the zip short
+	if err := WriteMediaArchive(c.Response(), store, items); err != nil {
+		slog.Error("Error writing media archive", "error", err)
+	}
+	return nil
+}
 
-		// Ensure valid range
-		if start < 0 || start >= contentLength || end >= contentLength || start > end {
-			slog.Warn("Range out of bounds", "start", start, "end", end, "contentLength", contentLength)
-			c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes */%d", contentLength))
-			return c.NoContent(http.StatusRequestedRangeNotSatisfiable)
+// parseGalleryFilter reads the media filter query parameters shared by the
+// gallery and media archive endpoints. errMsg is non-empty for invalid
+// values.
+func parseGalleryFilter(c echo.Context) (filter GalleryFilter, errMsg string) {
+	filter = GalleryFilter{
+		Address:   c.QueryParam("address"),
+		Direction: c.QueryParam("direction"),
+		Tag:       c.QueryParam("tag"),
+		Cursor:    c.QueryParam("cursor"),
+	}
+
+	if kinds := c.QueryParam("kind"); kinds != "" {
+		for _, kind := range strings.Split(kinds, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				filter.Kinds = append(filter.Kinds, kind)
+			}
 		}
+	}
 
-		slog.Debug("Serving range", "start", start, "end", end, "size", end-start+1)
+	if startStr := c.QueryParam("start"); startStr != "" {
+		t, err := time.Parse(time.RFC3339, startStr)
+		if err == nil {
+			filter.StartDate = &t
+		}
+	}
 
-		// Set response headers for partial content
-		c.Response().Header().Set("Content-Type", contentType)
-		c.Response().Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, contentLength))
-		c.Response().Header().Set("Content-Length", fmt.Sprintf("%d", end-start+1))
-		c.Response().WriteHeader(http.StatusPartialContent)
+	if endStr := c.QueryParam("end"); endStr != "" {
+		t, err := time.Parse(time.RFC3339, endStr)
+		if err == nil {
+			filter.EndDate = &t
+		}
+	}
 
-		// Write the requested range
-		_, writeErr := c.Response().Write(media[start : end+1])
-		return writeErr
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		if val, err := strconv.Atoi(limitStr); err == nil {
+			filter.Limit = val
+		}
 	}
 
-	// No range request - serve full content
-	c.Response().Header().Set("Content-Length", fmt.Sprintf("%d", len(media)))
-	return c.Blob(http.StatusOK, contentType, media)
+	if filter.Direction != "" && filter.Direction != "sent" && filter.Direction != "received" {
+		return filter, "direction must be sent or received"
+	}
+	for _, kind := range filter.Kinds {
+		if _, ok := galleryKindConditions[kind]; !ok {
+			return filter, "kind must be image, video, audio or vcard"
+		}
+	}
+	return filter, ""
 }
 
-func HandleSearch(c echo.Context) error {
+// HandleGallery lists media across all conversations with cursor pagination
+func HandleGallery(c echo.Context) error {
 	userDB, err := getUserDB(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
@@ -545,22 +751,101 @@ func HandleSearch(c echo.Context) error {
 		})
 	}
 
-	// Get search query from query parameter
-	query := c.QueryParam("q")
-	if query == "" {
-		return c.JSON(http.StatusOK, []SearchResult{})
+	// Dimensions and durations for media imported before the gallery
+	// existed are filled in the background the first time it's opened
+	userID, _ := c.Get("user_id").(string)
+	ensureMediaIndexed(userID, userDB)
+
+	filter, errMsg := parseGalleryFilter(c)
+	if errMsg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": errMsg,
+		})
+	}
+
+	page, err := GetGallery(userDB, filter)
+	if errors.Is(err, ErrInvalidCursor) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid cursor",
+		})
+	}
+	if err != nil {
+		slog.Error("Error getting gallery", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get gallery",
+		})
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// parseSearchOptions reads the search API's query parameters, shared by
+// HandleSearch and HandleTagSearchResults
+func parseSearchOptions(c echo.Context) SearchOptions {
+	opts := SearchOptions{
+		Query:        c.QueryParam("q"),
+		Contact:      c.QueryParam("contact"),
+		Direction:    c.QueryParam("direction"),
+		RecordType:   c.QueryParam("type"),
+		HasMedia:     c.QueryParam("has_media") == "true",
+		Conversation: c.QueryParam("conversation"),
+		Tag:          c.QueryParam("tag"),
+		Category:     c.QueryParam("category"),
+		Mode:         c.QueryParam("mode"),
+		Sort:         c.QueryParam("sort"),
+		Cursor:       c.QueryParam("cursor"),
+	}
+
+	if kinds := c.QueryParam("kind"); kinds != "" {
+		for _, kind := range strings.Split(kinds, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				opts.MediaKinds = append(opts.MediaKinds, kind)
+			}
+		}
+	}
+
+	if startStr := c.QueryParam("start"); startStr != "" {
+		t, err := time.Parse(time.RFC3339, startStr)
+		if err == nil {
+			opts.StartDate = &t
+		}
+	}
+
+	if endStr := c.QueryParam("end"); endStr != "" {
+		t, err := time.Parse(time.RFC3339, endStr)
+		if err == nil {
+			opts.EndDate = &t
+		}
 	}
 
 	// Get limit from query parameter, default to 100
-	limit := 100
 	if limitStr := c.QueryParam("limit"); limitStr != "" {
 		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
-			limit = parsedLimit
+			opts.Limit = parsedLimit
 		}
 	}
 
+	return opts
+}
+
+func HandleSearch(c echo.Context) error {
+	store, err := getUserStore(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	opts := parseSearchOptions(c)
+
 	// Perform search
-	results, err := SearchMessages(userDB, query, limit)
+	page, err := store.SearchMessages(opts)
+	if errors.Is(err, ErrInvalidSearch) || errors.Is(err, ErrInvalidCursor) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		slog.Error("Error searching messages", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -568,12 +853,65 @@ func HandleSearch(c echo.Context) error {
 		})
 	}
 
-	return c.JSON(http.StatusOK, results)
+	// The body stays a plain array of results; paging details go in headers
+	c.Response().Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		c.Response().Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	return c.JSON(http.StatusOK, page.Results)
+}
+
+// HandleSearchHits searches numbers, contact names and group names as well
+// as message bodies, returning typed hits
+func HandleSearchHits(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	var startDate, endDate *time.Time
+	if startStr := c.QueryParam("start"); startStr != "" {
+		t, err := time.Parse(time.RFC3339, startStr)
+		if err == nil {
+			startDate = &t
+		}
+	}
+	if endStr := c.QueryParam("end"); endStr != "" {
+		t, err := time.Parse(time.RFC3339, endStr)
+		if err == nil {
+			endDate = &t
+		}
+	}
+
+	limit := DefaultSearchHitsLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 && parsedLimit <= MaxSearchLimit {
+			limit = parsedLimit
+		}
+	}
+
+	hits, err := GetSearchHits(userDB, c.QueryParam("q"), startDate, endDate, limit)
+	if errors.Is(err, ErrInvalidSearch) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		slog.Error("Error searching", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Search failed: " + err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, hits)
 }
 
 // HandleAnalytics returns analytics data for the Summary tab
 func HandleAnalytics(c echo.Context) error {
-	userDB, err := getUserDB(c)
+	store, err := getUserStore(c)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -613,7 +951,18 @@ func HandleAnalytics(c echo.Context) error {
 		}
 	}
 
-	analytics, err := GetAnalytics(userDB, startDate, endDate, topN, tzOffsetMinutes)
+	// Conversations to leave out, by flag, e.g. exclude=muted,hidden
+	var exclude []string
+	if excludeStr := c.QueryParam("exclude"); excludeStr != "" {
+		exclude = strings.Split(excludeStr, ",")
+	}
+
+	analytics, err := store.GetAnalytics(startDate, endDate, c.QueryParam("tag"), c.QueryParam("category"), exclude, topN, tzOffsetMinutes)
+	if errors.Is(err, ErrInvalidConversationState) || errors.Is(err, ErrInvalidCategory) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		slog.Error("Error getting analytics", "error", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
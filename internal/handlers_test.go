@@ -1,11 +1,25 @@
 package internal
 
 import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -435,6 +449,403 @@ func TestHandleMediaNotFound(t *testing.T) {
 	}
 }
 
+func TestHandleMediaRange(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	msg := Message{
+		Address:     "+15551234567",
+		Type:        1,
+		Date:        time.Unix(1285799700, 0),
+		ContentType: "application/vnd.wap.multipart.related",
+		MediaType:   "image/png",
+		MediaData:   data,
+	}
+	if err := InsertMessage(userDB, &msg); err != nil {
+		t.Fatalf("Failed to insert media message: %v", err)
+	}
+	id := fmt.Sprintf("%d", msg.ID)
+
+	tests := []struct {
+		name       string
+		rangeHdr   string
+		wantStatus int
+		wantBody   []byte
+	}{
+		{"full", "", http.StatusOK, data},
+		{"explicit range", "bytes=10-19", http.StatusPartialContent, data[10:20]},
+		{"open-ended range", "bytes=95-", http.StatusPartialContent, data[95:]},
+		{"suffix range", "bytes=-5", http.StatusPartialContent, data[95:]},
+		{"unsatisfiable", "bytes=500-600", http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := setupTestContext(http.MethodGet, "/api/media?id="+id, "")
+			if tt.rangeHdr != "" {
+				c.Request().Header.Set("Range", tt.rangeHdr)
+			}
+
+			if err := HandleMedia(c); err != nil {
+				t.Fatalf("HandleMedia failed: %v", err)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantBody != nil && !bytes.Equal(rec.Body.Bytes(), tt.wantBody) {
+				t.Errorf("Expected body %v, got %v", tt.wantBody, rec.Body.Bytes())
+			}
+			if tt.wantStatus == http.StatusOK && rec.Header().Get("Content-Type") != "image/png" {
+				t.Errorf("Expected Content-Type image/png, got %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	// A matching ETag should short-circuit to 304
+	c, rec := setupTestContext(http.MethodGet, "/api/media?id="+id, "")
+	if err := HandleMedia(c); err != nil {
+		t.Fatalf("HandleMedia failed: %v", err)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected ETag header")
+	}
+
+	c, rec = setupTestContext(http.MethodGet, "/api/media?id="+id, "")
+	c.Request().Header.Set("If-None-Match", etag)
+	if err := HandleMedia(c); err != nil {
+		t.Fatalf("HandleMedia failed: %v", err)
+	}
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %d", rec.Code)
+	}
+}
+
+func TestMediaBlobReader(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	data := make([]byte, 2*mediaChunkSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	msg := Message{
+		Address:     "+15551234567",
+		Type:        1,
+		Date:        time.Unix(1285799700, 0),
+		ContentType: "application/vnd.wap.multipart.related",
+		MediaType:   "video/mp4",
+		MediaData:   data,
+	}
+	if err := InsertMessage(userDB, &msg); err != nil {
+		t.Fatalf("Failed to insert media message: %v", err)
+	}
+	id := strconv.FormatInt(msg.ID, 10)
+
+	// A range near the end is served from the one chunk holding it
+	var fetched []int
+	reader := newMediaBlobReader(int64(len(data)), func(offset, n int64) ([]byte, error) {
+		chunk, err := mediaChunk(userDB, id, offset, n)
+		fetched = append(fetched, len(chunk))
+		return chunk, err
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api/media?id="+id, nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", 2*mediaChunkSize, 2*mediaChunkSize+49))
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "video/mp4") // as HandleMedia does, so nothing is sniffed
+	http.ServeContent(rec, req, "", msg.Date, reader)
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[2*mediaChunkSize:2*mediaChunkSize+50]) {
+		t.Fatalf("Expected the requested range, got status %d and %d bytes", rec.Code, rec.Body.Len())
+	}
+	if !slices.Equal(fetched, []int{100}) {
+		t.Errorf("Expected a single read of the last 100 bytes, got reads of %v", fetched)
+	}
+
+	// A full read fetches every chunk once, none larger than mediaChunkSize
+	fetched = nil
+	reader.Seek(0, io.SeekStart)
+	all, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Fatalf("Expected the whole attachment, got %d bytes (%v)", len(all), err)
+	}
+	if !slices.Equal(fetched, []int{mediaChunkSize, mediaChunkSize, 100}) {
+		t.Errorf("Expected chunked reads, got %v", fetched)
+	}
+
+	// The handler streams it the same way
+	c, rec := setupTestContext(http.MethodGet, "/api/media?id="+id, "")
+	c.Request().Header.Set("Range", "bytes=-10")
+	if err := HandleMedia(c); err != nil {
+		t.Fatalf("HandleMedia failed: %v", err)
+	}
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[len(data)-10:]) {
+		t.Errorf("Expected the last 10 bytes, got status %d and %v", rec.Code, rec.Body.Bytes())
+	}
+}
+
+func TestHandleMediaThumb(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 800, 400))); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	msg := Message{
+		Address:     "+15551234567",
+		Type:        1,
+		Date:        time.Unix(1285799700, 0),
+		ContentType: "application/vnd.wap.multipart.related",
+		MediaType:   "image/png",
+		MediaData:   buf.Bytes(),
+	}
+	if err := InsertMessage(userDB, &msg); err != nil {
+		t.Fatalf("Failed to insert media message: %v", err)
+	}
+	id := fmt.Sprintf("%d", msg.ID)
+
+	// 300 should round up to the 320 bucket
+	c, rec := setupTestContext(http.MethodGet, "/api/media/thumb?id="+id+"&size=300", "")
+	if err := HandleMediaThumb(c); err != nil {
+		t.Fatalf("HandleMediaThumb failed: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expected Content-Type image/jpeg, got %q", rec.Header().Get("Content-Type"))
+	}
+
+	cfg, err := jpeg.DecodeConfig(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to decode thumbnail: %v", err)
+	}
+	if cfg.Width != 320 || cfg.Height != 160 {
+		t.Errorf("Expected 320x160 thumbnail, got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	// Images declaring more pixels than a thumbnail will decode are
+	// refused from their header, before anything is allocated for them
+	var bomb bytes.Buffer
+	bomb.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := []byte("IHDR\x00\x00\x4e\x20\x00\x00\x4e\x20\x08\x06\x00\x00\x00") // 20000x20000 RGBA
+	binary.Write(&bomb, binary.BigEndian, uint32(len(ihdr)-4))
+	bomb.Write(ihdr)
+	binary.Write(&bomb, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	msg = Message{
+		Address:     "+15551234567",
+		Type:        1,
+		Date:        time.Unix(1285799760, 0),
+		ContentType: "application/vnd.wap.multipart.related",
+		MediaType:   "image/png",
+		MediaData:   bomb.Bytes(),
+	}
+	if err := InsertMessage(userDB, &msg); err != nil {
+		t.Fatalf("Failed to insert media message: %v", err)
+	}
+	c, rec = setupTestContext(http.MethodGet, fmt.Sprintf("/api/media/thumb?id=%d", msg.ID), "")
+	if err := HandleMediaThumb(c); err != nil {
+		t.Fatalf("HandleMediaThumb failed: %v", err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an oversized image, got %d", rec.Code)
+	}
+
+	// Messages without an image or video have no thumbnail
+	c, rec = setupTestContext(http.MethodGet, "/api/media/thumb?id=99999", "")
+	if err := HandleMediaThumb(c); err != nil {
+		t.Fatalf("HandleMediaThumb failed: %v", err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", rec.Code)
+	}
+}
+
+func TestHandleGallery(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+	// Keep the background metadata pass from racing the test cleanup
+	galleryIndexed.Store(testUserID, true)
+	defer galleryIndexed.Delete(testUserID)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	media := []struct {
+		address   string
+		msgType   int
+		mediaType string
+		data      []byte
+	}{
+		{"+15550000001", 1, "image/png", buf.Bytes()},
+		{"+15550000002", 2, "image/png", buf.Bytes()},
+		{"+15550000001", 1, "video/mp4", []byte("not really a video")},
+		{"+15550000002", 1, "image/png", buf.Bytes()},
+		{"+15550000001", 1, "text/x-vcard", []byte("BEGIN:VCARD\nEND:VCARD")},
+	}
+	for i, m := range media {
+		msg := Message{
+			Address:     m.address,
+			Type:        m.msgType,
+			Date:        time.Unix(2000000000+int64(i)*60, 0),
+			ContentType: "application/vnd.wap.multipart.related",
+			MediaType:   m.mediaType,
+			MediaData:   m.data,
+		}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert media message: %v", err)
+		}
+	}
+
+	get := func(query string) (int, GalleryPage) {
+		c, rec := setupTestContext(http.MethodGet, "/api/gallery?"+query, "")
+		if err := HandleGallery(c); err != nil {
+			t.Fatalf("HandleGallery failed: %v", err)
+		}
+		var page GalleryPage
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+		}
+		return rec.Code, page
+	}
+
+	// Received images, one per page, newest first
+	query := "kind=image&direction=received&start=2033-01-01T00:00:00Z&limit=1"
+	code, page := get(query)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(page.Items) != 1 || page.Items[0].Address != "+15550000002" || page.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %+v", page)
+	}
+	item := page.Items[0]
+	if item.Kind != "image" || item.Width != 40 || item.Height != 30 || item.Size != int64(buf.Len()) {
+		t.Errorf("Unexpected item metadata: %+v", item)
+	}
+
+	code, page = get(query + "&cursor=" + page.NextCursor)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(page.Items) != 1 || page.Items[0].Address != "+15550000001" || page.NextCursor != "" {
+		t.Fatalf("Unexpected second page: %+v", page)
+	}
+
+	// Kinds combine, and the address filter applies on top
+	_, page = get("kind=video,vcard&address=%2B15550000001&start=2033-01-01T00:00:00Z")
+	if len(page.Items) != 2 || page.Items[0].Kind != "vcard" || page.Items[1].Kind != "video" {
+		t.Errorf("Unexpected video/vcard results: %+v", page.Items)
+	}
+
+	for _, bad := range []string{"kind=document", "direction=sideways", "cursor=%21%21"} {
+		if code, _ := get(bad); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", bad, code)
+		}
+	}
+}
+
+func TestHandleMediaArchive(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	var jpegBuf, pngBuf bytes.Buffer
+	if err := jpeg.Encode(&jpegBuf, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatalf("Failed to encode test JPEG: %v", err)
+	}
+	if err := png.Encode(&pngBuf, image.NewRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+
+	photoDate := time.Unix(1560000000, 0)
+	media := []Message{
+		{Address: "+15550000001", ContactName: "Mom", Date: photoDate, MediaType: "image/jpeg", MediaData: jpegBuf.Bytes(), MediaName: "IMG_0001.jpg"},
+		{Address: "+15550000001", ContactName: "Mom", Date: photoDate.Add(time.Hour), MediaType: "image/png", MediaData: pngBuf.Bytes()},
+		{Address: "+15550000001", ContactName: "Mom", Date: photoDate.Add(2 * time.Hour), MediaType: "video/mp4", MediaData: []byte("video")},
+		{Address: "+15550000002", ContactName: "Dad", Date: photoDate, MediaType: "image/png", MediaData: pngBuf.Bytes()},
+	}
+	for i := range media {
+		media[i].Type = 1
+		media[i].ContentType = "application/vnd.wap.multipart.related"
+		if err := InsertMessage(userDB, &media[i]); err != nil {
+			t.Fatalf("Failed to insert media message: %v", err)
+		}
+	}
+
+	c, rec := setupTestContext(http.MethodGet, "/api/media/archive?address=%2B15550000001&kind=image", "")
+	if err := HandleMediaArchive(c); err != nil {
+		t.Fatalf("HandleMediaArchive failed: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("Expected Content-Type application/zip, got %q", rec.Header().Get("Content-Type"))
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	wantNames := []string{
+		photoDate.Format("2006-01-02_150405") + "_Mom_IMG_0001.jpg",
+		photoDate.Add(time.Hour).Format("2006-01-02_150405") + fmt.Sprintf("_Mom_%d.png", media[1].ID),
+	}
+	if len(zr.File) != len(wantNames) {
+		t.Fatalf("Expected %d files, got %d", len(wantNames), len(zr.File))
+	}
+	for i, f := range zr.File {
+		if f.Name != wantNames[i] {
+			t.Errorf("Expected file %d to be %q, got %q", i, wantNames[i], f.Name)
+		}
+	}
+
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatalf("Failed to open archived JPEG: %v", err)
+	}
+	photo, _ := io.ReadAll(rc)
+	rc.Close()
+	if tiff := jpegExifTIFF(photo); tiff == nil || !exifHasDate(tiff) {
+		t.Errorf("Expected archived JPEG to carry an EXIF date")
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(photo)); err != nil {
+		t.Errorf("Archived JPEG no longer decodes: %v", err)
+	}
+}
+
 func TestHandleSearch(t *testing.T) {
 	_, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -513,6 +924,1171 @@ func TestHandleSearchWithLimit(t *testing.T) {
 	}
 }
 
+func TestHandleSearchAdvanced(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.Local)
+	msgs := []Message{
+		{Address: "+15550000001", ContactName: "Jane Doe", Type: 1, Date: base, Body: "Don't forget the follow-up invoice"},
+		{Address: "+15550000001", ContactName: "Jane Doe", Type: 2, Date: base.Add(24 * time.Hour), Body: "Invoice paid"},
+		{Address: "+15550000002", ContactName: "Bob", Type: 1, Date: base.Add(48 * time.Hour), Body: "Another invoice attached",
+			ContentType: "application/vnd.wap.multipart.related", MediaType: "image/png", MediaData: []byte("png")},
+		{Address: "+15550000001,+15550000002", Type: 1, Date: base.Add(72 * time.Hour), Body: "Group invoice thread"},
+	}
+	for i := range msgs {
+		if err := InsertMessage(userDB, &msgs[i]); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	search := func(query string) (int, []SearchResult, http.Header) {
+		c, rec := setupTestContext(http.MethodGet, "/api/search?"+query, "")
+		if err := HandleSearch(c); err != nil {
+			t.Fatalf("HandleSearch failed: %v", err)
+		}
+		var results []SearchResult
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+		}
+		return rec.Code, results, rec.Header()
+	}
+
+	cases := []struct {
+		query string
+		want  []int64 // message IDs, in order
+	}{
+		// FTS syntax characters are searched for, not parsed
+		{"q=" + url.QueryEscape("don't follow-up"), []int64{msgs[0].ID}},
+		{"q=" + url.QueryEscape(`invoice from:"Jane Doe"`), []int64{msgs[0].ID}},
+		{"q=" + url.QueryEscape("invoice to:jane"), []int64{msgs[1].ID}},
+		{"q=" + url.QueryEscape("invoice is:group"), []int64{msgs[3].ID}},
+		{"q=" + url.QueryEscape("invoice has:image"), []int64{msgs[2].ID}},
+		{"q=" + url.QueryEscape("invoice -paid after:2021-03-02 is:direct"), []int64{msgs[2].ID}},
+		{"q=invoice&contact=Bob&has_media=true", []int64{msgs[2].ID}},
+		{"q=invoic*&sort=date&direction=received", []int64{msgs[3].ID, msgs[2].ID, msgs[0].ID}},
+		// Operators alone list matches newest first
+		{"q=" + url.QueryEscape("with:+15550000001 before:2021-03-02"), []int64{msgs[0].ID}},
+	}
+	for _, tc := range cases {
+		code, results, _ := search(tc.query)
+		if code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", tc.query, code)
+			continue
+		}
+		var got []int64
+		for _, r := range results {
+			got = append(got, r.MessageID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.query, tc.want, got)
+		}
+	}
+
+	// Paging by date with a cursor, with the total in a header
+	var seen []int64
+	query := "q=invoice&sort=date&limit=3"
+	for pages := 0; pages < 3; pages++ {
+		_, results, header := search(query)
+		if header.Get("X-Total-Count") != "4" {
+			t.Errorf("Expected X-Total-Count 4, got %q", header.Get("X-Total-Count"))
+		}
+		for _, r := range results {
+			seen = append(seen, r.MessageID)
+		}
+		cursor := header.Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+		query = "q=invoice&sort=date&limit=3&cursor=" + cursor
+	}
+	if want := []int64{msgs[3].ID, msgs[2].ID, msgs[1].ID, msgs[0].ID}; fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("Expected paged results %v, got %v", want, seen)
+	}
+
+	for _, bad := range []string{"q=" + url.QueryEscape("x before:someday"), "q=x&direction=up", "q=x&cursor=%21"} {
+		if code, _, _ := search(bad); code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", bad, code)
+		}
+	}
+}
+
+func TestSearchModes(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Unix(1600000000, 0)
+	bodies := []string{
+		"Meet at the Café on Main",
+		"Happy birthday!!",
+		"東京タワーに行きました",
+		"Did you get the package?",
+		"The packages arrived",
+	}
+	var ids []int64
+	for i, body := range bodies {
+		msg := Message{Address: "+15550000077", Type: 1, Date: base.Add(time.Duration(i) * time.Minute), Body: body}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	cases := []struct {
+		mode, query string
+		want        []int64
+	}{
+		{SearchModeWords, "birthd", nil},
+		{SearchModePrefix, "birthd", []int64{ids[1]}},
+		{SearchModeSubstring, "cafe", []int64{ids[0]}},
+		{SearchModeSubstring, "irthda", []int64{ids[1]}},
+		{SearchModeSubstring, "タワー", []int64{ids[2]}},
+		{SearchModeSubstring, "on ma", []int64{ids[0]}},
+		// Terms too short for trigrams stay alternatives of OR
+		{SearchModeSubstring, "!! OR cafe", []int64{ids[1], ids[0]}},
+		{SearchModeSubstring, "py birth OR tower", []int64{ids[1]}},
+		{SearchModeSubstring, "!! OR ckage -arrived", []int64{ids[3], ids[1]}},
+		{SearchModeFuzzy, "birthdya", []int64{ids[1]}},
+		{SearchModeFuzzy, "cafe main", []int64{ids[0]}},
+		// The exact word ranks above the longer one
+		{SearchModeFuzzy, "package", []int64{ids[3], ids[4]}},
+		{SearchModeFuzzy, "pakage -arrived", []int64{ids[3]}},
+	}
+	for _, tc := range cases {
+		page, err := SearchMessages(userDB, SearchOptions{Query: tc.query, Mode: tc.mode})
+		if err != nil {
+			t.Errorf("%s %q: search failed: %v", tc.mode, tc.query, err)
+			continue
+		}
+		var got []int64
+		for _, r := range page.Results {
+			got = append(got, r.MessageID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) || page.Total != len(tc.want) {
+			t.Errorf("%s %q: expected %v, got %v (total %d)", tc.mode, tc.query, tc.want, got, page.Total)
+		}
+	}
+
+	page, err := SearchMessages(userDB, SearchOptions{Query: "birthdya", Mode: SearchModeFuzzy})
+	if err != nil || len(page.Results) != 1 || page.Results[0].Snippet != "Happy <mark>birthday</mark>!!" {
+		t.Errorf("Expected highlighted fuzzy snippet, got %+v (%v)", page, err)
+	}
+
+	page, err = SearchMessages(userDB, SearchOptions{Query: "!! OR cafe", Mode: SearchModeSubstring})
+	if err != nil || len(page.Results) != 2 || page.Results[0].Snippet != "Happy birthday<mark>!!</mark>" {
+		t.Errorf("Expected highlighted substring snippet, got %+v (%v)", page, err)
+	}
+
+	if _, err := SearchMessages(userDB, SearchOptions{Query: "x", Mode: "telepathic"}); !errors.Is(err, ErrInvalidSearch) {
+		t.Errorf("Expected ErrInvalidSearch for unknown mode, got %v", err)
+	}
+
+	// Regex mode matches what FTS tokens can't express
+	code := Message{Address: "+15550000078", Type: 1, Date: base.Add(time.Hour), Body: "Your code is 482913. Order #12-3456 shipped"}
+	if err := InsertMessage(userDB, &code); err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+	page, err = SearchMessages(userDB, SearchOptions{Query: `\b\d{6}\b`, Mode: SearchModeRegex})
+	if err != nil || len(page.Results) != 1 || page.Results[0].MessageID != code.ID ||
+		page.Results[0].Snippet != "Your code is <mark>482913</mark>. Order #12-3456 shipped" {
+		t.Errorf("Expected one highlighted regex match, got %+v (%v)", page, err)
+	}
+	page, err = SearchMessages(userDB, SearchOptions{Query: `(?i)^the|#\d+-\d+`, Mode: SearchModeRegex, Contact: "0000077"})
+	if err != nil || len(page.Results) != 1 || page.Results[0].MessageID != ids[4] {
+		t.Errorf("Expected the contact filter to bound the regex search, got %+v (%v)", page, err)
+	}
+	if _, err := SearchMessages(userDB, SearchOptions{Query: "(unclosed", Mode: SearchModeRegex}); !errors.Is(err, ErrInvalidSearch) {
+		t.Errorf("Expected ErrInvalidSearch for a bad pattern, got %v", err)
+	}
+
+	// A database from before the trigram index (and so before schema
+	// versions) gets it built on open
+	oldDBPath := filepath.Join(t.TempDir(), "sbv_old.db")
+	for _, stmt := range []string{
+		"DROP TRIGGER messages_trigram_ai",
+		"DROP TRIGGER messages_trigram_ad",
+		"DROP TRIGGER messages_trigram_au",
+		"DROP TABLE messages_trigram",
+		"PRAGMA user_version = 0",
+		"VACUUM INTO '" + oldDBPath + "'",
+	} {
+		if _, err := userDB.Exec(stmt); err != nil {
+			t.Fatalf("Failed to simulate old schema: %v", err)
+		}
+	}
+	if err := InitUserDB(testUserID, oldDBPath); err != nil {
+		t.Fatalf("Failed to reopen user database: %v", err)
+	}
+	reopened, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+	defer reopened.Close()
+	page, err = SearchMessages(reopened, SearchOptions{Query: "cafe", Mode: SearchModeSubstring})
+	if err != nil || len(page.Results) != 1 || page.Results[0].MessageID != ids[0] {
+		t.Errorf("Expected rebuilt trigram index to find message %d, got %+v (%v)", ids[0], page, err)
+	}
+}
+
+func TestHandleMessageContext(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	// Ten messages, with the middle pair sharing a timestamp
+	base := time.Unix(1600000000, 0)
+	var ids []int64
+	for i := 0; i < 10; i++ {
+		date := base.Add(time.Duration(i) * time.Minute)
+		if i == 5 {
+			date = base.Add(4 * time.Minute)
+		}
+		msg := Message{Address: "+15550000099", Type: 1, Date: date, Body: fmt.Sprintf("message %d", i)}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	get := func(query string) (int, MessageContext) {
+		c, rec := setupTestContext(http.MethodGet, "/api/messages/context?"+query, "")
+		if err := HandleMessageContext(c); err != nil {
+			t.Fatalf("HandleMessageContext failed: %v", err)
+		}
+		var ctx MessageContext
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &ctx); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+		}
+		return rec.Code, ctx
+	}
+
+	code, ctx := get(fmt.Sprintf("id=%d&before=2&after=3", ids[5]))
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if ctx.Address != "+15550000099" || ctx.Total != 10 || ctx.TargetOffset != 5 || ctx.Offset != 3 {
+		t.Errorf("Unexpected context: address=%s total=%d target=%d offset=%d", ctx.Address, ctx.Total, ctx.TargetOffset, ctx.Offset)
+	}
+	var got []int64
+	for _, item := range ctx.Items {
+		got = append(got, item.Message.ID)
+	}
+	if want := ids[3:9]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected items %v, got %v", want, got)
+	}
+
+	// The window is clipped at the start of the conversation, and the
+	// offsets agree with conversation paging
+	_, ctx = get(fmt.Sprintf("id=%d&before=5&after=0", ids[1]))
+	if ctx.Offset != 0 || ctx.TargetOffset != 1 || len(ctx.Items) != 2 {
+		t.Errorf("Expected clipped window of 2 at offset 0, got %d at %d", len(ctx.Items), ctx.Offset)
+	}
+	page, err := GetActivityByAddress(userDB, "+15550000099", nil, nil, 1, 5)
+	if err != nil || len(page) != 1 || page[0].Message.ID != ids[5] {
+		t.Errorf("Expected offset 5 of the conversation to be message %d", ids[5])
+	}
+
+	if code, _ := get("id=99999"); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown message, got %d", code)
+	}
+	if code, _ := get(fmt.Sprintf("id=%d&end=2000-01-01T00:00:00Z", ids[5])); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for message outside the date range, got %d", code)
+	}
+}
+
+func TestHandleSearchHits(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Unix(1600000000, 0)
+	messages := []Message{
+		{Address: "+15551230001,+15551230002", Type: 1, Date: base, Body: "Practice moved to 5", Subject: "Soccer Parents", ContactName: "Ann, Bob"},
+		{Address: "+15559870003", Type: 1, Date: base.Add(time.Minute), Body: "See you at practice", ContactName: "Coach Carol"},
+		{Address: "+15559870004", Type: 2, Date: base.Add(2 * time.Minute), Body: "Thanks", ContactName: "Coach Carol"},
+	}
+	for i := range messages {
+		if err := InsertMessage(userDB, &messages[i]); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+	call := CallLog{Number: "+15559870003", Duration: 60, Date: base.Add(3 * time.Minute), Type: 1, ContactName: "Coach Carol"}
+	if err := InsertCallLog(userDB, &call); err != nil {
+		t.Fatalf("Failed to insert call: %v", err)
+	}
+
+	get := func(query string) (int, SearchHits) {
+		c, rec := setupTestContext(http.MethodGet, "/api/search/hits?"+query, "")
+		if err := HandleSearchHits(c); err != nil {
+			t.Fatalf("HandleSearchHits failed: %v", err)
+		}
+		var hits SearchHits
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &hits); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+		}
+		return rec.Code, hits
+	}
+
+	code, hits := get("q=" + url.QueryEscape("soccer parents"))
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(hits.Groups) != 1 || hits.Groups[0].Subject != "Soccer Parents" || len(hits.Groups[0].Participants) != 2 {
+		t.Errorf("Expected the group hit, got %+v", hits.Groups)
+	}
+	if len(hits.Conversations) != 1 || hits.Conversations[0].Address != messages[0].Address {
+		t.Errorf("Expected the group conversation, got %+v", hits.Conversations)
+	}
+
+	// A partial, formatted number matches the stored address
+	_, hits = get("q=" + url.QueryEscape("(555) 987-0003"))
+	if len(hits.Conversations) != 1 || hits.Conversations[0].Address != "+15559870003" {
+		t.Errorf("Expected one conversation for the number, got %+v", hits.Conversations)
+	}
+	if len(hits.Calls) != 1 || hits.Calls[0].ID != call.ID {
+		t.Errorf("Expected the call hit, got %+v", hits.Calls)
+	}
+
+	_, hits = get("q=coach")
+	if len(hits.Contacts) != 1 {
+		t.Fatalf("Expected one contact hit, got %+v", hits.Contacts)
+	}
+	contact := hits.Contacts[0]
+	if contact.ContactName != "Coach Carol" || len(contact.Addresses) != 2 || contact.MessageCount != 2 || contact.CallCount != 1 {
+		t.Errorf("Unexpected contact hit: %+v", contact)
+	}
+	if len(hits.Calls) != 1 || len(hits.Conversations) != 2 {
+		t.Errorf("Expected both of the contact's conversations and the call, got %d conversations, %d calls", len(hits.Conversations), len(hits.Calls))
+	}
+
+	_, hits = get("q=practice")
+	if len(hits.Messages) != 2 || len(hits.Conversations) != 0 {
+		t.Errorf("Expected two message hits only, got %d messages, %d conversations", len(hits.Messages), len(hits.Conversations))
+	}
+
+	if code, _ := get("q="); code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an empty query, got %d", code)
+	}
+}
+
+func TestSavedSearches(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	c, rec := setupTestContext(http.MethodPost, "/api/saved-searches", `{"name":"Invoices","query":"invoice"}`)
+	if err := HandleCreateSavedSearch(c); err != nil {
+		t.Fatalf("HandleCreateSavedSearch failed: %v", err)
+	}
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created SavedSearch
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	c, rec = setupTestContext(http.MethodPost, "/api/saved-searches", `{"query":"is:nonsense"}`)
+	if err := HandleCreateSavedSearch(c); err != nil {
+		t.Fatalf("HandleCreateSavedSearch failed: %v", err)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid query, got %d", rec.Code)
+	}
+
+	c, rec = setupTestContext(http.MethodPut, "/api/saved-searches/", `{"name":"Invoices","query":"invoice","mode":"prefix"}`)
+	c.SetParamNames("id")
+	c.SetParamValues(strconv.FormatInt(created.ID, 10))
+	if err := HandleUpdateSavedSearch(c); err != nil {
+		t.Fatalf("HandleUpdateSavedSearch failed: %v", err)
+	}
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"mode":"prefix"`) {
+		t.Errorf("Expected updated saved search, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Only messages added after sinceID count as new
+	old := Message{Address: "+15550000066", Type: 1, Date: time.Unix(1600000000, 0), Body: "Invoice 1 attached"}
+	if err := InsertMessage(userDB, &old); err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+	sinceID, err := maxMessageID(userDB)
+	if err != nil {
+		t.Fatalf("maxMessageID failed: %v", err)
+	}
+	for i, body := range []string{"Invoices 2 and 3", "Lunch?", "Re: invoice"} {
+		msg := Message{Address: "+15550000066", Type: 1, Date: time.Unix(1600000060+int64(i), 0), Body: body}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+	matches, err := RecordSavedSearchMatches(testUserID, userDB, sinceID)
+	if err != nil {
+		t.Fatalf("RecordSavedSearchMatches failed: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Count != 2 || matches[0].Name != "Invoices" {
+		t.Errorf("Expected 2 new matches, got %+v", matches)
+	}
+
+	c, rec = setupTestContext(http.MethodGet, "/api/saved-searches", "")
+	if err := HandleGetSavedSearches(c); err != nil {
+		t.Fatalf("HandleGetSavedSearches failed: %v", err)
+	}
+	var searches []SavedSearch
+	if err := json.Unmarshal(rec.Body.Bytes(), &searches); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(searches) != 1 || searches[0].LastImportMatches != 2 || searches[0].LastImportAt == nil {
+		t.Errorf("Expected recorded matches on the saved search, got %+v", searches)
+	}
+
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		c, rec = setupTestContext(http.MethodDelete, "/api/saved-searches/", "")
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.FormatInt(created.ID, 10))
+		if err := HandleDeleteSavedSearch(c); err != nil {
+			t.Fatalf("HandleDeleteSavedSearch failed: %v", err)
+		}
+		if rec.Code != want {
+			t.Errorf("Expected status %d, got %d", want, rec.Code)
+		}
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Unix(1600000000, 0)
+	var msgs []Message
+	for i, body := range []string{"Flight is at 9", "Confirmation ABC123", "Thanks!"} {
+		msg := Message{Address: "+15550000055", Type: 1, Date: base.Add(time.Duration(i) * time.Minute), Body: body}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	target := msgs[1]
+
+	star := func(id int64, body string) int {
+		c, rec := setupTestContext(http.MethodPut, "/api/bookmarks/", body)
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.FormatInt(id, 10))
+		if err := HandleSetBookmark(c); err != nil {
+			t.Fatalf("HandleSetBookmark failed: %v", err)
+		}
+		return rec.Code
+	}
+	if code := star(target.ID, `{"note":"booking ref"}`); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if code := star(999999, ""); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing message, got %d", code)
+	}
+
+	// Re-importing the same message leaves the bookmark in place
+	dup := Message{Address: target.Address, Type: target.Type, Date: target.Date, Body: target.Body}
+	if err := InsertMessage(userDB, &dup); err != nil {
+		t.Fatalf("Failed to re-insert message: %v", err)
+	}
+
+	items, err := GetActivityByAddress(userDB, "+15550000055", nil, nil, 10, 0)
+	if err != nil || len(items) != 3 {
+		t.Fatalf("Expected 3 activity items, got %d (%v)", len(items), err)
+	}
+	if m := items[1].Message; !m.Bookmarked || m.BookmarkNote != "booking ref" || items[0].Message.Bookmarked {
+		t.Errorf("Expected only the starred message to be bookmarked, got %+v", items)
+	}
+
+	page, err := SearchMessages(userDB, SearchOptions{Query: "confirmation"})
+	if err != nil || len(page.Results) != 1 || !page.Results[0].Bookmarked {
+		t.Errorf("Expected a bookmarked search result, got %+v (%v)", page, err)
+	}
+
+	c, rec := setupTestContext(http.MethodGet, "/api/bookmarks?context=1", "")
+	if err := HandleBookmarks(c); err != nil {
+		t.Fatalf("HandleBookmarks failed: %v", err)
+	}
+	var bookmarks []Bookmark
+	if err := json.Unmarshal(rec.Body.Bytes(), &bookmarks); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(bookmarks) != 1 || bookmarks[0].Message == nil || bookmarks[0].Message.ID != target.ID ||
+		bookmarks[0].Note != "booking ref" || len(bookmarks[0].Context) != 3 {
+		t.Errorf("Unexpected bookmarks: %+v", bookmarks)
+	}
+
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		c, rec := setupTestContext(http.MethodDelete, "/api/bookmarks/", "")
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.FormatInt(target.ID, 10))
+		if err := HandleDeleteBookmark(c); err != nil {
+			t.Fatalf("HandleDeleteBookmark failed: %v", err)
+		}
+		if rec.Code != want {
+			t.Errorf("Expected status %d, got %d", want, rec.Code)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Unix(1600000000, 0)
+	var msgs []Message
+	for i, m := range []struct{ address, body string }{
+		{"+15550000044", "Receipt for your order"},
+		{"+15550000044", "Dinner tonight?"},
+		{"+15550000045", "Your receipt is attached"},
+		{"+15550000046", "Happy birthday"},
+	} {
+		msg := Message{Address: m.address, Type: 1, Date: base.Add(time.Duration(i) * time.Minute), Body: m.body}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	create := func(body string) (int, Tag) {
+		c, rec := setupTestContext(http.MethodPost, "/api/tags", body)
+		if err := HandleCreateTag(c); err != nil {
+			t.Fatalf("HandleCreateTag failed: %v", err)
+		}
+		var tag Tag
+		json.Unmarshal(rec.Body.Bytes(), &tag)
+		return rec.Code, tag
+	}
+	code, receipts := create(`{"name":"receipts","color":"#0a0"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", code)
+	}
+	if code, _ := create(`{"name":"Receipts"}`); code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a duplicate name, got %d", code)
+	}
+	_, family := create(`{"name":"family"}`)
+
+	// Bulk-tag a search result set
+	c, rec := setupTestContext(http.MethodPost, "/api/tags/?q=receipt", "")
+	c.SetParamNames("id")
+	c.SetParamValues(strconv.FormatInt(receipts.ID, 10))
+	if err := HandleTagSearchResults(c); err != nil {
+		t.Fatalf("HandleTagSearchResults failed: %v", err)
+	}
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"tagged":2`) {
+		t.Errorf("Expected 2 messages tagged, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	c, rec = setupTestContext(http.MethodPut, "/api/tags/?address=%2B15550000046", "")
+	c.SetParamNames("id")
+	c.SetParamValues(strconv.FormatInt(family.ID, 10))
+	if err := HandleTagConversation(c); err != nil {
+		t.Fatalf("HandleTagConversation failed: %v", err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", rec.Code)
+	}
+
+	conversations, err := GetConversations(userDB, nil, nil, "receipts", "", "")
+	if err != nil || len(conversations) != 2 {
+		t.Fatalf("Expected 2 conversations with receipts, got %d (%v)", len(conversations), err)
+	}
+	// Tagging a message keeps its whole conversation
+	for _, conv := range conversations {
+		if conv.Address == "+15550000044" && conv.MessageCount != 2 {
+			t.Errorf("Expected the full conversation, got %d messages", conv.MessageCount)
+		}
+	}
+	conversations, err = GetConversations(userDB, nil, nil, "family", "", "")
+	if err != nil || len(conversations) != 1 || fmt.Sprint(conversations[0].Tags) != "[family]" {
+		t.Errorf("Expected the tagged conversation, got %+v (%v)", conversations, err)
+	}
+
+	activity, err := GetActivity(userDB, nil, nil, "receipts", 50, 0)
+	if err != nil || len(activity) != 2 || fmt.Sprint(activity[0].Message.Tags) != "[receipts]" {
+		t.Errorf("Expected 2 tagged activity items, got %+v (%v)", activity, err)
+	}
+	activity, err = GetActivity(userDB, nil, nil, "family", 50, 0)
+	if err != nil || len(activity) != 1 || activity[0].Message.ID != msgs[3].ID {
+		t.Errorf("Expected the tagged conversation's message, got %+v (%v)", activity, err)
+	}
+
+	page, err := SearchMessages(userDB, SearchOptions{Query: "tag:receipts attached"})
+	if err != nil || len(page.Results) != 1 || page.Results[0].MessageID != msgs[2].ID {
+		t.Errorf("Expected the tag operator to filter search, got %+v (%v)", page, err)
+	}
+
+	analytics, err := GetAnalytics(userDB, nil, nil, "receipts", "", nil, 10, 0)
+	if err != nil || analytics.TotalMessages != 2 {
+		t.Errorf("Expected analytics over 2 tagged messages, got %+v (%v)", analytics, err)
+	}
+
+	// Deleting a tag removes it everywhere
+	c, rec = setupTestContext(http.MethodDelete, "/api/tags/", "")
+	c.SetParamNames("id")
+	c.SetParamValues(strconv.FormatInt(receipts.ID, 10))
+	if err := HandleDeleteTag(c); err != nil {
+		t.Fatalf("HandleDeleteTag failed: %v", err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", rec.Code)
+	}
+	tags, err := GetTags(userDB)
+	if err != nil || len(tags) != 1 || tags[0].Name != "family" || tags[0].ConversationCount != 1 {
+		t.Errorf("Expected only the family tag left, got %+v (%v)", tags, err)
+	}
+	var tagged int
+	userDB.QueryRow("SELECT COUNT(*) FROM message_tags").Scan(&tagged)
+	if tagged != 0 {
+		t.Errorf("Expected message tags to be removed with the tag, %d left", tagged)
+	}
+}
+
+func TestConversationState(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Unix(1600000000, 0)
+	// Oldest first, so the unpinned list order is 49, 48, 47
+	for i, address := range []string{"+15550000047", "+15550000048", "+15550000049"} {
+		msg := Message{Address: address, Type: 1, Date: base.Add(time.Duration(i) * time.Minute), Body: "hello"}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	setState := func(address, body string) int {
+		c, rec := setupTestContext(http.MethodPut, "/api/conversations/state?address="+url.QueryEscape(address), body)
+		if err := HandleConversationState(c); err != nil {
+			t.Fatalf("HandleConversationState failed: %v", err)
+		}
+		return rec.Code
+	}
+	if code := setState("+15550000047", `{"pinned":true}`); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	setState("+15550000048", `{"archived":true,"muted":true}`)
+	if code := setState("+15550009999", `{"hidden":true}`); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown conversation, got %d", code)
+	}
+
+	addresses := func(show string) []string {
+		conversations, err := GetConversations(userDB, nil, nil, "", show, "")
+		if err != nil {
+			t.Fatalf("GetConversations(%q) failed: %v", show, err)
+		}
+		// setupTestDB seeds other conversations; only look at these
+		var out []string
+		for _, c := range conversations {
+			if strings.HasPrefix(c.Address, "+155500000") {
+				out = append(out, c.Address)
+			}
+		}
+		return out
+	}
+	if got := addresses(""); !slices.Equal(got, []string{"+15550000047", "+15550000049"}) {
+		t.Errorf("Expected pinned first and archived left out, got %v", got)
+	}
+	if got := addresses("archived"); !slices.Equal(got, []string{"+15550000048"}) {
+		t.Errorf("Expected only the archived conversation, got %v", got)
+	}
+	if got := addresses("all"); len(got) != 3 {
+		t.Errorf("Expected all 3 conversations, got %v", got)
+	}
+
+	// Partial updates leave other flags alone
+	setState("+15550000048", `{"archived":false}`)
+	state, err := GetConversationState(userDB, "+15550000048")
+	if err != nil || state.Archived || !state.Muted {
+		t.Errorf("Expected unarchived but still muted, got %+v (%v)", state, err)
+	}
+
+	all, err := GetAnalytics(userDB, nil, nil, "", "", nil, 10, 0)
+	if err != nil {
+		t.Fatalf("GetAnalytics failed: %v", err)
+	}
+	analytics, err := GetAnalytics(userDB, nil, nil, "", "", []string{"muted"}, 10, 0)
+	if err != nil || analytics.TotalMessages != all.TotalMessages-1 {
+		t.Errorf("Expected analytics to leave out the muted conversation, got %+v (%v)", analytics, err)
+	}
+	if _, err := GetAnalytics(userDB, nil, nil, "", "", []string{"pinned"}, 10, 0); !errors.Is(err, ErrInvalidConversationState) {
+		t.Errorf("Expected ErrInvalidConversationState, got %v", err)
+	}
+}
+
+func TestSenderCategories(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Unix(1600000000, 0)
+	for i, m := range []struct {
+		address string
+		typ     int
+		body    string
+	}{
+		{"72975", 1, "Hello from a short code"},
+		{"BANKCO", 1, "Your balance is low"},
+		{"+15550000050", 1, "Your verification code is 482913"},
+		{"+15550000050", 1, "Sale today! Reply STOP to opt out"},
+		{"+15550000051", 1, "Your code for the gym locker is 1234"},
+		{"+15550000051", 2, "Thanks!"},
+	} {
+		msg := Message{Address: m.address, Type: m.typ, Date: base.Add(time.Duration(i) * time.Minute), Body: m.body}
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	check := func() {
+		t.Helper()
+		conversations, err := GetConversations(userDB, nil, nil, "", "", "")
+		if err != nil {
+			t.Fatalf("GetConversations failed: %v", err)
+		}
+		want := map[string]string{
+			"72975":        SenderCategoryAutomated,
+			"BANKCO":       SenderCategoryAutomated,
+			"+15550000050": SenderCategoryAutomated,
+			"+15550000051": SenderCategoryPersonal, // the user replied
+		}
+		for _, c := range conversations {
+			if category, ok := want[c.Address]; ok && c.Category != category {
+				t.Errorf("Expected %s to be %s, got %s", c.Address, category, c.Category)
+			}
+		}
+	}
+	check()
+
+	automated, err := GetConversations(userDB, nil, nil, "", "", SenderCategoryAutomated)
+	if err != nil || len(automated) != 3 {
+		t.Errorf("Expected 3 automated conversations, got %+v (%v)", automated, err)
+	}
+	if _, err := GetConversations(userDB, nil, nil, "", "", "bots"); !errors.Is(err, ErrInvalidCategory) {
+		t.Errorf("Expected ErrInvalidCategory, got %v", err)
+	}
+
+	page, err := SearchMessages(userDB, SearchOptions{Query: "code is:personal"})
+	if err != nil || len(page.Results) != 1 || page.Results[0].Address != "+15550000051" {
+		t.Errorf("Expected is:personal to leave out automated senders, got %+v (%v)", page, err)
+	}
+
+	all, err := GetAnalytics(userDB, nil, nil, "", "", nil, 10, 0)
+	if err != nil {
+		t.Fatalf("GetAnalytics failed: %v", err)
+	}
+	personal, err := GetAnalytics(userDB, nil, nil, "", SenderCategoryPersonal, nil, 10, 0)
+	if err != nil || personal.TotalMessages != all.TotalMessages-4 {
+		t.Errorf("Expected analytics to leave out 4 automated messages, got %+v (%v)", personal, err)
+	}
+
+	// Databases from before sender_stats existed get it backfilled
+	if _, err := userDB.Exec("DELETE FROM sender_stats"); err != nil {
+		t.Fatalf("Failed to clear sender_stats: %v", err)
+	}
+	if err := backfillDerivedIndexes(userDB, []string{"sender_stats"}); err != nil {
+		t.Fatalf("backfillDerivedIndexes failed: %v", err)
+	}
+	check()
+}
+
+func TestDeleteMessages(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer func() { mediaCache = nil }()
+	if err := InitMediaCache(t.TempDir(), 1<<20); err != nil {
+		t.Fatalf("Failed to initialize media cache: %v", err)
+	}
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	base := time.Unix(1600000000, 0)
+	newMessages := func() []Message {
+		return []Message{
+			{Address: "+15550000052", Type: 1, Date: base, Body: "Old secret"},
+			{Address: "+15550000052", Type: 2, Date: base.Add(time.Minute), Body: "Photo", ContentType: "application/vnd.wap.multipart.related", MediaType: "image/png", MediaData: []byte("png")},
+			{Address: "+15550000053", Type: 1, Date: base.Add(2 * time.Minute), Body: "Keep me"},
+		}
+	}
+	msgs := newMessages()
+	for i := range msgs {
+		if err := InsertMessage(userDB, &msgs[i]); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+	photoID := strconv.FormatInt(msgs[1].ID, 10)
+	cached := mediaCache.path(testUserID, photoID, "thumb256.jpg")
+	if err := mediaCache.store(cached, []byte("thumb")); err != nil {
+		t.Fatalf("Failed to cache thumbnail: %v", err)
+	}
+
+	deleteRequest := func(target string, handler echo.HandlerFunc, id string) *httptest.ResponseRecorder {
+		c, rec := setupTestContext(http.MethodDelete, target, "")
+		if id != "" {
+			c.SetParamNames("id")
+			c.SetParamValues(id)
+		}
+		if err := handler(c); err != nil {
+			t.Fatalf("Delete handler failed: %v", err)
+		}
+		return rec
+	}
+
+	rec := deleteRequest("/api/messages/?tombstone=true", HandleDeleteMessage, strconv.FormatInt(msgs[0].ID, 10))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deleted":1`) {
+		t.Errorf("Expected 1 message deleted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := deleteRequest("/api/messages/", HandleDeleteMessage, strconv.FormatInt(msgs[0].ID, 10)); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 deleting it again, got %d", rec.Code)
+	}
+	page, err := SearchMessages(userDB, SearchOptions{Query: "secret"})
+	if err != nil || page.Total != 0 {
+		t.Errorf("Expected the deleted message to leave the search index, got %+v (%v)", page, err)
+	}
+
+	// The whole conversation, without a tombstone, takes the cached media
+	// with it
+	rec = deleteRequest("/api/conversations?address=%2B15550000052", HandleDeleteConversation, "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deleted":1`) {
+		t.Errorf("Expected 1 message deleted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Errorf("Expected the cached thumbnail to be removed")
+	}
+
+	if rec := deleteRequest("/api/messages", HandleDeleteMessages, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a delete without criteria, got %d", rec.Code)
+	}
+
+	// Re-importing brings back only what wasn't tombstoned
+	for _, msg := range newMessages() {
+		if err := InsertMessage(userDB, &msg); err != nil {
+			t.Fatalf("Failed to re-insert message: %v", err)
+		}
+	}
+	var bodies []string
+	rows, err := userDB.Query("SELECT body FROM messages WHERE address IN ('+15550000052', '+15550000053') ORDER BY date")
+	if err != nil {
+		t.Fatalf("Failed to query messages: %v", err)
+	}
+	for rows.Next() {
+		var body string
+		rows.Scan(&body)
+		bodies = append(bodies, body)
+	}
+	rows.Close()
+	if !slices.Equal(bodies, []string{"Photo", "Keep me"}) {
+		t.Errorf("Expected the tombstoned message to stay deleted, got %v", bodies)
+	}
+
+	// With normalized dedup, so does a copy differing in whitespace
+	variant := Message{Address: "+15550000052", Type: 1, Date: base.Add(300 * time.Millisecond), Body: "Old  secret "}
+	if err := insertMessage(userDB, &variant, DedupNormalized); err != nil {
+		t.Fatalf("Failed to re-insert message: %v", err)
+	}
+	var n int
+	userDB.QueryRow("SELECT COUNT(*) FROM messages WHERE body LIKE 'Old%'").Scan(&n)
+	if n != 0 {
+		t.Errorf("Expected the tombstoned message to stay deleted under normalized dedup, found %d", n)
+	}
+
+	rec = deleteRequest("/api/messages?type=sms&start=2020-09-13T00:00:00Z", HandleDeleteMessages, "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deleted":1`) {
+		t.Errorf("Expected 1 SMS deleted from the range, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRetention(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	now := time.Now()
+	old := now.AddDate(-6, 0, 0)
+	call := CallLog{Number: "+15550000054", Type: 1, Date: old, Duration: 30}
+	if err := InsertCallLog(userDB, &call); err != nil {
+		t.Fatalf("Failed to insert call: %v", err)
+	}
+	photo := Message{Address: "+15550000054", Type: 1, Date: old, Body: "Look", ContentType: "application/vnd.wap.multipart.related", MediaType: "image/png", MediaData: []byte("png")}
+	recent := Message{Address: "+15550000054", Type: 1, Date: now.AddDate(0, 0, -1), Body: "New", ContentType: "application/vnd.wap.multipart.related", MediaType: "image/png", MediaData: []byte("png")}
+	alert := Message{Address: "72975", Type: 1, Date: now.AddDate(0, 0, -100), Body: "Your code is 123456"}
+	for _, msg := range []*Message{&photo, &recent, &alert} {
+		if err := InsertMessage(userDB, msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	// Invalid rules are rejected when saved
+	c, rec := setupTestContext(http.MethodPut, "/api/settings", `{"retention":[{"action":"strip_media","type":"call","older_than_days":30}]}`)
+	if err := HandleUpdateSettings(c); err != nil {
+		t.Fatalf("HandleUpdateSettings failed: %v", err)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid rule, got %d", rec.Code)
+	}
+
+	settings := GetDefaultSettings()
+	settings.Retention = []RetentionRule{
+		{Action: RetentionDelete, RecordType: "call", OlderThanDays: 5 * 365},
+		{Action: RetentionStripMedia, OlderThanDays: 2 * 365},
+		{Action: RetentionDelete, Category: SenderCategoryAutomated, OlderThanDays: 90, Tombstone: true},
+	}
+	if err := SaveUserSettings(testUserID, settings); err != nil {
+		t.Fatalf("Failed to save settings: %v", err)
+	}
+
+	run := func(method string) RetentionReport {
+		c, rec := setupTestContext(method, "/api/retention", "")
+		if err := HandleRetention(c); err != nil {
+			t.Fatalf("HandleRetention failed: %v", err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var report RetentionReport
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return report
+	}
+	exists := func(id int64) bool {
+		var n int
+		userDB.QueryRow("SELECT COUNT(*) FROM messages WHERE id = ?", id).Scan(&n)
+		return n == 1
+	}
+
+	preview := run(http.MethodGet)
+	if !preview.DryRun || len(preview.Results) != 3 {
+		t.Fatalf("Expected a dry run report for 3 rules, got %+v", preview)
+	}
+	for i, r := range preview.Results {
+		if r.Matched == 0 {
+			t.Errorf("Expected rule %d to match something, got %+v", i, r)
+		}
+	}
+	if !exists(call.ID) || !exists(alert.ID) {
+		t.Fatal("Expected a dry run to leave everything in place")
+	}
+
+	applied := run(http.MethodPost)
+	for i, r := range applied.Results {
+		if r.Matched != preview.Results[i].Matched {
+			t.Errorf("Expected rule %d to remove what the dry run reported (%d), got %d", i, preview.Results[i].Matched, r.Matched)
+		}
+	}
+	if exists(call.ID) || exists(alert.ID) {
+		t.Error("Expected the old call and automated message to be deleted")
+	}
+	var oldMedia, recentMedia string
+	var body string
+	userDB.QueryRow("SELECT COALESCE(media_type, ''), body FROM messages WHERE id = ?", photo.ID).Scan(&oldMedia, &body)
+	userDB.QueryRow("SELECT COALESCE(media_type, '') FROM messages WHERE id = ?", recent.ID).Scan(&recentMedia)
+	if oldMedia != "" || body != "Look" || recentMedia != "image/png" {
+		t.Errorf("Expected only old media stripped with text kept, got %q %q / %q", oldMedia, body, recentMedia)
+	}
+
+	// The automated message was tombstoned
+	if err := InsertMessage(userDB, &Message{Address: "72975", Type: 1, Date: alert.Date, Body: alert.Body}); err != nil {
+		t.Fatalf("Failed to re-insert message: %v", err)
+	}
+	var n int
+	userDB.QueryRow("SELECT COUNT(*) FROM messages WHERE address = '72975'").Scan(&n)
+	if n != 0 {
+		t.Errorf("Expected the tombstoned message to stay deleted, found %d", n)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	userDB, err := GetUserDB(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user database: %v", err)
+	}
+
+	// Two backups with the same message, one with a contact name and
+	// different whitespace: exact dedup keeps both
+	sent := time.UnixMilli(1600000000123)
+	first := Message{Address: "+15550000060", Type: 1, Date: sent, Body: "Running late, see you soon "}
+	second := Message{Address: "+15550000060", Type: 1, Date: sent, Body: "Running  late, see you soon", ContactName: "Sam"}
+	other := Message{Address: "+15550000060", Type: 1, Date: sent.Add(time.Minute), Body: "Here now"}
+	for _, msg := range []*Message{&first, &second, &other} {
+		if err := InsertMessage(userDB, msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	// Normalized dedup skips a third copy, but not a different message
+	third := Message{Address: "+15550000060", Type: 1, Date: sent, Body: "Running late,\nsee you soon"}
+	if err := insertMessage(userDB, &third, DedupNormalized); err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+	later := Message{Address: "+15550000060", Type: 1, Date: sent.Add(time.Second), Body: "Running late, see you soon"}
+	if err := insertMessage(userDB, &later, DedupNormalized); err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+	var n int
+	userDB.QueryRow("SELECT COUNT(*) FROM messages WHERE address = '+15550000060'").Scan(&n)
+	if n != 4 {
+		t.Errorf("Expected 4 messages after normalized inserts, got %d", n)
+	}
+
+	c, rec := setupTestContext(http.MethodPut, "/api/settings", `{"import":{"dedup":"fuzzy"}}`)
+	if err := HandleUpdateSettings(c); err != nil {
+		t.Fatalf("HandleUpdateSettings failed: %v", err)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown strategy, got %d", rec.Code)
+	}
+
+	// The user's store inserts with their strategy
+	settings := GetDefaultSettings()
+	settings.Import.Dedup = DedupNormalized
+	if err := SaveUserSettings(testUserID, settings); err != nil {
+		t.Fatalf("Failed to save settings: %v", err)
+	}
+	store, err := GetUserStore(testUserID, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user store: %v", err)
+	}
+	fourth := Message{Address: "+15550000060", Type: 1, Date: sent, Body: " Running late, see you soon"}
+	if err := store.InsertMessage(&fourth); err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+	userDB.QueryRow("SELECT COUNT(*) FROM messages WHERE address = '+15550000060'").Scan(&n)
+	if n != 4 {
+		t.Errorf("Expected the user's store to skip a normalized duplicate, got %d messages", n)
+	}
+
+	// PostgreSQL can't deduplicate normalized, so saving it there is refused
+	postgresDB, _ = sql.Open("pgx", "postgres://localhost/unused")
+	c, rec = setupTestContext(http.MethodPut, "/api/settings", `{"import":{"dedup":"normalized"}}`)
+	err = HandleUpdateSettings(c)
+	postgresDB.Close()
+	postgresDB = nil
+	if err != nil {
+		t.Fatalf("HandleUpdateSettings failed: %v", err)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for normalized dedup with PostgreSQL, got %d", rec.Code)
+	}
+
+	// Different pictures sent in the same second aren't duplicates, but a
+	// copy of one from a backup without milliseconds is
+	photo := func(ms int64, data string) Message {
+		return Message{Address: "+15550000061", Type: 2, Date: time.UnixMilli(ms), ContentType: "application/vnd.wap.multipart.related", MediaType: "image/png", MediaData: []byte(data)}
+	}
+	for _, msg := range []Message{photo(1600000000100, "first png"), photo(1600000000200, "second png"), photo(1600000000000, "first png")} {
+		if err := insertMessage(userDB, &msg, DedupNormalized); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+	userDB.QueryRow("SELECT COUNT(*) FROM messages WHERE address = '+15550000061'").Scan(&n)
+	if n != 2 {
+		t.Errorf("Expected both pictures and no copy, got %d messages", n)
+	}
+
+	c, rec = setupTestContext(http.MethodGet, "/api/duplicates", "")
+	if err := HandleDuplicates(c); err != nil {
+		t.Fatalf("HandleDuplicates failed: %v", err)
+	}
+	var report DuplicateReport
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if len(report.Groups) != 1 || report.Redundant != 1 {
+		t.Fatalf("Expected one group of duplicates, got %+v", report)
+	}
+	group := report.Groups[0]
+	if !slices.Equal(group.MessageIDs, []int64{second.ID, first.ID}) || group.Body != "Running late, see you soon" {
+		t.Errorf("Expected the copy with a contact name first, got %+v", group)
+	}
+
+	merge := func(body string) *httptest.ResponseRecorder {
+		c, rec := setupTestContext(http.MethodPost, "/api/duplicates/merge", body)
+		if err := HandleMergeDuplicates(c); err != nil {
+			t.Fatalf("HandleMergeDuplicates failed: %v", err)
+		}
+		return rec
+	}
+	if rec := merge(fmt.Sprintf(`{"message_ids":[%d,%d]}`, first.ID, other.ID)); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 merging different messages, got %d", rec.Code)
+	}
+
+	if _, err := userDB.Exec("INSERT INTO bookmarks (message_id, note, created_at) VALUES (?, 'pick up', 1)", first.ID); err != nil {
+		t.Fatalf("Failed to bookmark message: %v", err)
+	}
+	rec = merge(`{"all":true}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"removed":1`) {
+		t.Fatalf("Expected one copy removed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var note string
+	userDB.QueryRow("SELECT note FROM bookmarks WHERE message_id = ?", second.ID).Scan(&note)
+	if note != "pick up" {
+		t.Errorf("Expected the bookmark to move to the kept copy, got %q", note)
+	}
+
+	// The removed copy was tombstoned, so re-importing it doesn't bring it
+	// back
+	if err := InsertMessage(userDB, &Message{Address: first.Address, Type: 1, Date: sent, Body: first.Body}); err != nil {
+		t.Fatalf("Failed to re-insert message: %v", err)
+	}
+	userDB.QueryRow("SELECT COUNT(*) FROM messages WHERE address = '+15550000060'").Scan(&n)
+	if n != 3 {
+		t.Errorf("Expected 3 messages after merging, got %d", n)
+	}
+}
+
 func TestHandleProgress(t *testing.T) {
 	c, rec := setupTestContext(http.MethodGet, "/api/progress", "")
 
@@ -13,6 +13,15 @@ import (
 	"log/slog"
 )
 
+// heicSupported reports whether HEIC images are actually converted (rather
+// than replaced with a placeholder) in this build
+const heicSupported = false
+
+// heicDimensions is unavailable without libheif
+func heicDimensions(heicData []byte) (int, int, error) {
+	return 0, 0, fmt.Errorf("HEIC support is disabled")
+}
+
 // convertHEICtoJPEG returns a placeholder image when HEIC support is disabled
 // This version does not require the libheif library
 func convertHEICtoJPEG(heicData []byte) ([]byte, error) {
@@ -10,6 +10,27 @@ import (
 	libheif "github.com/lowcarbdev/libheif-go"
 )
 
+// heicSupported reports whether HEIC images are actually converted (rather
+// than replaced with a placeholder) in this build
+const heicSupported = true
+
+// heicDimensions returns the display size of a HEIC image's primary image
+// without decoding it
+func heicDimensions(heicData []byte) (int, int, error) {
+	ctx, err := libheif.NewContext()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := ctx.ReadFromMemory(heicData); err != nil {
+		return 0, 0, err
+	}
+	handle, err := ctx.GetPrimaryImageHandle()
+	if err != nil {
+		return 0, 0, err
+	}
+	return handle.GetWidth(), handle.GetHeight(), nil
+}
+
 // convertHEICtoJPEG converts HEIC image data to JPEG format
 // Returns the converted JPEG data or an error if conversion fails
 // This version requires the libheif library and is enabled with the 'heic' build tag
@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Maintenance operations, run by RunMaintenance
+const (
+	MaintenanceIntegrityCheck    = "integrity-check"    // PRAGMA integrity_check, plus the search indexes against messages
+	MaintenanceVacuum            = "vacuum"             // rebuild the file, switching it to incremental auto-vacuum
+	MaintenanceIncrementalVacuum = "incremental-vacuum" // release free pages without rebuilding
+	MaintenanceCheckpoint        = "checkpoint"         // PRAGMA wal_checkpoint(TRUNCATE)
+	MaintenanceRebuildFTS        = "rebuild-fts"        // rebuild the search indexes from messages
+	MaintenanceAnalyze           = "analyze"            // refresh the query planner's statistics
+)
+
+// MaintenanceOperations lists the operations in the order RunMaintenance
+// runs them. Rebuilding comes first so a check in the same run sees the
+// result.
+var MaintenanceOperations = []string{
+	MaintenanceRebuildFTS,
+	MaintenanceIntegrityCheck,
+	MaintenanceVacuum,
+	MaintenanceIncrementalVacuum,
+	MaintenanceCheckpoint,
+	MaintenanceAnalyze,
+}
+
+// ErrUnknownMaintenance is returned by RunMaintenance for an operation not
+// in MaintenanceOperations
+var ErrUnknownMaintenance = errors.New("unknown maintenance operation")
+
+// ErrMaintenanceRunning is returned by RunMaintenance while another run is
+// in progress
+var ErrMaintenanceRunning = errors.New("maintenance is already running")
+
+// ftsIndexes are the full-text indexes of a user database. All are
+// external-content tables, so they can drift from their content after a
+// crash and be rebuilt from it.
+var ftsIndexes = []string{"messages_fts", "messages_trigram", "search_names_fts"}
+
+// maintenanceMutex keeps maintenance runs from overlapping
+var maintenanceMutex sync.Mutex
+
+// MaintenanceResult is the outcome of one operation on one database
+type MaintenanceResult struct {
+	Operation  string `json:"operation"`
+	OK         bool   `json:"ok"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// DatabaseStats describes a database's size and contents. Row counts and
+// media bytes are only reported for user databases.
+type DatabaseStats struct {
+	FileBytes  int64 `json:"file_bytes"` // the database file plus its WAL
+	PageSize   int64 `json:"page_size"`
+	Pages      int64 `json:"pages"`
+	FreePages  int64 `json:"free_pages"` // reclaimable by a vacuum
+	SMS        int   `json:"sms"`
+	MMS        int   `json:"mms"`
+	Calls      int   `json:"calls"`
+	MediaBytes int64 `json:"media_bytes"`
+}
+
+// MaintenanceReport is what RunMaintenance did to one database
+type MaintenanceReport struct {
+	Database string              `json:"database"` // "auth", or the username a user database belongs to
+	UserID   string              `json:"user_id,omitempty"`
+	Path     string              `json:"path"`
+	Results  []MaintenanceResult `json:"results"`
+	Stats    *DatabaseStats      `json:"stats,omitempty"`
+	Error    string              `json:"error,omitempty"` // why the database was skipped
+}
+
+// RunMaintenance runs operations against the auth database and every
+// user database, in the order of MaintenanceOperations, and reports each
+// database's stats afterwards. It's safe while the server is running:
+// writes take the database's LockForWrite lock, and SQLite's busy timeout
+// covers other processes. Failures are reported per database rather than
+// stopping the run.
+func RunMaintenance(dbPathPrefix string, operations []string) ([]MaintenanceReport, error) {
+	requested := make(map[string]bool)
+	for _, op := range operations {
+		known := false
+		for _, candidate := range MaintenanceOperations {
+			known = known || op == candidate
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownMaintenance, op)
+		}
+		requested[op] = true
+	}
+
+	if !maintenanceMutex.TryLock() {
+		return nil, ErrMaintenanceRunning
+	}
+	defer maintenanceMutex.Unlock()
+
+	users, err := ListUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	maintain := func(report MaintenanceReport, database *sql.DB, userDB bool) MaintenanceReport {
+		report.Results = []MaintenanceResult{}
+		for _, op := range MaintenanceOperations {
+			if !requested[op] || (op == MaintenanceRebuildFTS && !userDB) {
+				continue
+			}
+			start := time.Now()
+			detail, err := runMaintenanceOperation(database, op, userDB)
+			result := MaintenanceResult{Operation: op, OK: err == nil, Detail: detail, DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Detail = err.Error()
+				slog.Warn("Maintenance operation failed", "database", report.Path, "operation", op, "error", err)
+			}
+			report.Results = append(report.Results, result)
+		}
+		stats, err := databaseStats(report.Path, database, userDB)
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to read stats: %v", err)
+		}
+		report.Stats = stats
+		return report
+	}
+
+	reports := []MaintenanceReport{maintain(MaintenanceReport{Database: "auth", Path: AuthDBPath(dbPathPrefix)}, authDB, false)}
+	for _, user := range users {
+		report := MaintenanceReport{Database: user.Username, UserID: user.ID, Path: UserDBPath(dbPathPrefix, user.ID)}
+		if _, err := os.Stat(report.Path); os.IsNotExist(err) {
+			// Not created until the user's first request
+			continue
+		}
+		userDB, err := GetUserDB(user.ID, user.Username)
+		if errors.Is(err, ErrDatabaseLocked) {
+			report.Error = "encrypted; locked until the user logs in"
+			reports = append(reports, report)
+			continue
+		}
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+		reports = append(reports, maintain(report, userDB, true))
+	}
+
+	if len(operations) > 0 {
+		slog.Info("Ran database maintenance", "operations", strings.Join(operations, ","), "databases", len(reports))
+	}
+	return reports, nil
+}
+
+// runMaintenanceOperation runs one operation, returning a summary of what
+// it did. Problems an integrity check finds are returned as its error.
+func runMaintenanceOperation(database *sql.DB, op string, userDB bool) (string, error) {
+	switch op {
+	case MaintenanceIntegrityCheck:
+		return "ok", checkIntegrity(database, userDB)
+
+	case MaintenanceVacuum:
+		unlock := LockForWrite(database)
+		defer unlock()
+		// auto_vacuum only changes on a VACUUM on the same connection. The
+		// pool may only have the one, so everything here goes through it.
+		ctx := context.Background()
+		conn, err := database.Conn(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		var before, after int64
+		if err := conn.QueryRowContext(ctx, "PRAGMA page_count").Scan(&before); err != nil {
+			return "", err
+		}
+		if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return "", err
+		}
+		if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+			return "", err
+		}
+		if err := conn.QueryRowContext(ctx, "PRAGMA page_count").Scan(&after); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d pages, was %d", after, before), nil
+
+	case MaintenanceIncrementalVacuum:
+		var mode int
+		if err := database.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+			return "", err
+		}
+		if mode != 2 {
+			return "", fmt.Errorf("incremental auto-vacuum isn't enabled; run %s once first", MaintenanceVacuum)
+		}
+		unlock := LockForWrite(database)
+		defer unlock()
+		before, err := pageCount(database)
+		if err != nil {
+			return "", err
+		}
+		// Each step of the pragma releases a page, so it's read to the end
+		rows, err := database.Query("PRAGMA incremental_vacuum")
+		if err != nil {
+			return "", err
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		after, err := pageCount(database)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d pages, was %d", after, before), nil
+
+	case MaintenanceCheckpoint:
+		var busy, logFrames, checkpointed int
+		if err := database.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+			return "", err
+		}
+		if logFrames < 0 {
+			return "not in WAL mode", nil
+		}
+		if busy != 0 {
+			return "", fmt.Errorf("blocked by active readers after %d of %d frames; try again later", checkpointed, logFrames)
+		}
+		return fmt.Sprintf("checkpointed %d frames", checkpointed), nil
+
+	case MaintenanceRebuildFTS:
+		unlock := LockForWrite(database)
+		defer unlock()
+		tx, err := database.Begin()
+		if err != nil {
+			return "", err
+		}
+		defer tx.Rollback()
+		var rebuilt []string
+		for _, table := range ftsIndexes {
+			if !tableExists(tx, table) {
+				continue
+			}
+			if _, err := tx.Exec("INSERT INTO " + table + "(" + table + ") VALUES('rebuild')"); err != nil {
+				return "", fmt.Errorf("failed to rebuild %s: %w", table, err)
+			}
+			rebuilt = append(rebuilt, table)
+		}
+		if err := tx.Commit(); err != nil {
+			return "", err
+		}
+		return "rebuilt " + strings.Join(rebuilt, ", "), nil
+
+	case MaintenanceAnalyze:
+		unlock := LockForWrite(database)
+		defer unlock()
+		if _, err := database.Exec("ANALYZE"); err != nil {
+			return "", err
+		}
+		return "ok", nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownMaintenance, op)
+}
+
+// checkIntegrity runs PRAGMA integrity_check and, for a user database,
+// checks each search index still matches the rows it indexes
+func checkIntegrity(database *sql.DB, userDB bool) error {
+	rows, err := database.Query("PRAGMA integrity_check(20)")
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	if !userDB {
+		return nil
+	}
+	// The check is issued as a write, so it queues like one
+	unlock := LockForWrite(database)
+	defer unlock()
+	for _, table := range ftsIndexes {
+		if !tableExists(database, table) {
+			continue
+		}
+		// A rank of 1 also compares the index against its content table
+		if _, err := database.Exec("INSERT INTO " + table + "(" + table + ", rank) VALUES('integrity-check', 1)"); err != nil {
+			return fmt.Errorf("%s doesn't match its content; run %s: %v", table, MaintenanceRebuildFTS, err)
+		}
+	}
+	return nil
+}
+
+// pageCount returns the number of pages in a database
+func pageCount(database *sql.DB) (int64, error) {
+	var pages int64
+	err := database.QueryRow("PRAGMA page_count").Scan(&pages)
+	return pages, err
+}
+
+// databaseStats returns the stats of the database at path
+func databaseStats(path string, database *sql.DB, userDB bool) (*DatabaseStats, error) {
+	stats := &DatabaseStats{}
+	for _, file := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(file); err == nil {
+			stats.FileBytes += info.Size()
+		}
+	}
+	for _, pragma := range []struct {
+		name string
+		dst  *int64
+	}{
+		{"page_size", &stats.PageSize},
+		{"page_count", &stats.Pages},
+		{"freelist_count", &stats.FreePages},
+	} {
+		if err := database.QueryRow("PRAGMA " + pragma.name).Scan(pragma.dst); err != nil {
+			return nil, err
+		}
+	}
+	if !userDB {
+		return stats, nil
+	}
+
+	rows, err := database.Query("SELECT record_type, COUNT(*), COALESCE(SUM(LENGTH(media_data)), 0) FROM messages GROUP BY record_type")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var recordType, count int
+		var mediaBytes int64
+		if err := rows.Scan(&recordType, &count, &mediaBytes); err != nil {
+			return nil, err
+		}
+		switch recordType {
+		case 1:
+			stats.SMS = count
+		case 2:
+			stats.MMS = count
+		case 3:
+			stats.Calls = count
+		}
+		stats.MediaBytes += mediaBytes
+	}
+	return stats, rows.Err()
+}
+
+// HandleDatabaseStats handles GET /api/admin/stats, reporting every
+// database's stats without changing anything
+func HandleDatabaseStats(c echo.Context) error {
+	return runMaintenanceHandler(c, nil)
+}
+
+// HandleMaintenance handles POST /api/admin/maintenance, running the
+// operations in the JSON body's "operations" against every database
+func HandleMaintenance(c echo.Context) error {
+	var req struct {
+		Operations []string `json:"operations"`
+	}
+	if err := c.Bind(&req); err != nil || len(req.Operations) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "operations must list one or more of " + strings.Join(MaintenanceOperations, ", "),
+		})
+	}
+	return runMaintenanceHandler(c, req.Operations)
+}
+
+// runMaintenanceHandler runs operations for the maintenance endpoints
+func runMaintenanceHandler(c echo.Context, operations []string) error {
+	dbPathPrefix := os.Getenv("DB_PATH_PREFIX")
+	if dbPathPrefix == "" {
+		dbPathPrefix = "."
+	}
+	reports, err := RunMaintenance(dbPathPrefix, operations)
+	if errors.Is(err, ErrUnknownMaintenance) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, ErrMaintenanceRunning) {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "Maintenance is already running",
+		})
+	}
+	if err != nil {
+		slog.Error("Error running maintenance", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to run maintenance",
+		})
+	}
+	return c.JSON(http.StatusOK, reports)
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunMaintenance(t *testing.T) {
+	defer func(wal bool) { UseWALMode = wal }(UseWALMode)
+
+	for _, wal := range []bool{true, false} {
+		UseWALMode = wal
+		dir, user := setupEncryptionTest(t)
+		if err := InitUserDB(user.ID, UserDBPath(dir, user.ID)); err != nil {
+			t.Fatalf("Failed to create database: %v", err)
+		}
+		userDB := userDBs[user.ID]
+		for _, msg := range []*Message{
+			{Address: "+15551234567", Body: "hello", Type: 1, Date: time.Now()},
+			{Address: "+15551234567", Body: "photo", Type: 2, Date: time.Now(), MediaType: "image/jpeg", MediaData: make([]byte, 1000)},
+		} {
+			if err := InsertMessage(userDB, msg); err != nil {
+				t.Fatalf("Failed to insert message: %v", err)
+			}
+		}
+		if _, err := userDB.Exec("UPDATE messages SET record_type = 2 WHERE media_type != ''"); err != nil {
+			t.Fatalf("Failed to mark MMS: %v", err)
+		}
+
+		if _, err := RunMaintenance(dir, []string{"defrag"}); !errors.Is(err, ErrUnknownMaintenance) {
+			t.Errorf("Expected ErrUnknownMaintenance, got %v", err)
+		}
+
+		reports, err := RunMaintenance(dir, MaintenanceOperations)
+		if err != nil || len(reports) != 2 {
+			t.Fatalf("Expected reports for the auth and user databases, got %+v (%v)", reports, err)
+		}
+		for _, report := range reports {
+			for _, result := range report.Results {
+				if !result.OK {
+					t.Errorf("wal=%v: expected %s on %s to succeed, got %q", wal, result.Operation, report.Database, result.Detail)
+				}
+			}
+		}
+		stats := reports[1].Stats
+		if stats == nil || stats.SMS != 1 || stats.MMS != 1 || stats.MediaBytes != 1000 || stats.FileBytes == 0 {
+			t.Errorf("Expected 1 SMS, 1 MMS and 1000 media bytes, got %+v", stats)
+		}
+		var autoVacuum int
+		userDB.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum)
+		if autoVacuum != 2 {
+			t.Errorf("Expected vacuum to enable incremental auto-vacuum, got mode %d", autoVacuum)
+		}
+
+		// An index entry without a message, as a crash could leave, fails
+		// the check until the index is rebuilt
+		if _, err := userDB.Exec("INSERT INTO messages_fts(rowid, body, address, contact_name) VALUES(999, 'ghost', '', '')"); err != nil {
+			t.Fatalf("Failed to corrupt index: %v", err)
+		}
+		reports, err = RunMaintenance(dir, []string{MaintenanceIntegrityCheck})
+		if err != nil || reports[1].Results[0].OK {
+			t.Errorf("Expected the integrity check to find the stray index entry, got %+v (%v)", reports, err)
+		}
+		reports, err = RunMaintenance(dir, []string{MaintenanceIntegrityCheck, MaintenanceRebuildFTS})
+		// Results are in MaintenanceOperations order, rebuild first
+		if err != nil || !reports[1].Results[0].OK || !reports[1].Results[1].OK {
+			t.Errorf("Expected the index to be rebuilt, got %+v (%v)", reports, err)
+		}
+		var ghosts int
+		userDB.QueryRow("SELECT COUNT(*) FROM messages_fts WHERE messages_fts MATCH 'ghost'").Scan(&ghosts)
+		if ghosts != 0 {
+			t.Errorf("Expected the stray entry to be gone after rebuilding, got %d", ghosts)
+		}
+		closeTestUserDB(user.ID)
+	}
+}
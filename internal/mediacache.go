@@ -0,0 +1,496 @@
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MediaCache is a persistent, size-capped cache of media converted for
+// browser playback (HEIC->JPEG, 3GP->MP4, AMR->MP3). Without it every
+// /api/media request for such an attachment re-runs the conversion -- for
+// video and audio that's an ffmpeg process per request, so scrolling a media
+// grid could spawn dozens of them at once.
+//
+// Entries are files under dir/<user-id>/<message-id>.<format>, so they
+// survive restarts and can be served straight from a file handle. Entries
+// of users with encrypted databases are encrypted too, and decrypted into
+// memory to serve. The least recently used entries are evicted once the
+// total exceeds maxBytes; recency is tracked via file mtime, which is
+// bumped on every hit so the LRU order is rebuilt correctly on the next
+// startup.
+type MediaCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List               // front = most recently used
+	entries map[string]*list.Element // path -> element holding *mediaCacheEntry
+	size    int64
+
+	// fills serializes conversion per cache path, so concurrent requests
+	// for the same not-yet-cached video run ffmpeg once rather than once
+	// each. An entry is removed once its last waiter is done.
+	fillMu sync.Mutex
+	fills  map[string]*mediaCacheFill
+}
+
+// mediaCacheFill is the lock on converting one cache path, counting the
+// requests holding or waiting for it
+type mediaCacheFill struct {
+	sync.Mutex
+	waiters int
+}
+
+type mediaCacheEntry struct {
+	path string
+	size int64
+}
+
+// mediaCache is the process-wide derived media cache; nil disables caching
+// (conversions then happen in memory per request, as before)
+var mediaCache *MediaCache
+
+// InitMediaCache enables the derived media cache in dir, capped at maxBytes.
+// Existing entries are indexed so the LRU order and size cap carry over
+// across restarts.
+func InitMediaCache(dir string, maxBytes int64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create media cache directory: %w", err)
+	}
+
+	mc := &MediaCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		fills:    make(map[string]*mediaCacheFill),
+	}
+
+	type found struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var existing []found
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// Leftover from a conversion interrupted mid-write
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		existing = append(existing, found{path, info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan media cache directory: %w", err)
+	}
+
+	// Oldest first, so each PushFront leaves the most recent at the front
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.Before(existing[j].modTime)
+	})
+	for _, f := range existing {
+		mc.entries[f.path] = mc.lru.PushFront(&mediaCacheEntry{path: f.path, size: f.size})
+		mc.size += f.size
+	}
+
+	mc.mu.Lock()
+	mc.evictLocked()
+	mc.mu.Unlock()
+
+	mediaCache = mc
+	slog.Info("Media cache initialized", "path", dir, "entries", mc.lru.Len(), "size", mc.size, "max_size", maxBytes)
+	return nil
+}
+
+// path returns where the converted form of messageID in the given format
+// is cached for this user
+func (mc *MediaCache) path(userID, messageID, format string) string {
+	return filepath.Join(mc.dir, userID, messageID+"."+format)
+}
+
+// open returns the cached file at path, marking it most recently used, or
+// nil if it isn't cached
+func (mc *MediaCache) open(path string) *os.File {
+	mc.mu.Lock()
+	elem, ok := mc.entries[path]
+	if ok {
+		mc.lru.MoveToFront(elem)
+	}
+	mc.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		// Removed out from under us (e.g. manually cleared); forget it
+		mc.remove(path)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f
+}
+
+// store writes data to path atomically and accounts for it, evicting least
+// recently used entries if that takes the cache over its cap
+func (mc *MediaCache) store(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if elem, ok := mc.entries[path]; ok {
+		mc.size -= elem.Value.(*mediaCacheEntry).size
+		mc.lru.Remove(elem)
+	}
+	mc.entries[path] = mc.lru.PushFront(&mediaCacheEntry{path: path, size: int64(len(data))})
+	mc.size += int64(len(data))
+	mc.evictLocked()
+	return nil
+}
+
+// remove drops a single entry from the cache
+func (mc *MediaCache) remove(path string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if elem, ok := mc.entries[path]; ok {
+		mc.size -= elem.Value.(*mediaCacheEntry).size
+		mc.lru.Remove(elem)
+		delete(mc.entries, path)
+	}
+	os.Remove(path)
+}
+
+// removeMessages drops every cached form (converted media, thumbnails) of
+// the given messages of a user
+func (mc *MediaCache) removeMessages(userID string, messageIDs []int64) {
+	ids := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		ids[strconv.FormatInt(id, 10)] = true
+	}
+	userDir := filepath.Join(mc.dir, userID)
+
+	mc.mu.Lock()
+	var paths []string
+	for path := range mc.entries {
+		if filepath.Dir(path) != userDir {
+			continue
+		}
+		if id, _, _ := strings.Cut(filepath.Base(path), "."); ids[id] {
+			paths = append(paths, path)
+		}
+	}
+	mc.mu.Unlock()
+
+	for _, path := range paths {
+		mc.remove(path)
+	}
+}
+
+// removeUser drops every cached entry of a user
+func (mc *MediaCache) removeUser(userID string) {
+	userDir := filepath.Join(mc.dir, userID)
+
+	mc.mu.Lock()
+	var paths []string
+	for path := range mc.entries {
+		if filepath.Dir(path) == userDir {
+			paths = append(paths, path)
+		}
+	}
+	mc.mu.Unlock()
+
+	for _, path := range paths {
+		mc.remove(path)
+	}
+}
+
+// evictLocked removes least recently used entries until the cache fits
+// within maxBytes. Callers must hold mc.mu.
+func (mc *MediaCache) evictLocked() {
+	for mc.size > mc.maxBytes && mc.lru.Len() > 0 {
+		elem := mc.lru.Back()
+		entry := elem.Value.(*mediaCacheEntry)
+		if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to evict media cache entry", "path", entry.path, "error", err)
+		}
+		mc.size -= entry.size
+		mc.lru.Remove(elem)
+		delete(mc.entries, entry.path)
+	}
+}
+
+// convertedMediaFormat returns the format (file extension) and content type
+// a media type is converted to for browser playback, or "" if it's served
+// as-is. forceTranscode re-encodes any video to MP4 (see HandleMedia's
+// transcode=true).
+func convertedMediaFormat(mediaType string, forceTranscode bool) (string, string) {
+	switch {
+	case isHEICContentType(mediaType):
+		return "jpg", "image/jpeg"
+	case needsVideoConversion(mediaType):
+		return "mp4", "video/mp4"
+	case forceTranscode && strings.HasPrefix(mediaType, "video/"):
+		return "mp4", "video/mp4"
+	case needsAudioConversion(mediaType):
+		return "mp3", "audio/mpeg"
+	}
+	return "", ""
+}
+
+// convertMessageMedia loads and converts a message's media. browserMedia
+// already re-encodes formats browsers can't play (3GP and friends);
+// forceTranscode additionally re-encodes video it passes through unchanged,
+// e.g. an MP4 whose codec the browser turns out not to support. converted
+// is false when the media was passed through or a conversion failed and
+// fell back to the original.
+func convertMessageMedia(store MessageStore, messageID, mediaType string, forceTranscode bool) (media []byte, contentType string, converted bool, err error) {
+	stored, storedType, err := store.GetMedia(messageID)
+	if err != nil {
+		return nil, "", false, err
+	}
+	media, contentType = browserMedia(messageID, stored, storedType)
+
+	if forceTranscode && strings.HasPrefix(mediaType, "video/") && !needsVideoConversion(mediaType) {
+		slog.Info("Transcode requested for video", "messageID", messageID, "contentType", contentType)
+		convertedData, err := convertVideoToMP4(media)
+		if err != nil {
+			slog.Error("Failed to transcode video", "messageID", messageID, "error", err)
+			// Continue with original video if conversion fails
+			return media, contentType, false, nil
+		}
+		slog.Info("Successfully transcoded video", "messageID", messageID)
+		return convertedData, "video/mp4", true, nil
+	}
+
+	return media, contentType, contentType != mediaType, nil
+}
+
+// nopSeekCloser adapts an in-memory reader to io.ReadSeekCloser
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// fetch returns the cached file at path, or calls produce to create it.
+// Concurrent callers for the same path wait for a single produce call
+// rather than each running their own conversion. produce's data is cached
+// only when it reports cacheable; either way it's returned to the caller.
+// With key set (see userMediaKey), the entry is stored encrypted under it.
+func (mc *MediaCache) fetch(path string, key []byte, produce func() (data []byte, cacheable bool, err error)) (io.ReadSeekCloser, error) {
+	if r := mc.read(path, key); r != nil {
+		return r, nil
+	}
+
+	fill := mc.lockFill(path)
+	defer mc.unlockFill(path, fill)
+
+	// Another request may have finished converting while we waited
+	if r := mc.read(path, key); r != nil {
+		return r, nil
+	}
+
+	data, cacheable, err := produce()
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		stored := data
+		if key != nil {
+			stored, err = sealMedia(key, data)
+		}
+		if err == nil {
+			err = mc.store(path, stored)
+		}
+		if err != nil {
+			slog.Warn("Failed to cache converted media", "path", path, "error", err)
+		}
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+// lockFill takes the conversion lock for path, waiting for a request
+// already converting it
+func (mc *MediaCache) lockFill(path string) *mediaCacheFill {
+	mc.fillMu.Lock()
+	fill := mc.fills[path]
+	if fill == nil {
+		fill = &mediaCacheFill{}
+		mc.fills[path] = fill
+	}
+	fill.waiters++
+	mc.fillMu.Unlock()
+
+	fill.Lock()
+	return fill
+}
+
+// unlockFill releases a lock from lockFill, forgetting it if no other
+// request is waiting for it
+func (mc *MediaCache) unlockFill(path string, fill *mediaCacheFill) {
+	fill.Unlock()
+	mc.fillMu.Lock()
+	fill.waiters--
+	if fill.waiters == 0 {
+		delete(mc.fills, path)
+	}
+	mc.fillMu.Unlock()
+}
+
+// read returns the cached entry at path, or nil if it isn't cached. An
+// entry encrypted under key is decrypted into memory; one that doesn't
+// decrypt, e.g. cached before the user's database was encrypted, is
+// dropped.
+func (mc *MediaCache) read(path string, key []byte) io.ReadSeekCloser {
+	f := mc.open(path)
+	if f == nil {
+		return nil
+	}
+	if key == nil {
+		return f
+	}
+	sealed, err := io.ReadAll(f)
+	f.Close()
+	if err == nil {
+		if data, err := openMedia(key, sealed); err == nil {
+			return nopSeekCloser{bytes.NewReader(data)}
+		}
+	}
+	mc.remove(path)
+	return nil
+}
+
+// OpenConvertedMedia returns a message's media converted for browser
+// playback along with its content type, serving from the derived media
+// cache when possible and populating it otherwise. The caller must close
+// the returned reader.
+//
+// Results of a failed conversion (browserMedia falls back to the
+// original) and HEIC placeholders from builds without libheif are served but
+// not cached, so they get retried once the cause is fixed.
+func OpenConvertedMedia(userID string, store MessageStore, messageID, mediaType string, forceTranscode bool) (io.ReadSeekCloser, string, error) {
+	format, convertedType := convertedMediaFormat(mediaType, forceTranscode)
+	cacheable := mediaCache != nil && format != "" && (heicSupported || !isHEICContentType(mediaType))
+
+	if !cacheable {
+		media, contentType, _, err := convertMessageMedia(store, messageID, mediaType, forceTranscode)
+		if err != nil {
+			return nil, "", err
+		}
+		return nopSeekCloser{bytes.NewReader(media)}, contentType, nil
+	}
+
+	// A failed conversion falls back to the original media, so the content
+	// type actually produced is only known once produce has run
+	contentType := convertedType
+	f, err := mediaCache.fetch(mediaCache.path(userID, messageID, format), userMediaKey(userID), func() ([]byte, bool, error) {
+		media, producedType, converted, err := convertMessageMedia(store, messageID, mediaType, forceTranscode)
+		contentType = producedType
+		return media, converted, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return f, contentType, nil
+}
+
+// PretranscodeMedia converts and caches every attachment in a user's
+// database that needs conversion, so the first view of each doesn't wait on
+// ffmpeg. Already-cached entries are skipped. Runs sequentially to keep at
+// most one ffmpeg process busy; meant to be started in the background after
+// an import when MEDIA_PRETRANSCODE=true.
+func PretranscodeMedia(userID string, userDB *sql.DB) {
+	if mediaCache == nil {
+		return
+	}
+
+	rows, err := userDB.Query(`
+		SELECT id, media_type
+		FROM messages
+		WHERE record_type IN (1, 2) AND media_type IS NOT NULL AND media_type != ''
+	`)
+	if err != nil {
+		slog.Error("Pre-transcode: failed to list media", "userID", userID, "error", err)
+		return
+	}
+
+	type pending struct {
+		id        string
+		mediaType string
+	}
+	var todo []pending
+	for rows.Next() {
+		var id int64
+		var mediaType string
+		if err := rows.Scan(&id, &mediaType); err != nil {
+			rows.Close()
+			slog.Error("Pre-transcode: failed to scan media", "userID", userID, "error", err)
+			return
+		}
+		if format, _ := convertedMediaFormat(mediaType, false); format != "" {
+			todo = append(todo, pending{fmt.Sprintf("%d", id), mediaType})
+		}
+	}
+	rows.Close()
+
+	if len(todo) == 0 {
+		return
+	}
+
+	slog.Info("Pre-transcode: starting", "userID", userID, "count", len(todo))
+	store := NewSQLiteStore(userDB)
+	start := time.Now()
+	converted := 0
+	for _, p := range todo {
+		f, _, err := OpenConvertedMedia(userID, store, p.id, p.mediaType, false)
+		if err != nil {
+			slog.Warn("Pre-transcode: failed to convert media", "userID", userID, "messageID", p.id, "error", err)
+			continue
+		}
+		f.Close()
+		converted++
+	}
+	slog.Info("Pre-transcode: completed", "userID", userID, "converted", converted, "duration", time.Since(start))
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMediaCacheLRUEviction(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { mediaCache = nil }()
+
+	if err := InitMediaCache(dir, 25); err != nil {
+		t.Fatalf("Failed to initialize media cache: %v", err)
+	}
+	mc := mediaCache
+
+	a := mc.path("user", "1", "jpg")
+	b := mc.path("user", "2", "jpg")
+	c := mc.path("user", "3", "jpg")
+
+	for _, p := range []string{a, b} {
+		if err := mc.store(p, make([]byte, 10)); err != nil {
+			t.Fatalf("Failed to store %s: %v", p, err)
+		}
+	}
+
+	// Touch a so b becomes the least recently used entry
+	f := mc.open(a)
+	if f == nil {
+		t.Fatal("Expected cache hit for first entry")
+	}
+	f.Close()
+
+	if err := mc.store(c, make([]byte, 10)); err != nil {
+		t.Fatalf("Failed to store third entry: %v", err)
+	}
+
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	for _, p := range []string{a, c} {
+		if f := mc.open(p); f == nil {
+			t.Errorf("Expected %s to still be cached", p)
+		} else {
+			f.Close()
+		}
+	}
+	if mc.size != 20 {
+		t.Errorf("Expected cache size 20, got %d", mc.size)
+	}
+
+	// Reopening the directory should pick up the surviving entries, and a
+	// smaller cap should evict the older one
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(a, old, old)
+	if err := InitMediaCache(dir, 15); err != nil {
+		t.Fatalf("Failed to reinitialize media cache: %v", err)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("Expected oldest entry to be evicted on reinitialization")
+	}
+	if f := mediaCache.open(c); f == nil {
+		t.Errorf("Expected newest entry to survive reinitialization")
+	} else {
+		f.Close()
+	}
+}
+
+func TestMediaCacheFetchSharesFill(t *testing.T) {
+	defer func() { mediaCache = nil }()
+	if err := InitMediaCache(t.TempDir(), 1<<20); err != nil {
+		t.Fatalf("Failed to initialize media cache: %v", err)
+	}
+	mc := mediaCache
+	p := mc.path("user", "1", "mp4")
+
+	var produced atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := mc.fetch(p, nil, func() ([]byte, bool, error) {
+				produced.Add(1)
+				<-release
+				return []byte("video"), true, nil
+			})
+			if err != nil {
+				t.Errorf("fetch failed: %v", err)
+				return
+			}
+			r.Close()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := produced.Load(); n != 1 {
+		t.Errorf("Expected one conversion, got %d", n)
+	}
+	if len(mc.fills) != 0 {
+		t.Errorf("Expected fill locks to be released, got %d", len(mc.fills))
+	}
+}
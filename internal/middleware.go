@@ -3,6 +3,8 @@ package internal
 
 import (
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 )
@@ -26,6 +28,15 @@ func AuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			})
 		}
 
+		// A database encrypted under the user's password can't be opened
+		// until they log in again after a restart
+		if DatabaseLocked(session.UserID) {
+			DeleteSession(cookie.Value)
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"error": "Unauthorized: Log in again to unlock your data",
+			})
+		}
+
 		// Store session in context for use by handlers
 		c.Set("session", session)
 		c.Set("user_id", session.UserID)
@@ -35,6 +46,31 @@ func AuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// IsAdmin reports whether username is one of the comma-separated
+// usernames in ADMIN_USERS
+func IsAdmin(username string) bool {
+	for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminMiddleware restricts a route to admins (see IsAdmin). It must run
+// after AuthMiddleware.
+func AdminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username, _ := c.Get("username").(string)
+		if !IsAdmin(username) {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "Forbidden: Admin access required",
+			})
+		}
+		return next(c)
+	}
+}
+
 // NoCacheMiddleware adds cache control headers to prevent browser caching
 // This ensures that dynamic API responses are always fetched fresh from the server
 func NoCacheMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
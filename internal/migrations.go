@@ -0,0 +1,666 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// migration is one step of a database's schema history. A database records
+// how many steps it has had in PRAGMA user_version, and each pending step
+// runs in its own transaction along with the version bump, so a failed
+// step leaves the database at the previous version.
+//
+// Append new steps to the end of a list; never edit or reorder ones that
+// have shipped.
+type migration struct {
+	name  string
+	apply func(tx *sql.Tx) error
+}
+
+// ErrSchemaTooNew is returned when a database has had more migrations than
+// this build knows, i.e. it was last opened by a newer version of sbv
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of sbv")
+
+// execMigration is a migration step that runs fixed SQL
+func execMigration(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// schemaVersion returns the number of migrations a database has had
+func schemaVersion(database dbQueryer) (int, error) {
+	var version int
+	err := database.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// runMigrations applies the migrations a database hasn't had yet, returning
+// its version before and after
+func runMigrations(database *sql.DB, migrations []migration) (from, to int, err error) {
+	unlock := LockForWrite(database)
+	defer unlock()
+
+	from, err = schemaVersion(database)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if from > len(migrations) {
+		return from, from, fmt.Errorf("%w (version %d, expected at most %d)", ErrSchemaTooNew, from, len(migrations))
+	}
+
+	for version := from; version < len(migrations); version++ {
+		m := migrations[version]
+		start := time.Now()
+		tx, err := database.Begin()
+		if err != nil {
+			return from, version, err
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return from, version, fmt.Errorf("migration %d (%s) failed: %w", version+1, m.name, err)
+		}
+		// PRAGMA doesn't take bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return from, version, err
+		}
+		if err := tx.Commit(); err != nil {
+			return from, version, err
+		}
+		slog.Info("Applied database migration", "version", version+1, "name", m.name, "duration", time.Since(start))
+	}
+	return from, len(migrations), nil
+}
+
+// userDBMigrations is the schema history of per-user message databases
+var userDBMigrations = []migration{
+	{"initial schema", migrateUserDBInitial},
+	{"normalized dedup keys", migrateDedupKeys},
+	{"millisecond dates", migrateMillisecondDates},
+	{"backup fields", migrateBackupFields},
+}
+
+// authDBMigrations is the schema history of the shared auth database
+var authDBMigrations = []migration{
+	{"initial schema", execMigration(authDBInitialSchema)},
+	{"user data keys", execMigration(`
+		-- Sealed data keys of users with encrypted databases (see
+		-- encryption.go). A user normally has one; re-encrypting adds the
+		-- new key before removing the old.
+		CREATE TABLE user_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			salt BLOB NOT NULL,
+			password_key BLOB,
+			escrow_key BLOB,
+			created_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_user_keys_user_id ON user_keys(user_id);
+	`)},
+}
+
+// migrateUserDBInitial creates the schema as it stood when versioning was
+// introduced. Unversioned databases from any earlier release get whatever
+// tables they're missing, with derived indexes backfilled from their
+// messages.
+func migrateUserDBInitial(tx *sql.Tx) error {
+	missing := missingDerivedIndexes(tx)
+	if _, err := tx.Exec(userDBInitialSchema); err != nil {
+		return err
+	}
+	return backfillDerivedIndexes(tx, missing)
+}
+
+// migrateDedupKeys adds dedup_key, a hash of a message's conversation,
+// direction, sender, second, whitespace-normalized body and attachment for
+// DedupNormalized (see dedupKey), and fills it in for existing SMS and MMS
+// messages. Calls don't have one. Tombstones get the column too, so a
+// normalized import skips copies of deleted messages; existing ones don't
+// have a key, as their messages are gone. Databases rolled back to an
+// earlier version may already have the columns.
+func migrateDedupKeys(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "messages", "dedup_key", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "tombstones", "dedup_key", "TEXT"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE messages SET dedup_key = message_dedup_key(address, type, COALESCE(sender, ''), date, COALESCE(body, ''), COALESCE(media_data, X''))
+		WHERE record_type IN (1, 2) AND dedup_key IS NULL;
+		CREATE INDEX IF NOT EXISTS idx_messages_dedup_key ON messages(dedup_key);
+		CREATE INDEX IF NOT EXISTS idx_tombstones_dedup_key ON tombstones(dedup_key);
+	`)
+	return err
+}
+
+// migrateMillisecondDates adds date_ms, the full-precision date that
+// messages and calls are ordered by, and date_sent, when a received message
+// was sent, both in Unix milliseconds. date stays in seconds for date-range
+// filters and per-day grouping. Existing rows were imported with whole
+// seconds, so they get date_ms = date * 1000, and a later import of the
+// same backup fills in their milliseconds (see completeEarlierImport).
+// idx_message_unique moves to date_ms so distinct messages sent within the
+// same second are no longer taken for duplicates. messages_au is narrowed
+// to the columns messages_fts holds first, so the backfill doesn't rewrite
+// the search index.
+func migrateMillisecondDates(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "messages", "date_ms", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "messages", "date_sent", "INTEGER"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		DROP TRIGGER IF EXISTS messages_au;
+		CREATE TRIGGER messages_au AFTER UPDATE OF address, body, contact_name, date ON messages BEGIN
+			INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
+			VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
+			INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
+			VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
+		END;
+
+		UPDATE messages SET date_ms = date * 1000 WHERE date_ms = 0;
+
+		DROP INDEX IF EXISTS idx_message_unique;
+		CREATE UNIQUE INDEX idx_message_unique ON messages(record_type, address, date_ms, type, COALESCE(body, ''), COALESCE(content_type, ''), COALESCE(message_id, ''), COALESCE(duration, 0));
+
+		CREATE INDEX IF NOT EXISTS idx_date_ms ON messages(date_ms);
+		CREATE INDEX IF NOT EXISTS idx_address_date_ms ON messages(address, date_ms);
+		DROP INDEX IF EXISTS idx_media_date;
+		CREATE INDEX IF NOT EXISTS idx_media_date_ms ON messages(date_ms, media_type) WHERE media_type != '';
+	`)
+	return err
+}
+
+// migrateBackupFields adds columns for the backup attributes that earlier
+// versions dropped: locked, seen, creator, and MMS priority, delivery
+// report and addresses with their roles (recipients, JSON), and call
+// post-dial digits, features and phone account. extra holds the rest of
+// each row's attributes as a JSON object. Imports always set extra, so a
+// NULL marks a row imported before this migration, which re-importing the
+// backup fills in (see completeEarlierImport). message_parts keeps every
+// part of an MMS, where messages only hold the first attachment.
+func migrateBackupFields(tx *sql.Tx) error {
+	for _, column := range []struct{ name, definition string }{
+		{"locked", "INTEGER"},
+		{"seen", "INTEGER"},
+		{"creator", "TEXT"},
+		{"priority", "INTEGER"},
+		{"delivery_report", "INTEGER"},
+		{"recipients", "TEXT"},
+		{"post_dial_digits", "TEXT"},
+		{"features", "INTEGER"},
+		{"phone_account_id", "TEXT"},
+		{"extra", "TEXT"},
+	} {
+		if err := addColumnIfMissing(tx, "messages", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`
+		-- Each <part> of an MMS as written (see MessagePart): its attributes
+		-- but data as JSON, and its decoded data, unless that's the message's
+		-- media_data (media = 1)
+		CREATE TABLE IF NOT EXISTS message_parts (
+			message_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			attributes TEXT NOT NULL,
+			data BLOB,
+			media INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (message_id, position)
+		);
+
+		CREATE TRIGGER IF NOT EXISTS message_parts_ad AFTER DELETE ON messages BEGIN
+			DELETE FROM message_parts WHERE message_id = old.id;
+		END;
+	`)
+	return err
+}
+
+// addColumnIfMissing adds a column to a table unless it's already there, as
+// it may be in databases rolled back to an earlier version
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	var exists bool
+	if err := tx.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// userDBInitialSchema is the per-user schema of migration 1. It's all IF NOT
+// EXISTS, since unversioned databases may have any subset of it.
+var userDBInitialSchema = `
+	-- Unified table for SMS messages, MMS messages, and call logs
+	-- record_type: 1 = SMS, 2 = MMS, 3 = call
+	CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		record_type INTEGER NOT NULL DEFAULT 1,
+		address TEXT NOT NULL,
+		body TEXT,
+		type INTEGER NOT NULL,
+		date INTEGER NOT NULL,
+		read INTEGER DEFAULT 0,
+		thread_id INTEGER,
+		subject TEXT,
+		media_type TEXT,
+		media_data BLOB,
+		protocol INTEGER,
+		status INTEGER,
+		service_center TEXT,
+		sub_id INTEGER,
+		contact_name TEXT,
+		sender TEXT,
+		content_type TEXT,
+		read_report INTEGER,
+		read_status INTEGER,
+		message_id TEXT,
+		message_size INTEGER,
+		message_type INTEGER,
+		sim_slot INTEGER,
+		addresses TEXT,
+		duration INTEGER,
+		presentation INTEGER,
+		subscription_id TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_address ON messages(address);
+	CREATE INDEX IF NOT EXISTS idx_date ON messages(date);
+	CREATE INDEX IF NOT EXISTS idx_thread ON messages(thread_id);
+	CREATE INDEX IF NOT EXISTS idx_record_type ON messages(record_type);
+	CREATE INDEX IF NOT EXISTS idx_record_type_date ON messages(record_type, date);
+	CREATE INDEX IF NOT EXISTS idx_address_date ON messages(address, date);
+
+	-- Create unique constraints for idempotent imports
+	-- record_type differentiates SMS (1), MMS (2), and calls (3)
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_message_unique ON messages(record_type, address, date, type, COALESCE(body, ''), COALESCE(content_type, ''), COALESCE(message_id, ''), COALESCE(duration, 0));
+
+	-- Create FTS5 virtual table for full-text search of messages
+	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+		message_id UNINDEXED,
+		address UNINDEXED,
+		body,
+		contact_name UNINDEXED,
+		date UNINDEXED,
+		content='messages',
+		content_rowid='id'
+	);
+
+	-- Create triggers to keep FTS table in sync
+	CREATE TRIGGER IF NOT EXISTS messages_ai AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
+		VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_ad AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
+		VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
+		VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
+		INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
+		VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
+	END;
+
+	-- Newest-first media browsing across all conversations (see GetGallery).
+	-- Partial, so it only holds rows that actually have an attachment.
+	CREATE INDEX IF NOT EXISTS idx_media_date ON messages(date, media_type) WHERE media_type != '';
+
+	-- Attachment metadata that's expensive to derive from the blob itself
+	-- (image dimensions, video/audio duration), filled in at import for
+	-- images and by a background pass for everything else
+	CREATE TABLE IF NOT EXISTS media_meta (
+		message_id INTEGER PRIMARY KEY,
+		width INTEGER,
+		height INTEGER,
+		duration_ms INTEGER
+	);
+
+	CREATE TRIGGER IF NOT EXISTS media_meta_ad AFTER DELETE ON messages BEGIN
+		DELETE FROM media_meta WHERE message_id = old.id;
+	END;
+
+	-- Original filename of each attachment from the MMS part (name or cl),
+	-- used to name files in media archives
+	CREATE TABLE IF NOT EXISTS media_names (
+		message_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL
+	);
+
+	CREATE TRIGGER IF NOT EXISTS media_names_ad AFTER DELETE ON messages BEGIN
+		DELETE FROM media_names WHERE message_id = old.id;
+	END;
+
+	-- Trigram index over message bodies for substring and fuzzy search
+	-- (see SearchMessages). Case- and diacritic-insensitive, and works for
+	-- CJK text that unicode61 can't split into words. Existing databases get
+	-- it populated by backfillDerivedIndexes when migrated.
+	CREATE VIRTUAL TABLE IF NOT EXISTS messages_trigram USING fts5(
+		body,
+		content='messages',
+		content_rowid='id',
+		tokenize='trigram remove_diacritics 1'
+	);
+
+	CREATE TRIGGER IF NOT EXISTS messages_trigram_ai AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_trigram(rowid, body) VALUES (new.id, new.body);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_trigram_ad AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_trigram(messages_trigram, rowid, body) VALUES('delete', old.id, old.body);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_trigram_au AFTER UPDATE OF body ON messages BEGIN
+		INSERT INTO messages_trigram(messages_trigram, rowid, body) VALUES('delete', old.id, old.body);
+		INSERT INTO messages_trigram(rowid, body) VALUES (new.id, new.body);
+	END;
+
+	-- Names a conversation can be found by, one row per distinct value: the
+	-- address itself (without formatting), the contact name and, for group
+	-- conversations, the group name (MMS subject). Filled by
+	-- messages_names_ai; see GetSearchHits. Rows aren't removed when
+	-- messages are, so lookups join back to messages.
+	CREATE TABLE IF NOT EXISTS search_names (
+		address TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		UNIQUE(address, kind, name)
+	);
+
+	CREATE VIRTUAL TABLE IF NOT EXISTS search_names_fts USING fts5(
+		name,
+		content='search_names',
+		tokenize='trigram remove_diacritics 1'
+	);
+
+	CREATE TRIGGER IF NOT EXISTS search_names_ai AFTER INSERT ON search_names BEGIN
+		INSERT INTO search_names_fts(rowid, name) VALUES (new.rowid, new.name);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS search_names_ad AFTER DELETE ON search_names BEGIN
+		INSERT INTO search_names_fts(search_names_fts, rowid, name) VALUES('delete', old.rowid, old.name);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_names_ai AFTER INSERT ON messages BEGIN
+		INSERT OR IGNORE INTO search_names(address, kind, name)
+		SELECT new.address, 'number', REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(new.address, ' ', ''), '-', ''), '(', ''), ')', ''), '.', '');
+		INSERT OR IGNORE INTO search_names(address, kind, name)
+		SELECT new.address, 'contact', new.contact_name
+		WHERE COALESCE(new.contact_name, '') NOT IN ('', '(Unknown)');
+		INSERT OR IGNORE INTO search_names(address, kind, name)
+		SELECT new.address, 'group', new.subject
+		WHERE COALESCE(new.subject, '') != '' AND new.address LIKE '%,%';
+	END;
+
+	-- Starred messages with an optional note. Message IDs survive
+	-- re-imports, since the unique index skips duplicates rather than
+	-- replacing them.
+	CREATE TABLE IF NOT EXISTS bookmarks (
+		message_id INTEGER PRIMARY KEY,
+		note TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TRIGGER IF NOT EXISTS bookmarks_ad AFTER DELETE ON messages BEGIN
+		DELETE FROM bookmarks WHERE message_id = old.id;
+	END;
+
+	-- User-defined labels, applied to individual messages and to whole
+	-- conversations (by address). See tags.go.
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		color TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS message_tags (
+		tag_id INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		PRIMARY KEY (tag_id, message_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_message_tags_message ON message_tags(message_id);
+
+	CREATE TABLE IF NOT EXISTS conversation_tags (
+		tag_id INTEGER NOT NULL,
+		address TEXT NOT NULL,
+		PRIMARY KEY (tag_id, address)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_conversation_tags_address ON conversation_tags(address);
+
+	CREATE TRIGGER IF NOT EXISTS tags_ad AFTER DELETE ON tags BEGIN
+		DELETE FROM message_tags WHERE tag_id = old.id;
+		DELETE FROM conversation_tags WHERE tag_id = old.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS message_tags_ad AFTER DELETE ON messages BEGIN
+		DELETE FROM message_tags WHERE message_id = old.id;
+	END;
+
+	-- Per-conversation list state. Rows are kept by address, so they outlive
+	-- deleting and re-importing a conversation's messages.
+	CREATE TABLE IF NOT EXISTS conversation_state (
+		address TEXT PRIMARY KEY,
+		pinned INTEGER NOT NULL DEFAULT 0,
+		archived INTEGER NOT NULL DEFAULT 0,
+		hidden INTEGER NOT NULL DEFAULT 0,
+		muted INTEGER NOT NULL DEFAULT 0, -- excluded from analytics on request
+		updated_at INTEGER NOT NULL
+	);
+
+	-- Per-address counts used to classify automated senders (see
+	-- senders.go): SMS/MMS messages, how many the user sent, and how many
+	-- bodies look machine-generated
+	CREATE TABLE IF NOT EXISTS sender_stats (
+		address TEXT PRIMARY KEY,
+		messages INTEGER NOT NULL DEFAULT 0,
+		sent INTEGER NOT NULL DEFAULT 0,
+		templated INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TRIGGER IF NOT EXISTS messages_sender_ai AFTER INSERT ON messages WHEN new.record_type IN (1, 2) BEGIN
+		INSERT INTO sender_stats(address, messages, sent, templated)
+		VALUES (new.address, 1, new.type = 2, ` + templatedBody("new.body") + `)
+		ON CONFLICT(address) DO UPDATE SET
+			messages = messages + 1, sent = sent + excluded.sent, templated = templated + excluded.templated;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_sender_ad AFTER DELETE ON messages WHEN old.record_type IN (1, 2) BEGIN
+		UPDATE sender_stats SET
+			messages = messages - 1, sent = sent - (old.type = 2), templated = templated - ` + templatedBody("old.body") + `
+		WHERE address = old.address;
+	END;
+
+	-- Deleted messages, recorded on request so re-importing an old backup
+	-- doesn't bring them back. key hashes the columns idx_message_unique
+	-- deduplicates on (see tombstoneKeyExpr); the message itself isn't kept.
+	CREATE TABLE IF NOT EXISTS tombstones (
+		key TEXT PRIMARY KEY,
+		record_type INTEGER NOT NULL,
+		address TEXT NOT NULL,
+		date INTEGER NOT NULL,
+		deleted_at INTEGER NOT NULL
+	);
+
+	CREATE TRIGGER IF NOT EXISTS messages_tombstone_bi BEFORE INSERT ON messages
+	WHEN EXISTS (SELECT 1 FROM tombstones)
+		AND EXISTS (SELECT 1 FROM tombstones WHERE key = ` + tombstoneKeyExpr("new.") + `)
+	BEGIN
+		SELECT RAISE(IGNORE);
+	END;
+`
+
+// authDBInitialSchema is the auth schema of migration 1
+const authDBInitialSchema = `
+	CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		user_id TEXT PRIMARY KEY,
+		settings_json TEXT NOT NULL DEFAULT '{}',
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS saved_searches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL,
+		mode TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		last_import_at INTEGER,
+		last_import_matches INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+	CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_saved_searches_user_id ON saved_searches(user_id);
+`
+
+// AuthDBPath returns where the auth database lives under dbPathPrefix
+func AuthDBPath(dbPathPrefix string) string {
+	return filepath.Join(dbPathPrefix, "sbv.db")
+}
+
+// UserDBPath returns where a user's message database lives under
+// dbPathPrefix. Files are named by user ID rather than username.
+func UserDBPath(dbPathPrefix, userID string) string {
+	return filepath.Join(dbPathPrefix, "sbv_"+userID+".db")
+}
+
+// SchemaStatus is the schema version of one database file
+type SchemaStatus struct {
+	Path    string
+	Version int // migrations applied (before migrating, from MigrateDatabases)
+	Latest  int // migrations this build has
+	// Encrypted databases can't be read without their user's key, so
+	// their version is unknown; they're migrated when next opened
+	Encrypted bool
+}
+
+// databaseFiles lists the auth database and every user database under
+// dbPathPrefix, with the migrations each takes. User databases are found
+// by filename, so ones whose user has been removed are included.
+func databaseFiles(dbPathPrefix string) ([]string, map[string][]migration, error) {
+	userFiles, err := filepath.Glob(filepath.Join(dbPathPrefix, "sbv_*.db"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(userFiles)
+
+	var paths []string
+	migrations := make(map[string][]migration)
+	if _, err := os.Stat(AuthDBPath(dbPathPrefix)); err == nil {
+		paths = append(paths, AuthDBPath(dbPathPrefix))
+		migrations[AuthDBPath(dbPathPrefix)] = authDBMigrations
+	}
+	for _, path := range userFiles {
+		paths = append(paths, path)
+		migrations[path] = userDBMigrations
+	}
+	return paths, migrations, nil
+}
+
+// GetSchemaStatus reports the schema version of every database under
+// dbPathPrefix without changing any of them
+func GetSchemaStatus(dbPathPrefix string) ([]SchemaStatus, error) {
+	paths, migrations, err := databaseFiles(dbPathPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []SchemaStatus
+	for _, path := range paths {
+		if encrypted, err := isEncryptedDatabase(path); err != nil || encrypted {
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			statuses = append(statuses, SchemaStatus{Path: path, Latest: len(migrations[path]), Encrypted: true})
+			continue
+		}
+		database, err := sql.Open(sqliteDriver, "file:"+path+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		version, err := schemaVersion(database)
+		database.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		statuses = append(statuses, SchemaStatus{Path: path, Version: version, Latest: len(migrations[path])})
+	}
+	return statuses, nil
+}
+
+// MigrateDatabases brings every database under dbPathPrefix up to date,
+// returning each one's status from before. Databases are otherwise migrated
+// when first opened; this does it up front, e.g. before starting a new
+// version. Encrypted databases are skipped. It stops at the first failure.
+func MigrateDatabases(dbPathPrefix string) ([]SchemaStatus, error) {
+	paths, migrations, err := databaseFiles(dbPathPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []SchemaStatus
+	for _, path := range paths {
+		if encrypted, err := isEncryptedDatabase(path); err != nil || encrypted {
+			if err != nil {
+				return statuses, fmt.Errorf("%s: %w", path, err)
+			}
+			statuses = append(statuses, SchemaStatus{Path: path, Latest: len(migrations[path]), Encrypted: true})
+			continue
+		}
+		from, err := migrateDatabaseFile(path, migrations[path])
+		if err != nil {
+			return statuses, fmt.Errorf("%s: %w", path, err)
+		}
+		statuses = append(statuses, SchemaStatus{Path: path, Version: from, Latest: len(migrations[path])})
+	}
+	return statuses, nil
+}
+
+// migrateDatabaseFile opens a database just to migrate it, returning its
+// version from before
+func migrateDatabaseFile(path string, migrations []migration) (int, error) {
+	database, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return 0, err
+	}
+	defer database.Close()
+	if _, err := database.Exec("PRAGMA busy_timeout=5000;"); err != nil {
+		return 0, fmt.Errorf("failed to set busy timeout: %w", err)
+	}
+	from, _, err := runMigrations(database, migrations)
+	return from, err
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrateBaselineUserDB(t *testing.T) {
+	dir := t.TempDir()
+	path := UserDBPath(dir, "fixture")
+
+	fixture, err := os.ReadFile("testdata/baseline_user_db.sql")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	database, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		t.Fatalf("Failed to create fixture database: %v", err)
+	}
+	if _, err := database.Exec(string(fixture)); err != nil {
+		t.Fatalf("Failed to load fixture: %v", err)
+	}
+	database.Close()
+
+	statuses, err := GetSchemaStatus(dir)
+	if err != nil || len(statuses) != 1 || statuses[0].Version != 0 || statuses[0].Latest != len(userDBMigrations) {
+		t.Fatalf("Expected one unversioned user database, got %+v (%v)", statuses, err)
+	}
+
+	statuses, err = MigrateDatabases(dir)
+	if err != nil || len(statuses) != 1 || statuses[0].Version != 0 {
+		t.Fatalf("Expected the fixture migrated from version 0, got %+v (%v)", statuses, err)
+	}
+
+	database, err = sql.Open(sqliteDriver, path)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer database.Close()
+
+	if version, err := schemaVersion(database); err != nil || version != len(userDBMigrations) {
+		t.Errorf("Expected version %d, got %d (%v)", len(userDBMigrations), version, err)
+	}
+	for _, table := range []string{"media_meta", "messages_trigram", "search_names", "bookmarks", "tags", "conversation_state", "sender_stats", "tombstones"} {
+		if !tableExists(database, table) {
+			t.Errorf("Expected migration to create %s", table)
+		}
+	}
+	var count int
+	database.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count)
+	if count != 5 {
+		t.Errorf("Expected the fixture's 5 rows to survive, got %d", count)
+	}
+
+	// Derived indexes are backfilled from the existing messages
+	page, err := SearchMessages(database, SearchOptions{Query: "afe", Mode: SearchModeSubstring})
+	if err != nil || page.Total != 1 {
+		t.Errorf("Expected the trigram index to find the fixture message, got %+v (%v)", page, err)
+	}
+	hits, err := GetSearchHits(database, "hiking", nil, nil, 0)
+	if err != nil || len(hits.Groups) != 1 {
+		t.Errorf("Expected the group name to be indexed, got %+v (%v)", hits, err)
+	}
+	conversations, err := GetConversations(database, nil, nil, "", "", SenderCategoryAutomated)
+	if err != nil || len(conversations) != 1 || conversations[0].Address != "72975" {
+		t.Errorf("Expected the short code to be classified, got %+v (%v)", conversations, err)
+	}
+
+	// Dates are carried over in milliseconds, and importing the same
+	// messages with their milliseconds fills them in rather than adding
+	// copies
+	var dateMs int64
+	database.QueryRow("SELECT date_ms FROM messages WHERE body = 'On my way'").Scan(&dateMs)
+	if dateMs != 1600000060000 {
+		t.Errorf("Expected date_ms to be backfilled, got %d", dateMs)
+	}
+	sent := time.UnixMilli(1600000059250)
+	msg := Message{Address: "+15551230001", Body: "On my way", Type: 2, Date: time.UnixMilli(1600000060250), DateSent: &sent}
+	if err := InsertMessage(database, &msg); err != nil {
+		t.Fatalf("Failed to reimport message: %v", err)
+	}
+	call := CallLog{Number: "+15551230001", Type: 2, Duration: 95, Date: time.UnixMilli(1600000240750)}
+	if err := InsertCallLog(database, &call); err != nil {
+		t.Fatalf("Failed to reimport call: %v", err)
+	}
+	database.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count)
+	if count != 5 {
+		t.Errorf("Expected reimporting to add nothing, got %d rows", count)
+	}
+	items, err := GetActivityByAddress(database, "+15551230001", nil, nil, 10, 0)
+	if err != nil || len(items) != 3 {
+		t.Fatalf("Expected 3 items, got %+v (%v)", items, err)
+	}
+	if !items[1].Date.Equal(msg.Date) || items[1].Message.DateSent == nil || !items[1].Message.DateSent.Equal(sent) {
+		t.Errorf("Expected the reimported message's dates, got %+v", items[1].Message)
+	}
+	if !items[2].Date.Equal(call.Date) {
+		t.Errorf("Expected the reimported call's date, got %v", items[2].Date)
+	}
+
+	// Normalized dedup matches the fixture's messages on their second
+	variant := Message{Address: "+15551230001", Body: "See you  at the café ", Type: 1, Date: time.UnixMilli(1600000000500)}
+	if err := insertMessage(database, &variant, DedupNormalized); err != nil {
+		t.Fatalf("Failed to import message: %v", err)
+	}
+	database.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count)
+	if count != 5 {
+		t.Errorf("Expected the variant to be skipped, got %d rows", count)
+	}
+
+	// Migrating again is a no-op
+	statuses, err = MigrateDatabases(dir)
+	if err != nil || len(statuses) != 1 || statuses[0].Version != statuses[0].Latest {
+		t.Errorf("Expected the database to be up to date, got %+v (%v)", statuses, err)
+	}
+
+	// A database from a newer build is left alone
+	if _, err := database.Exec("PRAGMA user_version = 999"); err != nil {
+		t.Fatalf("Failed to set user_version: %v", err)
+	}
+	if _, _, err := runMigrations(database, userDBMigrations); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestMigrateAuthDB(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { authDB = nil }()
+	if err := InitAuthDB(AuthDBPath(dir)); err != nil {
+		t.Fatalf("Failed to initialize auth database: %v", err)
+	}
+	defer authDB.Close()
+
+	if version, err := schemaVersion(authDB); err != nil || version != len(authDBMigrations) {
+		t.Errorf("Expected version %d, got %d (%v)", len(authDBMigrations), version, err)
+	}
+	statuses, err := GetSchemaStatus(dir)
+	if err != nil || len(statuses) != 1 || filepath.Base(statuses[0].Path) != "sbv.db" || statuses[0].Version != statuses[0].Latest {
+		t.Errorf("Expected the auth database to be up to date, got %+v (%v)", statuses, err)
+	}
+}
@@ -1,20 +1,21 @@
 package internal
 
-
 import "time"
 
 type Message struct {
-	ID          int64     `json:"id"`
-	Address     string    `json:"address"`
-	Body        string    `json:"body"`
-	Type        int       `json:"type"` // 1 = received, 2 = sent, 3 = draft, 4 = outbox, 5 = failed, 6 = queued
-	Date        time.Time `json:"date"`
-	Read        bool      `json:"read"`
-	ThreadID    int       `json:"thread_id"`
-	Subject     string    `json:"subject,omitempty"`
-	MediaType   string    `json:"media_type,omitempty"`
-	MediaData   []byte    `json:"-"`
-	MediaBase64 string    `json:"media_base64,omitempty"`
+	ID          int64      `json:"id"`
+	Address     string     `json:"address"`
+	Body        string     `json:"body"`
+	Type        int        `json:"type"` // 1 = received, 2 = sent, 3 = draft, 4 = outbox, 5 = failed, 6 = queued
+	Date        time.Time  `json:"date"`
+	DateSent    *time.Time `json:"date_sent,omitempty"` // when the sending phone sent it, if the backup recorded that
+	Read        bool       `json:"read"`
+	ThreadID    int        `json:"thread_id"`
+	Subject     string     `json:"subject,omitempty"`
+	MediaType   string     `json:"media_type,omitempty"`
+	MediaData   []byte     `json:"-"`
+	MediaName   string     `json:"media_name,omitempty"` // original attachment filename, if the part had one
+	MediaBase64 string     `json:"media_base64,omitempty"`
 	// Additional SMS fields
 	Protocol      int    `json:"protocol,omitempty"`
 	Status        int    `json:"status,omitempty"` // -1 = none, 0 = complete, 32 = pending, 64 = failed
@@ -23,14 +24,30 @@ type Message struct {
 	ContactName   string `json:"contact_name,omitempty"`
 	Sender        string `json:"sender,omitempty"` // Sender phone number for received messages
 	// Additional MMS fields
-	ContentType string `json:"content_type,omitempty"` // ct_t field
-	ReadReport  int    `json:"read_report,omitempty"`  // rr field
-	ReadStatus  int    `json:"read_status,omitempty"`
-	MessageID   string `json:"message_id,omitempty"`   // m_id field
+	ContentType string   `json:"content_type,omitempty"` // ct_t field
+	ReadReport  int      `json:"read_report,omitempty"`  // rr field
+	ReadStatus  int      `json:"read_status,omitempty"`
+	MessageID   string   `json:"message_id,omitempty"`   // m_id field
 	MessageSize int      `json:"message_size,omitempty"` // m_size field
 	MessageType int      `json:"message_type,omitempty"` // m_type field
 	SimSlot     int      `json:"sim_slot,omitempty"`
 	Addresses   []string `json:"addresses,omitempty"` // All phone numbers in conversation (for MMS)
+	// Remaining backup fields (see migrateBackupFields)
+	Locked         bool        `json:"locked,omitempty"`
+	Seen           bool        `json:"seen,omitempty"`
+	Creator        string      `json:"creator,omitempty"`         // package name of the app that wrote it
+	Priority       int         `json:"priority,omitempty"`        // MMS pri: 128 = low, 129 = normal, 130 = high
+	DeliveryReport int         `json:"delivery_report,omitempty"` // MMS d_rpt: 128 = requested, 129 = not
+	Recipients     []Recipient `json:"recipients,omitempty"`      // MMS addresses with their role
+	// Backup attributes without a field of their own, as written
+	Extra map[string]string `json:"-"`
+	// Every part of an MMS as written, including attachments beyond the
+	// first
+	Parts []MessagePart `json:"-"`
+	// Bookmark state (see the bookmarks table)
+	Bookmarked   bool     `json:"bookmarked,omitempty"`
+	BookmarkNote string   `json:"bookmark_note,omitempty"`
+	Tags         []string `json:"tags,omitempty"` // names of tags applied to this message
 }
 
 type CallLog struct {
@@ -42,6 +59,26 @@ type CallLog struct {
 	Presentation   int       `json:"presentation,omitempty"` // 1 = allowed, 2 = restricted, 3 = unknown, 4 = payphone
 	SubscriptionID string    `json:"subscription_id,omitempty"`
 	ContactName    string    `json:"contact_name,omitempty"`
+	PostDialDigits string    `json:"post_dial_digits,omitempty"` // digits dialed after connecting, e.g. an extension
+	Features       int       `json:"features,omitempty"`         // bit flags: 1 = video, 4 = HD, 8 = Wi-Fi, 32 = RTT, 64 = VoLTE
+	PhoneAccountID string    `json:"phone_account_id,omitempty"`
+	// Backup attributes without a field of their own, as written
+	Extra map[string]string `json:"-"`
+}
+
+// MessagePart is one <part> of an MMS (see the message_parts table)
+type MessagePart struct {
+	Position   int               // index among the message's parts
+	Attributes map[string]string // every attribute but data, as written
+	Data       []byte            // decoded data; nil for text and the Media part
+	Media      bool              // its data is the message's MediaData
+}
+
+// Recipient is one address of an MMS message and its role: "from", "to",
+// "cc" or "bcc"
+type Recipient struct {
+	Address string `json:"address"`
+	Role    string `json:"role"`
 }
 
 type Conversation struct {
@@ -51,7 +88,14 @@ type Conversation struct {
 	LastMessage  string    `json:"last_message"`
 	LastDate     time.Time `json:"last_date"`
 	MessageCount int       `json:"message_count"`
-	Type         string    `json:"type"` // "sms", "mms", or "call"
+	Type         string    `json:"type"`           // "sms", "mms", or "call"
+	Tags         []string  `json:"tags,omitempty"` // names of tags applied to the conversation
+	// List state (see ConversationState)
+	Pinned   bool   `json:"pinned,omitempty"`
+	Archived bool   `json:"archived,omitempty"`
+	Hidden   bool   `json:"hidden,omitempty"`
+	Muted    bool   `json:"muted,omitempty"`
+	Category string `json:"category"` // SenderCategoryPersonal or SenderCategoryAutomated
 }
 
 type ActivityItem struct {
@@ -99,10 +143,10 @@ type RegisterRequest struct {
 }
 
 type AuthResponse struct {
-	Success  bool    `json:"success"`
-	User     *User   `json:"user,omitempty"`
-	Session  *Session `json:"session,omitempty"`
-	Error    string  `json:"error,omitempty"`
+	Success bool     `json:"success"`
+	User    *User    `json:"user,omitempty"`
+	Session *Session `json:"session,omitempty"`
+	Error   string   `json:"error,omitempty"`
 }
 
 type ChangePasswordRequest struct {
@@ -147,3 +191,102 @@ type AnalyticsResponse struct {
 	HourlyDistribution []HourlyDistribution `json:"hourly_distribution"`
 	DailyTrend         []DailyCount         `json:"daily_trend"`
 }
+
+// GalleryItem is a media attachment as listed by the gallery, without its data
+type GalleryItem struct {
+	ID          int64     `json:"id"`
+	Address     string    `json:"address"`
+	ContactName string    `json:"contact_name,omitempty"`
+	Date        time.Time `json:"date"`
+	Type        int       `json:"type"` // 1 = received, 2 = sent
+	MediaType   string    `json:"media_type"`
+	Kind        string    `json:"kind"`           // "image", "video", "audio", "vcard" or "other"
+	Name        string    `json:"name,omitempty"` // original attachment filename, if known
+	Size        int64     `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	DurationMs  int64     `json:"duration_ms,omitempty"`
+}
+
+// GalleryPage is one page of gallery results. NextCursor is empty on the
+// last page.
+type GalleryPage struct {
+	Items      []GalleryItem `json:"items"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// MessageContext is a window of a conversation around one message. Offsets
+// are positions in the conversation's GetActivityByAddress ordering, so a
+// client can keep paging outward with /api/messages?type=conversation.
+type MessageContext struct {
+	Address      string         `json:"address"`
+	Items        []ActivityItem `json:"items"`
+	Offset       int            `json:"offset"`        // offset of Items[0]
+	TargetOffset int            `json:"target_offset"` // offset of the requested message
+	Total        int            `json:"total"`
+}
+
+// ContactHit is a contact whose name matched a search, with activity summed
+// over every address saved under that name
+type ContactHit struct {
+	ContactName  string    `json:"contact_name"`
+	Addresses    []string  `json:"addresses"`
+	MessageCount int       `json:"message_count"`
+	CallCount    int       `json:"call_count"`
+	LastDate     time.Time `json:"last_date"`
+}
+
+// GroupHit is a group conversation whose name (MMS subject) matched a search
+type GroupHit struct {
+	Address      string    `json:"address"`
+	Subject      string    `json:"subject"`
+	Participants []string  `json:"participants"`
+	ContactName  string    `json:"contact_name,omitempty"`
+	MessageCount int       `json:"message_count"`
+	LastDate     time.Time `json:"last_date"`
+}
+
+// SearchHits groups search matches by what matched. Conversations are every
+// conversation whose number, contact name or group name matched; Contacts,
+// Groups and Calls break those down, and Messages are body matches.
+type SearchHits struct {
+	Conversations []Conversation `json:"conversations"`
+	Contacts      []ContactHit   `json:"contacts"`
+	Groups        []GroupHit     `json:"groups"`
+	Calls         []CallLog      `json:"calls"`
+	Messages      []SearchResult `json:"messages"`
+}
+
+// Bookmark is a starred message. Context holds the surrounding conversation
+// when requested.
+type Bookmark struct {
+	MessageID   int64          `json:"message_id"`
+	Note        string         `json:"note,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Address     string         `json:"address"`
+	ContactName string         `json:"contact_name,omitempty"`
+	Message     *Message       `json:"message"`
+	Context     []ActivityItem `json:"context,omitempty"`
+}
+
+// Tag is a user-defined label for messages and conversations
+type Tag struct {
+	ID                int64     `json:"id"`
+	Name              string    `json:"name"`
+	Color             string    `json:"color,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	MessageCount      int       `json:"message_count"`
+	ConversationCount int       `json:"conversation_count"`
+}
+
+// ConversationState is how a conversation is treated in the conversation
+// list: pinned to the top, archived or hidden out of it, or muted so
+// analytics can leave it out
+type ConversationState struct {
+	Address   string    `json:"address"`
+	Pinned    bool      `json:"pinned"`
+	Archived  bool      `json:"archived"`
+	Hidden    bool      `json:"hidden"`
+	Muted     bool      `json:"muted"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
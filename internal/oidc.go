@@ -252,12 +252,15 @@ func findOrCreateOIDCUser(username string) (*User, error) {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	dbPathPrefix := os.Getenv("DB_PATH_PREFIX")
-	if dbPathPrefix == "" {
-		dbPathPrefix = "."
+	// With no password to seal it under, the data key is escrowed with the
+	// server key
+	if EncryptNewDatabases {
+		if err := CreateDataKey(user.ID, ""); err != nil {
+			return nil, fmt.Errorf("failed to create data key: %w", err)
+		}
 	}
-	userDBPath := fmt.Sprintf("%s/sbv_%s.db", dbPathPrefix, user.ID)
-	if err := InitUserDB(user.ID, userDBPath); err != nil {
+
+	if err := InitUserStore(user.ID); err != nil {
 		return nil, fmt.Errorf("failed to initialize user database: %w", err)
 	}
 
@@ -269,6 +272,12 @@ func findOrCreateOIDCUser(username string) (*User, error) {
 // provisioned via OIDC; bcrypt comparison against it always fails
 const oidcPasswordMarker = "*oidc*"
 
+// IsOIDCUser reports whether an account was provisioned via OIDC and so
+// has no password
+func IsOIDCUser(user *User) bool {
+	return user.PasswordHash == oidcPasswordMarker
+}
+
 func createOIDCUser(username string) (*User, error) {
 	userID := uuid.New().String()
 	createdAt := time.Now().Unix()
@@ -30,24 +30,30 @@ type SMSBackup struct {
 type SMSEntry struct {
 	Address       string `xml:"address,attr"`
 	Date          string `xml:"date,attr"`
+	DateSent      string `xml:"date_sent,attr"`
 	Type          string `xml:"type,attr"`
 	Body          string `xml:"body,attr"`
 	Read          string `xml:"read,attr"`
 	ThreadID      string `xml:"thread_id,attr"`
 	Subject       string `xml:"subject,attr"`
 	Protocol      string `xml:"protocol,attr"`
-	TOA           string `xml:"toa,attr"`
-	SCTOA         string `xml:"sc_toa,attr"`
 	ServiceCenter string `xml:"service_center,attr"`
 	Status        string `xml:"status,attr"`
 	SubID         string `xml:"sub_id,attr"`
+	Locked        string `xml:"locked,attr"`
+	Seen          string `xml:"seen,attr"`
+	Creator       string `xml:"creator,attr"`
 	ReadableDate  string `xml:"readable_date,attr"`
 	ContactName   string `xml:"contact_name,attr"`
+	// Every other attribute (toa, sc_toa, error_code, ...), kept as-is in
+	// Message.Extra
+	Extra []xml.Attr `xml:",any,attr"`
 }
 
 type MMSEntry struct {
 	Address      string    `xml:"address,attr"`
 	Date         string    `xml:"date,attr"`
+	DateSent     string    `xml:"date_sent,attr"`
 	Type         string    `xml:"msg_box,attr"`
 	Read         string    `xml:"read,attr"`
 	ThreadID     string    `xml:"thread_id,attr"`
@@ -60,11 +66,20 @@ type MMSEntry struct {
 	MessageSize  string    `xml:"m_size,attr"`
 	MessageType  string    `xml:"m_type,attr"`
 	SimSlot      string    `xml:"sim_slot,attr"`
+	SubID        string    `xml:"sub_id,attr"`
+	Locked       string    `xml:"locked,attr"`
+	Seen         string    `xml:"seen,attr"`
+	Creator      string    `xml:"creator,attr"`
+	Priority     string    `xml:"pri,attr"`
+	DeliveryRpt  string    `xml:"d_rpt,attr"`
 	ReadableDate string    `xml:"readable_date,attr"`
 	ContactName  string    `xml:"contact_name,attr"`
 	Parts        []MMSPart `xml:"parts>part"`
 	Addrs        []MMSAddr `xml:"addrs>addr"`
 	Body         string    `xml:"body,attr"`
+	// Every other attribute (exp, retr_st, ct_cls, ...), kept as-is in
+	// Message.Extra along with tr_id
+	Extra []xml.Attr `xml:",any,attr"`
 }
 
 type MMSPart struct {
@@ -75,6 +90,9 @@ type MMSPart struct {
 	CL          string `xml:"cl,attr"`
 	Text        string `xml:"text,attr"`
 	Data        string `xml:"data,attr"`
+	// Every other attribute (cid, cd, fn, ctt_s, ...), kept as-is in
+	// MessagePart.Attributes
+	Extra []xml.Attr `xml:",any,attr"`
 }
 
 type MMSAddr struct {
@@ -90,8 +108,13 @@ type CallEntry struct {
 	Type           string `xml:"type,attr"`
 	Presentation   string `xml:"presentation,attr"`
 	SubscriptionID string `xml:"subscription_id,attr"`
+	PostDialDigits string `xml:"post_dial_digits,attr"`
+	Features       string `xml:"features,attr"`
+	PhoneAccountID string `xml:"phone_account_id,attr"`
 	ReadableDate   string `xml:"readable_date,attr"`
 	ContactName    string `xml:"contact_name,attr"`
+	// Every other attribute, kept as-is in CallLog.Extra
+	Extra []xml.Attr `xml:",any,attr"`
 }
 
 type ParseResult struct {
@@ -142,6 +165,18 @@ func ParseSMSBackup(r io.Reader) (ParseResult, error) {
 	return result, nil
 }
 
+// parseDateSent parses a date_sent attribute counting units since the
+// epoch. Android stores it in milliseconds for SMS but seconds for MMS,
+// and backups copy it as is. Phones that don't record it write 0.
+func parseDateSent(value string, unit time.Duration) *time.Time {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	t := time.UnixMilli(n * unit.Milliseconds())
+	return &t
+}
+
 func convertSMSEntry(sms SMSEntry) (Message, error) {
 	dateMs, err := strconv.ParseInt(sms.Date, 10, 64)
 	if err != nil {
@@ -174,7 +209,8 @@ func convertSMSEntry(sms SMSEntry) (Message, error) {
 		Address:       normalizedAddress,
 		Body:          sms.Body,
 		Type:          msgType,
-		Date:          time.Unix(dateMs/1000, 0),
+		Date:          time.UnixMilli(dateMs),
+		DateSent:      parseDateSent(sms.DateSent, time.Millisecond),
 		Read:          read,
 		ThreadID:      threadID,
 		Subject:       normalizeNullString(sms.Subject),
@@ -185,6 +221,10 @@ func convertSMSEntry(sms SMSEntry) (Message, error) {
 		ContactName:   sms.ContactName,
 		Sender:        sender,
 		Addresses:     addresses,
+		Locked:        sms.Locked == "1",
+		Seen:          sms.Seen == "1",
+		Creator:       normalizeNullString(sms.Creator),
+		Extra:         extraAttributes(sms.Extra),
 	}, nil
 }
 
@@ -202,6 +242,9 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 	messageSize, _ := strconv.Atoi(mms.MessageSize)
 	messageType, _ := strconv.Atoi(mms.MessageType)
 	simSlot, _ := strconv.Atoi(mms.SimSlot)
+	subID, _ := strconv.Atoi(mms.SubID)
+	priority, _ := strconv.Atoi(mms.Priority)
+	deliveryReport, _ := strconv.Atoi(mms.DeliveryRpt)
 
 	// Normalize the phone number to remove formatting differences
 	normalizedAddress := normalizePhoneNumber(mms.Address)
@@ -211,6 +254,7 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 	addressMap := make(map[string]bool)
 	var senderAddress string
 	var firstAddress string
+	var recipients []Recipient
 
 	for _, addr := range mms.Addrs {
 		if addr.Address != "" {
@@ -230,6 +274,7 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 				if addrType == 137 {
 					senderAddress = normalizedAddr
 				}
+				recipients = append(recipients, Recipient{Address: normalizedAddr, Role: mmsAddrRole(addrType)})
 			}
 		}
 	}
@@ -277,27 +322,40 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 	}
 
 	msg := Message{
-		Address:     primaryAddress,
-		Type:        msgType,
-		Date:        time.Unix(dateMs/1000, 0),
-		Read:        read,
-		ThreadID:    threadID,
-		Subject:     normalizeNullString(mms.Subject),
-		ContentType: mms.ContentType,
-		ReadReport:  readReport,
-		ReadStatus:  readStatus,
-		MessageID:   mms.MessageID,
-		MessageSize: messageSize,
-		MessageType: messageType,
-		SimSlot:     simSlot,
-		ContactName: mms.ContactName,
-		Sender:      sender,
-		Addresses:   addresses,
+		Address:        primaryAddress,
+		Type:           msgType,
+		Date:           time.UnixMilli(dateMs),
+		DateSent:       parseDateSent(mms.DateSent, time.Second),
+		Read:           read,
+		ThreadID:       threadID,
+		Subject:        normalizeNullString(mms.Subject),
+		ContentType:    mms.ContentType,
+		ReadReport:     readReport,
+		ReadStatus:     readStatus,
+		MessageID:      mms.MessageID,
+		MessageSize:    messageSize,
+		MessageType:    messageType,
+		SimSlot:        simSlot,
+		SubID:          subID,
+		ContactName:    mms.ContactName,
+		Sender:         sender,
+		Addresses:      addresses,
+		Locked:         mms.Locked == "1",
+		Seen:           mms.Seen == "1",
+		Creator:        normalizeNullString(mms.Creator),
+		Priority:       priority,
+		DeliveryReport: deliveryReport,
+		Recipients:     recipients,
+		Extra:          extraAttributes(mms.Extra),
+	}
+	if mms.TrID != "" {
+		msg.Extra["tr_id"] = mms.TrID
 	}
 
 	// Extract body text and media from parts
 	var bodyText string
-	for _, part := range mms.Parts {
+	mediaPart := -1
+	for i, part := range mms.Parts {
 		// Skip SMIL content - it's presentation metadata, not actual message content
 		if isSMILContentType(part.ContentType) {
 			continue
@@ -305,11 +363,13 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 
 		// Check for VCF (vCard) files - these are text/* but should be treated as media attachments
 		if isVCardContentType(part.ContentType) && part.Data != "" {
-			if msg.MediaType == "" { // Only store first media item
+			if msg.MediaType == "" { // The first attachment is the message's media
 				data, err := base64.StdEncoding.DecodeString(part.Data)
 				if err == nil {
 					msg.MediaType = part.ContentType
 					msg.MediaData = data
+					msg.MediaName = mmsPartName(part)
+					mediaPart = i
 				}
 			}
 			continue
@@ -318,12 +378,14 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 		// Check for media - media parts often have text="null" which should be ignored
 		if part.ContentType != "" && part.Data != "" && !isTextContentType(part.ContentType) {
 			// This is media content (image, video, audio, etc.)
-			if msg.MediaType == "" { // Only store first media item
+			if msg.MediaType == "" { // The first attachment is the message's media
 				data, err := base64.StdEncoding.DecodeString(part.Data)
 				if err == nil {
 					// Store all media as-is (including HEIC images in original format)
 					msg.MediaType = part.ContentType
 					msg.MediaData = data
+					msg.MediaName = mmsPartName(part)
+					mediaPart = i
 				}
 			}
 		} else if part.Text != "" && normalizeNullString(part.Text) != "" {
@@ -336,6 +398,20 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 		msg.Body = strings.TrimSpace(bodyText)
 	}
 
+	// Keep every part as written, SMIL and further attachments included.
+	// The media part's data is already in MediaData.
+	for i, part := range mms.Parts {
+		p := MessagePart{Position: i, Attributes: mmsPartAttributes(part), Media: i == mediaPart}
+		if part.Data != "" && !p.Media {
+			if data, err := base64.StdEncoding.DecodeString(part.Data); err == nil {
+				p.Data = data
+			} else {
+				p.Attributes["data"] = part.Data
+			}
+		}
+		msg.Parts = append(msg.Parts, p)
+	}
+
 	// Extract group name from RCS proto: tr_id if available
 	// Use it as the subject if the current subject is empty or starts with "proto:"
 	if mms.TrID != "" && strings.HasPrefix(mms.TrID, "proto:") {
@@ -351,6 +427,45 @@ func convertMMSEntry(mms MMSEntry) (Message, error) {
 	return msg, nil
 }
 
+// mmsAddrRole names an MMS addr type (a PDU header field): 137 = from,
+// 151 = to, 130 = cc, 129 = bcc. Other types are kept as their number.
+func mmsAddrRole(addrType int) string {
+	switch addrType {
+	case 137:
+		return "from"
+	case 151:
+		return "to"
+	case 130:
+		return "cc"
+	case 129:
+		return "bcc"
+	}
+	return strconv.Itoa(addrType)
+}
+
+// extraAttributes returns the attributes of a backup element that have no
+// field of their own, by name
+func extraAttributes(attrs []xml.Attr) map[string]string {
+	extra := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		extra[attr.Name.Local] = attr.Value
+	}
+	return extra
+}
+
+// mmsPartAttributes returns every attribute of an MMS part but data
+func mmsPartAttributes(part MMSPart) map[string]string {
+	attrs := extraAttributes(part.Extra)
+	for name, value := range map[string]string{
+		"seq": part.Seq, "ct": part.ContentType, "name": part.Name, "chset": part.Charset, "cl": part.CL, "text": part.Text,
+	} {
+		if value != "" {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
 // normalizeNullString converts the string "null" to an empty string
 func normalizeNullString(s string) string {
 	if strings.TrimSpace(strings.ToLower(s)) == "null" {
@@ -359,6 +474,15 @@ func normalizeNullString(s string) string {
 	return s
 }
 
+// mmsPartName returns the original filename of an MMS part, preferring the
+// name attribute over the content location. Either may be "null".
+func mmsPartName(part MMSPart) string {
+	if name := strings.TrimSpace(normalizeNullString(part.Name)); name != "" {
+		return name
+	}
+	return strings.TrimSpace(normalizeNullString(part.CL))
+}
+
 // isTextContentType checks if a content type is text-based
 func isTextContentType(contentType string) bool {
 	ct := strings.ToLower(strings.TrimSpace(contentType))
@@ -457,30 +581,34 @@ func needsVideoConversion(contentType string) bool {
 // When HEIC support is enabled, it converts HEIC image data to JPEG format
 // When HEIC support is disabled, it returns a placeholder image
 
-// convertVideoToMP4 converts unsupported video formats (like 3GP) to MP4 using ffmpeg
-// Returns the converted MP4 data or an error if conversion fails
-func convertVideoToMP4(videoData []byte) ([]byte, error) {
-	// Create temporary files for input and output
-	tmpInputFile, err := os.CreateTemp("", "video-input-*.3gp")
+// converterInput writes data to name in a new temporary directory only the
+// server can read, for ffmpeg and ffprobe, which need seekable input files.
+// Attachments of encrypted users are only ever plaintext in memory, so
+// callers defer cleanup, which removes the directory with the input and
+// anything the tool wrote next to it, as soon as the tool has run.
+func converterInput(name string, data []byte) (dir, input string, cleanup func(), err error) {
+	dir, err = os.MkdirTemp("", "sbv-convert-*")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp input file: %w", err)
+		return "", "", nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
-	defer os.Remove(tmpInputFile.Name())
-	defer tmpInputFile.Close()
-
-	tmpOutputFile, err := os.CreateTemp("", "video-output-*.mp4")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp output file: %w", err)
+	cleanup = func() { os.RemoveAll(dir) }
+	input = filepath.Join(dir, name)
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		cleanup()
+		return "", "", nil, fmt.Errorf("failed to write input media: %w", err)
 	}
-	defer os.Remove(tmpOutputFile.Name())
-	tmpOutputFile.Close()
+	return dir, input, cleanup, nil
+}
 
-	// Write input video data to temp file
-	_, err = tmpInputFile.Write(videoData)
+// convertVideoToMP4 converts unsupported video formats (like 3GP) to MP4 using ffmpeg
+// Returns the converted MP4 data or an error if conversion fails
+func convertVideoToMP4(videoData []byte) ([]byte, error) {
+	dir, input, cleanup, err := converterInput("input.3gp", videoData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write input video: %w", err)
+		return nil, err
 	}
-	tmpInputFile.Close()
+	defer cleanup()
+	output := filepath.Join(dir, "output.mp4")
 
 	// Run ffmpeg to convert video to MP4 with H.264 codec
 	// -i: input file
@@ -490,14 +618,14 @@ func convertVideoToMP4(videoData []byte) ([]byte, error) {
 	// -preset fast: balance between speed and quality
 	// -crf 23: constant rate factor (quality, lower is better, 23 is good default)
 	cmd := exec.Command("ffmpeg",
-		"-i", tmpInputFile.Name(),
+		"-i", input,
 		"-c:v", "libx264",
 		"-c:a", "aac",
 		"-movflags", "+faststart",
 		"-preset", "fast",
 		"-crf", "23",
 		"-y", // overwrite output file
-		tmpOutputFile.Name(),
+		output,
 	)
 
 	// Capture stderr for error messages
@@ -510,7 +638,7 @@ func convertVideoToMP4(videoData []byte) ([]byte, error) {
 	}
 
 	// Read converted video data
-	convertedData, err := os.ReadFile(tmpOutputFile.Name())
+	convertedData, err := os.ReadFile(output)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read converted video: %w", err)
 	}
@@ -535,32 +663,19 @@ func needsAudioConversion(contentType string) bool {
 
 // convertAudioToMP3 converts unsupported audio formats (like AMR) to MP3 using ffmpeg
 func convertAudioToMP3(audioData []byte) ([]byte, error) {
-	tmpInputFile, err := os.CreateTemp("", "audio-input-*")
+	dir, input, cleanup, err := converterInput("input", audioData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp input file: %w", err)
+		return nil, err
 	}
-	defer os.Remove(tmpInputFile.Name())
-	defer tmpInputFile.Close()
-
-	tmpOutputFile, err := os.CreateTemp("", "audio-output-*.mp3")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp output file: %w", err)
-	}
-	defer os.Remove(tmpOutputFile.Name())
-	tmpOutputFile.Close()
-
-	_, err = tmpInputFile.Write(audioData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write input audio: %w", err)
-	}
-	tmpInputFile.Close()
+	defer cleanup()
+	output := filepath.Join(dir, "output.mp3")
 
 	cmd := exec.Command("ffmpeg",
-		"-i", tmpInputFile.Name(),
+		"-i", input,
 		"-codec:a", "libmp3lame",
 		"-q:a", "2",
 		"-y",
-		tmpOutputFile.Name(),
+		output,
 	)
 
 	var stderr bytes.Buffer
@@ -571,7 +686,7 @@ func convertAudioToMP3(audioData []byte) ([]byte, error) {
 		return nil, fmt.Errorf("ffmpeg audio conversion failed: %w, stderr: %s", err, stderr.String())
 	}
 
-	convertedData, err := os.ReadFile(tmpOutputFile.Name())
+	convertedData, err := os.ReadFile(output)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read converted audio: %w", err)
 	}
@@ -588,6 +703,7 @@ func convertCallEntry(call CallEntry) (CallLog, error) {
 	duration, _ := strconv.Atoi(call.Duration)
 	callType, _ := strconv.Atoi(call.Type)
 	presentation, _ := strconv.Atoi(call.Presentation)
+	features, _ := strconv.Atoi(call.Features)
 
 	// Normalize the phone number to remove formatting differences
 	normalizedNumber := normalizePhoneNumber(call.Number)
@@ -595,11 +711,15 @@ func convertCallEntry(call CallEntry) (CallLog, error) {
 	return CallLog{
 		Number:         normalizedNumber,
 		Duration:       duration,
-		Date:           time.Unix(dateMs/1000, 0),
+		Date:           time.UnixMilli(dateMs),
 		Type:           callType,
 		Presentation:   presentation,
 		SubscriptionID: call.SubscriptionID,
 		ContactName:    call.ContactName,
+		PostDialDigits: call.PostDialDigits,
+		Features:       features,
+		PhoneAccountID: normalizeNullString(call.PhoneAccountID),
+		Extra:          extraAttributes(call.Extra),
 	}, nil
 }
 
@@ -612,7 +732,10 @@ type UploadProgress struct {
 	Status            string    `json:"status"` // "parsing", "importing", "completed", "error"
 	ErrorMessage      string    `json:"error_message,omitempty"`
 	StartTime         time.Time `json:"start_time"`
-	mu                sync.RWMutex
+	// SavedSearchMatches counts the imported messages matching each saved
+	// search, once the import has finished
+	SavedSearchMatches []SavedSearchMatch `json:"saved_search_matches,omitempty"`
+	mu                 sync.RWMutex
 }
 
 var (
@@ -641,6 +764,8 @@ func GetUploadProgress() *UploadProgress {
 		Status:            uploadProgress.Status,
 		ErrorMessage:      uploadProgress.ErrorMessage,
 		StartTime:         uploadProgress.StartTime,
+
+		SavedSearchMatches: uploadProgress.SavedSearchMatches,
 	}
 }
 
@@ -693,6 +818,21 @@ func UpdateCallProgress(processed int) {
 	uploadProgress.ProcessedCalls = processed
 }
 
+// SetSavedSearchMatches records saved search matches on the upload progress
+func SetSavedSearchMatches(matches []SavedSearchMatch) {
+	uploadProgressLock.RLock()
+	defer uploadProgressLock.RUnlock()
+
+	if uploadProgress == nil {
+		return
+	}
+
+	uploadProgress.mu.Lock()
+	defer uploadProgress.mu.Unlock()
+
+	uploadProgress.SavedSearchMatches = matches
+}
+
 // ClearUploadProgress clears the upload progress
 func ClearUploadProgress() {
 	uploadProgressLock.Lock()
@@ -738,6 +878,18 @@ func SaveUploadedFile(file io.Reader, filename string) (string, error) {
 	return tempFile.Name(), nil
 }
 
+// failUpload marks the upload in progress as failed with the given message
+func failUpload(format string, args ...interface{}) {
+	SetUploadProgress(0, 0, "error")
+	uploadProgressLock.Lock()
+	if uploadProgress != nil {
+		uploadProgress.mu.Lock()
+		uploadProgress.ErrorMessage = fmt.Sprintf(format, args...)
+		uploadProgress.mu.Unlock()
+	}
+	uploadProgressLock.Unlock()
+}
+
 // ProcessUploadedFile processes the uploaded file in the background
 func ProcessUploadedFile(userID string, username string, filePath string) {
 	defer func() {
@@ -750,55 +902,91 @@ func ProcessUploadedFile(userID string, username string, filePath string) {
 
 	slog.Info("Starting background processing", "path", filePath, "user", username)
 
+	// Open the file for reading
+	file, err := os.Open(filePath)
+	if err != nil {
+		slog.Error("Error opening file", "error", err)
+		failUpload("Failed to open file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	// Saved searches and media indexing work on SQLite databases; with
+	// PostgreSQL the import is all there is
+	if UsingPostgres() {
+		store, err := GetUserStore(userID, username)
+		if err != nil {
+			slog.Error("Error getting user store", "error", err)
+			failUpload("Failed to get user database: %v", err)
+			return
+		}
+		messageCount, callCount, err := ImportBackup(store, file, defaultImportBatchSize)
+		if err != nil {
+			slog.Error("Error processing file", "error", err)
+			failUpload("Failed to process file: %v", err)
+			return
+		}
+		slog.Info("Completed processing", "messages", messageCount, "calls", callCount)
+		return
+	}
+
 	// Get user database
 	userDB, err := GetUserDB(userID, username)
 	if err != nil {
 		slog.Error("Error getting user database", "error", err)
-		SetUploadProgress(0, 0, "error")
-		uploadProgressLock.Lock()
-		if uploadProgress != nil {
-			uploadProgress.mu.Lock()
-			uploadProgress.ErrorMessage = fmt.Sprintf("Failed to get user database: %v", err)
-			uploadProgress.mu.Unlock()
-		}
-		uploadProgressLock.Unlock()
+		failUpload("Failed to get user database: %v", err)
 		return
 	}
 
-	// Open the file for reading
-	file, err := os.Open(filePath)
+	// Messages added by this import are the ones above the current highest ID
+	sinceID, err := maxMessageID(userDB)
 	if err != nil {
-		slog.Error("Error opening file", "error", err)
-		SetUploadProgress(0, 0, "error")
-		uploadProgressLock.Lock()
-		if uploadProgress != nil {
-			uploadProgress.mu.Lock()
-			uploadProgress.ErrorMessage = fmt.Sprintf("Failed to open file: %v", err)
-			uploadProgress.mu.Unlock()
-		}
-		uploadProgressLock.Unlock()
-		return
+		slog.Warn("Failed to get latest message ID", "error", err)
 	}
-	defer file.Close()
 
 	// Process with streaming parser. batchSize only controls how many rows
 	// share one commit -- rows are still inserted and their data freed one at
 	// a time as decoded, so this doesn't affect peak memory usage.
-	messageCount, callCount, err := ParseSMSBackupStreaming(userDB, file, defaultImportBatchSize)
+	messageCount, callCount, err := ParseSMSBackupStreaming(userDB, file, defaultImportBatchSize, UserDedupStrategy(userID))
 	if err != nil {
 		slog.Error("Error processing file", "error", err)
-		SetUploadProgress(0, 0, "error")
-		uploadProgressLock.Lock()
-		if uploadProgress != nil {
-			uploadProgress.mu.Lock()
-			uploadProgress.ErrorMessage = fmt.Sprintf("Failed to process file: %v", err)
-			uploadProgress.mu.Unlock()
-		}
-		uploadProgressLock.Unlock()
+		failUpload("Failed to process file: %v", err)
 		return
 	}
 
 	slog.Info("Completed processing", "messages", messageCount, "calls", callCount)
+
+	matches, err := RecordSavedSearchMatches(userID, userDB, sinceID)
+	if err != nil {
+		slog.Warn("Failed to check saved searches", "error", err)
+	}
+	SetSavedSearchMatches(matches)
+
+	afterImport(userID, userDB)
+}
+
+// MediaPretranscodeEnabled controls whether imports are followed by a
+// background pass converting and caching media (see PretranscodeMedia)
+var MediaPretranscodeEnabled bool
+
+// MediaPrethumbnailEnabled controls whether imports are followed by a
+// background pass generating thumbnails (see GenerateThumbnails)
+var MediaPrethumbnailEnabled bool
+
+// afterImport kicks off background work that should follow a successful
+// import, whether from an upload or the auto-import directory. The passes
+// run one after another in a single goroutine so at most one ffmpeg process
+// is busy at a time.
+func afterImport(userID string, userDB *sql.DB) {
+	go func() {
+		IndexMediaMetadata(userID, userDB)
+		if MediaPretranscodeEnabled {
+			PretranscodeMedia(userID, userDB)
+		}
+		if MediaPrethumbnailEnabled {
+			GenerateThumbnails(userID, userDB)
+		}
+	}()
 }
 
 // ParseSMSBackupStreaming parses SMS backup file with streaming to reduce memory usage
@@ -818,16 +1006,24 @@ const defaultImportBatchSize = 200
 // re-importable on retry either way, since INSERT ... ON CONFLICT DO NOTHING
 // makes re-running the same file idempotent, but a smaller batch bounds how
 // much re-decoding work a failure near the end of a large import wastes.
-func ParseSMSBackupStreaming(userDB *sql.DB, r io.Reader, batchSize int) (int, int, error) {
-	if batchSize <= 0 {
-		batchSize = defaultImportBatchSize
-	}
+// Messages are deduplicated with the dedup strategy (see DedupExact).
+func ParseSMSBackupStreaming(userDB *sql.DB, r io.Reader, batchSize int, dedup string) (int, int, error) {
 	// Serialize writers against this user's database when not in WAL mode (no-op
 	// in WAL mode). Held for the whole import so concurrent imports for the same
 	// user queue up instead of racing SQLite's single-writer rollback journal.
 	unlock := LockForWrite(userDB)
 	defer unlock()
 
+	return ImportBackup(&sqliteStore{db: userDB, dedup: dedup}, r, batchSize)
+}
+
+// ImportBackup parses an SMS Backup & Restore XML file into store, in
+// batches of batchSize rows (see ParseSMSBackupStreaming)
+func ImportBackup(store MessageStore, r io.Reader, batchSize int) (int, int, error) {
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
 	// Initialize progress tracking
 	uploadProgressLock.Lock()
 	uploadProgress = &UploadProgress{
@@ -846,15 +1042,15 @@ func ParseSMSBackupStreaming(userDB *sql.DB, r io.Reader, batchSize int) (int, i
 	// Batches inserts into transactions of importBatchSize rows instead of
 	// autocommitting each one individually. tx is nil when no transaction is
 	// currently open (lazily started on the first row after each commit).
-	var tx *sql.Tx
+	var tx MessageBatch
 	var rowsInBatch int
 
-	// currentExecer returns the target for the next insert: the open
+	// currentBatch returns the target for the next insert: the open
 	// transaction if one exists, opening a new one lazily on first use.
-	currentExecer := func() (dbExecer, error) {
+	currentBatch := func() (MessageBatch, error) {
 		if tx == nil {
 			var err error
-			tx, err = userDB.Begin()
+			tx, err = store.BeginBatch()
 			if err != nil {
 				return nil, err
 			}
@@ -937,12 +1133,12 @@ func ParseSMSBackupStreaming(userDB *sql.DB, r io.Reader, batchSize int) (int, i
 					continue
 				}
 
-				execer, err := currentExecer()
+				batch, err := currentBatch()
 				if err != nil {
 					SetUploadProgress(0, 0, "error")
 					return messageCount, callCount, fmt.Errorf("failed to begin batch: %w", err)
 				}
-				err = InsertMessage(execer, &msg)
+				err = batch.InsertMessage(&msg)
 				if err != nil {
 					slog.Error("Error inserting message", "error", err)
 				} else {
@@ -980,12 +1176,12 @@ func ParseSMSBackupStreaming(userDB *sql.DB, r io.Reader, batchSize int) (int, i
 					continue
 				}
 
-				execer, err := currentExecer()
+				batch, err := currentBatch()
 				if err != nil {
 					SetUploadProgress(0, 0, "error")
 					return messageCount, callCount, fmt.Errorf("failed to begin batch: %w", err)
 				}
-				err = InsertMessage(execer, &msg)
+				err = batch.InsertMessage(&msg)
 				if err != nil {
 					slog.Error("Error inserting message", "error", err)
 				} else {
@@ -1022,12 +1218,12 @@ func ParseSMSBackupStreaming(userDB *sql.DB, r io.Reader, batchSize int) (int, i
 					continue
 				}
 
-				execer, err := currentExecer()
+				batch, err := currentBatch()
 				if err != nil {
 					SetUploadProgress(0, 0, "error")
 					return messageCount, callCount, fmt.Errorf("failed to begin batch: %w", err)
 				}
-				err = InsertCallLog(execer, &callLog)
+				err = batch.InsertCallLog(&callLog)
 				if err != nil {
 					slog.Error("Error inserting call log", "error", err)
 				} else {
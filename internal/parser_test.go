@@ -3,6 +3,8 @@ package internal
 
 import (
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -49,7 +51,7 @@ func TestSampleXMLParsing(t *testing.T) {
 		t.Errorf("Expected status -1, got %d", msg1.Status)
 	}
 	// Check date: 1285799668193 milliseconds = Sep 30, 2010 8:34:28 AM
-	expectedDate1 := time.Unix(1285799668, 0)
+	expectedDate1 := time.UnixMilli(1285799668193)
 	if !msg1.Date.Equal(expectedDate1) {
 		t.Errorf("Expected date %v, got %v", expectedDate1, msg1.Date)
 	}
@@ -70,7 +72,7 @@ func TestSampleXMLParsing(t *testing.T) {
 		t.Errorf("Expected message to be unread (read=0)")
 	}
 	// Check date: 1289643415810 milliseconds = Nov 13, 2010 9:16:55 PM
-	expectedDate2 := time.Unix(1289643415, 0)
+	expectedDate2 := time.UnixMilli(1289643415810)
 	if !msg2.Date.Equal(expectedDate2) {
 		t.Errorf("Expected date %v, got %v", expectedDate2, msg2.Date)
 	}
@@ -168,7 +170,7 @@ func TestSampleXMLDatabaseIngestion(t *testing.T) {
 	}
 
 	// Test GetConversations
-	conversations, err := GetConversations(db, nil, nil)
+	conversations, err := GetConversations(db, nil, nil, "", "", "")
 	if err != nil {
 		t.Fatalf("Failed to get conversations: %v", err)
 	}
@@ -218,6 +220,215 @@ func TestSampleXMLDatabaseIngestion(t *testing.T) {
 	}
 }
 
+func TestMillisecondDates(t *testing.T) {
+	err := InitDB(filepath.Join(t.TempDir(), "test_messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	// Out of order within one second, with two identical replies
+	backup := `<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>
+<smses count="5">
+  <sms address="5551234567" date="1600000000900" date_sent="0" type="2" body="third" read="1" />
+  <sms address="5551234567" date="1600000000100" date_sent="1600000000050" type="1" body="first" read="1" />
+  <sms address="5551234567" date="1600000000300" type="2" body="ok" read="1" />
+  <sms address="5551234567" date="1600000000700" type="2" body="ok" read="1" />
+  <mms address="5551234567" date="1600000000500" date_sent="1599999999" msg_box="1" ct_t="application/vnd.wap.multipart.related" read="1">
+    <parts><part seq="0" ct="text/plain" text="second" /></parts>
+    <addrs><addr address="5551234567" type="137" /></addrs>
+  </mms>
+</smses>`
+	result, err := ParseSMSBackup(strings.NewReader(backup))
+	if err != nil {
+		t.Fatalf("Failed to parse XML: %v", err)
+	}
+	for i := range result.Messages {
+		if err := InsertMessage(db, &result.Messages[i]); err != nil {
+			t.Fatalf("Failed to insert message %d: %v", i, err)
+		}
+	}
+
+	items, err := GetActivityByAddress(db, "+15551234567", nil, nil, 10, 0)
+	if err != nil {
+		t.Fatalf("Failed to get activity: %v", err)
+	}
+	var bodies []string
+	for _, item := range items {
+		bodies = append(bodies, item.Message.Body)
+	}
+	if strings.Join(bodies, ",") != "first,ok,second,ok,third" {
+		t.Fatalf("Expected messages in millisecond order, got %v", bodies)
+	}
+	if !items[0].Date.Equal(time.UnixMilli(1600000000100)) {
+		t.Errorf("Expected the date to keep its milliseconds, got %v", items[0].Date)
+	}
+	if sent := items[0].Message.DateSent; sent == nil || !sent.Equal(time.UnixMilli(1600000000050)) {
+		t.Errorf("Expected the SMS sent date in milliseconds, got %v", sent)
+	}
+	if sent := items[2].Message.DateSent; sent == nil || !sent.Equal(time.Unix(1599999999, 0)) {
+		t.Errorf("Expected the MMS sent date in seconds, got %v", sent)
+	}
+	if sent := items[4].Message.DateSent; sent != nil {
+		t.Errorf("Expected no sent date for date_sent=0, got %v", sent)
+	}
+}
+
+func TestBackupFields(t *testing.T) {
+	err := InitDB(filepath.Join(t.TempDir(), "test_messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	backup := `<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>
+<smses count="3">
+  <sms address="5551234567" date="1600000000100" type="1" body="hi" read="1" locked="1" seen="1" toa="145" sc_toa="null" error_code="0" />
+  <mms address="5551234567" date="1600000001000" msg_box="2" ct_t="application/vnd.wap.multipart.related" read="1" seen="1" pri="130" d_rpt="128" creator="com.google.android.apps.messaging" exp="604800" retr_st="null" tr_id="T1" sub_id="2">
+    <parts><part seq="0" ct="text/plain" text="hello all" /></parts>
+    <addrs>
+      <addr address="5550000000" type="137" charset="106" />
+      <addr address="5551234567" type="151" charset="106" />
+      <addr address="5557654321" type="130" charset="106" />
+    </addrs>
+  </mms>
+  <call number="5551234567" date="1600000002000" duration="30" type="2" post_dial_digits=",123" features="1" phone_account_id="1" block_reason="0" />
+</smses>`
+	result, err := ParseSMSBackup(strings.NewReader(backup))
+	if err != nil {
+		t.Fatalf("Failed to parse XML: %v", err)
+	}
+	for i := range result.Messages {
+		if err := InsertMessage(db, &result.Messages[i]); err != nil {
+			t.Fatalf("Failed to insert message %d: %v", i, err)
+		}
+	}
+	if err := InsertCallLog(db, &result.Calls[0]); err != nil {
+		t.Fatalf("Failed to insert call: %v", err)
+	}
+
+	var extra []string
+	rows, err := db.Query("SELECT extra FROM messages ORDER BY date_ms")
+	if err != nil {
+		t.Fatalf("Failed to read extra: %v", err)
+	}
+	for rows.Next() {
+		var e string
+		rows.Scan(&e)
+		extra = append(extra, e)
+	}
+	rows.Close()
+	want := []string{
+		`{"error_code":"0","sc_toa":"null","toa":"145"}`,
+		`{"exp":"604800","retr_st":"null","tr_id":"T1"}`,
+		`{"block_reason":"0"}`,
+	}
+	if strings.Join(extra, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected unknown attributes kept as-is, got %v", extra)
+	}
+
+	items, err := GetActivityByAddress(db, "+15551234567", nil, nil, 10, 0)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Expected the SMS and call, got %+v (%v)", items, err)
+	}
+	if sms := items[0].Message; !sms.Locked || !sms.Seen {
+		t.Errorf("Expected the SMS locked and seen, got %+v", sms)
+	}
+	if call := items[1].Call; call.PostDialDigits != ",123" || call.Features != 1 || call.PhoneAccountID != "1" {
+		t.Errorf("Expected the call's backup fields, got %+v", call)
+	}
+
+	group := result.Messages[1].Address
+	items, err = GetActivityByAddress(db, group, nil, nil, 10, 0)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("Expected the MMS, got %+v (%v)", items, err)
+	}
+	mms := items[0].Message
+	if mms.Priority != 130 || mms.DeliveryReport != 128 || mms.Creator != "com.google.android.apps.messaging" || mms.SubID != 2 {
+		t.Errorf("Expected the MMS's backup fields, got %+v", mms)
+	}
+	wantRecipients := []Recipient{{"+15550000000", "from"}, {"+15551234567", "to"}, {"+15557654321", "cc"}}
+	if !slices.Equal(mms.Recipients, wantRecipients) {
+		t.Errorf("Expected recipients %v, got %v", wantRecipients, mms.Recipients)
+	}
+
+	// Re-importing fills in rows imported before the fields were kept
+	if _, err := db.Exec("UPDATE messages SET locked = NULL, seen = NULL, extra = NULL WHERE record_type = 1"); err != nil {
+		t.Fatalf("Failed to clear fields: %v", err)
+	}
+	sms, _ := convertSMSEntry(SMSEntry{Address: "5551234567", Date: "1600000000100", Type: "1", Body: "hi", Locked: "1", Seen: "1"})
+	if err := InsertMessage(db, &sms); err != nil {
+		t.Fatalf("Failed to reimport message: %v", err)
+	}
+	messages, err := GetMessages(db, "+15551234567", nil, nil)
+	if err != nil || len(messages) != 1 || !messages[0].Locked || !messages[0].Seen {
+		t.Errorf("Expected the SMS filled in, got %+v (%v)", messages, err)
+	}
+}
+
+func TestMultipartMMS(t *testing.T) {
+	err := InitDB(filepath.Join(t.TempDir(), "test_messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	// "first" and "second" in base64
+	backup := `<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>
+<smses count="1">
+  <mms address="5551234567" date="1600000001000" msg_box="1" ct_t="application/vnd.wap.multipart.related" read="1">
+    <parts>
+      <part seq="-1" ct="application/smil" name="null" chset="null" cl="null" text="&lt;smil /&gt;" />
+      <part seq="0" ct="image/jpeg" name="a.jpg" cl="a.jpg" cid="&lt;a&gt;" data="Zmlyc3Q=" />
+      <part seq="1" ct="image/png" name="b.png" cl="b.png" cid="&lt;b&gt;" fn="b.png" data="c2Vjb25k" />
+      <part seq="2" ct="text/plain" chset="106" text="two pictures" />
+    </parts>
+    <addrs><addr address="5551234567" type="137" charset="106" /></addrs>
+  </mms>
+</smses>`
+	for range 2 { // the second import adds nothing
+		result, err := ParseSMSBackup(strings.NewReader(backup))
+		if err != nil {
+			t.Fatalf("Failed to parse XML: %v", err)
+		}
+		if err := InsertMessage(db, &result.Messages[0]); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+	}
+
+	var body string
+	var media []byte
+	db.QueryRow("SELECT body, media_data FROM messages").Scan(&body, &media)
+	if body != "two pictures" || string(media) != "first" {
+		t.Errorf("Expected the text and first picture on the message, got %q and %q", body, media)
+	}
+
+	type part struct {
+		attributes, data string
+		media            bool
+	}
+	var parts []part
+	rows, err := db.Query("SELECT attributes, COALESCE(data, ''), media FROM message_parts ORDER BY position")
+	if err != nil {
+		t.Fatalf("Failed to read parts: %v", err)
+	}
+	for rows.Next() {
+		var p part
+		rows.Scan(&p.attributes, &p.data, &p.media)
+		parts = append(parts, p)
+	}
+	rows.Close()
+	want := []part{
+		{`{"chset":"null","cl":"null","ct":"application/smil","name":"null","seq":"-1","text":"\u003csmil /\u003e"}`, "", false},
+		{`{"cid":"\u003ca\u003e","cl":"a.jpg","ct":"image/jpeg","name":"a.jpg","seq":"0"}`, "", true},
+		{`{"cid":"\u003cb\u003e","cl":"b.png","ct":"image/png","fn":"b.png","name":"b.png","seq":"1"}`, "second", false},
+		{`{"chset":"106","ct":"text/plain","seq":"2","text":"two pictures"}`, "", false},
+	}
+	if !slices.Equal(parts, want) {
+		t.Errorf("Expected every part with its attributes, got %+v", parts)
+	}
+}
+
 func TestEmptyXML(t *testing.T) {
 	emptyXML := `<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>
 <smses count="0">
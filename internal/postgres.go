@@ -0,0 +1,1222 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresDB is the shared database messages are stored in when
+// STORAGE_BACKEND is postgres, or nil with SQLite
+var postgresDB *sql.DB
+
+// postgresStores caches each user's store once their schema exists
+var postgresStores sync.Map // map[string]*postgresStore
+
+// InitPostgres connects to the PostgreSQL database at url and stores
+// messages there from then on. Users and sessions stay in the SQLite auth
+// database.
+func InitPostgres(url string) error {
+	database, err := sql.Open("pgx", url)
+	if err != nil {
+		return err
+	}
+	if err := database.Ping(); err != nil {
+		database.Close()
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	postgresDB = database
+	return nil
+}
+
+// postgresStoreFor returns a user's store in postgresDB, creating their
+// schema on first use
+func postgresStoreFor(userID string) (MessageStore, error) {
+	if store, ok := postgresStores.Load(userID); ok {
+		return store.(*postgresStore), nil
+	}
+	store, err := newPostgresStore(postgresDB, userID)
+	if err != nil {
+		return nil, err
+	}
+	postgresStores.Store(userID, store)
+	return store, nil
+}
+
+// postgresSchemaName returns the quoted name of a user's schema
+func postgresSchemaName(userID string) (string, error) {
+	if userID == "" || strings.Trim(userID, "0123456789abcdefABCDEF-") != "" {
+		return "", fmt.Errorf("invalid user ID %q", userID)
+	}
+	return `"sbv_` + userID + `"`, nil
+}
+
+// postgresStore is a MessageStore over one user's schema. Every statement
+// runs in a transaction whose search_path is only that schema, so queries
+// name tables unqualified, as they do with SQLite, and can't reach another
+// user's.
+type postgresStore struct {
+	db     *sql.DB
+	schema string
+}
+
+// newPostgresStore returns a store over a user's schema in database,
+// creating or migrating it as needed
+func newPostgresStore(database *sql.DB, userID string) (*postgresStore, error) {
+	schema, err := postgresSchemaName(userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := runPostgresMigrations(database, schema, postgresMigrations); err != nil {
+		return nil, err
+	}
+	return &postgresStore{db: database, schema: schema}, nil
+}
+
+// runPostgresMigrations is runMigrations for a schema, whose version is
+// kept in its schema_version table. Each step takes an advisory lock on
+// the schema, so servers starting together migrate it one at a time.
+func runPostgresMigrations(database *sql.DB, schema string, migrations []migration) (from, to int, err error) {
+	from = -1
+	for {
+		version, applied, err := applyPostgresMigration(database, schema, migrations)
+		if from < 0 {
+			from = version
+		}
+		if err != nil || !applied {
+			return from, version, err
+		}
+	}
+}
+
+// applyPostgresMigration applies the first migration a schema hasn't had,
+// creating the schema first if need be. It returns the schema's version
+// before, and whether there was one to apply.
+func applyPostgresMigration(database *sql.DB, schema string, migrations []migration) (int, bool, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", schema); err != nil {
+		return 0, false, err
+	}
+	for _, query := range []string{
+		"CREATE SCHEMA IF NOT EXISTS " + schema,
+		"SET LOCAL search_path TO " + schema,
+		"CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)",
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			return 0, false, err
+		}
+	}
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return version, false, fmt.Errorf("%w (version %d, expected at most %d)", ErrSchemaTooNew, version, len(migrations))
+	}
+	if version == len(migrations) {
+		return version, false, tx.Commit()
+	}
+
+	m := migrations[version]
+	start := time.Now()
+	if err := m.apply(tx); err != nil {
+		return version, false, fmt.Errorf("migration %d (%s) failed: %w", version+1, m.name, err)
+	}
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		return version, false, err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES ($1)", version+1); err != nil {
+		return version, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return version, false, err
+	}
+	slog.Info("Applied PostgreSQL migration", "schema", schema, "version", version+1, "name", m.name, "duration", time.Since(start))
+	return version, true, nil
+}
+
+// postgresMigrations is the schema history of a user's PostgreSQL schema,
+// following userDBMigrations. Tables for bookmarks, tags and conversation
+// state are left out, since those features need SQLite. Schemas created
+// before the history was kept already have some of the initial tables and
+// columns, hence IF NOT EXISTS.
+var postgresMigrations = []migration{
+	{"initial schema", execMigration(`
+		-- record_type: 1 = SMS, 2 = MMS, 3 = call
+		CREATE TABLE IF NOT EXISTS messages (
+			id BIGSERIAL PRIMARY KEY,
+			record_type INTEGER NOT NULL DEFAULT 1,
+			address TEXT NOT NULL,
+			body TEXT,
+			type INTEGER NOT NULL,
+			date BIGINT NOT NULL,
+			read INTEGER DEFAULT 0,
+			thread_id BIGINT,
+			subject TEXT,
+			media_type TEXT,
+			media_data BYTEA,
+			protocol INTEGER,
+			status INTEGER,
+			service_center TEXT,
+			sub_id INTEGER,
+			contact_name TEXT,
+			sender TEXT,
+			content_type TEXT,
+			read_report INTEGER,
+			read_status INTEGER,
+			message_id TEXT,
+			message_size BIGINT,
+			message_type INTEGER,
+			sim_slot INTEGER,
+			addresses TEXT,
+			duration INTEGER,
+			presentation INTEGER,
+			subscription_id TEXT,
+			-- Words of the body for full-text search. The simple configuration
+			-- lowercases without stemming, like FTS5's unicode61.
+			body_tsv TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(body, ''))) STORED
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_date ON messages(date);
+		CREATE INDEX IF NOT EXISTS idx_record_type_date ON messages(record_type, date);
+		CREATE INDEX IF NOT EXISTS idx_address_date ON messages(address, date);
+		CREATE INDEX IF NOT EXISTS idx_body_tsv ON messages USING GIN (body_tsv);
+
+		-- Unique constraint for idempotent imports, as in SQLite. The body is
+		-- hashed since B-tree entries are limited to about 2.7kB.
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_message_unique ON messages(record_type, address, date, type, md5(COALESCE(body, '')), COALESCE(content_type, ''), COALESCE(message_id, ''), COALESCE(duration, 0));
+
+		CREATE TABLE IF NOT EXISTS media_meta (
+			message_id BIGINT PRIMARY KEY,
+			width INTEGER,
+			height INTEGER,
+			duration_ms INTEGER
+		);
+
+		CREATE TABLE IF NOT EXISTS media_names (
+			message_id BIGINT PRIMARY KEY,
+			name TEXT NOT NULL
+		);
+	`)},
+	// As migrateMillisecondDates
+	{"millisecond dates", execMigration(`
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS date_ms BIGINT;
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS date_sent BIGINT;
+		UPDATE messages SET date_ms = date * 1000 WHERE date_ms IS NULL;
+		ALTER TABLE messages ALTER COLUMN date_ms SET NOT NULL;
+
+		DROP INDEX IF EXISTS idx_message_unique;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_message_unique_ms ON messages(record_type, address, date_ms, type, md5(COALESCE(body, '')), COALESCE(content_type, ''), COALESCE(message_id, ''), COALESCE(duration, 0));
+
+		CREATE INDEX IF NOT EXISTS idx_date_ms ON messages(date_ms);
+		CREATE INDEX IF NOT EXISTS idx_address_date_ms ON messages(address, date_ms);
+	`)},
+	// As migrateBackupFields
+	{"backup fields", execMigration(`
+		ALTER TABLE messages
+			ADD COLUMN IF NOT EXISTS locked INTEGER,
+			ADD COLUMN IF NOT EXISTS seen INTEGER,
+			ADD COLUMN IF NOT EXISTS creator TEXT,
+			ADD COLUMN IF NOT EXISTS priority INTEGER,
+			ADD COLUMN IF NOT EXISTS delivery_report INTEGER,
+			ADD COLUMN IF NOT EXISTS recipients TEXT,
+			ADD COLUMN IF NOT EXISTS post_dial_digits TEXT,
+			ADD COLUMN IF NOT EXISTS features INTEGER,
+			ADD COLUMN IF NOT EXISTS phone_account_id TEXT,
+			ADD COLUMN IF NOT EXISTS extra TEXT;
+
+		CREATE TABLE IF NOT EXISTS message_parts (
+			message_id BIGINT NOT NULL,
+			position INTEGER NOT NULL,
+			attributes TEXT NOT NULL,
+			data BYTEA,
+			media INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (message_id, position)
+		);
+	`)},
+	// For media lists and archives across all conversations, as SQLite's
+	// idx_media_date_ms
+	{"media index", execMigration(`
+		CREATE INDEX idx_media_date_ms ON messages(date_ms, media_type) WHERE media_type != '';
+	`)},
+}
+
+// pgRebind rewrites ? placeholders as PostgreSQL's $1, $2, ..., leaving
+// string literals alone
+func pgRebind(query string) string {
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pgQueryer runs queries written for SQLite, with ? placeholders, in a
+// transaction on a user's schema. Reads whose SQL is the same on both
+// backends share their SQLite function this way.
+type pgQueryer struct {
+	tx *sql.Tx
+}
+
+func (q pgQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return q.tx.Exec(pgRebind(query), args...)
+}
+
+func (q pgQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return q.tx.Query(pgRebind(query), args...)
+}
+
+func (q pgQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	return q.tx.QueryRow(pgRebind(query), args...)
+}
+
+// begin starts a transaction on the user's schema
+func (s *postgresStore) begin() (*sql.Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("SET LOCAL search_path TO " + s.schema); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// inSchema runs fn in a transaction on the user's schema, committing if it
+// succeeds
+func (s *postgresStore) inSchema(fn func(tx *sql.Tx) error) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) InsertMessage(msg *Message) error {
+	return s.inSchema(func(tx *sql.Tx) error {
+		return pgInsertMessage(tx, msg)
+	})
+}
+
+func (s *postgresStore) InsertCallLog(call *CallLog) error {
+	return s.inSchema(func(tx *sql.Tx) error {
+		return pgInsertCallLog(tx, call)
+	})
+}
+
+func pgInsertMessage(tx *sql.Tx, msg *Message) error {
+	var addresses string
+	if len(msg.Addresses) > 0 {
+		addresses = strings.Join(msg.Addresses, ",")
+	}
+	// MMS messages have ContentType set, SMS messages don't
+	recordType := 1
+	if msg.ContentType != "" {
+		recordType = 2
+	}
+	read := 0
+	if msg.Read {
+		read = 1
+	}
+
+	completed, err := pgCompleteEarlierImport(tx, messageImportKey(recordType, msg),
+		columnAssignments(messageBackupColumns), messageBackupValues(msg))
+	if err != nil {
+		return err
+	}
+	if completed {
+		return insertMessageParts(pgQueryer{tx}, messageImportKey(recordType, msg), msg.Parts)
+	}
+
+	backupValues := messageBackupValues(msg)
+	var id int64
+	err = tx.QueryRow(pgRebind(`
+		INSERT INTO messages (
+			record_type, address, body, type, date, date_ms, read, thread_id, subject, media_type, media_data,
+			protocol, status, service_center, sub_id, contact_name, sender,
+			content_type, read_report, read_status, message_id, message_size, message_type, sim_slot, addresses,
+			`+messageBackupColumns+`
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, `+inPlaceholders(len(backupValues))+`)
+		ON CONFLICT DO NOTHING
+		RETURNING id
+	`), append([]interface{}{
+		recordType, msg.Address, msg.Body, msg.Type, msg.Date.Unix(), msg.Date.UnixMilli(), read, msg.ThreadID, msg.Subject,
+		msg.MediaType, msg.MediaData, msg.Protocol, msg.Status, msg.ServiceCenter, msg.SubID,
+		msg.ContactName, msg.Sender, msg.ContentType, msg.ReadReport, msg.ReadStatus, msg.MessageID,
+		msg.MessageSize, msg.MessageType, msg.SimSlot, addresses,
+	}, backupValues...)...).Scan(&id)
+	if err == sql.ErrNoRows {
+		// Already imported
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	msg.ID = id
+	if err := insertMessageParts(pgQueryer{tx}, messageImportKey(recordType, msg), msg.Parts); err != nil {
+		return err
+	}
+
+	if len(msg.MediaData) > 0 {
+		if width, height, ok := imageDimensions(msg.MediaData); ok {
+			if _, err := tx.Exec(
+				"INSERT INTO media_meta (message_id, width, height) VALUES ($1, $2, $3) ON CONFLICT (message_id) DO UPDATE SET width = excluded.width, height = excluded.height",
+				id, width, height,
+			); err != nil {
+				return err
+			}
+		}
+		if msg.MediaName != "" {
+			if _, err := tx.Exec(
+				"INSERT INTO media_names (message_id, name) VALUES ($1, $2) ON CONFLICT (message_id) DO UPDATE SET name = excluded.name",
+				id, msg.MediaName,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func pgInsertCallLog(tx *sql.Tx, call *CallLog) error {
+	completed, err := pgCompleteEarlierImport(tx, callImportKey(call), columnAssignments(callBackupColumns), callBackupValues(call))
+	if err != nil || completed {
+		return err
+	}
+
+	var id int64
+	err = tx.QueryRow(pgRebind(`
+		INSERT INTO messages (record_type, address, type, date, date_ms, duration, presentation, subscription_id, contact_name,
+			`+callBackupColumns+`)
+		VALUES (3, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+		RETURNING id
+	`), append([]interface{}{
+		call.Number, call.Type, call.Date.Unix(), call.Date.UnixMilli(), call.Duration, call.Presentation, call.SubscriptionID, call.ContactName,
+	}, callBackupValues(call)...)...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	call.ID = id
+	return nil
+}
+
+// pgCompleteEarlierImport is completeEarlierImport for PostgreSQL, which
+// doesn't keep dedup keys
+func pgCompleteEarlierImport(tx *sql.Tx, key importKey, set string, setArgs []interface{}) (bool, error) {
+	query, args := earlierImportUpdate(key, set, setArgs)
+	result, err := tx.Exec(pgRebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *postgresStore) BeginBatch() (MessageBatch, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	return &postgresBatch{tx: tx}, nil
+}
+
+// postgresBatch is a transaction on a user's schema. PostgreSQL aborts a
+// transaction at its first failed statement, so each row is inserted under
+// a savepoint that's rolled back if it fails.
+type postgresBatch struct {
+	tx *sql.Tx
+}
+
+func (b *postgresBatch) row(insert func() error) error {
+	if _, err := b.tx.Exec("SAVEPOINT sbv_row"); err != nil {
+		return err
+	}
+	if err := insert(); err != nil {
+		if _, rollbackErr := b.tx.Exec("ROLLBACK TO SAVEPOINT sbv_row"); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		return err
+	}
+	_, err := b.tx.Exec("RELEASE SAVEPOINT sbv_row")
+	return err
+}
+
+func (b *postgresBatch) InsertMessage(msg *Message) error {
+	return b.row(func() error { return pgInsertMessage(b.tx, msg) })
+}
+
+func (b *postgresBatch) InsertCallLog(call *CallLog) error {
+	return b.row(func() error { return pgInsertCallLog(b.tx, call) })
+}
+
+func (b *postgresBatch) Commit() error {
+	return b.tx.Commit()
+}
+
+func (b *postgresBatch) Rollback() error {
+	return b.tx.Rollback()
+}
+
+// pgTemplatedBody is templatedBody for PostgreSQL, whose LIKE is case
+// sensitive and which has regular expressions in place of GLOB
+func pgTemplatedBody(col string) string {
+	body := "COALESCE(" + col + ", '')"
+	var conds []string
+	for _, phrase := range automatedPhrases {
+		conds = append(conds, body+" ILIKE '%"+strings.ReplaceAll(phrase, "'", "''")+"%'")
+	}
+	conds = append(conds, "("+body+" ILIKE '%code%' AND "+body+" ~ '[0-9]{4}')")
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+// pgSenderStats computes the sender_stats table of the SQLite schema from
+// messages, which SQLite keeps up to date with triggers
+var pgSenderStats = `(SELECT address, COUNT(*) AS messages,
+		COUNT(*) FILTER (WHERE type = 2) AS sent,
+		COUNT(*) FILTER (WHERE ` + pgTemplatedBody("body") + `) AS templated
+	FROM messages WHERE record_type IN (1, 2) GROUP BY address)`
+
+// pgSenderCategoryExpr is senderCategoryExpr for PostgreSQL
+func pgSenderCategoryExpr(addressCol, stats string) string {
+	return `CASE
+		WHEN ` + addressCol + ` LIKE '%,%' THEN 'personal'
+		WHEN ` + addressCol + ` ~ '[A-Za-z]' AND ` + addressCol + ` NOT LIKE '%@%' THEN 'automated'
+		WHEN ` + addressCol + ` !~ '[^0-9]' AND LENGTH(` + addressCol + `) BETWEEN 3 AND 6 THEN 'automated'
+		WHEN ` + stats + `.messages > 0 AND ` + stats + `.sent = 0 AND ` + stats + `.templated * 2 >= ` + stats + `.messages THEN 'automated'
+		ELSE 'personal'
+	END`
+}
+
+// pgSenderCategoryCondition is senderCategoryCondition for PostgreSQL
+func pgSenderCategoryCondition(prefix, category string) (string, error) {
+	automated := "SELECT s.address FROM " + pgSenderStats + " s WHERE " + pgSenderCategoryExpr("s.address", "s") + " = 'automated'"
+	switch category {
+	case "":
+		return "", nil
+	case SenderCategoryAutomated:
+		return " AND " + prefix + "address IN (" + automated + ")", nil
+	case SenderCategoryPersonal:
+		return " AND " + prefix + "address NOT IN (" + automated + ")", nil
+	}
+	return "", fmt.Errorf("%w, not %q", ErrInvalidCategory, category)
+}
+
+// pgTagCondition filters by a tag. Tags need SQLite, so with PostgreSQL no
+// message or conversation has one.
+func pgTagCondition(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	return " AND FALSE"
+}
+
+// pgShowCondition is conversationShowCondition for PostgreSQL, where
+// conversations are never archived or hidden
+func pgShowCondition(show string) (string, error) {
+	switch show {
+	case ConversationsShowDefault, ConversationsShowAll:
+		return "", nil
+	case ConversationsShowArchived, ConversationsShowHidden:
+		return " AND FALSE", nil
+	}
+	return "", fmt.Errorf("%w: unknown view %q", ErrInvalidConversationState, show)
+}
+
+// pgActivityAnnotations are activityColumns' annotations for PostgreSQL,
+// where messages have no bookmarks or tags
+const pgActivityAnnotations = "FALSE, '', NULL::text"
+
+func (s *postgresStore) GetConversations(startDate, endDate *time.Time, tag, show, category string) ([]Conversation, error) {
+	filter := "1=1"
+	args := []interface{}{}
+	if startDate != nil {
+		filter += " AND date >= ?"
+		args = append(args, startDate.Unix())
+	}
+	if endDate != nil {
+		filter += " AND date <= ?"
+		args = append(args, endDate.Unix())
+	}
+	filter += pgTagCondition(tag)
+	stateCond, err := pgShowCondition(show)
+	if err != nil {
+		return nil, err
+	}
+	filter += stateCond
+	categoryCond, err := pgSenderCategoryCondition("", category)
+	if err != nil {
+		return nil, err
+	}
+	filter += categoryCond
+
+	query := `
+		WITH
+		agg AS (
+			SELECT
+				address,
+				MAX(COALESCE(contact_name, ''))                                AS contact_name,
+				MAX(CASE WHEN subject != '' THEN subject ELSE NULL END)        AS subject,
+				MAX(date_ms)                                                    AS last_date,
+				COUNT(*)                                                        AS activity_count
+			FROM messages
+			WHERE ` + filter + `
+			GROUP BY address
+		)
+		SELECT
+			agg.address,
+			agg.contact_name,
+			COALESCE(agg.subject, '') AS subject,
+			(
+				SELECT
+					CASE
+						WHEN m.record_type = 3 AND m.type = 1 THEN 'Incoming call'
+						WHEN m.record_type = 3 AND m.type = 2 THEN 'Outgoing call'
+						WHEN m.record_type = 3 AND m.type = 3 THEN 'Missed call'
+						WHEN m.record_type = 3 AND m.type = 4 THEN 'Voicemail'
+						WHEN m.record_type = 3 AND m.type = 5 THEN 'Rejected call'
+						WHEN m.record_type = 3 AND m.type = 6 THEN 'Refused call'
+						ELSE COALESCE(m.body, '')
+					END
+				FROM messages m
+				WHERE m.address = agg.address AND m.date_ms = agg.last_date
+				ORDER BY m.id
+				LIMIT 1
+			) AS last_message,
+			agg.last_date,
+			agg.activity_count,
+			` + pgSenderCategoryExpr("agg.address", "ss") + `
+		FROM agg
+		LEFT JOIN ` + pgSenderStats + ` ss ON ss.address = agg.address
+		ORDER BY agg.last_date DESC
+	`
+
+	conversations := []Conversation{}
+	err = s.inSchema(func(tx *sql.Tx) error {
+		rows, err := tx.Query(pgRebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var c Conversation
+			var lastDateMs int64
+			err := rows.Scan(&c.Address, &c.ContactName, &c.Subject, &c.LastMessage, &lastDateMs, &c.MessageCount, &c.Category)
+			if err != nil {
+				return err
+			}
+			c.LastDate = time.UnixMilli(lastDateMs)
+			c.Type = "conversation"
+			conversations = append(conversations, c)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+// pgActivityFilter is the condition on messages for an address and date
+// range
+func pgActivityFilter(address string, startDate, endDate *time.Time) (string, []interface{}) {
+	filter := ""
+	args := []interface{}{}
+	if address != "" {
+		filter += " AND address = ?"
+		args = append(args, address)
+	}
+	if startDate != nil {
+		filter += " AND date >= ?"
+		args = append(args, startDate.Unix())
+	}
+	if endDate != nil {
+		filter += " AND date <= ?"
+		args = append(args, endDate.Unix())
+	}
+	return filter, args
+}
+
+func (s *postgresStore) GetActivityByAddress(address string, startDate, endDate *time.Time, limit, offset int) ([]ActivityItem, error) {
+	return s.getActivity(address, startDate, endDate, "", limit, offset)
+}
+
+func (s *postgresStore) GetActivity(startDate, endDate *time.Time, tag string, limit, offset int) ([]ActivityItem, error) {
+	return s.getActivity("", startDate, endDate, tag, limit, offset)
+}
+
+func (s *postgresStore) getActivity(address string, startDate, endDate *time.Time, tag string, limit, offset int) ([]ActivityItem, error) {
+	filter, args := pgActivityFilter(address, startDate, endDate)
+	filter += pgTagCondition(tag)
+	query := `
+		SELECT ` + activityColumns(pgActivityAnnotations) + `
+		FROM messages
+		WHERE 1=1` + filter + `
+		ORDER BY date_ms ASC, id ASC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	var activities []ActivityItem
+	err := s.inSchema(func(tx *sql.Tx) error {
+		rows, err := tx.Query(pgRebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		activities, err = scanActivities(rows)
+		return err
+	})
+	return activities, err
+}
+
+func (s *postgresStore) CountActivityByAddress(address string, startDate, endDate *time.Time) (int, error) {
+	filter, args := pgActivityFilter(address, startDate, endDate)
+	var count int
+	err := s.inSchema(func(tx *sql.Tx) error {
+		return tx.QueryRow(pgRebind("SELECT COUNT(*) FROM messages WHERE 1=1"+filter), args...).Scan(&count)
+	})
+	return count, err
+}
+
+func (s *postgresStore) GetMessages(address string, startDate, endDate *time.Time) (messages []Message, err error) {
+	err = s.inSchema(func(tx *sql.Tx) error {
+		messages, err = GetMessages(pgQueryer{tx}, address, startDate, endDate)
+		return err
+	})
+	return messages, err
+}
+
+func (s *postgresStore) GetCallLogs(number string, startDate, endDate *time.Time) (calls []CallLog, err error) {
+	err = s.inSchema(func(tx *sql.Tx) error {
+		calls, err = GetCallLogs(pgQueryer{tx}, number, startDate, endDate)
+		return err
+	})
+	return calls, err
+}
+
+func (s *postgresStore) GetAllCalls(startDate, endDate *time.Time, limit, offset int) (calls []CallLog, err error) {
+	err = s.inSchema(func(tx *sql.Tx) error {
+		calls, err = GetAllCalls(pgQueryer{tx}, startDate, endDate, limit, offset)
+		return err
+	})
+	return calls, err
+}
+
+func (s *postgresStore) GetDateRange() (minDate, maxDate time.Time, err error) {
+	err = s.inSchema(func(tx *sql.Tx) error {
+		minDate, maxDate, err = GetDateRange(pgQueryer{tx})
+		return err
+	})
+	return minDate, maxDate, err
+}
+
+func (s *postgresStore) GetMediaByAddress(address string, startDate, endDate *time.Time) (items []Message, err error) {
+	err = s.inSchema(func(tx *sql.Tx) error {
+		items, err = GetMediaByAddress(pgQueryer{tx}, address, startDate, endDate)
+		return err
+	})
+	return items, err
+}
+
+func (s *postgresStore) GetMediaInfo(messageID string) (info *MediaInfo, err error) {
+	err = s.inSchema(func(tx *sql.Tx) error {
+		info, err = GetMediaInfo(pgQueryer{tx}, messageID)
+		return err
+	})
+	return info, err
+}
+
+func (s *postgresStore) GetMedia(messageID string) (data []byte, mediaType string, err error) {
+	err = s.inSchema(func(tx *sql.Tx) error {
+		data, mediaType, err = getRawMessageMedia(pgQueryer{tx}, messageID)
+		return err
+	})
+	return data, mediaType, err
+}
+
+func (s *postgresStore) MediaReader(messageID string, size int64) io.ReadSeeker {
+	return newMediaBlobReader(size, func(offset, n int64) (chunk []byte, err error) {
+		err = s.inSchema(func(tx *sql.Tx) error {
+			chunk, err = mediaChunk(pgQueryer{tx}, messageID, offset, n)
+			return err
+		})
+		return chunk, err
+	})
+}
+
+func (s *postgresStore) GetMediaArchiveItems(filter GalleryFilter) (items []GalleryItem, err error) {
+	conds, args, err := pgGalleryConditions(filter)
+	if err != nil {
+		return nil, err
+	}
+	err = s.inSchema(func(tx *sql.Tx) error {
+		items, err = mediaArchiveItems(pgQueryer{tx}, conds, args)
+		return err
+	})
+	return items, err
+}
+
+// pgMediaKindConditions are galleryKindConditions for PostgreSQL, whose
+// string comparisons follow the database's collation, which may not order
+// "image/" before "image0"
+var pgMediaKindConditions = map[string]string{
+	"image": "m.media_type LIKE 'image/%'",
+	"video": "m.media_type LIKE 'video/%'",
+	"audio": "m.media_type LIKE 'audio/%'",
+	"vcard": galleryKindConditions["vcard"],
+}
+
+// pgMediaKindCondition is the condition on messages m for any of the given
+// media kinds
+func pgMediaKindCondition(kinds []string) (string, error) {
+	if len(kinds) == 0 {
+		return "", nil
+	}
+	var conds []string
+	for _, kind := range kinds {
+		cond, ok := pgMediaKindConditions[kind]
+		if !ok {
+			return "", fmt.Errorf("unknown media kind %q", kind)
+		}
+		conds = append(conds, cond)
+	}
+	return " AND (" + strings.Join(conds, " OR ") + ")", nil
+}
+
+// pgGalleryConditions is galleryConditions for PostgreSQL
+func pgGalleryConditions(filter GalleryFilter) (string, []interface{}, error) {
+	kinds, err := pgMediaKindCondition(filter.Kinds)
+	if err != nil {
+		return "", nil, err
+	}
+	rest := filter
+	rest.Kinds = nil
+	rest.Tag = ""
+	conds, args, err := galleryConditions(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	return kinds + conds + pgTagCondition(filter.Tag), args, nil
+}
+
+// pgSearchConditions is searchConditions for PostgreSQL
+func pgSearchConditions(opts SearchOptions) (string, []interface{}, error) {
+	var query string
+	args := []interface{}{}
+
+	if opts.Contact != "" {
+		like := "%" + escapeLike(opts.Contact) + "%"
+		query += ` AND (m.address ILIKE ? ESCAPE '\' OR m.contact_name ILIKE ? ESCAPE '\')`
+		args = append(args, like, like)
+	}
+
+	switch opts.Direction {
+	case "":
+	case "sent":
+		query += " AND m.type = 2"
+	case "received":
+		query += " AND m.type = 1"
+	default:
+		return "", nil, fmt.Errorf("%w: direction must be sent or received", ErrInvalidSearch)
+	}
+
+	switch opts.RecordType {
+	case "":
+	case "sms":
+		query += " AND m.record_type = 1"
+	case "mms":
+		query += " AND m.record_type = 2"
+	case "call":
+		query += " AND m.record_type = 3"
+	default:
+		return "", nil, fmt.Errorf("%w: type must be sms, mms or call", ErrInvalidSearch)
+	}
+
+	if opts.HasMedia {
+		query += " AND m.media_type != ''"
+	}
+	kinds, err := pgMediaKindCondition(opts.MediaKinds)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidSearch, err)
+	}
+	query += kinds
+
+	switch opts.Conversation {
+	case "":
+	case "group":
+		query += " AND m.address LIKE '%,%'"
+	case "direct":
+		query += " AND m.address NOT LIKE '%,%'"
+	default:
+		return "", nil, fmt.Errorf("%w: conversation must be group or direct", ErrInvalidSearch)
+	}
+
+	if opts.StartDate != nil {
+		query += " AND m.date >= ?"
+		args = append(args, opts.StartDate.Unix())
+	}
+	if opts.EndDate != nil {
+		query += " AND m.date <= ?"
+		args = append(args, opts.EndDate.Unix())
+	}
+	query += pgTagCondition(opts.Tag)
+	if opts.Category != "" {
+		cond, err := pgSenderCategoryCondition("m.", opts.Category)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrInvalidSearch, err)
+		}
+		query += cond
+	}
+	if opts.AfterID > 0 {
+		query += " AND m.id > ?"
+		args = append(args, opts.AfterID)
+	}
+
+	return query, args, nil
+}
+
+// pgTermQuery returns a tsquery expression for a search term: its words as
+// a phrase, the last of them a prefix if the term is one
+func pgTermQuery(t searchTerm) (string, interface{}, bool) {
+	if !t.prefix {
+		return "phraseto_tsquery('simple', ?)", t.text, true
+	}
+	words := strings.FieldsFunc(t.text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return "", nil, false
+	}
+	for i, w := range words {
+		words[i] = "'" + w + "'"
+	}
+	return "to_tsquery('simple', ?)", strings.Join(words, " <-> ") + ":*", true
+}
+
+// pgSubstringCondition returns a condition matching a term anywhere in a
+// message body
+func pgSubstringCondition(t searchTerm) (string, interface{}, bool) {
+	return `COALESCE(m.body, '') ILIKE ? ESCAPE '\'`, "%" + escapeLike(t.text) + "%", true
+}
+
+// SearchMessages searches message bodies with a tsvector index. Word and
+// prefix searches match words as FTS5 does and substring searches are
+// case-insensitive scans, but unlike SQLite neither folds diacritics. Fuzzy
+// and regex searches aren't supported.
+func (s *postgresStore) SearchMessages(opts SearchOptions) (*SearchPage, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	if opts.Mode == SearchModeFuzzy || opts.Mode == SearchModeRegex {
+		return nil, fmt.Errorf("%w: %s search isn't available with PostgreSQL", ErrInvalidSearch, opts.Mode)
+	}
+
+	terms, err := ParseSearchQuery(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conds, args, err := pgSearchConditions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	substring := false
+	switch opts.Mode {
+	case "", SearchModeWords:
+	case SearchModePrefix:
+		for i := range terms {
+			terms[i].prefix = true
+		}
+	case SearchModeSubstring:
+		substring = true
+	default:
+		return nil, fmt.Errorf("%w: mode must be words, prefix, substring, fuzzy or regex", ErrInvalidSearch)
+	}
+
+	from := " FROM messages m WHERE 1=1"
+	snippet := "substr(COALESCE(m.body, ''), 1, 200)"
+	order := ""
+	var match, exclude string
+	var matchArgs, excludeArgs []interface{}
+	if substring {
+		match, matchArgs, exclude, excludeArgs = combineTerms(terms, " AND ", " OR ", pgSubstringCondition)
+		if match != "" {
+			// Highlighted from the whole body once fetched
+			from = " FROM messages m WHERE (" + match + ")"
+			snippet = "COALESCE(m.body, '')"
+			order = "m.date_ms DESC, m.id DESC"
+		}
+		if exclude != "" {
+			exclude = " AND NOT (" + exclude + ")"
+		}
+	} else {
+		match, matchArgs, exclude, excludeArgs = combineTerms(terms, " && ", " || ", pgTermQuery)
+		if match != "" {
+			from = " FROM messages m, (SELECT " + match + " AS q) sq WHERE m.body_tsv @@ sq.q"
+			snippet = "ts_headline('simple', COALESCE(m.body, ''), sq.q, 'StartSel=<mark>, StopSel=</mark>, MaxWords=35, MinWords=15')"
+			order = "ts_rank(m.body_tsv, sq.q) DESC, m.id"
+		}
+		if exclude != "" {
+			exclude = " AND NOT m.body_tsv @@ (" + exclude + ")"
+		}
+	}
+	// A query with nothing to match and no filters (empty, or only
+	// negations) would list every message; treat it as an empty search
+	if match == "" && conds == "" {
+		return &SearchPage{Results: []SearchResult{}}, nil
+	}
+	args = append(matchArgs, args...)
+	conds += exclude
+	args = append(args, excludeArgs...)
+
+	if opts.Sort != "" && opts.Sort != "date" && opts.Sort != "relevance" {
+		return nil, fmt.Errorf("%w: sort must be relevance or date", ErrInvalidSearch)
+	}
+	byDate := opts.Sort == "date" || match == ""
+
+	query := `
+		SELECT m.id, m.address, COALESCE(m.contact_name, ''), COALESCE(m.body, ''), m.date_ms, ` + snippet + `, FALSE` + from + conds
+	countArgs := args
+	offset := int64(0)
+	if byDate {
+		if opts.Cursor != "" {
+			parts, err := decodeSearchCursor(opts.Cursor, 2)
+			if err != nil {
+				return nil, err
+			}
+			query += " AND (m.date_ms < ? OR (m.date_ms = ? AND m.id < ?))"
+			args = append(args, parts[0], parts[0], parts[1])
+		}
+		query += " ORDER BY m.date_ms DESC, m.id DESC LIMIT ?"
+		args = append(args, limit+1)
+	} else {
+		if opts.Cursor != "" {
+			parts, err := decodeSearchCursor(opts.Cursor, 1)
+			if err != nil {
+				return nil, err
+			}
+			offset = parts[0]
+		}
+		query += " ORDER BY " + order + " LIMIT ? OFFSET ?"
+		args = append(args, limit+1, offset)
+	}
+
+	page := &SearchPage{Results: []SearchResult{}}
+	err = s.inSchema(func(tx *sql.Tx) error {
+		if err := tx.QueryRow(pgRebind("SELECT COUNT(*)"+from+conds), countArgs...).Scan(&page.Total); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(pgRebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var r SearchResult
+			var dateMs int64
+			if err := rows.Scan(&r.MessageID, &r.Address, &r.ContactName, &r.Body, &dateMs, &r.Snippet, &r.Bookmarked); err != nil {
+				return err
+			}
+			r.Date = time.UnixMilli(dateMs)
+			if substring && match != "" {
+				r.Snippet = highlightSpans(r.Snippet, substringSpans(r.Snippet, terms))
+			}
+			page.Results = append(page.Results, r)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		if byDate {
+			last := page.Results[limit-1]
+			page.NextCursor = encodeSearchCursor(last.Date.UnixMilli(), last.MessageID)
+		} else {
+			page.NextCursor = encodeSearchCursor(offset + int64(limit))
+		}
+	}
+	return page, nil
+}
+
+// GetAnalytics computes the Summary tab as the SQLite queries do. Days in
+// the daily trend are those of the database session's TimeZone setting
+// rather than the server's local time.
+func (s *postgresStore) GetAnalytics(startDate, endDate *time.Time, tag, category string, exclude []string, topN int, tzOffsetMinutes int) (*AnalyticsResponse, error) {
+	dateFilter := ""
+	args := []interface{}{}
+	if startDate != nil {
+		dateFilter += " AND date >= ?"
+		args = append(args, startDate.Unix())
+	}
+	if endDate != nil {
+		dateFilter += " AND date <= ?"
+		args = append(args, endDate.Unix())
+	}
+	dateFilter += pgTagCondition(tag)
+	// No conversation has flags to exclude it by, but they're still checked
+	if _, err := conversationExcludeCondition(exclude); err != nil {
+		return nil, err
+	}
+	categoryCond, err := pgSenderCategoryCondition("", category)
+	if err != nil {
+		return nil, err
+	}
+	dateFilter += categoryCond
+
+	analytics := &AnalyticsResponse{}
+	err = s.inSchema(func(tx *sql.Tx) error {
+		err := tx.QueryRow(pgRebind(`
+			SELECT
+				COUNT(*),
+				COUNT(*) FILTER (WHERE record_type = 1),
+				COUNT(*) FILTER (WHERE record_type = 2),
+				COUNT(*) FILTER (WHERE record_type = 3),
+				COUNT(*) FILTER (WHERE record_type IN (1, 2) AND type = 2),
+				COUNT(*) FILTER (WHERE record_type IN (1, 2) AND type = 1),
+				COUNT(*) FILTER (WHERE record_type = 3 AND type = 1),
+				COUNT(*) FILTER (WHERE record_type = 3 AND type = 2),
+				COUNT(*) FILTER (WHERE record_type = 3 AND type = 3),
+				COALESCE(SUM(duration) FILTER (WHERE record_type = 3), 0),
+				COALESCE(AVG(LENGTH(body)) FILTER (WHERE record_type IN (1, 2) AND body != ''), 0)::float8
+			FROM messages
+			WHERE 1=1 `+dateFilter), args...).Scan(
+			&analytics.TotalMessages,
+			&analytics.TotalSMS,
+			&analytics.TotalMMS,
+			&analytics.TotalCalls,
+			&analytics.TotalSent,
+			&analytics.TotalReceived,
+			&analytics.IncomingCalls,
+			&analytics.OutgoingCalls,
+			&analytics.MissedCalls,
+			&analytics.TotalCallDuration,
+			&analytics.AvgMessageLength,
+		)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(pgRebind(`
+			SELECT
+				address,
+				MAX(COALESCE(contact_name, '')),
+				COUNT(*) AS message_count,
+				COUNT(*) FILTER (WHERE type = 2),
+				COUNT(*) FILTER (WHERE type = 1)
+			FROM messages
+			WHERE record_type IN (1, 2) `+dateFilter+`
+			GROUP BY address
+			ORDER BY message_count DESC
+			LIMIT ?`), append(args, topN)...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var c TopContact
+			if err := rows.Scan(&c.Address, &c.ContactName, &c.MessageCount, &c.SentCount, &c.ReceivedCount); err != nil {
+				rows.Close()
+				return err
+			}
+			analytics.TopContacts = append(analytics.TopContacts, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		analytics.HourlyDistribution = make([]HourlyDistribution, 24)
+		for i := range analytics.HourlyDistribution {
+			analytics.HourlyDistribution[i].Hour = i
+		}
+		rows, err = tx.Query(pgRebind(`
+			SELECT
+				EXTRACT(HOUR FROM to_timestamp(date + `+strconv.Itoa(tzOffsetMinutes*60)+`) AT TIME ZONE 'UTC')::int AS hour,
+				COUNT(*)
+			FROM messages
+			WHERE record_type IN (1, 2) `+dateFilter+`
+			GROUP BY hour`), args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var hour, count int
+			if err := rows.Scan(&hour, &count); err != nil {
+				rows.Close()
+				return err
+			}
+			analytics.HourlyDistribution[hour].Count = count
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = tx.Query(pgRebind(`
+			SELECT
+				to_char(to_timestamp(date), 'YYYY-MM-DD') AS day,
+				COUNT(*)
+			FROM messages
+			WHERE record_type IN (1, 2) `+dateFilter+`
+			GROUP BY day
+			ORDER BY day`), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var d DailyCount
+			if err := rows.Scan(&d.Date, &d.Count); err != nil {
+				return err
+			}
+			analytics.DailyTrend = append(analytics.DailyTrend, d)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return analytics, nil
+}
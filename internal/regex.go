@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// newRegexpFunc returns a REGEXP implementation backed by Go's regexp
+// package, for sqliteFunctions. Each connection keeps the last pattern it
+// compiled, since a query evaluates the same pattern against every row.
+func newRegexpFunc() interface{} {
+	var lastPattern string
+	var lastRe *regexp.Regexp
+	return func(pattern, s string) (bool, error) {
+		if lastRe == nil || pattern != lastPattern {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return false, err
+			}
+			lastPattern, lastRe = pattern, re
+		}
+		return lastRe.MatchString(s), nil
+	}
+}
+
+// Regex searches can't use an index, so they scan every message within
+// their filters. These bound how long that can take.
+const (
+	regexSearchTimeout = 10 * time.Second
+	// regexMatchLimit caps how many matches a regex search counts
+	regexMatchLimit = 10000
+)
+
+// searchRegex implements SearchModeRegex. The whole query is the pattern, in
+// Go regexp syntax, so operators aren't recognized; filters come from opts.
+// Results are newest first, and Total stops counting at regexMatchLimit.
+func searchRegex(userDB *sql.DB, opts SearchOptions, limit int) (*SearchPage, error) {
+	re, err := regexp.Compile(opts.Query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSearch, err)
+	}
+	if opts.Sort != "" && opts.Sort != "date" {
+		return nil, fmt.Errorf("%w: regex results can only be sorted by date", ErrInvalidSearch)
+	}
+
+	conds, args, err := searchConditions(opts)
+	if err != nil {
+		return nil, err
+	}
+	from := ` FROM messages m WHERE COALESCE(m.body, '') REGEXP ?` + conds
+	args = append([]interface{}{opts.Query}, args...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), regexSearchTimeout)
+	defer cancel()
+
+	page := &SearchPage{Results: []SearchResult{}}
+	if err := userDB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM (SELECT 1"+from+" LIMIT ?)", append(args, regexMatchLimit)...,
+	).Scan(&page.Total); err != nil {
+		return nil, regexSearchError(ctx, err)
+	}
+
+	query := `SELECT m.id, m.address, COALESCE(m.contact_name, ''), COALESCE(m.body, ''), m.date_ms, ` + bookmarkedColumn + from
+	if opts.Cursor != "" {
+		parts, err := decodeSearchCursor(opts.Cursor, 2)
+		if err != nil {
+			return nil, err
+		}
+		query += " AND (m.date_ms < ? OR (m.date_ms = ? AND m.id < ?))"
+		args = append(args, parts[0], parts[0], parts[1])
+	}
+	query += " ORDER BY m.date_ms DESC, m.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := userDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, regexSearchError(ctx, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r SearchResult
+		var dateMs int64
+		if err := rows.Scan(&r.MessageID, &r.Address, &r.ContactName, &r.Body, &dateMs, &r.Bookmarked); err != nil {
+			return nil, err
+		}
+		r.Date = time.UnixMilli(dateMs)
+		var spans [][2]int
+		for _, loc := range re.FindAllStringIndex(r.Body, -1) {
+			// Empty matches (e.g. from x*) have nothing to highlight
+			if loc[1] > loc[0] {
+				spans = append(spans, [2]int{loc[0], loc[1]})
+			}
+		}
+		r.Snippet = highlightSpans(r.Body, spans)
+		page.Results = append(page.Results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, regexSearchError(ctx, err)
+	}
+
+	if len(page.Results) > limit {
+		last := page.Results[limit-1]
+		page.Results = page.Results[:limit]
+		page.NextCursor = encodeSearchCursor(last.Date.UnixMilli(), last.MessageID)
+	}
+	return page, nil
+}
+
+// regexSearchError reports a search that ran out of time as the user's to
+// fix, since narrowing the filters is the remedy
+func regexSearchError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: regex search timed out; narrow it with a date range or contact", ErrInvalidSearch)
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Retention rule actions
+const (
+	RetentionDelete     = "delete"      // delete matching messages and calls
+	RetentionStripMedia = "strip_media" // drop attachments, keeping the text
+)
+
+// ErrInvalidRetentionRule is returned by RetentionRule.Validate
+var ErrInvalidRetentionRule = errors.New("invalid retention rule")
+
+// RetentionRule removes data older than a number of days, optionally only
+// of one record type or sender category. Rules are part of a user's
+// Settings and enforced daily by EnforceRetentionPolicies.
+type RetentionRule struct {
+	Action        string `json:"action"`
+	RecordType    string `json:"type,omitempty"`     // "sms", "mms" or "call"; all when empty
+	Category      string `json:"category,omitempty"` // SenderCategoryPersonal or SenderCategoryAutomated
+	OlderThanDays int    `json:"older_than_days"`
+	// Tombstone records deleted messages, so re-importing a backup that
+	// still has them doesn't bring them back. Only for RetentionDelete;
+	// stripped media isn't restored by re-imports anyway.
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// Validate checks the rule is one ApplyRetention can run
+func (r RetentionRule) Validate() error {
+	switch r.Action {
+	case RetentionDelete:
+	case RetentionStripMedia:
+		if r.RecordType == "call" {
+			return fmt.Errorf("%w: calls have no media", ErrInvalidRetentionRule)
+		}
+		if r.Tombstone {
+			return fmt.Errorf("%w: tombstone only applies to delete", ErrInvalidRetentionRule)
+		}
+	default:
+		return fmt.Errorf("%w: action must be %s or %s", ErrInvalidRetentionRule, RetentionDelete, RetentionStripMedia)
+	}
+	if r.OlderThanDays < 1 {
+		return fmt.Errorf("%w: older_than_days must be at least 1", ErrInvalidRetentionRule)
+	}
+	if _, _, err := r.filter(time.Now()).conditions(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRetentionRule, err)
+	}
+	return nil
+}
+
+// filter selects what the rule applies to as of now
+func (r RetentionRule) filter(now time.Time) DeleteFilter {
+	cutoff := now.AddDate(0, 0, -r.OlderThanDays)
+	return DeleteFilter{RecordType: r.RecordType, Category: r.Category, EndDate: &cutoff}
+}
+
+// RetentionResult is what one rule removed, or would remove in a dry run
+type RetentionResult struct {
+	Rule       RetentionRule `json:"rule"`
+	Matched    int           `json:"matched"`     // messages deleted or stripped
+	MediaBytes int64         `json:"media_bytes"` // attachment data removed with them
+}
+
+// RetentionReport is the outcome of applying a user's retention rules
+type RetentionReport struct {
+	DryRun  bool              `json:"dry_run"`
+	RanAt   time.Time         `json:"ran_at"`
+	Results []RetentionResult `json:"results"`
+}
+
+// ApplyRetention runs rules in order against a user's messages. With dryRun
+// set nothing is changed; the report says what would be removed.
+func ApplyRetention(userID string, userDB *sql.DB, rules []RetentionRule, dryRun bool) (*RetentionReport, error) {
+	now := time.Now()
+	report := &RetentionReport{DryRun: dryRun, RanAt: now, Results: []RetentionResult{}}
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		filter := rule.filter(now)
+		where, args, err := filter.conditions()
+		if err != nil {
+			return nil, err
+		}
+		if rule.Action == RetentionStripMedia {
+			where += " AND media_type != ''"
+		}
+
+		result := RetentionResult{Rule: rule}
+		if err := userDB.QueryRow(
+			"SELECT COUNT(*), COALESCE(SUM(LENGTH(media_data)), 0) FROM messages WHERE "+where, args...,
+		).Scan(&result.Matched, &result.MediaBytes); err != nil {
+			return nil, err
+		}
+
+		if !dryRun && result.Matched > 0 {
+			switch rule.Action {
+			case RetentionDelete:
+				result.Matched, err = DeleteMessages(userID, userDB, filter, rule.Tombstone)
+			case RetentionStripMedia:
+				result.Matched, err = stripMedia(userID, userDB, where, args)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply %s rule: %w", rule.Action, err)
+			}
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, nil
+}
+
+// stripMedia removes the attachments of the messages matching where, along
+// with their metadata and cached conversions, and returns how many
+// messages lost one. The message text stays. Re-importing doesn't restore
+// the media, since the import dedup key doesn't cover it.
+func stripMedia(userID string, userDB *sql.DB, where string, args []interface{}) (int, error) {
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	tx, err := userDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var ids []int64
+	rows, err := tx.Query("SELECT id FROM messages WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, table := range []string{"media_meta", "media_names"} {
+		if _, err := tx.Exec(
+			"DELETE FROM "+table+" WHERE message_id IN (SELECT id FROM messages WHERE "+where+")", args...,
+		); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(
+		"UPDATE message_parts SET data = NULL WHERE message_id IN (SELECT id FROM messages WHERE "+where+")", args...,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE messages SET media_data = NULL, media_type = '' WHERE "+where, args...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if mediaCache != nil && len(ids) > 0 {
+		mediaCache.removeMessages(userID, ids)
+	}
+	return len(ids), nil
+}
+
+// EnforceRetentionPolicies applies every user's retention rules, logging
+// what each removed. A failure for one user doesn't stop the others.
+func EnforceRetentionPolicies() {
+	users, err := ListUsers()
+	if err != nil {
+		slog.Error("Failed to list users for retention", "error", err)
+		return
+	}
+	for _, user := range users {
+		settings, err := GetUserSettings(user.ID)
+		if err != nil {
+			slog.Error("Failed to get settings for retention", "userID", user.ID, "error", err)
+			continue
+		}
+		if len(settings.Retention) == 0 {
+			continue
+		}
+		userDB, err := GetUserDB(user.ID, user.Username)
+		if errors.Is(err, ErrDatabaseLocked) {
+			slog.Info("Skipping retention until user logs in", "userID", user.ID)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to open database for retention", "userID", user.ID, "error", err)
+			continue
+		}
+		report, err := ApplyRetention(user.ID, userDB, settings.Retention, false)
+		if err != nil {
+			slog.Error("Failed to apply retention rules", "userID", user.ID, "error", err)
+			continue
+		}
+		logRetentionReport(user.ID, report)
+	}
+}
+
+// logRetentionReport logs what each rule of an applied report removed
+func logRetentionReport(userID string, report *RetentionReport) {
+	for _, r := range report.Results {
+		if r.Matched == 0 {
+			continue
+		}
+		slog.Info("Retention rule applied", "userID", userID, "action", r.Rule.Action,
+			"type", r.Rule.RecordType, "category", r.Rule.Category, "older_than_days", r.Rule.OlderThanDays,
+			"removed", r.Matched, "media_bytes", r.MediaBytes)
+	}
+}
+
+// HandleRetention handles GET /api/retention (a dry run of the saved
+// rules) and POST /api/retention (applying them now)
+func HandleRetention(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	settings, err := GetUserSettings(userID)
+	if err != nil {
+		slog.Error("Error getting settings", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get settings",
+		})
+	}
+
+	dryRun := c.Request().Method != http.MethodPost
+	report, err := ApplyRetention(userID, userDB, settings.Retention, dryRun)
+	if err != nil {
+		slog.Error("Error applying retention rules", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to apply retention rules",
+		})
+	}
+	if !dryRun {
+		logRetentionReport(userID, report)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SavedSearch is a search a user runs repeatedly. After each import the
+// messages it newly matches are counted into LastImportMatches.
+type SavedSearch struct {
+	ID                int64      `json:"id"`
+	Name              string     `json:"name"`
+	Query             string     `json:"query"`
+	Mode              string     `json:"mode,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	LastImportAt      *time.Time `json:"last_import_at,omitempty"`
+	LastImportMatches int        `json:"last_import_matches"`
+}
+
+// SavedSearchMatch is the number of newly imported messages matching a
+// saved search
+type SavedSearchMatch struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	Count int    `json:"count"`
+}
+
+const savedSearchColumns = `id, name, query, mode, created_at, updated_at, last_import_at, last_import_matches`
+
+func scanSavedSearch(row interface{ Scan(...interface{}) error }) (SavedSearch, error) {
+	var s SavedSearch
+	var createdAt, updatedAt int64
+	var lastImportAt sql.NullInt64
+	if err := row.Scan(&s.ID, &s.Name, &s.Query, &s.Mode, &createdAt, &updatedAt, &lastImportAt, &s.LastImportMatches); err != nil {
+		return SavedSearch{}, err
+	}
+	s.CreatedAt = time.Unix(createdAt, 0)
+	s.UpdatedAt = time.Unix(updatedAt, 0)
+	if lastImportAt.Valid {
+		t := time.Unix(lastImportAt.Int64, 0)
+		s.LastImportAt = &t
+	}
+	return s, nil
+}
+
+// GetSavedSearches lists a user's saved searches in the order they were
+// created
+func GetSavedSearches(userID string) ([]SavedSearch, error) {
+	rows, err := authDB.Query(
+		"SELECT "+savedSearchColumns+" FROM saved_searches WHERE user_id = ? ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		s, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, s)
+	}
+	return searches, rows.Err()
+}
+
+// GetSavedSearch returns one of a user's saved searches, or sql.ErrNoRows
+func GetSavedSearch(userID string, id int64) (SavedSearch, error) {
+	return scanSavedSearch(authDB.QueryRow(
+		"SELECT "+savedSearchColumns+" FROM saved_searches WHERE id = ? AND user_id = ?",
+		id, userID,
+	))
+}
+
+// CreateSavedSearch stores a new saved search, setting its ID and timestamps
+func CreateSavedSearch(userID string, s *SavedSearch) error {
+	now := time.Now()
+	result, err := authDB.Exec(`
+		INSERT INTO saved_searches (user_id, name, query, mode, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, s.Name, s.Query, s.Mode, now.Unix(), now.Unix())
+	if err != nil {
+		return err
+	}
+	s.ID, err = result.LastInsertId()
+	s.CreatedAt = time.Unix(now.Unix(), 0)
+	s.UpdatedAt = s.CreatedAt
+	return err
+}
+
+// UpdateSavedSearch changes the name, query and mode of a saved search.
+// Returns sql.ErrNoRows if the user has no such saved search.
+func UpdateSavedSearch(userID string, s *SavedSearch) error {
+	result, err := authDB.Exec(`
+		UPDATE saved_searches SET name = ?, query = ?, mode = ?, updated_at = ?
+		WHERE id = ? AND user_id = ?
+	`, s.Name, s.Query, s.Mode, time.Now().Unix(), s.ID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteSavedSearch removes a saved search. Returns sql.ErrNoRows if the
+// user has no such saved search.
+func DeleteSavedSearch(userID string, id int64) error {
+	result, err := authDB.Exec("DELETE FROM saved_searches WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// maxMessageID returns the highest message ID in a user's database. IDs
+// only increase (AUTOINCREMENT), so rows an import adds are those above the
+// value from before it started.
+func maxMessageID(userDB *sql.DB) (int64, error) {
+	var id int64
+	err := userDB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM messages").Scan(&id)
+	return id, err
+}
+
+// RecordSavedSearchMatches counts, for each of a user's saved searches, the
+// messages added since sinceID (see maxMessageID) that match it, and records
+// the counts on the saved searches. A saved search that can no longer run,
+// e.g. because of a bad mode, is skipped.
+func RecordSavedSearchMatches(userID string, userDB *sql.DB, sinceID int64) ([]SavedSearchMatch, error) {
+	searches, err := GetSavedSearches(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	matches := []SavedSearchMatch{}
+	for _, s := range searches {
+		page, err := SearchMessages(userDB, SearchOptions{Query: s.Query, Mode: s.Mode, AfterID: sinceID, Limit: 1})
+		if err != nil {
+			slog.Warn("Failed to run saved search", "userID", userID, "savedSearch", s.ID, "error", err)
+			continue
+		}
+		if _, err := authDB.Exec(
+			"UPDATE saved_searches SET last_import_at = ?, last_import_matches = ? WHERE id = ?",
+			now, page.Total, s.ID,
+		); err != nil {
+			return nil, err
+		}
+		matches = append(matches, SavedSearchMatch{ID: s.ID, Name: s.Name, Query: s.Query, Count: page.Total})
+	}
+	return matches, nil
+}
+
+// bindSavedSearch reads and validates a saved search from a request body,
+// returning an error message for the client if it's invalid
+func bindSavedSearch(c echo.Context, userDB *sql.DB) (SavedSearch, string) {
+	var s SavedSearch
+	if err := c.Bind(&s); err != nil {
+		return s, "Invalid saved search data"
+	}
+	s.Name = strings.TrimSpace(s.Name)
+	s.Query = strings.TrimSpace(s.Query)
+	if s.Query == "" {
+		return s, "query is required"
+	}
+	if s.Name == "" {
+		s.Name = s.Query
+	}
+	// Run it once so a typo in an operator or mode is reported now rather
+	// than silently skipped after every import
+	if _, err := SearchMessages(userDB, SearchOptions{Query: s.Query, Mode: s.Mode, Limit: 1}); err != nil {
+		if errors.Is(err, ErrInvalidSearch) {
+			return s, err.Error()
+		}
+		slog.Warn("Failed to check saved search", "error", err)
+	}
+	return s, ""
+}
+
+// HandleGetSavedSearches handles GET /api/saved-searches
+func HandleGetSavedSearches(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+
+	searches, err := GetSavedSearches(userID)
+	if err != nil {
+		slog.Error("Error getting saved searches", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get saved searches",
+		})
+	}
+
+	return c.JSON(http.StatusOK, searches)
+}
+
+// HandleCreateSavedSearch handles POST /api/saved-searches
+func HandleCreateSavedSearch(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	s, errMsg := bindSavedSearch(c, userDB)
+	if errMsg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": errMsg,
+		})
+	}
+
+	if err := CreateSavedSearch(userID, &s); err != nil {
+		slog.Error("Error creating saved search", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save search",
+		})
+	}
+
+	return c.JSON(http.StatusCreated, s)
+}
+
+// HandleUpdateSavedSearch handles PUT /api/saved-searches/:id
+func HandleUpdateSavedSearch(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid saved search ID",
+		})
+	}
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	s, errMsg := bindSavedSearch(c, userDB)
+	if errMsg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": errMsg,
+		})
+	}
+	s.ID = id
+
+	err = UpdateSavedSearch(userID, &s)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Saved search not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error updating saved search", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to save search",
+		})
+	}
+
+	updated, err := GetSavedSearch(userID, id)
+	if err != nil {
+		slog.Error("Error getting saved search", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get saved search",
+		})
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+// HandleDeleteSavedSearch handles DELETE /api/saved-searches/:id
+func HandleDeleteSavedSearch(c echo.Context) error {
+	userID := c.Get("user_id").(string)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid saved search ID",
+		})
+	}
+
+	err = DeleteSavedSearch(userID, id)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Saved search not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error deleting saved search", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete saved search",
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
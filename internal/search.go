@@ -0,0 +1,687 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search page size bounds
+const (
+	DefaultSearchLimit = 100
+	MaxSearchLimit     = 1000
+)
+
+// Search modes control how free-text terms match message bodies
+const (
+	// SearchModeWords matches whole words (FTS5 unicode61)
+	SearchModeWords = "words"
+	// SearchModePrefix matches words starting with each term
+	SearchModePrefix = "prefix"
+	// SearchModeSubstring matches terms anywhere in the text, including
+	// inside words and in unsegmented (CJK) text, ignoring diacritics
+	SearchModeSubstring = "substring"
+	// SearchModeFuzzy tolerates typos, ranking closer matches first
+	SearchModeFuzzy = "fuzzy"
+	// SearchModeRegex treats the whole query as a Go regular expression
+	SearchModeRegex = "regex"
+)
+
+// ErrInvalidSearch wraps errors in a search query or its filters, as opposed
+// to failures running it
+var ErrInvalidSearch = errors.New("invalid search")
+
+// SearchOptions describes a message search. Query is what the user typed and
+// may contain operators (see ParseSearchQuery); the remaining fields come
+// from API parameters and are combined with whatever the query sets.
+type SearchOptions struct {
+	Query        string
+	Contact      string // address (or part of one) or contact name
+	Direction    string // "sent" or "received"
+	RecordType   string // "sms", "mms" or "call"
+	HasMedia     bool
+	MediaKinds   []string // gallery kinds: "image", "video", "audio", "vcard"
+	Conversation string   // "group" or "direct"
+	Tag          string   // tag name, on the message or its conversation
+	Category     string   // SenderCategoryPersonal or SenderCategoryAutomated
+	StartDate    *time.Time
+	EndDate      *time.Time
+	Mode         string // SearchModeWords (default), SearchModePrefix, SearchModeSubstring, SearchModeFuzzy or SearchModeRegex
+	Sort         string // "relevance" (default with search terms) or "date"
+	Cursor       string // NextCursor from the previous page
+	Limit        int
+	AfterID      int64 // only messages with a greater ID, i.e. imported later
+}
+
+// SearchPage is one page of search results. Total counts every match, not
+// just this page; NextCursor is empty on the last page.
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	Total      int            `json:"total"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// searchTerm is one free-text term of a query: a word, a "quoted phrase" or
+// a word* prefix, optionally negated with a leading -
+type searchTerm struct {
+	text   string
+	prefix bool
+	negate bool
+	or     bool // the OR keyword; text is empty
+}
+
+// splitSearchQuery splits a query on whitespace, keeping double-quoted runs
+// (including operator values like from:"Jane Doe") together. Quotes are left
+// in place for the caller to interpret.
+func splitSearchQuery(q string) []string {
+	var tokens []string
+	var cur strings.Builder
+	inQuote := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			cur.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuote:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// parseSearchDate accepts a date (2006-01-02) or full RFC3339 timestamp
+func parseSearchDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid date %q", ErrInvalidSearch, value)
+	}
+	return t, nil
+}
+
+// ParseSearchQuery pulls operators out of a user's query into opts and
+// returns the remaining free-text terms. Supported operators:
+//
+//	from:X / to:X     messages received from / sent to a contact; from:me and
+//	                  to:me select sent and received messages
+//	with:X            any message in conversations with a contact
+//	after:D before:D  date range (2006-01-02 or RFC3339); before is exclusive
+//	is:sent is:received is:group is:direct is:personal is:automated
+//	type:sms type:mms type:call
+//	has:media has:image has:video has:audio has:vcard
+//	tag:X             tagged messages, or messages in tagged conversations
+//
+// Anything else, including unknown operators, is searched for as text.
+func ParseSearchQuery(opts *SearchOptions) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, token := range splitSearchQuery(opts.Query) {
+		if token == "OR" {
+			terms = append(terms, searchTerm{or: true})
+			continue
+		}
+
+		if key, value, ok := strings.Cut(token, ":"); ok && !strings.HasPrefix(token, `"`) {
+			value = strings.Trim(value, `"`)
+			handled := true
+			switch strings.ToLower(key) {
+			case "from":
+				if strings.EqualFold(value, "me") {
+					opts.Direction = "sent"
+				} else {
+					opts.Contact, opts.Direction = value, "received"
+				}
+			case "to":
+				if strings.EqualFold(value, "me") {
+					opts.Direction = "received"
+				} else {
+					opts.Contact, opts.Direction = value, "sent"
+				}
+			case "with":
+				opts.Contact = value
+			case "after":
+				t, err := parseSearchDate(value)
+				if err != nil {
+					return nil, err
+				}
+				opts.StartDate = &t
+			case "before":
+				t, err := parseSearchDate(value)
+				if err != nil {
+					return nil, err
+				}
+				t = t.Add(-time.Second)
+				opts.EndDate = &t
+			case "is":
+				switch strings.ToLower(value) {
+				case "sent", "received":
+					opts.Direction = strings.ToLower(value)
+				case "group", "direct":
+					opts.Conversation = strings.ToLower(value)
+				case SenderCategoryPersonal, SenderCategoryAutomated:
+					opts.Category = strings.ToLower(value)
+				default:
+					return nil, fmt.Errorf("%w: unknown is:%s", ErrInvalidSearch, value)
+				}
+			case "type":
+				opts.RecordType = strings.ToLower(value)
+			case "tag":
+				opts.Tag = value
+			case "has":
+				if kind := strings.ToLower(value); kind == "media" {
+					opts.HasMedia = true
+				} else {
+					opts.MediaKinds = append(opts.MediaKinds, kind)
+				}
+			default:
+				handled = false
+			}
+			if handled {
+				continue
+			}
+		}
+
+		term := searchTerm{}
+		if len(token) > 1 && token[0] == '-' {
+			term.negate = true
+			token = token[1:]
+		}
+		if len(token) > 1 && strings.HasSuffix(token, "*") && !strings.HasSuffix(token, `"`) {
+			term.prefix = true
+			token = strings.TrimSuffix(token, "*")
+		}
+		term.text = strings.Trim(token, `"`)
+		if strings.TrimSpace(term.text) != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms, nil
+}
+
+// ftsQuote turns user text into an FTS5 string literal, so punctuation like
+// apostrophes, hyphens and colons is searched for rather than parsed as
+// query syntax
+func ftsQuote(text string) string {
+	return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+}
+
+// buildFTSQuery converts parsed terms into FTS5 MATCH expressions: one for
+// the terms that must match and one for the negated terms. FTS5 can't
+// evaluate a NOT without a left-hand side, so negations are returned
+// separately for the caller to exclude.
+func buildFTSQuery(terms []searchTerm) (match, exclude string) {
+	var pos, neg []string
+	pendingOr := false
+	for _, t := range terms {
+		if t.or {
+			pendingOr = len(pos) > 0
+			continue
+		}
+		expr := ftsQuote(t.text)
+		if t.prefix {
+			expr += "*"
+		}
+		if t.negate {
+			neg = append(neg, expr)
+			continue
+		}
+		if pendingOr {
+			pos = append(pos, "OR")
+			pendingOr = false
+		}
+		pos = append(pos, expr)
+	}
+	return strings.Join(pos, " "), strings.Join(neg, " OR ")
+}
+
+// combineTerms joins an expression per search term the way buildFTSQuery
+// does: terms must all match, except that OR separates alternatives, and
+// negated terms are joined separately with or for the caller to exclude.
+// expr returns false for a term with nothing to search for.
+func combineTerms(terms []searchTerm, and, or string, expr func(searchTerm) (string, interface{}, bool)) (match string, matchArgs []interface{}, exclude string, excludeArgs []interface{}) {
+	var groups [][]string
+	var neg []string
+	pendingOr := false
+	for _, t := range terms {
+		if t.or {
+			pendingOr = len(groups) > 0
+			continue
+		}
+		e, arg, ok := expr(t)
+		if !ok {
+			continue
+		}
+		if t.negate {
+			neg = append(neg, e)
+			excludeArgs = append(excludeArgs, arg)
+			continue
+		}
+		if pendingOr || len(groups) == 0 {
+			groups = append(groups, nil)
+			pendingOr = false
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], e)
+		matchArgs = append(matchArgs, arg)
+	}
+
+	alternatives := make([]string, len(groups))
+	for i, group := range groups {
+		alternatives[i] = "(" + strings.Join(group, and) + ")"
+	}
+	return strings.Join(alternatives, or), matchArgs, strings.Join(neg, or), excludeArgs
+}
+
+// substringSpans returns where the non-negated terms occur in body, for
+// highlightSpans
+func substringSpans(body string, terms []searchTerm) [][2]int {
+	var spans [][2]int
+	for _, t := range terms {
+		if t.or || t.negate {
+			continue
+		}
+		for _, loc := range regexp.MustCompile("(?i)"+regexp.QuoteMeta(t.text)).FindAllStringIndex(body, -1) {
+			spans = append(spans, [2]int{loc[0], loc[1]})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	var merged [][2]int
+	for _, sp := range spans {
+		if len(merged) > 0 && sp[0] < merged[len(merged)-1][1] {
+			merged[len(merged)-1][1] = max(merged[len(merged)-1][1], sp[1])
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged
+}
+
+// hasShortAlternative reports whether a query has an OR and a term too short
+// for the trigram index to match, which then can't simply be required
+func hasShortAlternative(terms []searchTerm) bool {
+	hasOr, hasShort := false, false
+	for _, t := range terms {
+		switch {
+		case t.or:
+			hasOr = true
+		case !t.negate && utf8.RuneCountInString(t.text) < 3:
+			hasShort = true
+		}
+	}
+	return hasOr && hasShort
+}
+
+// substringCondition returns a condition matching a term anywhere in a
+// message body, for combineTerms: the trigram index where it can, LIKE for
+// shorter terms
+func substringCondition(t searchTerm) (string, interface{}, bool) {
+	if utf8.RuneCountInString(t.text) < 3 {
+		return `COALESCE(m.body, '') LIKE ? ESCAPE '\'`, "%" + escapeLike(t.text) + "%", true
+	}
+	return "m.id IN (SELECT rowid FROM messages_trigram WHERE messages_trigram MATCH ?)", ftsQuote(t.text), true
+}
+
+// escapeLike escapes LIKE wildcards for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// searchConditions builds the WHERE clause additions for the structured
+// filters of a search. The messages table must be aliased as m.
+func searchConditions(opts SearchOptions) (string, []interface{}, error) {
+	var query string
+	args := []interface{}{}
+
+	if opts.Contact != "" {
+		like := "%" + escapeLike(opts.Contact) + "%"
+		query += ` AND (m.address LIKE ? ESCAPE '\' OR m.contact_name LIKE ? ESCAPE '\')`
+		args = append(args, like, like)
+	}
+
+	switch opts.Direction {
+	case "":
+	case "sent":
+		query += " AND m.type = 2"
+	case "received":
+		query += " AND m.type = 1"
+	default:
+		return "", nil, fmt.Errorf("%w: direction must be sent or received", ErrInvalidSearch)
+	}
+
+	switch opts.RecordType {
+	case "":
+	case "sms":
+		query += " AND m.record_type = 1"
+	case "mms":
+		query += " AND m.record_type = 2"
+	case "call":
+		query += " AND m.record_type = 3"
+	default:
+		return "", nil, fmt.Errorf("%w: type must be sms, mms or call", ErrInvalidSearch)
+	}
+
+	if opts.HasMedia {
+		query += " AND m.media_type != ''"
+	}
+	if len(opts.MediaKinds) > 0 {
+		var conds []string
+		for _, kind := range opts.MediaKinds {
+			cond, ok := galleryKindConditions[kind]
+			if !ok {
+				return "", nil, fmt.Errorf("%w: unknown media kind %q", ErrInvalidSearch, kind)
+			}
+			conds = append(conds, cond)
+		}
+		query += " AND (" + strings.Join(conds, " OR ") + ")"
+	}
+
+	// Group conversations are stored under a comma-separated address list
+	switch opts.Conversation {
+	case "":
+	case "group":
+		query += " AND m.address LIKE '%,%'"
+	case "direct":
+		query += " AND m.address NOT LIKE '%,%'"
+	default:
+		return "", nil, fmt.Errorf("%w: conversation must be group or direct", ErrInvalidSearch)
+	}
+
+	if opts.StartDate != nil {
+		query += " AND m.date >= ?"
+		args = append(args, opts.StartDate.Unix())
+	}
+	if opts.EndDate != nil {
+		query += " AND m.date <= ?"
+		args = append(args, opts.EndDate.Unix())
+	}
+	if opts.Tag != "" {
+		cond, tagArgs := tagMessageCondition("m.", opts.Tag)
+		query += cond
+		args = append(args, tagArgs...)
+	}
+	if opts.Category != "" {
+		cond, err := senderCategoryCondition("m.", opts.Category)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrInvalidSearch, err)
+		}
+		query += cond
+	}
+	if opts.AfterID > 0 {
+		query += " AND m.id > ?"
+		args = append(args, opts.AfterID)
+	}
+
+	return query, args, nil
+}
+
+// Search cursors are opaque to clients. Relevance-ordered pages use an offset
+// since FTS rank isn't a stable key; date-ordered pages use (date in
+// milliseconds, id) so they don't shift as new messages are imported.
+func encodeSearchCursor(parts ...int64) string {
+	strs := make([]string, len(parts))
+	for i, p := range parts {
+		strs[i] = strconv.FormatInt(p, 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(strs, ":")))
+}
+
+func decodeSearchCursor(cursor string, n int) ([]int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	strs := strings.Split(string(raw), ":")
+	if len(strs) != n {
+		return nil, ErrInvalidCursor
+	}
+	parts := make([]int64, n)
+	for i, s := range strs {
+		if parts[i], err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return parts, nil
+}
+
+// SearchMessages searches message bodies with FTS5, combined with the
+// structured filters in opts. A query with only operators and no text lists
+// every matching message (including calls) by date.
+func SearchMessages(userDB *sql.DB, opts SearchOptions) (*SearchPage, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	// Regex patterns would be mangled by operator and term parsing
+	if opts.Mode == SearchModeRegex {
+		return searchRegex(userDB, opts, limit)
+	}
+
+	terms, err := ParseSearchQuery(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conds, args, err := searchConditions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Word and prefix searches use the unicode61 index; substring and fuzzy
+	// searches use the trigram one. likeTerms are set when a substring
+	// search is matched with LIKE instead, to highlight them in snippets.
+	ftsTable, snippetCol := "messages_fts", 2
+	var likeTerms []searchTerm
+	switch opts.Mode {
+	case "", SearchModeWords:
+	case SearchModePrefix:
+		for i := range terms {
+			terms[i].prefix = true
+		}
+	case SearchModeSubstring:
+		ftsTable, snippetCol = "messages_trigram", 0
+		// Trigrams can't match anything shorter than three characters, so
+		// short terms are checked with LIKE instead. When one is an
+		// alternative of OR, each term is its own condition so the query
+		// keeps its grouping.
+		if hasShortAlternative(terms) {
+			match, matchArgs, exclude, excludeArgs := combineTerms(terms, " AND ", " OR ", substringCondition)
+			conds += " AND (" + match + ")"
+			args = append(args, matchArgs...)
+			if exclude != "" {
+				conds += " AND NOT (" + exclude + ")"
+				args = append(args, excludeArgs...)
+			}
+			likeTerms, terms = terms, nil
+			break
+		}
+		var long []searchTerm
+		for _, t := range terms {
+			if t.or || utf8.RuneCountInString(t.text) >= 3 {
+				long = append(long, t)
+				continue
+			}
+			not := ""
+			if t.negate {
+				not = "NOT "
+			}
+			conds += " AND COALESCE(m.body, '') " + not + `LIKE ? ESCAPE '\'`
+			args = append(args, "%"+escapeLike(t.text)+"%")
+		}
+		terms = long
+	case SearchModeFuzzy:
+		return searchFuzzy(userDB, opts, terms, conds, args, limit)
+	default:
+		return nil, fmt.Errorf("%w: mode must be words, prefix, substring, fuzzy or regex", ErrInvalidSearch)
+	}
+	match, exclude := buildFTSQuery(terms)
+
+	// Snippets come from FTS when there's something to highlight;
+	// otherwise fall back to the start of the body
+	from := " FROM messages m WHERE 1=1"
+	snippet := "substr(COALESCE(m.body, ''), 1, 200)"
+	if likeTerms != nil {
+		snippet = "COALESCE(m.body, '')"
+	}
+	if match != "" {
+		from = fmt.Sprintf(" FROM %[1]s JOIN messages m ON %[1]s.rowid = m.id WHERE %[1]s MATCH ?", ftsTable)
+		snippet = fmt.Sprintf("snippet(%s, %d, '<mark>', '</mark>', '...', 50)", ftsTable, snippetCol)
+		args = append([]interface{}{match}, args...)
+	}
+	// A query with nothing to match and no filters (empty, or only
+	// negations) would list every message; treat it as an empty search
+	if match == "" && conds == "" {
+		return &SearchPage{Results: []SearchResult{}}, nil
+	}
+	if exclude != "" {
+		conds += fmt.Sprintf(" AND m.id NOT IN (SELECT rowid FROM %[1]s WHERE %[1]s MATCH ?)", ftsTable)
+		args = append(args, exclude)
+	}
+
+	if opts.Sort != "" && opts.Sort != "date" && opts.Sort != "relevance" {
+		return nil, fmt.Errorf("%w: sort must be relevance or date", ErrInvalidSearch)
+	}
+	byDate := opts.Sort == "date" || match == ""
+
+	page := &SearchPage{Results: []SearchResult{}}
+	if err := userDB.QueryRow("SELECT COUNT(*)"+from+conds, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT m.id, m.address, COALESCE(m.contact_name, ''), COALESCE(m.body, ''), m.date_ms, ` + snippet + `, ` + bookmarkedColumn + from + conds
+	offset := int64(0)
+	if byDate {
+		if opts.Cursor != "" {
+			parts, err := decodeSearchCursor(opts.Cursor, 2)
+			if err != nil {
+				return nil, err
+			}
+			query += " AND (m.date_ms < ? OR (m.date_ms = ? AND m.id < ?))"
+			args = append(args, parts[0], parts[0], parts[1])
+		}
+		query += " ORDER BY m.date_ms DESC, m.id DESC LIMIT ?"
+		args = append(args, limit+1)
+	} else {
+		if opts.Cursor != "" {
+			parts, err := decodeSearchCursor(opts.Cursor, 1)
+			if err != nil {
+				return nil, err
+			}
+			offset = parts[0]
+		}
+		query += " ORDER BY rank, m.id LIMIT ? OFFSET ?"
+		args = append(args, limit+1, offset)
+	}
+
+	rows, err := userDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r SearchResult
+		var dateMs int64
+		if err := rows.Scan(&r.MessageID, &r.Address, &r.ContactName, &r.Body, &dateMs, &r.Snippet, &r.Bookmarked); err != nil {
+			return nil, err
+		}
+		r.Date = time.UnixMilli(dateMs)
+		if likeTerms != nil {
+			r.Snippet = highlightSpans(r.Snippet, substringSpans(r.Snippet, likeTerms))
+		}
+		page.Results = append(page.Results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		if byDate {
+			last := page.Results[limit-1]
+			page.NextCursor = encodeSearchCursor(last.Date.UnixMilli(), last.MessageID)
+		} else {
+			page.NextCursor = encodeSearchCursor(offset + int64(limit))
+		}
+	}
+	return page, nil
+}
+
+// snippetContext is how much text (in bytes, roughly) highlightSpans keeps
+// around the first highlighted span
+const snippetContext = 80
+
+// highlightSpans builds a snippet of body around the given byte ranges, in
+// the same shape FTS5's snippet() produces: matches wrapped in <mark> and
+// "..." where text was cut. Spans must be sorted and non-overlapping.
+func highlightSpans(body string, spans [][2]int) string {
+	if len(spans) == 0 {
+		if len(body) > 200 {
+			return body[:runeBoundary(body, 200)] + "..."
+		}
+		return body
+	}
+
+	start := runeBoundary(body, max(0, spans[0][0]-snippetContext))
+	end := runeBoundary(body, min(len(body), spans[0][1]+2*snippetContext))
+	// Prefer cutting at a space so the snippet doesn't start mid-word
+	if start > 0 {
+		if i := strings.IndexByte(body[start:spans[0][0]], ' '); i >= 0 {
+			start += i + 1
+		}
+	}
+	if end < len(body) {
+		if i := strings.LastIndexByte(body[spans[0][1]:end], ' '); i >= 0 {
+			end = spans[0][1] + i
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+	pos := start
+	for _, sp := range spans {
+		if sp[0] < pos || sp[1] > end {
+			continue
+		}
+		b.WriteString(body[pos:sp[0]])
+		b.WriteString("<mark>")
+		b.WriteString(body[sp[0]:sp[1]])
+		b.WriteString("</mark>")
+		pos = sp[1]
+	}
+	b.WriteString(body[pos:end])
+	if end < len(body) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
+
+// runeBoundary moves a byte offset back to the start of the rune it's in
+func runeBoundary(s string, i int) int {
+	for i > 0 && i < len(s) && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
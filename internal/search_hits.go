@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultSearchHitsLimit caps each type of hit returned by GetSearchHits
+const DefaultSearchHitsLimit = 20
+
+// searchNamesLimit bounds how many search_names rows a query can match, so a
+// short query can't pull in every conversation
+const searchNamesLimit = 1000
+
+// searchName is a matching row of search_names
+type searchName struct {
+	address string
+	kind    string // "number", "contact" or "group"
+	name    string
+}
+
+// normalizePhoneQuery strips the formatting from a query that looks like a
+// phone number, the same way search_names stores numbers, so "(555) 123"
+// finds +15551234567. Other queries are returned unchanged.
+func normalizePhoneQuery(q string) string {
+	digits := 0
+	for _, r := range q {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case strings.ContainsRune(" -().+", r):
+		default:
+			return q
+		}
+	}
+	if digits == 0 {
+		return q
+	}
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "").Replace(q)
+}
+
+// matchSearchNames finds the numbers, contact names and group names
+// containing q
+func matchSearchNames(userDB *sql.DB, q string) ([]searchName, error) {
+	var query string
+	var arg interface{}
+	// The trigram index can't match fewer than three characters
+	if utf8.RuneCountInString(q) < 3 {
+		query = `SELECT address, kind, name FROM search_names
+			WHERE name LIKE ? ESCAPE '\' LIMIT ?`
+		arg = "%" + escapeLike(q) + "%"
+	} else {
+		query = `SELECT n.address, n.kind, n.name FROM search_names_fts
+			JOIN search_names n ON n.rowid = search_names_fts.rowid
+			WHERE search_names_fts MATCH ? LIMIT ?`
+		arg = ftsQuote(q)
+	}
+
+	rows, err := userDB.Query(query, arg, searchNamesLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []searchName
+	for rows.Next() {
+		var n searchName
+		if err := rows.Scan(&n.address, &n.kind, &n.name); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	return names, rows.Err()
+}
+
+// inPlaceholders returns "?, ?, ..." for n values
+func inPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// dateConditions returns SQL conditions limiting date to a range
+func dateConditions(startDate, endDate *time.Time) (string, []interface{}) {
+	var conds string
+	var args []interface{}
+	if startDate != nil {
+		conds += " AND date >= ?"
+		args = append(args, startDate.Unix())
+	}
+	if endDate != nil {
+		conds += " AND date <= ?"
+		args = append(args, endDate.Unix())
+	}
+	return conds, args
+}
+
+// GetSearchHits searches conversation numbers, contact names and group names
+// as well as message bodies, returning each kind of match in its own shape.
+// Up to limit hits of each type are returned.
+func GetSearchHits(userDB *sql.DB, query string, startDate, endDate *time.Time, limit int) (*SearchHits, error) {
+	q := strings.TrimSpace(query)
+	if q == "" {
+		return nil, fmt.Errorf("%w: empty query", ErrInvalidSearch)
+	}
+	if limit <= 0 {
+		limit = DefaultSearchHitsLimit
+	}
+
+	names, err := matchSearchNames(userDB, normalizePhoneQuery(q))
+	if err != nil {
+		return nil, fmt.Errorf("failed to match names: %w", err)
+	}
+
+	hits := &SearchHits{
+		Conversations: []Conversation{},
+		Contacts:      []ContactHit{},
+		Groups:        []GroupHit{},
+		Calls:         []CallLog{},
+		Messages:      []SearchResult{},
+	}
+
+	var addresses, contactNames []string
+	for _, n := range names {
+		if !slices.Contains(addresses, n.address) {
+			addresses = append(addresses, n.address)
+		}
+		if n.kind == "contact" && !slices.Contains(contactNames, n.name) {
+			contactNames = append(contactNames, n.name)
+		}
+	}
+
+	dateConds, dateArgs := dateConditions(startDate, endDate)
+
+	if len(addresses) > 0 {
+		filter := "address IN (" + inPlaceholders(len(addresses)) + ")" + dateConds
+		args := make([]interface{}, 0, len(addresses)+len(dateArgs))
+		for _, a := range addresses {
+			args = append(args, a)
+		}
+		args = append(args, dateArgs...)
+
+		// Addresses whose messages have since been deleted drop out here
+		conversations, err := queryConversations(userDB, filter, args)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get conversations: %w", err)
+		}
+		byAddress := make(map[string]Conversation, len(conversations))
+		for _, c := range conversations {
+			byAddress[c.Address] = c
+		}
+
+		for _, n := range names {
+			c, ok := byAddress[n.address]
+			if n.kind != "group" || !ok || len(hits.Groups) >= limit {
+				continue
+			}
+			hits.Groups = append(hits.Groups, GroupHit{
+				Address:      c.Address,
+				Subject:      n.name,
+				Participants: strings.Split(c.Address, ","),
+				ContactName:  c.ContactName,
+				MessageCount: c.MessageCount,
+				LastDate:     c.LastDate,
+			})
+		}
+
+		if len(conversations) > limit {
+			conversations = conversations[:limit]
+		}
+		hits.Conversations = conversations
+
+		hits.Calls, err = getSearchHitCalls(userDB, filter, args, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get calls: %w", err)
+		}
+	}
+
+	if len(contactNames) > 0 {
+		hits.Contacts, err = getContactHits(userDB, contactNames, dateConds, dateArgs, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get contacts: %w", err)
+		}
+	}
+
+	page, err := SearchMessages(userDB, SearchOptions{
+		Query:     q,
+		StartDate: startDate,
+		EndDate:   endDate,
+		Limit:     limit,
+	})
+	// A query that matches names can still be invalid as a message search,
+	// e.g. a lone operator; only the message hits are lost then
+	if err != nil && !errors.Is(err, ErrInvalidSearch) {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	if err == nil {
+		hits.Messages = page.Results
+	}
+
+	return hits, nil
+}
+
+// getSearchHitCalls returns the most recent calls matching filter
+func getSearchHitCalls(userDB *sql.DB, filter string, args []interface{}, limit int) ([]CallLog, error) {
+	query := `
+		SELECT id, address, duration, date_ms, type,
+		       COALESCE(presentation, 0), COALESCE(subscription_id, ''), COALESCE(contact_name, '')
+		FROM messages
+		WHERE record_type = 3 AND ` + filter + `
+		ORDER BY date_ms DESC, id DESC
+		LIMIT ?
+	`
+	rows, err := userDB.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calls := []CallLog{}
+	for rows.Next() {
+		var c CallLog
+		var dateMs int64
+		if err := rows.Scan(&c.ID, &c.Number, &c.Duration, &dateMs, &c.Type,
+			&c.Presentation, &c.SubscriptionID, &c.ContactName); err != nil {
+			return nil, err
+		}
+		c.Date = time.UnixMilli(dateMs)
+		calls = append(calls, c)
+	}
+	return calls, rows.Err()
+}
+
+// getContactHits summarizes activity for each of the given contact names,
+// most recently active first
+func getContactHits(userDB *sql.DB, contactNames []string, dateConds string, dateArgs []interface{}, limit int) ([]ContactHit, error) {
+	query := `
+		SELECT contact_name, address,
+			SUM(CASE WHEN record_type != 3 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN record_type = 3 THEN 1 ELSE 0 END),
+			MAX(date_ms)
+		FROM messages
+		WHERE contact_name IN (` + inPlaceholders(len(contactNames)) + `)` + dateConds + `
+		GROUP BY contact_name, address
+		ORDER BY MAX(date_ms) DESC
+	`
+	args := make([]interface{}, 0, len(contactNames)+len(dateArgs))
+	for _, name := range contactNames {
+		args = append(args, name)
+	}
+	args = append(args, dateArgs...)
+
+	rows, err := userDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := []ContactHit{}
+	index := make(map[string]int)
+	for rows.Next() {
+		var name, address string
+		var messages, calls int
+		var lastMs int64
+		if err := rows.Scan(&name, &address, &messages, &calls, &lastMs); err != nil {
+			return nil, err
+		}
+		i, ok := index[name]
+		if !ok {
+			// Rows come most recent first, so the first row for a name
+			// carries its last date
+			i = len(contacts)
+			index[name] = i
+			contacts = append(contacts, ContactHit{ContactName: name, LastDate: time.UnixMilli(lastMs)})
+		}
+		contacts[i].Addresses = append(contacts[i].Addresses, address)
+		contacts[i].MessageCount += messages
+		contacts[i].CallCount += calls
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(contacts) > limit {
+		contacts = contacts[:limit]
+	}
+	return contacts, nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sender categories. A conversation is automated when it's with a short
+// code or an alphanumeric sender ID, or when the user has never replied and
+// most of its messages read like templates (one-time codes, "Reply STOP").
+// Everything else, including every group conversation, is personal.
+const (
+	SenderCategoryPersonal  = "personal"
+	SenderCategoryAutomated = "automated"
+)
+
+// ErrInvalidCategory is returned for a category filter other than the
+// SenderCategory values
+var ErrInvalidCategory = errors.New("category must be personal or automated")
+
+// automatedPhrases are found in bodies of bulk and transactional messages.
+// LIKE is case-insensitive for ASCII, so these match any case.
+var automatedPhrases = []string{
+	"reply stop", "text stop", "txt stop", "stop to end", "stop to opt", "stop to cancel",
+	"to unsubscribe", "msg&data rates", "msg & data rates",
+	"do not reply", "don't share this code", "do not share this code",
+}
+
+// templatedBody returns an SQL expression that is 1 if the body in col
+// looks machine-generated and 0 otherwise. The sender_stats triggers and
+// backfill count bodies with it.
+func templatedBody(col string) string {
+	body := "COALESCE(" + col + ", '')"
+	var conds []string
+	for _, phrase := range automatedPhrases {
+		conds = append(conds, body+" LIKE '%"+strings.ReplaceAll(phrase, "'", "''")+"%'")
+	}
+	// One-time codes: "code" alongside a run of at least four digits
+	conds = append(conds, "("+body+" LIKE '%code%' AND "+body+" GLOB '*[0-9][0-9][0-9][0-9]*')")
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+// senderCategoryExpr returns an SQL expression giving the category of the
+// conversation at addressCol, whose sender_stats row (possibly NULL from a
+// LEFT JOIN) is aliased stats
+func senderCategoryExpr(addressCol, stats string) string {
+	return `CASE
+		WHEN ` + addressCol + ` LIKE '%,%' THEN 'personal'
+		WHEN ` + addressCol + ` GLOB '*[A-Za-z]*' AND ` + addressCol + ` NOT LIKE '%@%' THEN 'automated'
+		WHEN ` + addressCol + ` NOT GLOB '*[^0-9]*' AND LENGTH(` + addressCol + `) BETWEEN 3 AND 6 THEN 'automated'
+		WHEN ` + stats + `.messages > 0 AND ` + stats + `.sent = 0 AND ` + stats + `.templated * 2 >= ` + stats + `.messages THEN 'automated'
+		ELSE 'personal'
+	END`
+}
+
+// senderCategoryCondition returns the SQL condition keeping rows whose
+// address (prefixed by prefix, e.g. "m.") is in a conversation of the given
+// category. Addresses without messages, e.g. call-only numbers, are personal.
+func senderCategoryCondition(prefix, category string) (string, error) {
+	automated := "SELECT s.address FROM sender_stats s WHERE " + senderCategoryExpr("s.address", "s") + " = 'automated'"
+	switch category {
+	case "":
+		return "", nil
+	case SenderCategoryAutomated:
+		return " AND " + prefix + "address IN (" + automated + ")", nil
+	case SenderCategoryPersonal:
+		return " AND " + prefix + "address NOT IN (" + automated + ")", nil
+	}
+	return "", fmt.Errorf("%w, not %q", ErrInvalidCategory, category)
+}
@@ -12,6 +12,13 @@ import (
 // Settings represents user settings stored as JSON
 type Settings struct {
 	Conversations ConversationSettings `json:"conversations"`
+	Retention     []RetentionRule      `json:"retention,omitempty"` // see retention.go
+	Import        ImportSettings       `json:"import"`
+}
+
+// ImportSettings contains settings for importing backups
+type ImportSettings struct {
+	Dedup string `json:"dedup,omitempty"` // DedupExact (default) or DedupNormalized, see dedup.go
 }
 
 // ConversationSettings contains settings for the conversation view
@@ -101,6 +108,18 @@ func HandleUpdateSettings(c echo.Context) error {
 			"error": "Invalid settings data",
 		})
 	}
+	if err := ValidateDedupStrategy(settings.Import.Dedup); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	for _, rule := range settings.Retention {
+		if err := rule.Validate(); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+	}
 
 	if err := SaveUserSettings(userID, settings); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MessageStore is where a user's messages and calls are kept: the operations
+// the conversation list, thread views, activity and call lists, media,
+// search, analytics and imports need. SQLite, one database file per user, is
+// the default; PostgreSQL (see postgres.go) keeps every user in a schema of
+// one shared database. Features outside this interface (tags, bookmarks,
+// the gallery, deletes, retention, backups) are only available with SQLite.
+type MessageStore interface {
+	InsertMessage(msg *Message) error
+	InsertCallLog(call *CallLog) error
+	// BeginBatch starts a set of inserts committed together (see
+	// ImportBackup)
+	BeginBatch() (MessageBatch, error)
+
+	GetConversations(startDate, endDate *time.Time, tag, show, category string) ([]Conversation, error)
+	GetActivityByAddress(address string, startDate, endDate *time.Time, limit, offset int) ([]ActivityItem, error)
+	CountActivityByAddress(address string, startDate, endDate *time.Time) (int, error)
+	GetActivity(startDate, endDate *time.Time, tag string, limit, offset int) ([]ActivityItem, error)
+	GetMessages(address string, startDate, endDate *time.Time) ([]Message, error)
+	GetCallLogs(number string, startDate, endDate *time.Time) ([]CallLog, error)
+	GetAllCalls(startDate, endDate *time.Time, limit, offset int) ([]CallLog, error)
+	// GetDateRange returns ErrNoDateRange if there are no messages yet
+	GetDateRange() (time.Time, time.Time, error)
+
+	GetMediaByAddress(address string, startDate, endDate *time.Time) ([]Message, error)
+	GetMediaInfo(messageID string) (*MediaInfo, error)
+	// GetMedia returns a message's attachment as stored, without
+	// conversion (see browserMedia)
+	GetMedia(messageID string) ([]byte, string, error)
+	// MediaReader reads an attachment of size bytes (see GetMediaInfo) as
+	// stored, in pieces rather than loading it whole
+	MediaReader(messageID string, size int64) io.ReadSeeker
+	GetMediaArchiveItems(filter GalleryFilter) ([]GalleryItem, error)
+
+	SearchMessages(opts SearchOptions) (*SearchPage, error)
+	GetAnalytics(startDate, endDate *time.Time, tag, category string, exclude []string, topN int, tzOffsetMinutes int) (*AnalyticsResponse, error)
+}
+
+// MessageBatch is a set of inserts committed together. A row that fails to
+// insert is skipped without affecting the rest of the batch.
+type MessageBatch interface {
+	InsertMessage(msg *Message) error
+	InsertCallLog(call *CallLog) error
+	Commit() error
+	Rollback() error
+}
+
+// sqliteStore is a MessageStore over a user's SQLite database
+type sqliteStore struct {
+	db    *sql.DB
+	dedup string // DedupExact or DedupNormalized, for inserted messages
+}
+
+// NewSQLiteStore returns a MessageStore over a user's SQLite database,
+// skipping exact duplicates on insert
+func NewSQLiteStore(userDB *sql.DB) MessageStore {
+	return &sqliteStore{db: userDB, dedup: DedupExact}
+}
+
+func (s *sqliteStore) InsertMessage(msg *Message) error {
+	return insertMessage(s.db, msg, s.dedup)
+}
+
+func (s *sqliteStore) InsertCallLog(call *CallLog) error {
+	return InsertCallLog(s.db, call)
+}
+
+func (s *sqliteStore) BeginBatch() (MessageBatch, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBatch{tx: tx, dedup: s.dedup}, nil
+}
+
+func (s *sqliteStore) GetConversations(startDate, endDate *time.Time, tag, show, category string) ([]Conversation, error) {
+	return GetConversations(s.db, startDate, endDate, tag, show, category)
+}
+
+func (s *sqliteStore) GetActivityByAddress(address string, startDate, endDate *time.Time, limit, offset int) ([]ActivityItem, error) {
+	return GetActivityByAddress(s.db, address, startDate, endDate, limit, offset)
+}
+
+func (s *sqliteStore) CountActivityByAddress(address string, startDate, endDate *time.Time) (int, error) {
+	return CountActivityByAddress(s.db, address, startDate, endDate)
+}
+
+func (s *sqliteStore) GetActivity(startDate, endDate *time.Time, tag string, limit, offset int) ([]ActivityItem, error) {
+	return GetActivity(s.db, startDate, endDate, tag, limit, offset)
+}
+
+func (s *sqliteStore) GetMessages(address string, startDate, endDate *time.Time) ([]Message, error) {
+	return GetMessages(s.db, address, startDate, endDate)
+}
+
+func (s *sqliteStore) GetCallLogs(number string, startDate, endDate *time.Time) ([]CallLog, error) {
+	return GetCallLogs(s.db, number, startDate, endDate)
+}
+
+func (s *sqliteStore) GetAllCalls(startDate, endDate *time.Time, limit, offset int) ([]CallLog, error) {
+	return GetAllCalls(s.db, startDate, endDate, limit, offset)
+}
+
+func (s *sqliteStore) GetDateRange() (time.Time, time.Time, error) {
+	return GetDateRange(s.db)
+}
+
+func (s *sqliteStore) GetMediaByAddress(address string, startDate, endDate *time.Time) ([]Message, error) {
+	return GetMediaByAddress(s.db, address, startDate, endDate)
+}
+
+func (s *sqliteStore) GetMediaInfo(messageID string) (*MediaInfo, error) {
+	return GetMediaInfo(s.db, messageID)
+}
+
+func (s *sqliteStore) GetMedia(messageID string) ([]byte, string, error) {
+	return getRawMessageMedia(s.db, messageID)
+}
+
+func (s *sqliteStore) MediaReader(messageID string, size int64) io.ReadSeeker {
+	return newMediaBlobReader(size, func(offset, n int64) ([]byte, error) {
+		return mediaChunk(s.db, messageID, offset, n)
+	})
+}
+
+func (s *sqliteStore) GetMediaArchiveItems(filter GalleryFilter) ([]GalleryItem, error) {
+	return GetMediaArchiveItems(s.db, filter)
+}
+
+func (s *sqliteStore) SearchMessages(opts SearchOptions) (*SearchPage, error) {
+	return SearchMessages(s.db, opts)
+}
+
+func (s *sqliteStore) GetAnalytics(startDate, endDate *time.Time, tag, category string, exclude []string, topN int, tzOffsetMinutes int) (*AnalyticsResponse, error) {
+	return GetAnalytics(s.db, startDate, endDate, tag, category, exclude, topN, tzOffsetMinutes)
+}
+
+// sqliteBatch is a transaction on a user's SQLite database. SQLite carries
+// on with a transaction after a failed statement, so rows are inserted
+// directly.
+type sqliteBatch struct {
+	tx    *sql.Tx
+	dedup string
+}
+
+func (b *sqliteBatch) InsertMessage(msg *Message) error {
+	return insertMessage(b.tx, msg, b.dedup)
+}
+
+func (b *sqliteBatch) InsertCallLog(call *CallLog) error {
+	return InsertCallLog(b.tx, call)
+}
+
+func (b *sqliteBatch) Commit() error {
+	return b.tx.Commit()
+}
+
+func (b *sqliteBatch) Rollback() error {
+	return b.tx.Rollback()
+}
+
+// Storage backends, selected with STORAGE_BACKEND
+const (
+	StorageBackendSQLite   = "sqlite"
+	StorageBackendPostgres = "postgres"
+)
+
+// UsingPostgres reports whether messages are stored in PostgreSQL rather
+// than per-user SQLite databases (see InitPostgres)
+func UsingPostgres() bool {
+	return postgresDB != nil
+}
+
+// GetUserStore returns the MessageStore holding a user's messages, which
+// inserts them with the user's dedup strategy
+func GetUserStore(userID string, username string) (MessageStore, error) {
+	if UsingPostgres() {
+		return postgresStoreFor(userID)
+	}
+	userDB, err := GetUserDB(userID, username)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteStore{db: userDB, dedup: UserDedupStrategy(userID)}, nil
+}
+
+// InitUserStore creates a new user's storage: their SQLite database, or
+// their schema in PostgreSQL
+func InitUserStore(userID string) error {
+	if UsingPostgres() {
+		_, err := postgresStoreFor(userID)
+		return err
+	}
+	dbPathPrefix := os.Getenv("DB_PATH_PREFIX")
+	if dbPathPrefix == "" {
+		dbPathPrefix = "."
+	}
+	return InitUserDB(userID, UserDBPath(dbPathPrefix, userID))
+}
+
+// getUserStore returns the MessageStore of the user making the request
+func getUserStore(c echo.Context) (MessageStore, error) {
+	userID, ok := c.Get("user_id").(string)
+	if !ok {
+		return nil, fmt.Errorf("user_id not found in context")
+	}
+	username, ok := c.Get("username").(string)
+	if !ok {
+		return nil, fmt.Errorf("username not found in context")
+	}
+	return GetUserStore(userID, username)
+}
+
+// postgresRoutes are the API routes served with the PostgreSQL backend:
+// those backed by MessageStore, plus ones that only use the auth database
+var postgresRoutes = map[string]bool{
+	"GET /api/auth/me":               true,
+	"POST /api/auth/change-password": true,
+	"POST /api/upload":               true,
+	"GET /api/progress":              true,
+	"GET /api/conversations":         true,
+	"GET /api/messages":              true,
+	"GET /api/activity":              true,
+	"GET /api/calls":                 true,
+	"GET /api/daterange":             true,
+	"GET /api/media":                 true,
+	"GET /api/media/thumb":           true,
+	"GET /api/media/archive":         true,
+	"GET /api/media-items":           true,
+	"GET /api/search":                true,
+	"GET /api/analytics":             true,
+	"GET /api/settings":              true,
+	"PUT /api/settings":              true,
+}
+
+// StorageBackendMiddleware answers 501 Not Implemented for routes that need
+// a user's SQLite database when messages are stored in PostgreSQL
+func StorageBackendMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if UsingPostgres() && !postgresRoutes[c.Request().Method+" "+c.Path()] {
+			return c.JSON(http.StatusNotImplemented, map[string]string{
+				"error": "Not available with the PostgreSQL storage backend",
+			})
+		}
+		return next(c)
+	}
+}
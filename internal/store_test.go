@@ -0,0 +1,510 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) MessageStore {
+		dir, user := setupEncryptionTest(t)
+		if err := InitUserDB(user.ID, UserDBPath(dir, user.ID)); err != nil {
+			t.Fatalf("Failed to initialize user database: %v", err)
+		}
+		return NewSQLiteStore(userDBs[user.ID])
+	})
+}
+
+// testPostgresDB opens the database at SBV_TEST_POSTGRES_URL, skipping the
+// test if it isn't set
+func testPostgresDB(t *testing.T) *sql.DB {
+	url := os.Getenv("SBV_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("SBV_TEST_POSTGRES_URL not set")
+	}
+	database, err := sql.Open("pgx", url)
+	if err != nil {
+		t.Fatalf("Failed to open PostgreSQL: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// newTestPostgresStore creates a store in a new schema, dropped after the
+// test
+func newTestPostgresStore(t *testing.T, database *sql.DB) *postgresStore {
+	store, err := newPostgresStore(database, uuid.New().String())
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := database.Exec("DROP SCHEMA " + store.schema + " CASCADE"); err != nil {
+			t.Errorf("Failed to drop schema: %v", err)
+		}
+	})
+	return store
+}
+
+// TestPostgresStoreConformance runs against the database at
+// SBV_TEST_POSTGRES_URL, in a schema dropped afterwards
+func TestPostgresStoreConformance(t *testing.T) {
+	database := testPostgresDB(t)
+	runStoreConformance(t, func(t *testing.T) MessageStore {
+		return newTestPostgresStore(t, database)
+	})
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	database := testPostgresDB(t)
+	store := newTestPostgresStore(t, database)
+
+	var version int
+	if err := database.QueryRow("SELECT version FROM " + store.schema + ".schema_version").Scan(&version); err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if version != len(postgresMigrations) {
+		t.Errorf("Expected version %d, got %d", len(postgresMigrations), version)
+	}
+
+	// Reopening a migrated schema changes nothing
+	from, to, err := runPostgresMigrations(database, store.schema, postgresMigrations)
+	if err != nil {
+		t.Fatalf("Failed to rerun migrations: %v", err)
+	}
+	if from != len(postgresMigrations) || to != len(postgresMigrations) {
+		t.Errorf("Expected no migrations, got %d to %d", from, to)
+	}
+
+	if _, _, err := runPostgresMigrations(database, store.schema, postgresMigrations[:1]); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Expected ErrSchemaTooNew for an older build, got %v", err)
+	}
+
+	// Only the tables PostgreSQL routes use are created
+	var tables int
+	err = database.QueryRow(`SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = $1 AND table_name IN ('bookmarks', 'tags', 'message_tags', 'conversation_tags', 'conversation_state')`,
+		strings.Trim(store.schema, `"`)).Scan(&tables)
+	if err != nil {
+		t.Fatalf("Failed to list tables: %v", err)
+	}
+	if tables != 0 {
+		t.Errorf("Expected no SQLite-only tables, got %d", tables)
+	}
+}
+
+// runStoreConformance checks a MessageStore against the behaviour handlers
+// rely on. newStore returns an empty store for one test.
+func runStoreConformance(t *testing.T, newStore func(t *testing.T) MessageStore) {
+	const (
+		alice = "+15551234567"
+		bob   = "+15559876543"
+		bank  = "72345"
+	)
+	t0 := time.Date(2024, 3, 1, 9, 15, 0, 0, time.UTC)
+
+	// seed inserts three conversations: Alice's (three messages and a
+	// call), Bob's from the day before and a bank short code the day after
+	seed := func(t *testing.T) MessageStore {
+		t.Helper()
+		store := newStore(t)
+		batch, err := store.BeginBatch()
+		if err != nil {
+			t.Fatalf("Failed to begin batch: %v", err)
+		}
+		messages := []Message{
+			{Address: alice, ContactName: "Alice", Type: 1, Date: t0, Body: "Are we still meeting for lunch tomorrow?"},
+			{Address: alice, ContactName: "Alice", Type: 2, Date: t0.Add(time.Hour), Body: "Yes, lunch at noon works"},
+			{Address: alice, ContactName: "Alice", Type: 1, Date: t0.Add(2 * time.Hour), Body: "Great, see you at the cafe"},
+			{Address: bob, ContactName: "Bob", Type: 1, Date: time.Date(2024, 2, 29, 20, 0, 0, 0, time.UTC), Body: "Lunch was delicious yesterday"},
+			{Address: bob, ContactName: "Bob", Type: 2, Date: time.Date(2024, 2, 29, 20, 30, 0, 0, time.UTC), Body: "Party tonight"},
+			{Address: bank, Type: 1, Date: time.Date(2024, 3, 2, 14, 0, 0, 0, time.UTC), Body: "Your verification code is 4821. Do not share this code"},
+		}
+		for i := range messages {
+			if err := batch.InsertMessage(&messages[i]); err != nil {
+				t.Fatalf("Failed to insert message: %v", err)
+			}
+		}
+		call := CallLog{Number: alice, ContactName: "Alice", Type: 1, Duration: 120, Date: t0.Add(3 * time.Hour)}
+		if err := batch.InsertCallLog(&call); err != nil {
+			t.Fatalf("Failed to insert call: %v", err)
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatalf("Failed to commit batch: %v", err)
+		}
+		return store
+	}
+
+	t.Run("InsertDeduplicates", func(t *testing.T) {
+		store := seed(t)
+		dup := Message{Address: alice, ContactName: "Alice", Type: 1, Date: t0, Body: "Are we still meeting for lunch tomorrow?"}
+		if err := store.InsertMessage(&dup); err != nil {
+			t.Fatalf("Failed to insert duplicate: %v", err)
+		}
+		call := CallLog{Number: alice, Type: 1, Duration: 120, Date: t0.Add(3 * time.Hour)}
+		if err := store.InsertCallLog(&call); err != nil {
+			t.Fatalf("Failed to insert duplicate call: %v", err)
+		}
+
+		msg := Message{Address: bob, Type: 1, Date: t0, Body: "New"}
+		if err := store.InsertMessage(&msg); err != nil {
+			t.Fatalf("Failed to insert message: %v", err)
+		}
+		if msg.ID == 0 {
+			t.Error("Expected the new message to get an ID")
+		}
+
+		count, err := store.CountActivityByAddress(alice, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to count activity: %v", err)
+		}
+		if count != 4 {
+			t.Errorf("Expected 4 items for Alice after duplicate inserts, got %d", count)
+		}
+	})
+
+	t.Run("Conversations", func(t *testing.T) {
+		store := seed(t)
+		conversations, err := store.GetConversations(nil, nil, "", "", "")
+		if err != nil {
+			t.Fatalf("Failed to get conversations: %v", err)
+		}
+		var addresses []string
+		for _, c := range conversations {
+			addresses = append(addresses, c.Address)
+		}
+		if strings.Join(addresses, " ") != bank+" "+alice+" "+bob {
+			t.Fatalf("Expected conversations newest first, got %v", addresses)
+		}
+		a := conversations[1]
+		if a.MessageCount != 4 || a.ContactName != "Alice" || a.LastMessage != "Incoming call" {
+			t.Errorf("Unexpected conversation for Alice: %+v", a)
+		}
+		if !a.LastDate.Equal(t0.Add(3 * time.Hour)) {
+			t.Errorf("Expected Alice's last date %v, got %v", t0.Add(3*time.Hour), a.LastDate)
+		}
+		if conversations[0].Category != SenderCategoryAutomated || a.Category != SenderCategoryPersonal {
+			t.Errorf("Expected the short code automated and Alice personal, got %q and %q", conversations[0].Category, a.Category)
+		}
+
+		start := t0
+		conversations, err = store.GetConversations(&start, nil, "", "", SenderCategoryPersonal)
+		if err != nil {
+			t.Fatalf("Failed to get conversations: %v", err)
+		}
+		if len(conversations) != 1 || conversations[0].Address != alice {
+			t.Errorf("Expected only Alice's conversation, got %+v", conversations)
+		}
+
+		if _, err := store.GetConversations(nil, nil, "", "", "bogus"); err == nil {
+			t.Error("Expected an error for an unknown category")
+		}
+
+		// Nothing is tagged or archived yet
+		for _, filter := range [][2]string{{"work", ""}, {"", ConversationsShowArchived}} {
+			conversations, err = store.GetConversations(nil, nil, filter[0], filter[1], "")
+			if err != nil {
+				t.Fatalf("Failed to get conversations: %v", err)
+			}
+			if len(conversations) != 0 {
+				t.Errorf("Expected no conversations for %v, got %d", filter, len(conversations))
+			}
+		}
+	})
+
+	t.Run("Activity", func(t *testing.T) {
+		store := seed(t)
+		items, err := store.GetActivityByAddress(alice, nil, nil, 100, 0)
+		if err != nil {
+			t.Fatalf("Failed to get activity: %v", err)
+		}
+		if len(items) != 4 {
+			t.Fatalf("Expected 4 items, got %d", len(items))
+		}
+		if items[0].Type != "message" || items[0].Message.Body != "Are we still meeting for lunch tomorrow?" {
+			t.Errorf("Expected the first message first, got %+v", items[0])
+		}
+		if items[3].Type != "call" || items[3].Call.Duration != 120 {
+			t.Errorf("Expected the call last, got %+v", items[3])
+		}
+
+		items, err = store.GetActivityByAddress(alice, nil, nil, 2, 1)
+		if err != nil {
+			t.Fatalf("Failed to get activity: %v", err)
+		}
+		if len(items) != 2 || items[0].Message.Body != "Yes, lunch at noon works" {
+			t.Errorf("Expected the second and third items, got %+v", items)
+		}
+
+		end := t0.Add(90 * time.Minute)
+		count, err := store.CountActivityByAddress(alice, nil, &end)
+		if err != nil {
+			t.Fatalf("Failed to count activity: %v", err)
+		}
+		if count != 2 {
+			t.Errorf("Expected 2 items before %v, got %d", end, count)
+		}
+	})
+
+	t.Run("ThreadsAndCalls", func(t *testing.T) {
+		store := seed(t)
+		messages, err := store.GetMessages(alice, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to get messages: %v", err)
+		}
+		if len(messages) != 3 || messages[0].Body != "Are we still meeting for lunch tomorrow?" || messages[2].ContactName != "Alice" {
+			t.Errorf("Expected Alice's 3 messages oldest first, got %+v", messages)
+		}
+
+		calls, err := store.GetCallLogs(alice, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to get call logs: %v", err)
+		}
+		if len(calls) != 1 || calls[0].Duration != 120 || !calls[0].Date.Equal(t0.Add(3*time.Hour)) {
+			t.Errorf("Expected Alice's call, got %+v", calls)
+		}
+		calls, err = store.GetAllCalls(nil, &t0, 50, 0)
+		if err != nil {
+			t.Fatalf("Failed to get calls: %v", err)
+		}
+		if len(calls) != 0 {
+			t.Errorf("Expected no calls before %v, got %+v", t0, calls)
+		}
+
+		items, err := store.GetActivity(&t0, nil, "", 2, 0)
+		if err != nil {
+			t.Fatalf("Failed to get activity: %v", err)
+		}
+		if len(items) != 2 || items[0].Message.Body != "Are we still meeting for lunch tomorrow?" {
+			t.Errorf("Expected the first 2 items from %v, got %+v", t0, items)
+		}
+		items, err = store.GetActivity(nil, nil, "work", 50, 0)
+		if err != nil {
+			t.Fatalf("Failed to get activity: %v", err)
+		}
+		if len(items) != 0 {
+			t.Errorf("Expected nothing tagged, got %+v", items)
+		}
+
+		minDate, maxDate, err := store.GetDateRange()
+		if err != nil {
+			t.Fatalf("Failed to get date range: %v", err)
+		}
+		if minDate.Unix() != time.Date(2024, 2, 29, 20, 0, 0, 0, time.UTC).Unix() || maxDate.Unix() != time.Date(2024, 3, 2, 14, 0, 0, 0, time.UTC).Unix() {
+			t.Errorf("Unexpected date range %v to %v", minDate, maxDate)
+		}
+		if _, _, err := newStore(t).GetDateRange(); err != ErrNoDateRange {
+			t.Errorf("Expected ErrNoDateRange for an empty store, got %v", err)
+		}
+	})
+
+	t.Run("Media", func(t *testing.T) {
+		store := newStore(t)
+		photo := []byte("\xff\xd8\xff\xe0 not really a JPEG")
+		mms := []Message{
+			{Address: alice, Type: 1, Date: t0, ContentType: "application/vnd.wap.multipart.related", MediaType: "image/jpeg", MediaData: photo, MediaName: "IMG_1234.jpg"},
+			{Address: alice, Type: 2, Date: t0.Add(time.Minute), ContentType: "application/vnd.wap.multipart.related", MediaType: "audio/amr", MediaData: []byte("#!AMR")},
+			{Address: bob, Type: 1, Date: t0.Add(time.Hour), Body: "No attachment"},
+		}
+		for i := range mms {
+			if err := store.InsertMessage(&mms[i]); err != nil {
+				t.Fatalf("Failed to insert message: %v", err)
+			}
+		}
+		id := strconv.FormatInt(mms[0].ID, 10)
+
+		items, err := store.GetMediaByAddress(alice, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to get media items: %v", err)
+		}
+		if len(items) != 1 || items[0].ID != mms[0].ID || items[0].MediaType != "image/jpeg" {
+			t.Errorf("Expected only the photo, got %+v", items)
+		}
+
+		info, err := store.GetMediaInfo(id)
+		if err != nil {
+			t.Fatalf("Failed to get media info: %v", err)
+		}
+		if info.MediaType != "image/jpeg" || info.Size != int64(len(photo)) || info.Date.Unix() != t0.Unix() {
+			t.Errorf("Unexpected media info %+v", info)
+		}
+		if _, err := store.GetMediaInfo(strconv.FormatInt(mms[2].ID, 10)); err == nil {
+			t.Error("Expected an error for a message without media")
+		}
+
+		data, mediaType, err := store.GetMedia(id)
+		if err != nil {
+			t.Fatalf("Failed to get media: %v", err)
+		}
+		if !bytes.Equal(data, photo) || mediaType != "image/jpeg" {
+			t.Errorf("Expected the stored photo, got %q (%s)", data, mediaType)
+		}
+
+		archived, err := store.GetMediaArchiveItems(GalleryFilter{Address: alice})
+		if err != nil {
+			t.Fatalf("Failed to list archive items: %v", err)
+		}
+		if len(archived) != 2 || archived[0].Name != "IMG_1234.jpg" || archived[0].Size != int64(len(photo)) || archived[1].Kind != "audio" {
+			t.Errorf("Expected both attachments oldest first, got %+v", archived)
+		}
+		for _, tt := range []struct {
+			filter GalleryFilter
+			want   int
+		}{
+			{GalleryFilter{Kinds: []string{"image"}}, 1},
+			{GalleryFilter{Kinds: []string{"image", "audio"}, Direction: "sent"}, 1},
+			{GalleryFilter{Tag: "work"}, 0},
+		} {
+			archived, err := store.GetMediaArchiveItems(tt.filter)
+			if err != nil {
+				t.Fatalf("Failed to list archive items: %v", err)
+			}
+			if len(archived) != tt.want {
+				t.Errorf("Expected %d items for %+v, got %d", tt.want, tt.filter, len(archived))
+			}
+		}
+		if _, err := store.GetMediaArchiveItems(GalleryFilter{Kinds: []string{"bogus"}}); err == nil {
+			t.Error("Expected an error for an unknown kind")
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		store := seed(t)
+		tests := []struct {
+			name  string
+			opts  SearchOptions
+			total int
+		}{
+			{"word", SearchOptions{Query: "lunch"}, 3},
+			{"case insensitive", SearchOptions{Query: "LUNCH"}, 3},
+			{"whole words", SearchOptions{Query: "deli"}, 0},
+			{"prefix mode", SearchOptions{Query: "deli", Mode: SearchModePrefix}, 1},
+			{"prefix term", SearchOptions{Query: "deli*"}, 1},
+			{"phrase", SearchOptions{Query: `"see you"`}, 1},
+			{"phrase in order", SearchOptions{Query: `"you see"`}, 0},
+			{"all words", SearchOptions{Query: "lunch noon"}, 1},
+			{"negation", SearchOptions{Query: "lunch -tomorrow"}, 2},
+			{"or", SearchOptions{Query: "cafe OR party"}, 2},
+			{"direction", SearchOptions{Query: "lunch", Direction: "sent"}, 1},
+			{"contact", SearchOptions{Query: "lunch", Contact: "bob"}, 1},
+			{"from operator", SearchOptions{Query: "from:me lunch"}, 1},
+			{"substring", SearchOptions{Query: "unch", Mode: SearchModeSubstring}, 3},
+			{"filters only", SearchOptions{RecordType: "sms", Direction: "sent"}, 2},
+			{"untagged", SearchOptions{Query: "lunch", Tag: "work"}, 0},
+			{"empty", SearchOptions{}, 0},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				page, err := store.SearchMessages(tt.opts)
+				if err != nil {
+					t.Fatalf("Search failed: %v", err)
+				}
+				if page.Total != tt.total || len(page.Results) != tt.total {
+					t.Errorf("Expected %d results, got %d of %d", tt.total, len(page.Results), page.Total)
+				}
+			})
+		}
+
+		page, err := store.SearchMessages(SearchOptions{Query: "delicious"})
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if len(page.Results) != 1 || !strings.Contains(page.Results[0].Snippet, "<mark>delicious</mark>") {
+			t.Errorf("Expected a highlighted snippet, got %+v", page.Results)
+		}
+
+		page, err = store.SearchMessages(SearchOptions{Query: "unch", Mode: SearchModeSubstring, Contact: "bob"})
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if len(page.Results) != 1 || !strings.Contains(page.Results[0].Snippet, "L<mark>unch</mark>") {
+			t.Errorf("Expected a highlighted substring, got %+v", page.Results)
+		}
+
+		if _, err := store.SearchMessages(SearchOptions{Query: "lunch", Sort: "bogus"}); err == nil {
+			t.Error("Expected an error for an unknown sort")
+		}
+	})
+
+	t.Run("SearchPaging", func(t *testing.T) {
+		store := seed(t)
+		for _, sort := range []string{"date", "relevance"} {
+			var bodies []string
+			opts := SearchOptions{Query: "lunch", Sort: sort, Limit: 2}
+			for pages := 0; ; pages++ {
+				if pages > 2 {
+					t.Fatalf("Expected 2 pages sorted by %s", sort)
+				}
+				page, err := store.SearchMessages(opts)
+				if err != nil {
+					t.Fatalf("Search failed: %v", err)
+				}
+				if page.Total != 3 {
+					t.Errorf("Expected a total of 3, got %d", page.Total)
+				}
+				for _, r := range page.Results {
+					bodies = append(bodies, r.Body)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+			if len(bodies) != 3 {
+				t.Errorf("Expected 3 results sorted by %s, got %v", sort, bodies)
+			}
+			if sort == "date" && (bodies[0] != "Yes, lunch at noon works" || bodies[2] != "Lunch was delicious yesterday") {
+				t.Errorf("Expected results newest first, got %v", bodies)
+			}
+		}
+	})
+
+	t.Run("Analytics", func(t *testing.T) {
+		store := seed(t)
+		analytics, err := store.GetAnalytics(nil, nil, "", "", nil, 10, 60)
+		if err != nil {
+			t.Fatalf("Failed to get analytics: %v", err)
+		}
+		if analytics.TotalMessages != 7 || analytics.TotalSMS != 6 || analytics.TotalCalls != 1 {
+			t.Errorf("Unexpected totals: %+v", analytics)
+		}
+		if analytics.TotalSent != 2 || analytics.TotalReceived != 4 || analytics.IncomingCalls != 1 || analytics.TotalCallDuration != 120 {
+			t.Errorf("Unexpected directions: %+v", analytics)
+		}
+		if analytics.AvgMessageLength <= 0 {
+			t.Errorf("Expected an average message length, got %v", analytics.AvgMessageLength)
+		}
+		if len(analytics.TopContacts) != 3 || analytics.TopContacts[0].Address != alice || analytics.TopContacts[0].MessageCount != 3 {
+			t.Errorf("Expected Alice as top contact, got %+v", analytics.TopContacts)
+		}
+		// Hours are shifted by the offset: 09:15 UTC is 10 at UTC+1
+		for hour, want := range map[int]int{10: 1, 11: 1, 12: 1, 15: 1, 21: 2} {
+			if got := analytics.HourlyDistribution[hour].Count; got != want {
+				t.Errorf("Expected %d messages at %d:00, got %d", want, hour, got)
+			}
+		}
+		// Days depend on the server's time zone, so only the sum is checked
+		days := 0
+		for _, d := range analytics.DailyTrend {
+			days += d.Count
+		}
+		if days != 6 {
+			t.Errorf("Expected 6 messages over the daily trend, got %d", days)
+		}
+
+		analytics, err = store.GetAnalytics(nil, nil, "", SenderCategoryAutomated, nil, 10, 0)
+		if err != nil {
+			t.Fatalf("Failed to get analytics: %v", err)
+		}
+		if analytics.TotalMessages != 1 {
+			t.Errorf("Expected 1 automated message, got %d", analytics.TotalMessages)
+		}
+	})
+}
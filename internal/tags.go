@@ -0,0 +1,643 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ErrTagExists is returned when creating or renaming a tag to a name another
+// tag already has (names are case-insensitive)
+var ErrTagExists = errors.New("a tag with that name already exists")
+
+// tagSeparator joins tag names in a single column; it can't appear in names
+const tagSeparator = "\x1f"
+
+// tagNamesColumn selects the names of the tags on the message with the given
+// id column, joined by tagSeparator
+func tagNamesColumn(idColumn string) string {
+	return `(SELECT group_concat(t.name, char(31)) FROM message_tags mt JOIN tags t ON t.id = mt.tag_id
+		WHERE mt.message_id = ` + idColumn + `)`
+}
+
+// splitTagNames splits a tagNamesColumn value
+func splitTagNames(names sql.NullString) []string {
+	if !names.Valid || names.String == "" {
+		return nil
+	}
+	return strings.Split(names.String, tagSeparator)
+}
+
+// tagMessageCondition returns a condition matching messages with a tag,
+// either on the message itself or on its conversation. prefix qualifies the
+// messages columns ("m." or "").
+func tagMessageCondition(prefix, tag string) (string, []interface{}) {
+	cond := ` AND (` + prefix + `id IN (SELECT mt.message_id FROM message_tags mt JOIN tags t ON t.id = mt.tag_id WHERE t.name = ?)
+		OR ` + prefix + `address IN (SELECT ct.address FROM conversation_tags ct JOIN tags t ON t.id = ct.tag_id WHERE t.name = ?))`
+	return cond, []interface{}{tag, tag}
+}
+
+// tagConversationCondition returns a condition matching every message of
+// conversations that have a tag, or that have a message with it
+func tagConversationCondition(tag string) (string, []interface{}) {
+	cond := ` AND address IN (
+		SELECT ct.address FROM conversation_tags ct JOIN tags t ON t.id = ct.tag_id WHERE t.name = ?
+		UNION
+		SELECT tm.address FROM message_tags mt JOIN tags t ON t.id = mt.tag_id
+		JOIN messages tm ON tm.id = mt.message_id WHERE t.name = ?)`
+	return cond, []interface{}{tag, tag}
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// GetTags lists tags by name with how many messages and conversations
+// carry each
+func GetTags(userDB *sql.DB) ([]Tag, error) {
+	rows, err := userDB.Query(`
+		SELECT t.id, t.name, t.color, t.created_at,
+			(SELECT COUNT(*) FROM message_tags mt WHERE mt.tag_id = t.id),
+			(SELECT COUNT(*) FROM conversation_tags ct WHERE ct.tag_id = t.id)
+		FROM tags t
+		ORDER BY t.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		var createdAt int64
+		if err := rows.Scan(&t.ID, &t.Name, &t.Color, &createdAt, &t.MessageCount, &t.ConversationCount); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = time.Unix(createdAt, 0)
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// CreateTag adds a tag, setting its ID. Returns ErrTagExists if the name is
+// taken.
+func CreateTag(userDB *sql.DB, t *Tag) error {
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	now := time.Now().Unix()
+	result, err := userDB.Exec("INSERT INTO tags (name, color, created_at) VALUES (?, ?, ?)", t.Name, t.Color, now)
+	if isUniqueViolation(err) {
+		return ErrTagExists
+	}
+	if err != nil {
+		return err
+	}
+	t.ID, err = result.LastInsertId()
+	t.CreatedAt = time.Unix(now, 0)
+	return err
+}
+
+// UpdateTag renames or recolors a tag. Returns sql.ErrNoRows if there's no
+// such tag and ErrTagExists if the new name is taken.
+func UpdateTag(userDB *sql.DB, t *Tag) error {
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	result, err := userDB.Exec("UPDATE tags SET name = ?, color = ? WHERE id = ?", t.Name, t.Color, t.ID)
+	if isUniqueViolation(err) {
+		return ErrTagExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTag removes a tag from everything it was applied to. Returns
+// sql.ErrNoRows if there's no such tag.
+func DeleteTag(userDB *sql.DB, id int64) error {
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	result, err := userDB.Exec("DELETE FROM tags WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// tagExists reports whether a tag ID is valid
+func tagExists(userDB *sql.DB, id int64) (bool, error) {
+	var exists bool
+	err := userDB.QueryRow("SELECT EXISTS (SELECT 1 FROM tags WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
+// TagMessages applies a tag to messages, ignoring IDs that don't exist or
+// already have it, and returns how many were newly tagged. Returns
+// sql.ErrNoRows if there's no such tag.
+func TagMessages(userDB *sql.DB, tagID int64, messageIDs []int64) (int, error) {
+	if ok, err := tagExists(userDB, tagID); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	tx, err := userDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO message_tags (tag_id, message_id)
+		SELECT ?, id FROM messages WHERE id = ?
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	tagged := 0
+	for _, id := range messageIDs {
+		result, err := stmt.Exec(tagID, id)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		tagged += int(n)
+	}
+	return tagged, tx.Commit()
+}
+
+// UntagMessages removes a tag from messages and returns how many had it
+func UntagMessages(userDB *sql.DB, tagID int64, messageIDs []int64) (int, error) {
+	if len(messageIDs) == 0 {
+		return 0, nil
+	}
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	args := []interface{}{tagID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	result, err := userDB.Exec(
+		"DELETE FROM message_tags WHERE tag_id = ? AND message_id IN ("+inPlaceholders(len(messageIDs))+")",
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// TagSearchResults applies a tag to every message a search matches, not
+// just its first page, and returns how many were newly tagged
+func TagSearchResults(userDB *sql.DB, tagID int64, opts SearchOptions) (int, error) {
+	opts.Cursor = ""
+	opts.Limit = MaxSearchLimit
+
+	var ids []int64
+	for {
+		page, err := SearchMessages(userDB, opts)
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range page.Results {
+			ids = append(ids, r.MessageID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	return TagMessages(userDB, tagID, ids)
+}
+
+// TagConversation applies a tag to a conversation. Returns sql.ErrNoRows if
+// there's no such tag.
+func TagConversation(userDB *sql.DB, tagID int64, address string) error {
+	if ok, err := tagExists(userDB, tagID); err != nil {
+		return err
+	} else if !ok {
+		return sql.ErrNoRows
+	}
+
+	unlock := LockForWrite(userDB)
+	defer unlock()
+	_, err := userDB.Exec("INSERT OR IGNORE INTO conversation_tags (tag_id, address) VALUES (?, ?)", tagID, address)
+	return err
+}
+
+// UntagConversation removes a tag from a conversation. Returns sql.ErrNoRows
+// if the conversation didn't have it.
+func UntagConversation(userDB *sql.DB, tagID int64, address string) error {
+	unlock := LockForWrite(userDB)
+	defer unlock()
+
+	result, err := userDB.Exec("DELETE FROM conversation_tags WHERE tag_id = ? AND address = ?", tagID, address)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// conversationTagNames returns the tags applied to each conversation
+func conversationTagNames(userDB dbQueryer) (map[string][]string, error) {
+	rows, err := userDB.Query(`
+		SELECT ct.address, t.name FROM conversation_tags ct JOIN tags t ON t.id = ct.tag_id
+		ORDER BY t.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string][]string)
+	for rows.Next() {
+		var address, name string
+		if err := rows.Scan(&address, &name); err != nil {
+			return nil, err
+		}
+		names[address] = append(names[address], name)
+	}
+	return names, rows.Err()
+}
+
+// parseTagID reads the :id path parameter
+func parseTagID(c echo.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	return id, err == nil
+}
+
+// bindTag reads and validates a tag from a request body, returning an error
+// message for the client if it's invalid
+func bindTag(c echo.Context) (Tag, string) {
+	var t Tag
+	if err := c.Bind(&t); err != nil {
+		return t, "Invalid tag data"
+	}
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return t, "name is required"
+	}
+	if strings.IndexFunc(t.Name, unicode.IsControl) >= 0 {
+		return t, "name can't contain control characters"
+	}
+	return t, ""
+}
+
+// HandleTags handles GET /api/tags
+func HandleTags(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	tags, err := GetTags(userDB)
+	if err != nil {
+		slog.Error("Error getting tags", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get tags",
+		})
+	}
+
+	return c.JSON(http.StatusOK, tags)
+}
+
+// HandleCreateTag handles POST /api/tags
+func HandleCreateTag(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	t, errMsg := bindTag(c)
+	if errMsg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": errMsg,
+		})
+	}
+
+	err = CreateTag(userDB, &t)
+	if errors.Is(err, ErrTagExists) {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		slog.Error("Error creating tag", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to create tag",
+		})
+	}
+
+	return c.JSON(http.StatusCreated, t)
+}
+
+// HandleUpdateTag handles PUT /api/tags/:id
+func HandleUpdateTag(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	id, ok := parseTagID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid tag ID",
+		})
+	}
+	t, errMsg := bindTag(c)
+	if errMsg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": errMsg,
+		})
+	}
+	t.ID = id
+
+	err = UpdateTag(userDB, &t)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Tag not found",
+		})
+	}
+	if errors.Is(err, ErrTagExists) {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		slog.Error("Error updating tag", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to update tag",
+		})
+	}
+
+	return c.JSON(http.StatusOK, t)
+}
+
+// HandleDeleteTag handles DELETE /api/tags/:id
+func HandleDeleteTag(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	id, ok := parseTagID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid tag ID",
+		})
+	}
+
+	err = DeleteTag(userDB, id)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Tag not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error deleting tag", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to delete tag",
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// HandleTagMessages handles POST /api/tags/:id/messages, tagging the
+// messages in a {"message_ids": [...]} body
+func HandleTagMessages(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	id, ok := parseTagID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid tag ID",
+		})
+	}
+	var body struct {
+		MessageIDs []int64 `json:"message_ids"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid message IDs",
+		})
+	}
+
+	tagged, err := TagMessages(userDB, id, body.MessageIDs)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Tag not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error tagging messages", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to tag messages",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"tagged": tagged})
+}
+
+// HandleUntagMessages handles DELETE /api/tags/:id/messages?ids=1,2,3
+func HandleUntagMessages(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	id, ok := parseTagID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid tag ID",
+		})
+	}
+	var messageIDs []int64
+	for _, s := range strings.Split(c.QueryParam("ids"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		messageID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "Invalid message IDs",
+			})
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+
+	untagged, err := UntagMessages(userDB, id, messageIDs)
+	if err != nil {
+		slog.Error("Error untagging messages", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to untag messages",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"untagged": untagged})
+}
+
+// HandleTagSearchResults handles POST /api/tags/:id/search, tagging every
+// message matched by a search given with the same parameters as /api/search
+func HandleTagSearchResults(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	id, ok := parseTagID(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid tag ID",
+		})
+	}
+
+	tagged, err := TagSearchResults(userDB, id, parseSearchOptions(c))
+	if errors.Is(err, ErrInvalidSearch) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Tag not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error tagging search results", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to tag search results",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"tagged": tagged})
+}
+
+// HandleTagConversation handles PUT /api/tags/:id/conversations?address=
+func HandleTagConversation(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	id, ok := parseTagID(c)
+	address := c.QueryParam("address")
+	if !ok || address == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Tag ID and address required",
+		})
+	}
+
+	err = TagConversation(userDB, id, address)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Tag not found",
+		})
+	}
+	if err != nil {
+		slog.Error("Error tagging conversation", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to tag conversation",
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// HandleUntagConversation handles DELETE /api/tags/:id/conversations?address=
+func HandleUntagConversation(c echo.Context) error {
+	userDB, err := getUserDB(c)
+	if err != nil {
+		slog.Error("Error getting user database", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to get user database",
+		})
+	}
+
+	id, ok := parseTagID(c)
+	address := c.QueryParam("address")
+	if !ok || address == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Tag ID and address required",
+		})
+	}
+
+	err = UntagConversation(userDB, id, address)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error": "Conversation doesn't have that tag",
+		})
+	}
+	if err != nil {
+		slog.Error("Error untagging conversation", "error", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to untag conversation",
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+-- Per-user database as created by sbv before schema versioning (user_version 0),
+-- with a few messages. TestMigrateBaselineUserDB upgrades it.
+
+-- Unified table for SMS messages, MMS messages, and call logs
+-- record_type: 1 = SMS, 2 = MMS, 3 = call
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	record_type INTEGER NOT NULL DEFAULT 1,
+	address TEXT NOT NULL,
+	body TEXT,
+	type INTEGER NOT NULL,
+	date INTEGER NOT NULL,
+	read INTEGER DEFAULT 0,
+	thread_id INTEGER,
+	subject TEXT,
+	media_type TEXT,
+	media_data BLOB,
+	protocol INTEGER,
+	status INTEGER,
+	service_center TEXT,
+	sub_id INTEGER,
+	contact_name TEXT,
+	sender TEXT,
+	content_type TEXT,
+	read_report INTEGER,
+	read_status INTEGER,
+	message_id TEXT,
+	message_size INTEGER,
+	message_type INTEGER,
+	sim_slot INTEGER,
+	addresses TEXT,
+	duration INTEGER,
+	presentation INTEGER,
+	subscription_id TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_address ON messages(address);
+CREATE INDEX IF NOT EXISTS idx_date ON messages(date);
+CREATE INDEX IF NOT EXISTS idx_thread ON messages(thread_id);
+CREATE INDEX IF NOT EXISTS idx_record_type ON messages(record_type);
+CREATE INDEX IF NOT EXISTS idx_record_type_date ON messages(record_type, date);
+CREATE INDEX IF NOT EXISTS idx_address_date ON messages(address, date);
+
+-- record_type differentiates SMS (1), MMS (2), and calls (3)
+CREATE UNIQUE INDEX IF NOT EXISTS idx_message_unique ON messages(record_type, address, date, type, COALESCE(body, ''), COALESCE(content_type, ''), COALESCE(message_id, ''), COALESCE(duration, 0));
+
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+	message_id UNINDEXED,
+	address UNINDEXED,
+	body,
+	contact_name UNINDEXED,
+	date UNINDEXED,
+	content='messages',
+	content_rowid='id'
+);
+
+CREATE TRIGGER IF NOT EXISTS messages_ai AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
+	VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_ad AFTER DELETE ON messages BEGIN
+	INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
+	VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE ON messages BEGIN
+	INSERT INTO messages_fts(messages_fts, rowid, message_id, address, body, contact_name, date)
+	VALUES('delete', old.id, old.id, old.address, old.body, old.contact_name, old.date);
+	INSERT INTO messages_fts(rowid, message_id, address, body, contact_name, date)
+	VALUES (new.id, new.id, new.address, new.body, new.contact_name, new.date);
+END;
+
+INSERT INTO messages (record_type, address, body, type, date, contact_name) VALUES
+	(1, '+15551230001', 'See you at the café', 1, 1600000000, 'Alice'),
+	(1, '+15551230001', 'On my way', 2, 1600000060, 'Alice'),
+	(1, '72975', 'Your code is 123456', 1, 1600000120, NULL);
+INSERT INTO messages (record_type, address, body, type, date, subject, content_type, message_id) VALUES
+	(2, '+15551230001,+15551230002', 'Group photo', 1, 1600000180, 'Hiking crew', 'application/vnd.wap.multipart.related', 'mms-1');
+INSERT INTO messages (record_type, address, type, date, duration) VALUES
+	(3, '+15551230001', 2, 1600000240, 95);
@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // register GIF decoding for image.Decode
+	"image/jpeg"
+	_ "image/png" // register PNG decoding for image.Decode
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// thumbnailSizes are the bounding boxes (longest side, in pixels) thumbnails
+// are generated at. Requested sizes are rounded up to the nearest one, so
+// the cache holds a bounded number of variants per attachment.
+var thumbnailSizes = []int{160, 320, 640}
+
+// DefaultThumbnailSize is used when a request doesn't specify a size, and
+// by the post-import thumbnail pass
+const DefaultThumbnailSize = 320
+
+// maxThumbnailSourcePixels caps the dimensions of an image decoded for a
+// thumbnail. Decoding allocates for every pixel up front, so a small file
+// declaring huge dimensions could otherwise exhaust memory. 50 megapixels
+// covers full-resolution photos from current phones.
+const maxThumbnailSourcePixels = 50_000_000
+
+// errImageTooLarge is returned for images over maxThumbnailSourcePixels
+var errImageTooLarge = errors.New("image too large to thumbnail")
+
+// snapThumbnailSize rounds a requested size up to a supported one
+func snapThumbnailSize(requested int) int {
+	for _, size := range thumbnailSizes {
+		if requested <= size {
+			return size
+		}
+	}
+	return thumbnailSizes[len(thumbnailSizes)-1]
+}
+
+// thumbnailSupported reports whether a thumbnail can be generated for a
+// media type: images (including HEIC) and video poster frames
+func thumbnailSupported(mediaType string) bool {
+	ct := strings.ToLower(strings.TrimSpace(mediaType))
+	return strings.HasPrefix(ct, "image/") || strings.HasPrefix(ct, "video/")
+}
+
+// generateThumbnail renders a JPEG thumbnail of a message's attachment
+// fitting within size x size. Thumbnails are always JPEG: the standard
+// library has no WebP encoder, and at thumbnail sizes WebP's savings
+// wouldn't justify a cgo dependency on libwebp. cacheable is false for HEIC
+// images in builds without libheif, whose "thumbnail" is just the
+// placeholder image.
+func generateThumbnail(store MessageStore, messageID string, size int) (thumb []byte, cacheable bool, err error) {
+	media, mediaType, err := store.GetMedia(messageID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ct := strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case strings.HasPrefix(ct, "video/"):
+		thumb, err = ffmpegThumbnail(media, size, true)
+		return thumb, err == nil, err
+
+	case isHEICContentType(ct):
+		jpegData, err := convertHEICtoJPEG(media)
+		if err != nil {
+			return nil, false, err
+		}
+		thumb, err = resizeImageData(jpegData, size)
+		return thumb, err == nil && heicSupported, err
+	}
+
+	// JPEG/PNG/GIF decode natively; anything else (WebP, BMP, ...) or a file
+	// the standard library chokes on goes through ffmpeg instead. Oversized
+	// images aren't handed to ffmpeg either.
+	thumb, err = resizeImageData(media, size)
+	if err != nil && !errors.Is(err, errImageTooLarge) {
+		slog.Debug("Falling back to ffmpeg for thumbnail", "message_id", messageID, "media_type", mediaType, "error", err)
+		thumb, err = ffmpegThumbnail(media, size, false)
+	}
+	return thumb, err == nil, err
+}
+
+// resizeImageData decodes an image, scales it to fit within size x size
+// (never upscaling), applies any EXIF orientation and encodes it as JPEG.
+// Images over maxThumbnailSourcePixels are rejected before decoding.
+func resizeImageData(data []byte, size int) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("%w: %dx%d", errImageTooLarge, cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	thumb := orientImage(resizeToFit(src, size), jpegOrientation(data))
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeToFit downscales img to fit within size x size using a box filter
+// (averaging every source pixel that falls within each destination pixel),
+// which is plenty for thumbnails and avoids aliasing on large reductions
+func resizeToFit(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+
+	// Convert once up front so the inner loop can index Pix directly
+	// instead of going through img.At per pixel
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	if srcW <= size && srcH <= size {
+		return src
+	}
+
+	dstW, dstH := size, size
+	if srcW > srcH {
+		dstH = max(1, srcH*size/srcW)
+	} else {
+		dstW = max(1, srcW*size/srcH)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for dy := 0; dy < dstH; dy++ {
+		y0 := dy * srcH / dstH
+		y1 := max(y0+1, (dy+1)*srcH/dstH)
+		for dx := 0; dx < dstW; dx++ {
+			x0 := dx * srcW / dstW
+			x1 := max(x0+1, (dx+1)*srcW/dstW)
+
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[dy*dst.Stride+dx*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(bl / n)
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// orientImage applies an EXIF orientation (1-8) so the image displays
+// upright without relying on the tag, which the re-encoded thumbnail
+// doesn't carry
+func orientImage(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dstW, dstH := w, h
+	// Orientations 5-8 swap width and height
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored horizontally, rotated 270 CW
+				dx, dy = y, x
+			case 6: // rotated 90 CW
+				dx, dy = h-1-y, x
+			case 7: // mirrored horizontally, rotated 90 CW
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 270 CW
+				dx, dy = y, w-1-x
+			}
+			si := y*img.Stride + x*4
+			di := dy*dst.Stride + dx*4
+			copy(dst.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// ffmpegThumbnail renders a JPEG thumbnail with ffmpeg, fitting within
+// size x size. For video it grabs a poster frame half a second in (the very
+// first frame is often black), falling back to the first frame for clips
+// shorter than that.
+func ffmpegThumbnail(data []byte, size int, isVideo bool) ([]byte, error) {
+	_, input, cleanup, err := converterInput("input", data)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	run := func(seek string) ([]byte, error) {
+		args := []string{}
+		if seek != "" {
+			args = append(args, "-ss", seek)
+		}
+		args = append(args,
+			"-i", input,
+			"-frames:v", "1",
+			// Fit within size x size, never upscaling
+			"-vf", fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", size, size),
+			"-q:v", "5",
+			"-f", "mjpeg",
+			"pipe:1",
+		)
+		cmd := exec.Command("ffmpeg", args...)
+
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("ffmpeg thumbnail failed: %w, stderr: %s", err, stderr.String())
+		}
+		if stdout.Len() == 0 {
+			return nil, fmt.Errorf("ffmpeg produced no thumbnail")
+		}
+		return stdout.Bytes(), nil
+	}
+
+	if isVideo {
+		if thumb, err := run("0.5"); err == nil {
+			return thumb, nil
+		}
+	}
+	return run("")
+}
+
+// OpenThumbnail returns a JPEG thumbnail of a message's attachment, from
+// the derived media cache when possible. The caller must close the returned
+// reader.
+func OpenThumbnail(userID string, store MessageStore, messageID string, size int) (io.ReadSeekCloser, error) {
+	if mediaCache == nil {
+		thumb, _, err := generateThumbnail(store, messageID, size)
+		if err != nil {
+			return nil, err
+		}
+		return nopSeekCloser{bytes.NewReader(thumb)}, nil
+	}
+
+	path := mediaCache.path(userID, messageID, fmt.Sprintf("thumb%d.jpg", size))
+	return mediaCache.fetch(path, userMediaKey(userID), func() ([]byte, bool, error) {
+		return generateThumbnail(store, messageID, size)
+	})
+}
+
+// GenerateThumbnails pre-generates default-size thumbnails for every image
+// and video in a user's database, so the media grid doesn't wait on them
+// the first time it's opened. Already-cached thumbnails are skipped. Meant
+// to be run in the background after an import when MEDIA_PRETHUMBNAIL=true.
+func GenerateThumbnails(userID string, userDB *sql.DB) {
+	if mediaCache == nil {
+		return
+	}
+
+	rows, err := userDB.Query(`
+		SELECT id
+		FROM messages
+		WHERE record_type IN (1, 2)
+		AND (media_type LIKE 'image/%' OR media_type LIKE 'video/%')
+	`)
+	if err != nil {
+		slog.Error("Thumbnails: failed to list media", "userID", userID, "error", err)
+		return
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			slog.Error("Thumbnails: failed to scan media", "userID", userID, "error", err)
+			return
+		}
+		ids = append(ids, fmt.Sprintf("%d", id))
+	}
+	rows.Close()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	slog.Info("Thumbnails: starting", "userID", userID, "count", len(ids))
+	store := NewSQLiteStore(userDB)
+	start := time.Now()
+	generated := 0
+	for _, id := range ids {
+		f, err := OpenThumbnail(userID, store, id, DefaultThumbnailSize)
+		if err != nil {
+			slog.Warn("Thumbnails: failed to generate thumbnail", "userID", userID, "messageID", id, "error", err)
+			continue
+		}
+		f.Close()
+		generated++
+	}
+	slog.Info("Thumbnails: completed", "userID", userID, "generated", generated, "duration", time.Since(start))
+}
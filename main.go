@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
@@ -8,6 +9,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -26,6 +28,13 @@ func main() {
 	resetPassword := flag.String("reset-password", "", "Reset password for the specified username")
 	listUsers := flag.Bool("list-users", false, "List all users")
 	journalMode := flag.Bool("journal", false, "Use rollback journal mode instead of WAL (for network filesystems)")
+	migrate := flag.Bool("migrate", false, "Apply pending schema migrations to all databases and exit")
+	migrateStatus := flag.Bool("migrate-status", false, "Show the schema version of all databases and exit")
+	encrypt := flag.String("encrypt", "", "Encrypt the specified user's database (or rotate its key if already encrypted) and exit")
+	backup := flag.Bool("backup", false, "Take a snapshot of all databases and exit")
+	restore := flag.String("restore", "", "Restore all databases from the specified snapshot directory and exit")
+	maintain := flag.String("maintain", "", "Run comma-separated maintenance operations ("+strings.Join(internal.MaintenanceOperations, ", ")+") on all databases and exit")
+	dbStats := flag.Bool("db-stats", false, "Show the size and contents of all databases and exit")
 	flag.Parse()
 
 	// Use WAL mode by default, unless disabled via the -journal flag or the
@@ -67,8 +76,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Migration commands run before anything opens (and so migrates) the
+	// databases
+	if *migrateStatus {
+		if err := handleMigrateStatus(dbPathPrefix); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *migrate {
+		if err := handleMigrate(dbPathPrefix); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Initialize authentication database
-	authDBPath := dbPathPrefix + "/sbv.db"
+	authDBPath := internal.AuthDBPath(dbPathPrefix)
 
 	err := internal.InitAuthDB(authDBPath)
 	if err != nil {
@@ -77,6 +103,60 @@ func main() {
 	}
 	logger.Info("Authentication database initialized", "path", authDBPath)
 
+	// Cache media converted for browser playback (HEIC, 3GP, AMR) on the
+	// data volume, so each attachment is only converted once
+	mediaCacheDir := os.Getenv("MEDIA_CACHE_DIR")
+	if mediaCacheDir == "" {
+		mediaCacheDir = filepath.Join(dbPathPrefix, "media-cache")
+	}
+	mediaCacheMB := int64(1024)
+	if mb := os.Getenv("MEDIA_CACHE_MAX_MB"); mb != "" {
+		if val, err := strconv.ParseInt(mb, 10, 64); err == nil && val >= 0 {
+			mediaCacheMB = val
+		}
+	}
+	if mediaCacheMB > 0 {
+		if err := internal.InitMediaCache(mediaCacheDir, mediaCacheMB<<20); err != nil {
+			logger.Error("Failed to initialize media cache, converting media per request", "error", err)
+		}
+	}
+	internal.MediaPretranscodeEnabled = os.Getenv("MEDIA_PRETRANSCODE") == "true"
+	internal.MediaPrethumbnailEnabled = os.Getenv("MEDIA_PRETHUMBNAIL") == "true"
+
+	// Encrypt new users' databases at rest. The server key seals the data
+	// keys of OIDC users, who have no password to seal them under.
+	internal.EncryptNewDatabases = os.Getenv("ENCRYPT_DATABASES") == "true"
+	serverKey := os.Getenv("ENCRYPTION_SERVER_KEY")
+	if serverKey != "" {
+		if err := internal.SetServerKey(serverKey); err != nil {
+			logger.Error("Invalid ENCRYPTION_SERVER_KEY", "error", err)
+			os.Exit(1)
+		}
+	}
+	if internal.EncryptNewDatabases && internal.OIDCEnabled() && serverKey == "" {
+		logger.Error("ENCRYPT_DATABASES with OIDC login requires ENCRYPTION_SERVER_KEY")
+		os.Exit(1)
+	}
+
+	// Store messages in a shared PostgreSQL database, a schema per user,
+	// rather than a SQLite database per user
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", internal.StorageBackendSQLite:
+	case internal.StorageBackendPostgres:
+		if internal.EncryptNewDatabases {
+			logger.Error("ENCRYPT_DATABASES isn't supported with STORAGE_BACKEND=postgres")
+			os.Exit(1)
+		}
+		if err := internal.InitPostgres(os.Getenv("POSTGRES_URL")); err != nil {
+			logger.Error("Failed to initialize PostgreSQL storage", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Storing messages in PostgreSQL")
+	default:
+		logger.Error("Unknown STORAGE_BACKEND, expected sqlite or postgres", "backend", backend)
+		os.Exit(1)
+	}
+
 	// Handle password reset if requested
 	if *resetPassword != "" {
 		if err := handleResetPassword(*resetPassword); err != nil {
@@ -86,6 +166,46 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Handle database encryption if requested
+	if *encrypt != "" {
+		if err := handleEncrypt(dbPathPrefix, *encrypt); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Handle snapshots if requested. Snapshots can be taken while the
+	// server runs; restoring replaces the databases it has open.
+	if *backup {
+		if err := handleBackup(dbPathPrefix); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *restore != "" {
+		if err := handleRestore(dbPathPrefix, *restore); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Handle database maintenance if requested. It can run alongside the
+	// server, though the admin API avoids contending with it for locks.
+	if *maintain != "" || *dbStats {
+		var operations []string
+		if *maintain != "" {
+			operations = strings.Split(*maintain, ",")
+		}
+		if err := handleMaintenance(dbPathPrefix, operations); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Handle list users if requested
 	if *listUsers {
 		if err := handleListUsers(dbPathPrefix); err != nil {
@@ -107,13 +227,51 @@ func main() {
 		}
 	}()
 
+	// Apply users' retention rules daily. Like snapshots and auto-import,
+	// retention works on SQLite databases, so is off with PostgreSQL.
+	if !internal.UsingPostgres() {
+		go func() {
+			ticker := time.NewTicker(24 * time.Hour)
+			defer ticker.Stop()
+			for {
+				internal.EnforceRetentionPolicies()
+				<-ticker.C
+			}
+		}()
+	}
+
+	// Take scheduled snapshots when BACKUP_INTERVAL_HOURS is set, keeping
+	// the newest BACKUP_KEEP
+	if hours, err := strconv.Atoi(os.Getenv("BACKUP_INTERVAL_HOURS")); err == nil && hours > 0 && !internal.UsingPostgres() {
+		keep := 7
+		if val, err := strconv.Atoi(os.Getenv("BACKUP_KEEP")); err == nil && val > 0 {
+			keep = val
+		}
+		backupDir := internal.BackupDir(dbPathPrefix)
+		logger.Info("Scheduled snapshots enabled", "path", backupDir, "interval_hours", hours, "keep", keep)
+		go func() {
+			ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				internal.RunScheduledSnapshot(dbPathPrefix, backupDir, keep)
+			}
+		}()
+	}
+
 	// Create Echo instance
 	e := echo.New()
 
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{Level: 5}))
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		Level: 5,
+		// Media is already compressed, and gzipping a 206 response would
+		// break the byte offsets http.ServeContent computed for the Range
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/api/media" || c.Path() == "/api/media/thumb" || c.Path() == "/api/media/archive"
+		},
+	}))
 
 	// Use custom CORS middleware that properly handles credentials
 	e.Use(internal.CustomCORSMiddleware())
@@ -152,23 +310,60 @@ func main() {
 	protected := e.Group("/api")
 	protected.Use(internal.AuthMiddleware)
 	protected.Use(internal.NoCacheMiddleware) // Prevent browser caching of API responses
+	protected.Use(internal.StorageBackendMiddleware)
 
 	protected.GET("/auth/me", internal.HandleMe)
 	protected.POST("/auth/change-password", internal.HandleChangePassword)
 	protected.POST("/upload", internal.HandleUpload)
 	protected.GET("/conversations", internal.HandleConversations)
+	protected.PUT("/conversations/state", internal.HandleConversationState)
+	protected.DELETE("/conversations", internal.HandleDeleteConversation)
 	protected.GET("/messages", internal.HandleMessages)
+	protected.DELETE("/messages", internal.HandleDeleteMessages)
+	protected.DELETE("/messages/:id", internal.HandleDeleteMessage)
+	protected.GET("/duplicates", internal.HandleDuplicates)
+	protected.POST("/duplicates/merge", internal.HandleMergeDuplicates)
+	protected.GET("/retention", internal.HandleRetention)
+	protected.POST("/retention", internal.HandleRetention)
+	protected.GET("/messages/context", internal.HandleMessageContext)
+	protected.GET("/bookmarks", internal.HandleBookmarks)
+	protected.PUT("/bookmarks/:id", internal.HandleSetBookmark)
+	protected.DELETE("/bookmarks/:id", internal.HandleDeleteBookmark)
+	protected.GET("/tags", internal.HandleTags)
+	protected.POST("/tags", internal.HandleCreateTag)
+	protected.PUT("/tags/:id", internal.HandleUpdateTag)
+	protected.DELETE("/tags/:id", internal.HandleDeleteTag)
+	protected.POST("/tags/:id/messages", internal.HandleTagMessages)
+	protected.DELETE("/tags/:id/messages", internal.HandleUntagMessages)
+	protected.POST("/tags/:id/search", internal.HandleTagSearchResults)
+	protected.PUT("/tags/:id/conversations", internal.HandleTagConversation)
+	protected.DELETE("/tags/:id/conversations", internal.HandleUntagConversation)
 	protected.GET("/activity", internal.HandleActivity)
 	protected.GET("/calls", internal.HandleCalls)
 	protected.GET("/daterange", internal.HandleDateRange)
 	protected.GET("/progress", internal.HandleProgress)
 	protected.GET("/media", internal.HandleMedia)
+	protected.GET("/media/thumb", internal.HandleMediaThumb)
+	protected.GET("/media/archive", internal.HandleMediaArchive)
+	protected.GET("/gallery", internal.HandleGallery)
 	protected.GET("/media-items", internal.HandleMediaItems)
 	protected.GET("/search", internal.HandleSearch)
+	protected.GET("/search/hits", internal.HandleSearchHits)
+	protected.GET("/saved-searches", internal.HandleGetSavedSearches)
+	protected.POST("/saved-searches", internal.HandleCreateSavedSearch)
+	protected.PUT("/saved-searches/:id", internal.HandleUpdateSavedSearch)
+	protected.DELETE("/saved-searches/:id", internal.HandleDeleteSavedSearch)
 	protected.GET("/settings", internal.HandleGetSettings)
 	protected.PUT("/settings", internal.HandleUpdateSettings)
 	protected.GET("/analytics", internal.HandleAnalytics)
 
+	// Admin routes (users listed in ADMIN_USERS)
+	admin := protected.Group("/admin", internal.AdminMiddleware)
+	admin.GET("/backup", internal.HandleListBackups)
+	admin.POST("/backup", internal.HandleCreateBackup)
+	admin.GET("/stats", internal.HandleDatabaseStats)
+	admin.POST("/maintenance", internal.HandleMaintenance)
+
 	// Health check
 	e.GET("/api/health", func(c echo.Context) error {
 		return c.String(http.StatusOK, "OK")
@@ -206,9 +401,13 @@ func main() {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		logger.Error("Failed to create data directory", "path", dataDir, "error", err)
 	}
-	autoImportService := internal.NewAutoImportService(dataDir)
-	autoImportService.Start()
-	defer autoImportService.Stop()
+	if internal.UsingPostgres() {
+		logger.Info("Auto-import is disabled with PostgreSQL storage")
+	} else {
+		autoImportService := internal.NewAutoImportService(dataDir)
+		autoImportService.Start()
+		defer autoImportService.Stop()
+	}
 
 	// Start pprof server on localhost when profiling is explicitly enabled
 	if os.Getenv("PPROF_ENABLED") == "true" {
@@ -280,8 +479,12 @@ func handleResetPassword(username string) error {
 		return fmt.Errorf("password must be at least 6 characters")
 	}
 
-	// Update the password
-	if err := internal.UpdatePassword(user.ID, password); err != nil {
+	// Update the password. Without the old one, an encrypted database's
+	// key can only be re-sealed from escrow.
+	if err := internal.UpdatePassword(user.ID, "", password); err != nil {
+		if errors.Is(err, internal.ErrDataKeyUnavailable) {
+			return fmt.Errorf("'%s''s database is encrypted under their password and has no escrowed key, so the password can't be reset without losing it", username)
+		}
 		return fmt.Errorf("failed to update password: %w", err)
 	}
 
@@ -289,6 +492,137 @@ func handleResetPassword(username string) error {
 	return nil
 }
 
+// handleEncrypt encrypts a user's database in place, or rotates its key if
+// it's already encrypted. A password user's password is prompted for.
+func handleEncrypt(dbPathPrefix string, username string) error {
+	user, err := internal.GetUserByUsername(username)
+	if err != nil {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+
+	var password string
+	if !internal.IsOIDCUser(user) {
+		fmt.Printf("Enter %s's password: ", username)
+		passwordBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+		password = string(passwordBytes)
+	}
+
+	rotated, err := internal.EncryptUserDatabase(dbPathPrefix, user, password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt database: %w", err)
+	}
+
+	if rotated {
+		fmt.Printf("Database key rotated for user '%s'\n", username)
+	} else {
+		fmt.Printf("Database encrypted for user '%s'\n", username)
+	}
+	return nil
+}
+
+// handleBackup takes a snapshot of all databases
+func handleBackup(dbPathPrefix string) error {
+	backupDir := internal.BackupDir(dbPathPrefix)
+	snap, err := internal.CreateSnapshot(dbPathPrefix, backupDir)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	fmt.Printf("Snapshot created: %s\n", filepath.Join(backupDir, snap.Name))
+	for _, file := range snap.Files {
+		encrypted := ""
+		if file.Encrypted {
+			encrypted = " (encrypted)"
+		}
+		fmt.Printf("  %s  %d bytes%s\n", file.Name, file.Size, encrypted)
+	}
+	return nil
+}
+
+// handleRestore validates a snapshot and swaps its databases in
+func handleRestore(dbPathPrefix string, dir string) error {
+	movedTo, err := internal.RestoreSnapshot(dbPathPrefix, dir)
+	if err != nil {
+		if movedTo != "" {
+			return fmt.Errorf("failed to restore snapshot (previous databases are in %s): %w", movedTo, err)
+		}
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+
+	fmt.Printf("Snapshot restored from %s\n", dir)
+	fmt.Printf("Previous databases moved to %s\n", movedTo)
+	return nil
+}
+
+// handleMaintenance runs maintenance operations on every database and
+// prints their results and stats
+func handleMaintenance(dbPathPrefix string, operations []string) error {
+	reports, err := internal.RunMaintenance(dbPathPrefix, operations)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	if len(operations) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DATABASE\tOPERATION\tRESULT\tTIME")
+		fmt.Fprintln(w, "--------\t---------\t------\t----")
+		for _, r := range reports {
+			if r.Error != "" && r.Stats == nil {
+				fmt.Fprintf(w, "%s\t-\tskipped: %s\t-\n", r.Database, r.Error)
+				continue
+			}
+			for _, result := range r.Results {
+				status := result.Detail
+				if !result.OK {
+					status = "FAILED: " + result.Detail
+					failed++
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Database, result.Operation, status, time.Duration(result.DurationMS)*time.Millisecond)
+			}
+		}
+		w.Flush()
+		fmt.Println()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tSIZE\tFREE\tSMS\tMMS\tCALLS\tMEDIA")
+	fmt.Fprintln(w, "--------\t----\t----\t---\t---\t-----\t-----")
+	for _, r := range reports {
+		if r.Stats == nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\n", r.Database)
+			continue
+		}
+		s := r.Stats
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", r.Database, formatBytes(s.FileBytes),
+			formatBytes(s.FreePages*s.PageSize), s.SMS, s.MMS, s.Calls, formatBytes(s.MediaBytes))
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d operations failed", failed)
+	}
+	return nil
+}
+
+// formatBytes formats a byte count for display, e.g. 1.5 MB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 // handleListUsers lists all users with their usernames, UUIDs, and ingest directories
 func handleListUsers(dbPathPrefix string) error {
 	users, err := internal.ListUsers()
@@ -313,3 +647,58 @@ func handleListUsers(dbPathPrefix string) error {
 	w.Flush()
 	return nil
 }
+
+// handleMigrateStatus prints the schema version of each database
+func handleMigrateStatus(dbPathPrefix string) error {
+	statuses, err := internal.GetSchemaStatus(dbPathPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to read schema versions: %w", err)
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No databases found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tVERSION\tLATEST\tSTATUS")
+	fmt.Fprintln(w, "--------\t-------\t------\t------")
+	for _, s := range statuses {
+		if s.Encrypted {
+			fmt.Fprintf(w, "%s\t-\t%d\tencrypted, migrated when next opened\n", s.Path, s.Latest)
+			continue
+		}
+		status := "up to date"
+		switch {
+		case s.Version < s.Latest:
+			status = fmt.Sprintf("%d pending", s.Latest-s.Version)
+		case s.Version > s.Latest:
+			status = "newer than this build"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", s.Path, s.Version, s.Latest, status)
+	}
+	w.Flush()
+	return nil
+}
+
+// handleMigrate applies pending migrations to each database
+func handleMigrate(dbPathPrefix string) error {
+	statuses, err := internal.MigrateDatabases(dbPathPrefix)
+	for _, s := range statuses {
+		if s.Encrypted {
+			fmt.Printf("%s: encrypted, migrated when next opened\n", s.Path)
+			continue
+		}
+		if s.Version == s.Latest {
+			fmt.Printf("%s: up to date (version %d)\n", s.Path, s.Latest)
+		} else {
+			fmt.Printf("%s: migrated from version %d to %d\n", s.Path, s.Version, s.Latest)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No databases found.")
+	}
+	return nil
+}